@@ -0,0 +1,345 @@
+package alert
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+	"timedb"
+)
+
+/*
+Package alert evaluates threshold rules on the metrics of each team, after every sync, and notifies a
+Slack or Teams incoming webhook when a rule's condition starts to hold. A rule raises a single alert
+per team, which stays open, without further notifications, until the condition no longer holds.
+Every alert is kept in the alerts table, which is the alert history.
+
+The optional config file config/alerts.json:
+
+{
+	"WebhookURL": "https://hooks.slack.com/services/...",
+	"Format": "slack",
+	"DashboardURL": "http://timetracker:3333",
+	"Rules": [
+		{"Name": "Bug share", "Team": "Platform", "Metric": "bug_share", "Above": 40, "Weeks": 2, "MinHours": 20},
+		{"Name": "Interrupt load", "Metric": "hours_per_person", "Types": ["intr"], "Above": 6}
+	]
+}
+
+Metrics, which are calculated per complete week (Monday to Sunday):
+	bug_share         Bug hours, as a percentage of bug and feature hours, as on the dashboard chart
+	type_share        Hours of Types, as a percentage of all hours
+	hours_per_person  Hours of Types, divided by the number of people that logged time that week
+
+A rule holds when its metric is Above (or Below) the threshold for Weeks consecutive weeks, up to the last
+complete week. Weeks in which the team logged fewer than MinHours don't count, because ratios of a handful
+of hours are noise. Rules without a Team are evaluated for every team. Format is "slack" or "teams".
+*/
+
+const (
+	MetricBugShare       = "bug_share"
+	MetricTypeShare      = "type_share"
+	MetricHoursPerPerson = "hours_per_person"
+)
+
+const (
+	FormatSlack = "slack"
+	FormatTeams = "teams"
+)
+
+type Rule struct {
+	Name     string // Alerts are linked to their rule by name, so renaming or removing a rule resolves its open alerts
+	Team     string // Empty for every team
+	Metric   string
+	Types    []string // Ticket types of type_share and hours_per_person
+	Above    *float64
+	Below    *float64
+	Weeks    int // Default is 1
+	MinHours float64
+}
+
+type Config struct {
+	WebhookURL   string
+	Format       string
+	DashboardURL string
+	Rules        []Rule
+}
+
+type Evaluator struct {
+	Config Config
+	DB     *timedb.TimeDB
+}
+
+// Load config/alerts.json. Returns false if the file does not exist, in which case alerts are disabled.
+func (e *Evaluator) LoadConfig() (bool, error) {
+	filename := "config/alerts.json"
+	raw, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("Error loading config file %v: %v", filename, err)
+	}
+	if err := json.Unmarshal(raw, &e.Config); err != nil {
+		return false, fmt.Errorf("Error decoding config file %v: %v", filename, err)
+	}
+	if e.Config.Format == "" {
+		e.Config.Format = FormatSlack
+	}
+	if e.Config.Format != FormatSlack && e.Config.Format != FormatTeams {
+		return false, fmt.Errorf("Invalid Format '%v' in %v. Expected slack or teams", e.Config.Format, filename)
+	}
+	names := map[string]bool{}
+	for i := range e.Config.Rules {
+		r := &e.Config.Rules[i]
+		if r.Name == "" || names[r.Name] {
+			return false, fmt.Errorf("Every rule in %v needs a unique Name", filename)
+		}
+		names[r.Name] = true
+		switch r.Metric {
+		case MetricBugShare:
+		case MetricTypeShare, MetricHoursPerPerson:
+			if len(r.Types) == 0 {
+				return false, fmt.Errorf("Rule '%v' in %v needs Types", r.Name, filename)
+			}
+		default:
+			return false, fmt.Errorf("Rule '%v' in %v has an unknown Metric '%v'", r.Name, filename, r.Metric)
+		}
+		if (r.Above == nil) == (r.Below == nil) {
+			return false, fmt.Errorf("Rule '%v' in %v needs either Above or Below", r.Name, filename)
+		}
+		if r.Weeks <= 0 {
+			r.Weeks = 1
+		}
+	}
+	return true, nil
+}
+
+// Returns the start of the week (Monday midnight, local time) that contains t
+func weekStart(t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+	return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+}
+
+// The hours that a team logged in a single week
+type weekHours struct {
+	total  float64
+	types  map[string]float64
+	people map[int64]bool
+}
+
+func (r *Rule) threshold() float64 {
+	if r.Above != nil {
+		return *r.Above
+	}
+	return *r.Below
+}
+
+// Returns the value of the rule's metric, and false if the week has too little time to say
+func (r *Rule) value(w *weekHours) (float64, bool) {
+	if w == nil || w.total == 0 || w.total < r.MinHours {
+		return 0, false
+	}
+	selected := 0.0
+	for _, t := range r.Types {
+		selected += w.types[t]
+	}
+	switch r.Metric {
+	case MetricBugShare:
+		bugs, features := w.types[timedb.TicketTypeBug], w.types[timedb.TicketTypeFeature]
+		if bugs+features == 0 {
+			return 0, false
+		}
+		return 100 * bugs / (bugs + features), true
+	case MetricTypeShare:
+		return 100 * selected / w.total, true
+	case MetricHoursPerPerson:
+		return selected / float64(len(w.people)), true
+	}
+	return 0, false
+}
+
+func (r *Rule) holds(value float64) bool {
+	if r.Above != nil {
+		return value > *r.Above
+	}
+	return value < *r.Below
+}
+
+// Describe a value of the rule's metric, such as "bug share 52%"
+func (r *Rule) describe(value float64) string {
+	switch r.Metric {
+	case MetricBugShare:
+		return fmt.Sprintf("bug share %.0f%%", value)
+	case MetricTypeShare:
+		return fmt.Sprintf("%v share %.0f%%", strings.Join(r.Types, "+"), value)
+	}
+	return fmt.Sprintf("%.1f %v hours per person", value, strings.Join(r.Types, "+"))
+}
+
+func (r *Rule) message(team string, value float64) string {
+	direction, threshold := "above", r.threshold()
+	if r.Below != nil {
+		direction = "below"
+	}
+	limit := fmt.Sprintf("%.0f%%", threshold)
+	if r.Metric == MetricHoursPerPerson {
+		limit = fmt.Sprintf("%.1f", threshold)
+	}
+	weeks := "last week"
+	if r.Weeks > 1 {
+		weeks = fmt.Sprintf("for %v consecutive weeks", r.Weeks)
+	}
+	return fmt.Sprintf("%v: %v, %v %v %v (%v)", team, r.describe(value), direction, limit, weeks, r.Name)
+}
+
+// Returns the hours of a team in each of the given weeks, keyed by the start of the week (2006-01-02)
+func (e *Evaluator) teamWeeks(teamid int64, start, end time.Time) (map[string]*weekHours, error) {
+	rows, err := e.DB.QueryReport(&timedb.ReportQuery{
+		Filter:  timedb.TimeFilter{TeamIDs: []int64{teamid}, Start: start, End: end},
+		GroupBy: []timedb.ReportGroup{timedb.GroupTicketType, timedb.GroupUser},
+		Bucket:  timedb.BucketWeek,
+	})
+	if err != nil {
+		return nil, err
+	}
+	weeks := map[string]*weekHours{}
+	for _, row := range rows {
+		key := row.Bucket.Format("2006-01-02")
+		w := weeks[key]
+		if w == nil {
+			w = &weekHours{types: map[string]float64{}, people: map[int64]bool{}}
+			weeks[key] = w
+		}
+		hours := row.Seconds / 3600
+		w.total += hours
+		w.types[row.TicketType] += hours
+		w.people[row.UserID] = true
+	}
+	return weeks, nil
+}
+
+// Result of an evaluation
+type Result struct {
+	Fired    int
+	Resolved int
+}
+
+// Evaluate checks every rule for every team, and raises and resolves alerts, and notifies the webhook.
+// Open alerts of rules (or teams) that are no longer evaluated, because the rule was renamed, removed or
+// moved to another team, are resolved. Failed notifications are logged, and retried on the next evaluation.
+func (e *Evaluator) Evaluate(now time.Time) (Result, error) {
+	result := Result{}
+	teams, err := e.DB.Teams()
+	if err != nil {
+		return result, err
+	}
+	evaluated := map[string]bool{}
+	end := weekStart(now)
+	for i := range e.Config.Rules {
+		rule := &e.Config.Rules[i]
+		start := end.AddDate(0, 0, -7*rule.Weeks)
+		for _, team := range teams {
+			if rule.Team != "" && rule.Team != team.Name {
+				continue
+			}
+			evaluated[alertKey(rule.Name, team.TeamID)] = true
+			weeks, err := e.teamWeeks(team.TeamID, start, end)
+			if err != nil {
+				return result, err
+			}
+			holds := true
+			value := 0.0
+			for w := start; w.Before(end); w = w.AddDate(0, 0, 7) {
+				v, ok := rule.value(weeks[w.Format("2006-01-02")])
+				holds = holds && ok && rule.holds(v)
+				value = v
+			}
+			fired, resolved, err := e.update(rule, team, start, value, holds)
+			if err != nil {
+				return result, err
+			}
+			if fired {
+				result.Fired++
+			}
+			if resolved {
+				result.Resolved++
+			}
+		}
+	}
+
+	open, err := e.DB.OpenAlerts()
+	if err != nil {
+		return result, err
+	}
+	for i := range open {
+		if evaluated[alertKey(open[i].Rule, open[i].TeamID)] {
+			continue
+		}
+		if err := e.resolve(&open[i]); err != nil {
+			return result, err
+		}
+		result.Resolved++
+	}
+	return result, nil
+}
+
+func alertKey(rule string, teamid int64) string {
+	return fmt.Sprintf("%v/%v", teamid, rule)
+}
+
+// Raise, update or resolve the alert of a rule and team
+func (e *Evaluator) update(rule *Rule, team timedb.Team, firstWeek time.Time, value float64, holds bool) (fired, resolved bool, err error) {
+	open, err := e.DB.OpenAlert(rule.Name, team.TeamID)
+	if err != nil {
+		return false, false, err
+	}
+	message := rule.message(team.Name, value)
+	switch {
+	case holds && open == nil:
+		a := &timedb.Alert{Rule: rule.Name, TeamID: team.TeamID, FirstWeek: firstWeek, Value: value, Threshold: rule.threshold(), Message: message, FiredAt: time.Now()}
+		if a.AlertID, err = e.DB.InsertAlert(a); err != nil || a.AlertID == 0 {
+			// An AlertID of 0 means that a concurrent evaluation raised it first
+			return false, false, err
+		}
+		e.notifyFired(a.AlertID, message)
+		return true, false, nil
+	case holds:
+		if err := e.DB.UpdateAlert(open.AlertID, value, message); err != nil {
+			return false, false, err
+		}
+		if open.NotifiedAt == nil {
+			e.notifyFired(open.AlertID, message)
+		}
+	case open != nil:
+		if err := e.resolve(open); err != nil {
+			return false, false, err
+		}
+		return false, true, nil
+	}
+	return false, false, nil
+}
+
+// Resolve an open alert, and notify the resolution if the alert itself was notified
+func (e *Evaluator) resolve(open *timedb.Alert) error {
+	if err := e.DB.ResolveAlert(open.AlertID); err != nil {
+		return err
+	}
+	if open.NotifiedAt != nil {
+		if err := e.Notify("Resolved: "+open.Message, false); err != nil {
+			e.DB.Log.Errorf("Alert: unable to notify resolution of alert %v: %v", open.AlertID, err)
+		}
+	}
+	return nil
+}
+
+func (e *Evaluator) notifyFired(alertid int64, message string) {
+	if err := e.Notify(message, true); err != nil {
+		e.DB.Log.Errorf("Alert: unable to notify alert %v: %v", alertid, err)
+		return
+	}
+	if err := e.DB.SetAlertNotified(alertid); err != nil {
+		e.DB.Log.Errorf("Alert: unable to record notification of alert %v: %v", alertid, err)
+	}
+}
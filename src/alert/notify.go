@@ -0,0 +1,69 @@
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// Slack incoming webhook
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+// Teams incoming webhook (Office 365 connector card)
+type teamsMessage struct {
+	Type       string `json:"@type"`
+	Context    string `json:"@context"`
+	ThemeColor string `json:"themeColor"`
+	Summary    string `json:"summary"`
+	Title      string `json:"title"`
+	Text       string `json:"text"`
+}
+
+// Notify posts a message to the webhook. fired is false for a message about a resolved alert.
+// Without a WebhookURL, alerts are only recorded, so this does nothing.
+func (e *Evaluator) Notify(message string, fired bool) error {
+	if e.Config.WebhookURL == "" {
+		return nil
+	}
+	var body interface{}
+	switch e.Config.Format {
+	case FormatTeams:
+		color := "DD5555"
+		if !fired {
+			color = "55DD55"
+		}
+		text := message
+		if e.Config.DashboardURL != "" {
+			text += fmt.Sprintf("\n\n[Open the dashboard](%v)", e.Config.DashboardURL)
+		}
+		body = &teamsMessage{Type: "MessageCard", Context: "https://schema.org/extensions", ThemeColor: color, Summary: message, Title: "Time tracker alert", Text: text}
+	default:
+		text := message
+		if e.Config.DashboardURL != "" {
+			text += fmt.Sprintf(" <%v|Open the dashboard>", e.Config.DashboardURL)
+		}
+		body = &slackMessage{Text: text}
+	}
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Post(e.Config.WebhookURL, "application/json", bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1000))
+		return fmt.Errorf("Webhook returned %v: %v", resp.Status, string(msg))
+	}
+	return nil
+}
@@ -0,0 +1,917 @@
+package api
+
+import (
+	"auth"
+	"encoding/json"
+	"fmt"
+	"forecast"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"timedb"
+)
+
+/*
+Package api serves the versioned JSON API at /api/v1. The routes below are also the source of the
+OpenAPI spec at /api/v1/openapi.json, so a route and its documentation cannot drift apart.
+
+Conventions:
+	Lists are paginated with 'limit' (default 100, maximum 1000) and 'offset', and are returned as
+	{"Items": [...], "Total": n, "Limit": n, "Offset": n}.
+	List parameters may be repeated (type=bug&type=feat) or comma separated (type=bug,feat).
+	Dates are 2006-01-02. 'from' is inclusive, and 'to' is inclusive.
+	Errors are returned as {"Error": {"Code": "...", "Message": "..."}}, with a matching HTTP status.
+
+Requests are authenticated with the dashboard session cookie, or with "Authorization: Bearer <token>",
+where the token is created with 'go run src/cmd/accounts.go -token <email>'.
+*/
+
+const Prefix = "/api/v1"
+
+const defaultLimit = 100
+const maxLimit = 1000
+
+// Reports cover the last year, unless 'from' is specified
+const defaultReportDays = 365
+
+// Velocity covers the last 26 weeks, unless 'from' is specified, in periods of at most 8 weeks
+const defaultVelocityWeeks = 26
+const maxVelocityWeeks = 8
+
+// Forecasts, and their history, are at most three years long
+const maxForecastWeeks = 156
+
+type Server struct {
+	DB   *timedb.TimeDB
+	Auth *auth.Auth
+}
+
+// Error is an error that is reported to the client, with an HTTP status
+type Error struct {
+	Status  int `json:"-"`
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func badRequest(format string, args ...interface{}) *Error {
+	return &Error{Status: http.StatusBadRequest, Code: "bad_request", Message: fmt.Sprintf(format, args...)}
+}
+
+func notFound(format string, args ...interface{}) *Error {
+	return &Error{Status: http.StatusNotFound, Code: "not_found", Message: fmt.Sprintf(format, args...)}
+}
+
+func forbidden(format string, args ...interface{}) *Error {
+	return &Error{Status: http.StatusForbidden, Code: "forbidden", Message: fmt.Sprintf(format, args...)}
+}
+
+type errorResponse struct {
+	Error *Error
+}
+
+// Page is the response of every list endpoint
+type Page struct {
+	Items  interface{}
+	Total  int
+	Limit  int
+	Offset int
+}
+
+// A request that has been matched to a route
+type call struct {
+	r       *http.Request
+	session *auth.Session
+	id      int64 // The {id} path parameter
+}
+
+type param struct {
+	Name        string
+	In          string // "query" or "path"
+	Type        string // "integer", "string" or "date"
+	Description string
+}
+
+type route struct {
+	Path     string // May end in {id}
+	Summary  string
+	Params   []param
+	Response interface{} // A value of the response type (or of the item type, for lists), for the spec
+	List     bool
+	handler  func(s *Server, c *call) (interface{}, error)
+}
+
+var pageParams = []param{
+	{"limit", "query", "integer", "Maximum number of items to return (default 100, maximum 1000)"},
+	{"offset", "query", "integer", "Number of items to skip"},
+}
+
+var timeFilterParams = []param{
+	{"userid", "query", "integer", "Only these users. Requires permission to see the individuals."},
+	{"teamid", "query", "integer", "Only the time of people while they were members of these teams"},
+	{"from", "query", "date", "Inclusive start date"},
+	{"to", "query", "date", "Inclusive end date"},
+	{"type", "query", "string", "Ticket types, such as bug, feat, bau"},
+	{"system", "query", "string", "Time sources, such as tmet, togl, jira"},
+	{"project", "query", "string", "Projects, as recorded by the time source"},
+}
+
+var costParam = param{"cost", "query", "boolean", "Also sum the cost of the time, at each person's hourly rate. Requires a role that may see costs, or an admin for the costs of individuals."}
+
+var idParam = param{"id", "path", "integer", ""}
+
+func params(lists ...[]param) []param {
+	all := []param{}
+	for _, l := range lists {
+		all = append(all, l...)
+	}
+	return all
+}
+
+var routes = []route{
+	{Path: "/users", Summary: "Users whose individual data you may see", List: true, Response: timedb.User{},
+		Params:  params([]param{{"q", "query", "string", "Substring of the email address"}, {"teamid", "query", "integer", "Only users that were ever members of these teams"}}, pageParams),
+		handler: (*Server).listUsers},
+	{Path: "/users/{id}", Summary: "A single user", Response: timedb.User{}, Params: []param{idParam}, handler: (*Server).getUser},
+	{Path: "/teams", Summary: "Teams. Members are only included for teams whose individuals you may see.", List: true, Response: timedb.Team{},
+		Params: pageParams, handler: (*Server).listTeams},
+	{Path: "/teams/{id}", Summary: "A single team", Response: timedb.Team{}, Params: []param{idParam}, handler: (*Server).getTeam},
+	{Path: "/tickets", Summary: "Tickets", List: true, Response: timedb.Ticket{},
+		Params: params([]param{
+			{"q", "query", "string", "Substring of the key or title"},
+			{"key", "query", "string", "JIRA keys"},
+			{"parent", "query", "string", "Only the children of this JIRA key"},
+			{"type", "query", "string", "Ticket types"},
+			{"system", "query", "string", "Ticket systems, such as jira or anon"},
+		}, pageParams),
+		handler: (*Server).listTickets},
+	{Path: "/tickets/{id}", Summary: "A single ticket, with the hours logged against it per person, and its commits", Response: ticketDetail{},
+		Params: []param{idParam}, handler: (*Server).getTicket},
+	{Path: "/times", Summary: "Raw time entries. Requires permission to see the individuals selected by userid or teamid.", List: true, Response: timedb.TimeEntry{},
+		Params: params(timeFilterParams, pageParams), handler: (*Server).listTimes},
+	{Path: "/reports/monthly", Summary: "Hours per month and ticket type", Response: []timedb.MonthlyHours{},
+		Params: params(timeFilterParams, []param{costParam}), handler: (*Server).monthlyReport},
+	{Path: "/reports/hours", Summary: "Hours per bucket, grouped by any of type, user, system, project and ticket. Grouping by user requires permission to see the individuals.",
+		Response: []timedb.ReportRow{},
+		Params: params([]param{
+			{"group", "query", "string", "Groups: type, user, system, project, ticket"},
+			{"bucket", "query", "string", "day, week, month, quarter, year, or empty for a total"},
+			costParam,
+		}, timeFilterParams),
+		handler: (*Server).hoursReport},
+	{Path: "/reports/tickets", Summary: "The tickets that time was logged against, with the hours of each person. People that you may not see individually are combined.",
+		Response: []timedb.DrillDownTicket{}, Params: params(timeFilterParams, []param{costParam}), handler: (*Server).ticketsReport},
+	{Path: "/reports/rollup", Summary: "Hours per story or epic, including the hours of their descendants", Response: []timedb.TicketRollup{},
+		Params: params([]param{{"level", "query", "string", "story (default) or epic"}, costParam}, timeFilterParams), handler: (*Server).rollupReport},
+	{Path: "/reports/timesheets", Summary: "Logged against expected hours per person and working day, with gaps and under or over logging. Defaults to the last four weeks. Requires permission to see the individuals.",
+		Response: []timedb.TimesheetSummary{}, Params: timeFilterParams[:4], handler: (*Server).timesheetsReport},
+	{Path: "/reports/capitalisation", Summary: "CapEx and OpEx hours per team and project, classified by the capitalisation rules. Requires a role that may see costs.",
+		Response: []timedb.CapitalisationRow{}, Params: []param{timeFilterParams[1], timeFilterParams[2], timeFilterParams[3], costParam}, handler: (*Server).capitalisationReport},
+	{Path: "/reports/velocity", Summary: "Story points and tickets resolved, and hours per point, per team and period, from JIRA resolutions. Defaults to the last 26 weeks.",
+		Response: []timedb.TeamVelocity{},
+		Params: []param{
+			timeFilterParams[1],
+			{"from", "query", "date", "Start of the first period"},
+			{"to", "query", "date", "Inclusive end date"},
+			{"weeks", "query", "integer", "Length of each period, in weeks, such as 2 for two week sprints (default 1)"},
+		},
+		handler: (*Server).velocityReport},
+	{Path: "/reports/cycletime", Summary: "Percentiles of lead time, time to first work and active work span of resolved tickets, per team, period of resolution and ticket type",
+		Response: []timedb.CycleTimeStats{},
+		Params: []param{
+			timeFilterParams[1], timeFilterParams[2], timeFilterParams[3], timeFilterParams[4],
+			{"bucket", "query", "string", "Period of resolution: week, month (default), quarter, year, or total"},
+		},
+		handler: (*Server).cycleTimeReport},
+	{Path: "/reports/cycletime/tickets", Summary: "Lead time, time to first work and active work span of each resolved ticket, in order of resolution",
+		List: true, Response: timedb.TicketCycleTime{}, Params: params(timeFilterParams[1:5], pageParams), handler: (*Server).cycleTimeTickets},
+	{Path: "/reports/focus", Summary: "Context switching per team and week: tickets and switches per day, longest uninterrupted block and share of interrupt work. TMetric and Harvest time, which has no time of day, is left out.",
+		Response: []timedb.TeamFocusWeek{}, Params: params(timeFilterParams[1:4], timeFilterParams[5:6]), handler: (*Server).focusReport},
+	{Path: "/reports/focus/days", Summary: "Context switching per person and day. Requires permission to see the individuals.",
+		List: true, Response: timedb.FocusDay{}, Params: params(timeFilterParams[:4], timeFilterParams[5:6], pageParams), handler: (*Server).focusDays},
+	{Path: "/reports/forecast", Summary: "Forecast hours of unplanned work per team and week, with 80% and 95% confidence bands, and the nominal capacity that they leave. Defaults to the 13 weeks from next Monday.",
+		Response: []forecast.Forecast{},
+		Params: []param{
+			timeFilterParams[1],
+			{"from", "query", "date", "First day of the forecast, on which its weeks start"},
+			{"weeks", "query", "integer", "Number of weeks to forecast (default 13)"},
+			{"history", "query", "integer", "Number of past weeks to fit the forecast to (default 52)"},
+			{"type", "query", "string", "Ticket types of unplanned work (default bug, bau and intr)"},
+		},
+		handler: (*Server).forecastReport},
+	{Path: "/alerts", Summary: "Alerts raised by the alert rules, open and resolved, newest first", List: true, Response: timedb.Alert{},
+		Params: pageParams, handler: (*Server).listAlerts},
+}
+
+// Match a path (without the prefix) to a route, and parse its {id}
+func matchRoute(path string) (*route, int64, bool) {
+	path = strings.TrimRight(path, "/")
+	for i := range routes {
+		rt := &routes[i]
+		if rt.Path == path {
+			return rt, 0, true
+		}
+		if base := strings.TrimSuffix(rt.Path, "{id}"); base != rt.Path && strings.HasPrefix(path, base) {
+			if id, err := strconv.ParseInt(path[len(base):], 10, 64); err == nil {
+				return rt, id, true
+			}
+		}
+	}
+	return nil, 0, false
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			s.DB.Log.Errorf("API %v: %v", r.URL.Path, rec)
+			sendError(w, &Error{Status: http.StatusInternalServerError, Code: "internal", Message: "Internal error"})
+		}
+	}()
+
+	path := strings.TrimPrefix(r.URL.Path, Prefix)
+	if path == "/openapi.json" {
+		send(w, http.StatusOK, spec())
+		return
+	}
+	rt, id, ok := matchRoute(path)
+	if !ok {
+		sendError(w, notFound("No such resource: %v", r.URL.Path))
+		return
+	}
+	if r.Method != "GET" {
+		sendError(w, &Error{Status: http.StatusMethodNotAllowed, Code: "method_not_allowed", Message: "Only GET is supported"})
+		return
+	}
+	session, err := s.Auth.Session(r)
+	if err != nil {
+		panic(err)
+	}
+	if session == nil {
+		sendError(w, &Error{Status: http.StatusUnauthorized, Code: "unauthorized", Message: "Sign in, or send a bearer token"})
+		return
+	}
+	result, err := rt.handler(s, &call{r: r, session: session, id: id})
+	if err != nil {
+		if apiErr, ok := err.(*Error); ok {
+			sendError(w, apiErr)
+		} else {
+			panic(err)
+		}
+		return
+	}
+	send(w, http.StatusOK, result)
+}
+
+func send(w http.ResponseWriter, status int, v interface{}) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(raw)
+}
+
+func sendError(w http.ResponseWriter, e *Error) {
+	send(w, e.Status, &errorResponse{Error: e})
+}
+
+// Split a list parameter, which may be repeated, or comma separated
+func (c *call) list(name string) []string {
+	list := []string{}
+	c.r.ParseForm()
+	for _, v := range c.r.Form[name] {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+// Returns nil if the parameter is absent
+func (c *call) idList(name string) ([]int64, error) {
+	items := c.list(name)
+	if len(items) == 0 {
+		return nil, nil
+	}
+	ids := []int64{}
+	for _, item := range items {
+		id, err := strconv.ParseInt(item, 10, 64)
+		if err != nil {
+			return nil, badRequest("Invalid %v '%v'", name, item)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (c *call) date(name string) (time.Time, error) {
+	v := c.r.FormValue(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+	if err != nil {
+		return t, badRequest("Invalid %v '%v'. Expected format 2006-01-02", name, v)
+	}
+	return t, nil
+}
+
+// Returns true if the cost parameter asks for costs, which the session must be allowed to see.
+// The cost of one person's time reveals their rate, so only admins may see costs per userid.
+func (c *call) cost() (bool, error) {
+	v := c.r.FormValue("cost")
+	if v != "true" && v != "1" {
+		return false, nil
+	}
+	if !c.session.CanSeeCosts() {
+		return false, forbidden("You may not see costs")
+	}
+	if c.r.FormValue("userid") != "" && !c.session.IsAdmin() {
+		return false, forbidden("Only admins may see the costs of individuals")
+	}
+	return true, nil
+}
+
+func (c *call) page() (int, int, error) {
+	limit, offset := defaultLimit, 0
+	var err error
+	if v := c.r.FormValue("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxLimit {
+			return 0, 0, badRequest("limit must be between 1 and %v", maxLimit)
+		}
+	}
+	if v := c.r.FormValue("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return 0, 0, badRequest("offset must be zero or more")
+		}
+	}
+	return limit, offset, nil
+}
+
+// Slice a page out of a list that was loaded in full
+func pageOf(items []interface{}, limit, offset int) *Page {
+	p := &Page{Items: []interface{}{}, Total: len(items), Limit: limit, Offset: offset}
+	if offset < len(items) {
+		end := offset + limit
+		if end > len(items) {
+			end = len(items)
+		}
+		p.Items = items[offset:end]
+	}
+	return p
+}
+
+// Build a time filter from the userid, teamid, from, to, type and system parameters.
+// If individuals is true, then the time of individuals is returned, so the session needs
+// permission to see them. Otherwise only aggregates are returned, so any team may be selected.
+func (c *call) timeFilter(individuals bool) (*timedb.TimeFilter, error) {
+	f := &timedb.TimeFilter{}
+	var err error
+	if f.UserIDs, err = c.idList("userid"); err != nil {
+		return nil, err
+	}
+	if f.TeamIDs, err = c.idList("teamid"); err != nil {
+		return nil, err
+	}
+	for _, userid := range f.UserIDs {
+		if !c.session.CanSeeUser(userid) {
+			return nil, forbidden("You may not see the data of user %v", userid)
+		}
+	}
+	if individuals && f.UserIDs == nil {
+		if f.TeamIDs == nil && !c.session.IsAdmin() {
+			return nil, forbidden("Specify userid or teamid")
+		}
+		if f.TeamIDs != nil && !c.session.CanSeeTeamIndividuals(f.TeamIDs) {
+			return nil, forbidden("You may not see the individuals of these teams")
+		}
+	}
+	if f.Start, err = c.date("from"); err != nil {
+		return nil, err
+	}
+	if f.End, err = c.date("to"); err != nil {
+		return nil, err
+	}
+	if !f.End.IsZero() {
+		f.End = f.End.AddDate(0, 0, 1)
+	}
+	f.TicketTypes = c.list("type")
+	f.Systems = c.list("system")
+	f.Projects = c.list("project")
+	return f, nil
+}
+
+// Same as timeFilter(false), but defaults to the last year
+func (c *call) reportFilter() (*timedb.TimeFilter, error) {
+	f, err := c.timeFilter(false)
+	if err == nil && f.Start.IsZero() {
+		f.Start = time.Now().AddDate(0, 0, -defaultReportDays)
+	}
+	return f, err
+}
+
+func (s *Server) listUsers(c *call) (interface{}, error) {
+	limit, offset, err := c.page()
+	if err != nil {
+		return nil, err
+	}
+	teamids, err := c.idList("teamid")
+	if err != nil {
+		return nil, err
+	}
+	var members map[int64]bool
+	if teamids != nil {
+		ids, err := s.DB.TeamMemberUserIDs(teamids)
+		if err != nil {
+			return nil, err
+		}
+		members = map[int64]bool{}
+		for _, id := range ids {
+			members[id] = true
+		}
+	}
+	users, err := s.DB.Users()
+	if err != nil {
+		return nil, err
+	}
+	q := strings.ToLower(c.r.FormValue("q"))
+	items := []interface{}{}
+	for _, u := range users {
+		if c.session.CanSeeUser(u.UserID) && (members == nil || members[u.UserID]) && strings.Contains(strings.ToLower(u.Email), q) {
+			items = append(items, u)
+		}
+	}
+	return pageOf(items, limit, offset), nil
+}
+
+func (s *Server) getUser(c *call) (interface{}, error) {
+	if !c.session.CanSeeUser(c.id) {
+		return nil, forbidden("You may not see user %v", c.id)
+	}
+	users, err := s.DB.Users()
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		if u.UserID == c.id {
+			return u, nil
+		}
+	}
+	return nil, notFound("User %v not found", c.id)
+}
+
+// Omit the members of a team whose individuals the session may not see
+func (c *call) visibleTeam(t timedb.Team) timedb.Team {
+	if !c.session.CanSeeTeamIndividuals([]int64{t.TeamID}) {
+		t.Members = []timedb.TeamMember{}
+	}
+	return t
+}
+
+func (s *Server) listTeams(c *call) (interface{}, error) {
+	limit, offset, err := c.page()
+	if err != nil {
+		return nil, err
+	}
+	teams, err := s.DB.Teams()
+	if err != nil {
+		return nil, err
+	}
+	items := []interface{}{}
+	for _, t := range teams {
+		items = append(items, c.visibleTeam(t))
+	}
+	return pageOf(items, limit, offset), nil
+}
+
+func (s *Server) getTeam(c *call) (interface{}, error) {
+	teams, err := s.DB.Teams()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range teams {
+		if t.TeamID == c.id {
+			return c.visibleTeam(t), nil
+		}
+	}
+	return nil, notFound("Team %v not found", c.id)
+}
+
+// Anonymous tasks are personal, so they are limited to the users that the session may see
+func (c *call) anonUserIDs() []int64 {
+	visible := c.session.VisibleUsers()
+	if visible == nil {
+		return nil
+	}
+	ids := []int64{}
+	for id := range visible {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (s *Server) listTickets(c *call) (interface{}, error) {
+	limit, offset, err := c.page()
+	if err != nil {
+		return nil, err
+	}
+	q := &timedb.TicketQuery{
+		Search:      c.r.FormValue("q"),
+		Keys:        c.list("key"),
+		ParentKey:   c.r.FormValue("parent"),
+		Types:       c.list("type"),
+		Systems:     c.list("system"),
+		AnonUserIDs: c.anonUserIDs(),
+	}
+	tickets, total, err := s.DB.QueryTickets(q, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return &Page{Items: tickets, Total: total, Limit: limit, Offset: offset}, nil
+}
+
+type ticketDetail struct {
+	Ticket   timedb.Ticket
+	Activity timedb.TicketActivity
+}
+
+func (s *Server) getTicket(c *call) (interface{}, error) {
+	ticket, err := s.DB.Ticket(c.id)
+	if err != nil {
+		return nil, err
+	}
+	if ticket == nil || (ticket.System == timedb.SystemTypeAnon && !c.session.CanSeeUser(ticket.UserID)) {
+		return nil, notFound("Ticket %v not found", c.id)
+	}
+	activity, err := s.DB.QueryTicketActivity(c.id)
+	if err != nil {
+		return nil, err
+	}
+	c.session.FilterTicketActivity(activity)
+	return &ticketDetail{Ticket: *ticket, Activity: *activity}, nil
+}
+
+func (s *Server) listTimes(c *call) (interface{}, error) {
+	limit, offset, err := c.page()
+	if err != nil {
+		return nil, err
+	}
+	filter, err := c.timeFilter(true)
+	if err != nil {
+		return nil, err
+	}
+	times, total, err := s.DB.QueryTimes(filter, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return &Page{Items: times, Total: total, Limit: limit, Offset: offset}, nil
+}
+
+func (s *Server) monthlyReport(c *call) (interface{}, error) {
+	filter, err := c.reportFilter()
+	if err != nil {
+		return nil, err
+	}
+	cost, err := c.cost()
+	if err != nil {
+		return nil, err
+	}
+	return s.DB.QueryMonthlyHours(filter, cost)
+}
+
+func (s *Server) rollupReport(c *call) (interface{}, error) {
+	filter, err := c.reportFilter()
+	if err != nil {
+		return nil, err
+	}
+	level := timedb.RollupLevel(c.r.FormValue("level"))
+	if level == "" {
+		level = timedb.RollupStory
+	}
+	if level != timedb.RollupStory && level != timedb.RollupEpic {
+		return nil, badRequest("Invalid level '%v'. Expected story or epic", level)
+	}
+	cost, err := c.cost()
+	if err != nil {
+		return nil, err
+	}
+	return s.DB.QueryRollup(level, filter, cost)
+}
+
+func (s *Server) hoursReport(c *call) (interface{}, error) {
+	q := &timedb.ReportQuery{Bucket: timedb.ReportBucket(c.r.FormValue("bucket"))}
+	if !timedb.ValidReportBucket(q.Bucket) {
+		return nil, badRequest("Invalid bucket '%v'", q.Bucket)
+	}
+	individuals := false
+	for _, g := range c.list("group") {
+		group := timedb.ReportGroup(g)
+		if !timedb.ValidReportGroup(group) {
+			return nil, badRequest("Invalid group '%v'", g)
+		}
+		individuals = individuals || group == timedb.GroupUser
+		q.GroupBy = append(q.GroupBy, group)
+	}
+	filter, err := c.timeFilter(individuals)
+	if err != nil {
+		return nil, err
+	}
+	if filter.Start.IsZero() {
+		filter.Start = time.Now().AddDate(0, 0, -defaultReportDays)
+	}
+	q.Filter = *filter
+	if q.Cost, err = c.cost(); err != nil {
+		return nil, err
+	}
+	if q.Cost && individuals && !c.session.IsAdmin() {
+		return nil, forbidden("Only admins may see the costs of individuals")
+	}
+	return s.DB.QueryReport(q)
+}
+
+func (s *Server) ticketsReport(c *call) (interface{}, error) {
+	filter, err := c.reportFilter()
+	if err != nil {
+		return nil, err
+	}
+	cost, err := c.cost()
+	if err != nil {
+		return nil, err
+	}
+	tickets, err := s.DB.QueryDrillDown(filter, cost)
+	if err != nil {
+		return nil, err
+	}
+	for i := range tickets {
+		tickets[i].People = c.session.FilterPeople(tickets[i].People)
+	}
+	return tickets, nil
+}
+
+func (s *Server) timesheetsReport(c *call) (interface{}, error) {
+	filter, err := c.timeFilter(true)
+	if err != nil {
+		return nil, err
+	}
+	q := &timedb.TimesheetQuery{UserIDs: filter.UserIDs, TeamIDs: filter.TeamIDs, Start: filter.Start, End: filter.End}
+	if q.UserIDs == nil && q.TeamIDs == nil {
+		if q.TeamIDs, err = s.DB.AllTeamIDs(); err != nil {
+			return nil, err
+		}
+	}
+	if q.End.IsZero() {
+		q.End = time.Now()
+	}
+	if q.Start.IsZero() {
+		q.Start = q.End.AddDate(0, 0, -28)
+	}
+	return s.DB.QueryTimesheets(q)
+}
+
+func (s *Server) capitalisationReport(c *call) (interface{}, error) {
+	if !c.session.CanSeeCosts() {
+		return nil, forbidden("You may not see the capitalisation report")
+	}
+	teamids, err := c.idList("teamid")
+	if err != nil {
+		return nil, err
+	}
+	start, err := c.date("from")
+	if err != nil {
+		return nil, err
+	}
+	end, err := c.date("to")
+	if err != nil {
+		return nil, err
+	}
+	if start.IsZero() || end.IsZero() {
+		return nil, badRequest("Specify from and to")
+	}
+	cost, err := c.cost()
+	if err != nil {
+		return nil, err
+	}
+	return s.DB.QueryCapitalisation(start, end.AddDate(0, 0, 1), teamids, cost)
+}
+
+func (s *Server) velocityReport(c *call) (interface{}, error) {
+	teamids, err := c.idList("teamid")
+	if err != nil {
+		return nil, err
+	}
+	weeks := 1
+	if v := c.r.FormValue("weeks"); v != "" {
+		if weeks, err = strconv.Atoi(v); err != nil || weeks < 1 || weeks > maxVelocityWeeks {
+			return nil, badRequest("weeks must be between 1 and %v", maxVelocityWeeks)
+		}
+	}
+	start, err := c.date("from")
+	if err != nil {
+		return nil, err
+	}
+	end, err := c.date("to")
+	if err != nil {
+		return nil, err
+	}
+	if end.IsZero() {
+		now := time.Now()
+		end = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	}
+	end = end.AddDate(0, 0, 1)
+	if start.IsZero() {
+		start = end.AddDate(0, 0, -7*defaultVelocityWeeks)
+	}
+	if !start.Before(end) {
+		return nil, badRequest("from must be before to")
+	}
+	return s.DB.QueryVelocity(start, end, weeks, teamids)
+}
+
+// The tickets resolved in the period of the from and to parameters, by the teams and of the types of the teamid and type parameters
+func (s *Server) cycleTimes(c *call) ([]timedb.TicketCycleTime, error) {
+	teamids, err := c.idList("teamid")
+	if err != nil {
+		return nil, err
+	}
+	start, err := c.date("from")
+	if err != nil {
+		return nil, err
+	}
+	end, err := c.date("to")
+	if err != nil {
+		return nil, err
+	}
+	if end.IsZero() {
+		end = time.Now()
+	} else {
+		end = end.AddDate(0, 0, 1)
+	}
+	if start.IsZero() {
+		start = end.AddDate(0, 0, -defaultReportDays)
+	}
+	return s.DB.QueryCycleTimes(start, end, teamids, c.list("type"))
+}
+
+func (s *Server) cycleTimeReport(c *call) (interface{}, error) {
+	bucket := timedb.BucketMonth
+	if v := c.r.FormValue("bucket"); v == "total" {
+		bucket = timedb.BucketNone
+	} else if v != "" {
+		bucket = timedb.ReportBucket(v)
+		if !timedb.ValidReportBucket(bucket) {
+			return nil, badRequest("Invalid bucket '%v'", v)
+		}
+	}
+	tickets, err := s.cycleTimes(c)
+	if err != nil {
+		return nil, err
+	}
+	return timedb.CycleTimeDistribution(tickets, bucket, true), nil
+}
+
+func (s *Server) cycleTimeTickets(c *call) (interface{}, error) {
+	limit, offset, err := c.page()
+	if err != nil {
+		return nil, err
+	}
+	tickets, err := s.cycleTimes(c)
+	if err != nil {
+		return nil, err
+	}
+	items := []interface{}{}
+	for _, t := range tickets {
+		items = append(items, t)
+	}
+	return pageOf(items, limit, offset), nil
+}
+
+func (s *Server) focusReport(c *call) (interface{}, error) {
+	filter, err := c.reportFilter()
+	if err != nil {
+		return nil, err
+	}
+	all, err := s.DB.Teams()
+	if err != nil {
+		return nil, err
+	}
+	teams := []timedb.Team{}
+	for _, t := range all {
+		for _, id := range filter.TeamIDs {
+			if id == t.TeamID {
+				teams = append(teams, t)
+			}
+		}
+	}
+	if filter.TeamIDs == nil {
+		teams = all
+	}
+	days, err := s.DB.QueryFocusDays(filter)
+	if err != nil {
+		return nil, err
+	}
+	return timedb.TeamFocusWeeks(days, teams), nil
+}
+
+func (s *Server) focusDays(c *call) (interface{}, error) {
+	limit, offset, err := c.page()
+	if err != nil {
+		return nil, err
+	}
+	filter, err := c.timeFilter(true)
+	if err != nil {
+		return nil, err
+	}
+	if filter.Start.IsZero() {
+		filter.Start = time.Now().AddDate(0, 0, -defaultReportDays)
+	}
+	days, err := s.DB.QueryFocusDays(filter)
+	if err != nil {
+		return nil, err
+	}
+	items := []interface{}{}
+	for _, d := range days {
+		if c.session.CanSeeUser(d.UserID) {
+			items = append(items, d)
+		}
+	}
+	return pageOf(items, limit, offset), nil
+}
+
+// Returns the integer parameter, or def if it is absent
+func (c *call) intParam(name string, def, min, max int) (int, error) {
+	v := c.r.FormValue(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < min || n > max {
+		return 0, badRequest("%v must be between %v and %v", name, min, max)
+	}
+	return n, nil
+}
+
+func (s *Server) forecastReport(c *call) (interface{}, error) {
+	teamids, err := c.idList("teamid")
+	if err != nil {
+		return nil, err
+	}
+	q := forecast.Query{Types: c.list("type")}
+	if q.Start, err = c.date("from"); err != nil {
+		return nil, err
+	}
+	if q.Start.IsZero() {
+		now := time.Now()
+		q.Start = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+		q.Start = q.Start.AddDate(0, 0, 7-(int(q.Start.Weekday())+6)%7)
+	}
+	if q.Weeks, err = c.intParam("weeks", forecast.DefaultWeeks, 1, maxForecastWeeks); err != nil {
+		return nil, err
+	}
+	if q.HistoryWeeks, err = c.intParam("history", forecast.DefaultHistoryWeeks, 2, maxForecastWeeks); err != nil {
+		return nil, err
+	}
+	teams, err := s.DB.Teams()
+	if err != nil {
+		return nil, err
+	}
+	result := []*forecast.Forecast{}
+	for _, t := range teams {
+		selected := teamids == nil
+		for _, id := range teamids {
+			selected = selected || id == t.TeamID
+		}
+		if !selected {
+			continue
+		}
+		q.TeamIDs, q.Team = []int64{t.TeamID}, t.Name
+		f, err := forecast.Compute(s.DB, &q)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, f)
+	}
+	return result, nil
+}
+
+func (s *Server) listAlerts(c *call) (interface{}, error) {
+	limit, offset, err := c.page()
+	if err != nil {
+		return nil, err
+	}
+	alerts, err := s.DB.RecentAlerts(0)
+	if err != nil {
+		return nil, err
+	}
+	items := []interface{}{}
+	for _, a := range alerts {
+		items = append(items, a)
+	}
+	return pageOf(items, limit, offset), nil
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Generate the OpenAPI 3 spec from the routes, and the Go types of their responses.
+// Struct types become component schemas, named after the type.
+
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := b.schema(t.Elem())
+		s["nullable"] = true
+		return s
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		name := t.Name()
+		if _, ok := b.components[name]; !ok {
+			b.components[name] = nil // Guard against recursive types
+			props := map[string]interface{}{}
+			for i := 0; i < t.NumField(); i++ {
+				f := t.Field(i)
+				tag := f.Tag.Get("json")
+				if f.PkgPath != "" || tag == "-" {
+					continue
+				}
+				fieldName := f.Name
+				if tagName := strings.Split(tag, ",")[0]; tagName != "" {
+					fieldName = tagName
+				}
+				props[fieldName] = b.schema(f.Type)
+			}
+			b.components[name] = map[string]interface{}{"type": "object", "properties": props}
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+func (b *schemaBuilder) parameter(p param) map[string]interface{} {
+	schema := map[string]interface{}{"type": p.Type}
+	if p.Type == "date" {
+		schema = map[string]interface{}{"type": "string", "format": "date"}
+	}
+	out := map[string]interface{}{
+		"name":        p.Name,
+		"in":          p.In,
+		"required":    p.In == "path",
+		"description": p.Description,
+		"schema":      schema,
+	}
+	return out
+}
+
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+func spec() map[string]interface{} {
+	b := &schemaBuilder{components: map[string]interface{}{}}
+	errorSchema := b.schema(reflect.TypeOf(errorResponse{}))
+	errors := map[string]interface{}{}
+	for _, status := range []string{"400", "401", "403", "404", "500"} {
+		errors[status] = map[string]interface{}{"description": "Error", "content": jsonContent(errorSchema)}
+	}
+
+	paths := map[string]interface{}{}
+	for _, rt := range routes {
+		schema := b.schema(reflect.TypeOf(rt.Response))
+		if rt.List {
+			schema = map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"Items":  map[string]interface{}{"type": "array", "items": schema},
+					"Total":  map[string]interface{}{"type": "integer"},
+					"Limit":  map[string]interface{}{"type": "integer"},
+					"Offset": map[string]interface{}{"type": "integer"},
+				},
+			}
+		}
+		responses := map[string]interface{}{"200": map[string]interface{}{"description": "OK", "content": jsonContent(schema)}}
+		for status, resp := range errors {
+			responses[status] = resp
+		}
+		parameters := []interface{}{}
+		for _, p := range rt.Params {
+			parameters = append(parameters, b.parameter(p))
+		}
+		paths[Prefix+rt.Path] = map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary":    rt.Summary,
+				"parameters": parameters,
+				"responses":  responses,
+			},
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Time Tracker API",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": b.components,
+			"securitySchemes": map[string]interface{}{
+				"bearer":  map[string]interface{}{"type": "http", "scheme": "bearer"},
+				"session": map[string]interface{}{"type": "apiKey", "in": "cookie", "name": "session"},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"bearer": []string{}},
+			map[string]interface{}{"session": []string{}},
+		},
+	}
+}
@@ -0,0 +1,415 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"timedb"
+)
+
+/*
+Package auth provides dashboard logins, either with a local password, or through an OIDC provider,
+and decides which data a signed in account may see.
+
+Roles:
+	admin     Sees everything, and manages teams, users and accounts
+	lead      Sees the individuals of the teams that the account leads, and their own data
+	engineer  Sees their own data, and team aggregates
+	viewer    Sees only team aggregates
+
+The optional config file config/auth.json:
+
+{
+	"SessionHours": 12,
+	"DefaultRole": "viewer",
+	"CostRoles": ["admin", "lead"],
+	"OIDC": {
+		"Name": "Dex",
+		"Issuer": "http://localhost:5556/dex",
+		"ClientID": "timetracker",
+		"ClientSecret": "SECRET",
+		"RedirectURL": "http://localhost:3333/auth/oidc/callback"
+	}
+}
+
+CostRoles are the roles that may see costs, which are hours multiplied by hourly rates. The default is
+admin only. The rates themselves, and the costs of individuals, which reveal their rates, are only
+ever shown to admins.
+*/
+
+const (
+	RoleAdmin    = "admin"
+	RoleLead     = "lead"
+	RoleEngineer = "engineer"
+	RoleViewer   = "viewer"
+)
+
+var Roles = []string{RoleAdmin, RoleLead, RoleEngineer, RoleViewer}
+
+func ValidRole(role string) bool {
+	for _, r := range Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+const sessionCookie = "session"
+const defaultSessionHours = 12
+
+// PBKDF2 iterations for new password hashes. The count is stored in the hash, so it can be raised later.
+const passwordIterations = 100000
+
+type OIDCConfig struct {
+	Name         string // Shown on the login button
+	Issuer       string // The provider's discovery document is at Issuer + "/.well-known/openid-configuration"
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string // Must point at /auth/oidc/callback on this server
+}
+
+type Config struct {
+	SessionHours int
+	DefaultRole  string      // Role of an account that is created by its first OIDC sign in. Default is viewer.
+	SecureCookie bool        // Only send the session cookie over https
+	CostRoles    []string    // Roles that may see costs. Default is admin.
+	OIDC         *OIDCConfig // nil if OIDC is disabled
+}
+
+type Auth struct {
+	Config Config
+	DB     *timedb.TimeDB
+
+	oidcLock sync.Mutex // Guards oidc
+	oidc     *oidcProvider
+}
+
+// Load config/auth.json. The file is optional, and without it only local accounts can sign in.
+func (a *Auth) LoadConfig() error {
+	filename := "config/auth.json"
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error loading config file %v: %v", filename, err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(bytes, &a.Config); err != nil {
+			return fmt.Errorf("Error decoding config file %v: %v", filename, err)
+		}
+	}
+	if a.Config.SessionHours <= 0 {
+		a.Config.SessionHours = defaultSessionHours
+	}
+	if a.Config.DefaultRole == "" {
+		a.Config.DefaultRole = RoleViewer
+	}
+	if !ValidRole(a.Config.DefaultRole) {
+		return fmt.Errorf("Invalid DefaultRole '%v' in %v", a.Config.DefaultRole, filename)
+	}
+	if len(a.Config.CostRoles) == 0 {
+		a.Config.CostRoles = []string{RoleAdmin}
+	}
+	for _, role := range a.Config.CostRoles {
+		if !ValidRole(role) {
+			return fmt.Errorf("Invalid role '%v' in CostRoles in %v", role, filename)
+		}
+	}
+	return nil
+}
+
+// Session is a signed in account, along with what it is allowed to see
+type Session struct {
+	Account      timedb.Account
+	visibleUsers map[int64]bool // nil if all users are visible
+	canSeeCosts  bool
+}
+
+func (s *Session) IsAdmin() bool {
+	return s.Account.Role == RoleAdmin
+}
+
+// Returns true if the session may see costs, which are hours multiplied by hourly rates
+func (s *Session) CanSeeCosts() bool {
+	return s.canSeeCosts
+}
+
+// Returns true if the session may see the individual data of the given user
+func (s *Session) CanSeeUser(userid int64) bool {
+	return s.visibleUsers == nil || s.visibleUsers[userid]
+}
+
+// Returns true if the session may see the individuals of all of the given teams
+func (s *Session) CanSeeTeamIndividuals(teamids []int64) bool {
+	if s.IsAdmin() {
+		return true
+	}
+	if s.Account.Role != RoleLead {
+		return false
+	}
+	for _, teamid := range teamids {
+		found := false
+		for _, lead := range s.Account.LeadTeamIDs {
+			found = found || lead == teamid
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the users whose individual data the session may see, or nil if it may see all users
+func (s *Session) VisibleUsers() map[int64]bool {
+	return s.visibleUsers
+}
+
+// Lump together the time of the people that the session may not see individually
+func (s *Session) FilterPeople(people []timedb.TicketUserHours) []timedb.TicketUserHours {
+	visible := []timedb.TicketUserHours{}
+	others := timedb.TicketUserHours{Email: "(others)"}
+	for _, u := range people {
+		if s.CanSeeUser(u.UserID) {
+			visible = append(visible, u)
+		} else {
+			others.Seconds += u.Seconds
+			others.Commits += u.Commits
+		}
+	}
+	if others.Seconds != 0 || others.Commits != 0 {
+		visible = append(visible, others)
+	}
+	return visible
+}
+
+// Lump together the time of the people that the session may not see individually, and hide their commit authors
+func (s *Session) FilterTicketActivity(activity *timedb.TicketActivity) {
+	activity.Users = s.FilterPeople(activity.Users)
+	for i := range activity.Commits {
+		if !s.CanSeeUser(activity.Commits[i].UserID) {
+			activity.Commits[i].UserID = 0
+			activity.Commits[i].Email = ""
+		}
+	}
+}
+
+func (a *Auth) newSession(account *timedb.Account) (*Session, error) {
+	s := &Session{Account: *account}
+	for _, role := range a.Config.CostRoles {
+		s.canSeeCosts = s.canSeeCosts || role == account.Role
+	}
+	if account.Role == RoleAdmin {
+		return s, nil
+	}
+	s.visibleUsers = map[int64]bool{}
+	if account.Role == RoleLead {
+		ids, err := a.DB.TeamMemberUserIDs(account.LeadTeamIDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			s.visibleUsers[id] = true
+		}
+	}
+	if (account.Role == RoleLead || account.Role == RoleEngineer) && account.UserID != 0 {
+		s.visibleUsers[account.UserID] = true
+	}
+	return s, nil
+}
+
+type contextKey int
+
+const sessionKey contextKey = 0
+
+// Returns the session that RequireSession attached to the request
+func FromRequest(r *http.Request) *Session {
+	s, _ := r.Context().Value(sessionKey).(*Session)
+	return s
+}
+
+// Wrap a handler so that it is only reachable with a valid session. A request for the home page is
+// redirected to the login page, and any other request receives a 401.
+// The session cookie is SameSite=Lax, so a state changing request from another site carries no session.
+func (a *Auth) RequireSession(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, err := a.Session(r)
+		if err != nil {
+			a.DB.Log.Errorf("Error reading session: %v", err)
+			http.Error(w, "Error reading session", http.StatusInternalServerError)
+			return
+		}
+		if s == nil {
+			if r.Method == "GET" && r.URL.Path == "/" {
+				http.Redirect(w, r, "/login", http.StatusFound)
+			} else {
+				http.Error(w, "Not signed in", http.StatusUnauthorized)
+			}
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), sessionKey, s)))
+	}
+}
+
+// Same as RequireSession, but only for admins
+func (a *Auth) RequireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return a.RequireSession(func(w http.ResponseWriter, r *http.Request) {
+		if !FromRequest(r).IsAdmin() {
+			http.Error(w, "Only admins may do this", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	})
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// Returns the session of the request, or nil if it is not signed in. The session token comes from
+// the session cookie, or from an "Authorization: Bearer <token>" header (see CreateToken).
+func (a *Auth) Session(r *http.Request) (*Session, error) {
+	token := ""
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	} else if cookie, err := r.Cookie(sessionCookie); err == nil {
+		token = cookie.Value
+	}
+	if token == "" {
+		return nil, nil
+	}
+	account, err := a.DB.SessionAccount(hashToken(token))
+	if err != nil || account == nil {
+		return nil, err
+	}
+	return a.newSession(account)
+}
+
+// Create a long lived session for a tool that uses the API, and return its token
+func (a *Auth) CreateToken(account *timedb.Account, lifetime time.Duration) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	return token, a.DB.CreateSession(hashToken(token), account.AccountID, time.Now().Add(lifetime))
+}
+
+// Create a session for the account, and send its cookie
+func (a *Auth) startSession(w http.ResponseWriter, account *timedb.Account) error {
+	lifetime := time.Duration(a.Config.SessionHours) * time.Hour
+	token, err := a.CreateToken(account, lifetime)
+	if err != nil {
+		return err
+	}
+	expires := time.Now().Add(lifetime)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   a.Config.SecureCookie,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// Sign in with a local password. Returns false if the email or password is wrong.
+func (a *Auth) Login(w http.ResponseWriter, email, password string) (bool, error) {
+	account, hash, err := a.DB.AccountByEmail(email)
+	if err != nil {
+		return false, err
+	}
+	if account == nil || hash == "" {
+		// Spend the same time as a real check, so that the response time doesn't reveal which accounts exist
+		CheckPassword(password, "pbkdf2-sha256$"+strconv.Itoa(passwordIterations)+"$00$00")
+		return false, nil
+	}
+	if !CheckPassword(password, hash) {
+		return false, nil
+	}
+	return true, a.startSession(w, account)
+}
+
+// End the session of the request, and clear its cookie
+func (a *Auth) Logout(w http.ResponseWriter, r *http.Request) error {
+	if cookie, err := r.Cookie(sessionCookie); err == nil && cookie.Value != "" {
+		if err := a.DB.DeleteSession(hashToken(cookie.Value)); err != nil {
+			return err
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	return nil
+}
+
+// PBKDF2 (RFC 8018) with HMAC-SHA256
+func pbkdf2(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	result := []byte{}
+	for block := uint32(1); len(result) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		blockIndex := make([]byte, 4)
+		binary.BigEndian.PutUint32(blockIndex, block)
+		prf.Write(blockIndex)
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		result = append(result, t...)
+	}
+	return result[:keyLen]
+}
+
+// Returns a hash of the form pbkdf2-sha256$<iterations>$<salt>$<key>
+func HashPassword(password string) (string, error) {
+	if len(password) < 8 {
+		return "", fmt.Errorf("Password must be at least 8 characters long")
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2([]byte(password), salt, passwordIterations, sha256.Size)
+	return fmt.Sprintf("pbkdf2-sha256$%v$%v$%v", passwordIterations, hex.EncodeToString(salt), hex.EncodeToString(key)), nil
+}
+
+func CheckPassword(password, hash string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	salt, serr := hex.DecodeString(parts[2])
+	key, kerr := hex.DecodeString(parts[3])
+	if err != nil || serr != nil || kerr != nil || iterations <= 0 || len(key) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare(pbkdf2([]byte(password), salt, iterations, len(key)), key) == 1
+}
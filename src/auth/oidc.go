@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// OIDC authorization code flow. We read the email address from the provider's userinfo endpoint,
+// which we call directly with the access token, so there is no ID token signature to verify.
+// Any standards compliant provider works, including a local Dex or Keycloak for development.
+
+const oidcStateCookie = "oidc_state"
+
+type oidcProvider struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+type oidcTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+type oidcUserinfo struct {
+	Email         string `json:"email"`
+	EmailVerified *bool  `json:"email_verified"`
+}
+
+var oidcClient = &http.Client{Timeout: 30 * time.Second}
+
+// Returns true if OIDC sign in is configured
+func (a *Auth) OIDCEnabled() bool {
+	return a.Config.OIDC != nil && a.Config.OIDC.Issuer != ""
+}
+
+// Returns the name to show on the OIDC sign in button
+func (a *Auth) OIDCName() string {
+	if !a.OIDCEnabled() {
+		return ""
+	}
+	if a.Config.OIDC.Name != "" {
+		return a.Config.OIDC.Name
+	}
+	return a.Config.OIDC.Issuer
+}
+
+// Fetch the provider's discovery document. This is cached after the first success.
+// The lock is held during the fetch, so that concurrent sign ins don't all fetch it.
+func (a *Auth) discover() (*oidcProvider, error) {
+	a.oidcLock.Lock()
+	defer a.oidcLock.Unlock()
+	if a.oidc != nil {
+		return a.oidc, nil
+	}
+	resp, err := oidcClient.Get(strings.TrimRight(a.Config.OIDC.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OIDC discovery failed: %v", resp.Status)
+	}
+	p := &oidcProvider{}
+	if err := json.NewDecoder(resp.Body).Decode(p); err != nil {
+		return nil, fmt.Errorf("Error decoding OIDC discovery document: %v", err)
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.UserinfoEndpoint == "" {
+		return nil, fmt.Errorf("OIDC discovery document is missing an endpoint")
+	}
+	a.oidc = p
+	return p, nil
+}
+
+// Redirect to the provider's sign in page
+func (a *Auth) HandleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if !a.OIDCEnabled() {
+		http.Error(w, "OIDC is not configured", http.StatusNotFound)
+		return
+	}
+	p, err := a.discover()
+	if err != nil {
+		a.DB.Log.Errorf("OIDC: %v", err)
+		http.Error(w, "Unable to reach the identity provider", http.StatusBadGateway)
+		return
+	}
+	state, err := randomToken()
+	if err != nil {
+		panic(err)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/auth/oidc/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   a.Config.SecureCookie,
+		SameSite: http.SameSiteLaxMode,
+	})
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", a.Config.OIDC.ClientID)
+	q.Set("redirect_uri", a.Config.OIDC.RedirectURL)
+	q.Set("scope", "openid email")
+	q.Set("state", state)
+	sep := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, p.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// Exchange the authorization code for an access token, and return the verified email address of the user
+func (a *Auth) oidcEmail(code string) (string, error) {
+	p, err := a.discover()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", a.Config.OIDC.RedirectURL)
+	form.Set("client_id", a.Config.OIDC.ClientID)
+	form.Set("client_secret", a.Config.OIDC.ClientSecret)
+	resp, err := oidcClient.PostForm(p.TokenEndpoint, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	token := oidcTokenResponse{}
+	raw, _ := ioutil.ReadAll(resp.Body)
+	if err := json.Unmarshal(raw, &token); err != nil {
+		return "", fmt.Errorf("Error decoding token response (%v): %v", resp.Status, err)
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("Token request failed: %v %v", token.Error, token.Description)
+	}
+
+	req, err := http.NewRequest("GET", p.UserinfoEndpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	infoResp, err := oidcClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer infoResp.Body.Close()
+	if infoResp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Userinfo request failed: %v", infoResp.Status)
+	}
+	info := oidcUserinfo{}
+	if err := json.NewDecoder(infoResp.Body).Decode(&info); err != nil {
+		return "", fmt.Errorf("Error decoding userinfo: %v", err)
+	}
+	if info.Email == "" {
+		return "", fmt.Errorf("The identity provider did not return an email address")
+	}
+	if info.EmailVerified != nil && !*info.EmailVerified {
+		return "", fmt.Errorf("Email address %v is not verified", info.Email)
+	}
+	return strings.ToLower(info.Email), nil
+}
+
+// The provider redirects back to here after sign in. An account is created on the first sign in.
+func (a *Auth) HandleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if !a.OIDCEnabled() {
+		http.Error(w, "OIDC is not configured", http.StatusNotFound)
+		return
+	}
+	cookie, err := r.Cookie(oidcStateCookie)
+	state := r.FormValue("state")
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		http.Error(w, "Invalid sign in state. Please try again.", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: "", Path: "/auth/oidc/", MaxAge: -1})
+	if e := r.FormValue("error"); e != "" {
+		http.Error(w, "Sign in failed: "+e, http.StatusUnauthorized)
+		return
+	}
+
+	email, err := a.oidcEmail(r.FormValue("code"))
+	if err != nil {
+		a.DB.Log.Errorf("OIDC: %v", err)
+		http.Error(w, "Sign in failed", http.StatusUnauthorized)
+		return
+	}
+	account, _, err := a.DB.AccountByEmail(email)
+	if err == nil && account == nil {
+		if _, err = a.DB.CreateAccount(email, a.Config.DefaultRole, ""); err == nil {
+			a.DB.Log.Infof("Created account %v (%v) on first OIDC sign in", email, a.Config.DefaultRole)
+			account, _, err = a.DB.AccountByEmail(email)
+		}
+	}
+	if err == nil {
+		err = a.startSession(w, account)
+	}
+	if err != nil {
+		panic(err)
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
@@ -0,0 +1,294 @@
+package billing
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"timedb"
+)
+
+/*
+Package billing works out what to invoice a client for. A contract (see timedb.Contract) owns the time of
+its scopes: projects, as recorded by the time sources, JIRA projects, and epics. When scopes of different
+contracts match the same time entry, the most specific scope wins (an epic before a JIRA project, and a JIRA
+project before a project), and then the oldest contract. Time in a non-billable scope is reported, but not
+invoiced.
+
+Billable time is rounded per the contract, to a multiple of RoundMinutes, either per time entry, per person
+and ticket and day, or per invoice line, and invoiced at the contract's hourly rate, with a line per ticket.
+
+Issuing an invoice keeps a copy of its lines, and locks its period of the contract, so that the period can't
+be invoiced twice. Time that is logged in a locked period afterwards shows up as the difference between the
+statement and the invoice. Voiding the invoice unlocks the period.
+*/
+
+// A line of a statement, which is the time of a single ticket (or project, for time without a ticket)
+type Line struct {
+	TicketKey   string
+	Description string
+	RawHours    float64 // Before rounding
+	Hours       float64
+	Amount      float64
+}
+
+// Statement is what a contract bills for a period, before or after it is invoiced
+type Statement struct {
+	Contract         timedb.Contract
+	Start            time.Time
+	End              time.Time // Exclusive
+	Lines            []Line    // Billable
+	NonBillable      []Line
+	BillableHours    float64
+	NonBillableHours float64
+	Amount           float64
+	Invoice          *timedb.Invoice // The invoice that locks the period, if any
+}
+
+// Higher is more specific
+var scopePriority = map[string]int{
+	timedb.ScopeProject:     1,
+	timedb.ScopeJiraProject: 2,
+	timedb.ScopeEpic:        3,
+}
+
+func (s *Statement) contains(t time.Time) bool {
+	c := &s.Contract
+	return !t.Before(c.Start) && (c.End == nil || t.Before(*c.End))
+}
+
+func scopeMatches(scope *timedb.ContractScope, e *timedb.BillingEntry) bool {
+	switch scope.Kind {
+	case timedb.ScopeProject:
+		return strings.EqualFold(scope.Value, e.Project)
+	case timedb.ScopeJiraProject:
+		return strings.EqualFold(scope.Value, e.JiraProject)
+	case timedb.ScopeEpic:
+		return strings.EqualFold(scope.Value, e.EpicKey)
+	}
+	return false
+}
+
+// Returns the contract that owns a time entry, and its matching scope, or nil if no contract does
+func owner(contracts []timedb.Contract, e *timedb.BillingEntry) (*timedb.Contract, *timedb.ContractScope) {
+	var best *timedb.Contract
+	var bestScope *timedb.ContractScope
+	for i := range contracts {
+		c := &contracts[i]
+		if e.Start.Before(c.Start) || (c.End != nil && !e.Start.Before(*c.End)) {
+			continue
+		}
+		for j := range c.Scopes {
+			s := &c.Scopes[j]
+			if !scopeMatches(s, e) {
+				continue
+			}
+			if bestScope == nil || scopePriority[s.Kind] > scopePriority[bestScope.Kind] ||
+				(scopePriority[s.Kind] == scopePriority[bestScope.Kind] && c.ContractID < best.ContractID) {
+				best, bestScope = c, s
+			}
+		}
+	}
+	return best, bestScope
+}
+
+// Round hours to a multiple of 'minutes'. Without rounding, hours are still rounded to the nearest hundredth,
+// so that the amount of a line is exactly its hours times the rate.
+func roundHours(hours float64, minutes int, mode string) float64 {
+	if minutes <= 0 {
+		return math.Round(hours*100) / 100
+	}
+	units := hours * 60 / float64(minutes)
+	switch mode {
+	case timedb.RoundNearest:
+		units = math.Round(units)
+	case timedb.RoundDown:
+		units = math.Floor(units + 1e-9)
+	default:
+		units = math.Ceil(units - 1e-9)
+	}
+	return math.Round(units*float64(minutes)/60*100) / 100
+}
+
+func roundMoney(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// Returns the key of the line of an entry, and the line's description
+func lineOf(e *timedb.BillingEntry) (string, string) {
+	if e.TicketID != 0 {
+		return e.TicketKey, e.TicketTitle
+	}
+	if e.Project != "" {
+		return "", e.Project
+	}
+	return "", "Other"
+}
+
+// Add up entries into lines, rounding them per the contract
+func buildLines(c *timedb.Contract, entries []*timedb.BillingEntry, round bool) []Line {
+	type lineKey struct {
+		key         string
+		description string
+	}
+	type dayKey struct {
+		line   lineKey
+		userid int64
+		day    string
+	}
+	lines := map[lineKey]*Line{}
+	days := map[dayKey]float64{}
+	for _, e := range entries {
+		key, description := lineOf(e)
+		lk := lineKey{key, description}
+		l := lines[lk]
+		if l == nil {
+			l = &Line{TicketKey: key, Description: description}
+			lines[lk] = l
+		}
+		hours := e.Seconds / 3600
+		l.RawHours += hours
+		if !round {
+			continue
+		}
+		switch c.RoundPer {
+		case timedb.RoundPerEntry:
+			l.Hours += roundHours(hours, c.RoundMinutes, c.RoundMode)
+		case timedb.RoundPerDay:
+			days[dayKey{lk, e.UserID, e.Start.Format("2006-01-02")}] += hours
+		}
+	}
+	for dk, hours := range days {
+		lines[dk.line].Hours += roundHours(hours, c.RoundMinutes, c.RoundMode)
+	}
+
+	result := []Line{}
+	for _, l := range lines {
+		if !round {
+			l.Hours = roundHours(l.RawHours, 0, "")
+		} else if c.RoundPer == timedb.RoundPerLine {
+			l.Hours = roundHours(l.RawHours, c.RoundMinutes, c.RoundMode)
+		} else {
+			l.Hours = roundHours(l.Hours, 0, "")
+		}
+		if round {
+			l.Amount = roundMoney(l.Hours * c.HourlyRate)
+		}
+		result = append(result, *l)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].TicketKey != result[j].TicketKey {
+			// Lines without a ticket go last
+			return result[j].TicketKey == "" || (result[i].TicketKey != "" && result[i].TicketKey < result[j].TicketKey)
+		}
+		return result[i].Description < result[j].Description
+	})
+	return result
+}
+
+// Compute the statement of a contract for the period [start, end)
+func Compute(db *timedb.TimeDB, contractid int64, start, end time.Time) (*Statement, error) {
+	if !start.Before(end) {
+		return nil, fmt.Errorf("The billing period is empty")
+	}
+	contracts, err := db.Contracts()
+	if err != nil {
+		return nil, err
+	}
+	s := &Statement{Start: start, End: end}
+	found := false
+	for _, c := range contracts {
+		if c.ContractID == contractid {
+			s.Contract = c
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("Unknown contract %v", contractid)
+	}
+
+	entries, err := db.BillingEntries(start, end)
+	if err != nil {
+		return nil, err
+	}
+	billable, nonBillable := []*timedb.BillingEntry{}, []*timedb.BillingEntry{}
+	for i := range entries {
+		e := &entries[i]
+		if !s.contains(e.Start) {
+			continue
+		}
+		c, scope := owner(contracts, e)
+		if c == nil || c.ContractID != contractid {
+			continue
+		}
+		if scope.Billable {
+			billable = append(billable, e)
+		} else {
+			nonBillable = append(nonBillable, e)
+		}
+	}
+	s.Lines = buildLines(&s.Contract, billable, true)
+	s.NonBillable = buildLines(&s.Contract, nonBillable, false)
+	for _, l := range s.Lines {
+		s.BillableHours += l.Hours
+		s.Amount += l.Amount
+	}
+	for _, l := range s.NonBillable {
+		s.NonBillableHours += l.Hours
+	}
+	s.BillableHours = roundHours(s.BillableHours, 0, "")
+	s.NonBillableHours = roundHours(s.NonBillableHours, 0, "")
+	s.Amount = roundMoney(s.Amount)
+
+	if s.Invoice, err = db.LockingInvoice(contractid, start, end); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Returns the invoice number that is used when none is given
+func DefaultNumber(contractid int64, start time.Time) string {
+	return fmt.Sprintf("C%v-%v", contractid, start.Format("20060102"))
+}
+
+// Issue an invoice for the statement of a contract for the period [start, end), which locks the period.
+// Returns a *timedb.PeriodLockedError if part of the period has already been invoiced.
+func Issue(db *timedb.TimeDB, contractid int64, start, end time.Time, number, issuedBy string) (*timedb.Invoice, error) {
+	s, err := Compute(db, contractid, start, end)
+	if err != nil {
+		return nil, err
+	}
+	if s.Invoice != nil {
+		return nil, &timedb.PeriodLockedError{Number: s.Invoice.Number}
+	}
+	if len(s.Lines) == 0 {
+		return nil, fmt.Errorf("There is no billable time in this period")
+	}
+	number = strings.TrimSpace(number)
+	if number == "" {
+		number = DefaultNumber(contractid, start)
+	}
+	inv := &timedb.Invoice{
+		ContractID:       contractid,
+		Contract:         s.Contract.Name,
+		Client:           s.Contract.Client,
+		Number:           number,
+		PeriodStart:      start,
+		PeriodEnd:        end,
+		IssuedAt:         time.Now(),
+		IssuedBy:         issuedBy,
+		Currency:         s.Contract.Currency,
+		BillableHours:    s.BillableHours,
+		NonBillableHours: s.NonBillableHours,
+		Amount:           s.Amount,
+	}
+	for _, l := range s.Lines {
+		inv.Lines = append(inv.Lines, timedb.InvoiceLine{TicketKey: l.TicketKey, Description: l.Description, RawHours: l.RawHours,
+			Hours: l.Hours, Rate: s.Contract.HourlyRate, Amount: l.Amount})
+	}
+	if inv.InvoiceID, err = db.InsertInvoice(inv); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
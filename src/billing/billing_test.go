@@ -0,0 +1,76 @@
+package billing
+
+import (
+	"math"
+	"testing"
+	"time"
+	"timedb"
+)
+
+func TestRoundHours(t *testing.T) {
+	cases := []struct {
+		hours   float64
+		minutes int
+		mode    string
+		expect  float64
+	}{
+		{1.234, 0, "", 1.23},
+		{1.235001, 0, "", 1.24},
+		{0.1, 15, timedb.RoundUp, 0.25},
+		{0.25, 15, timedb.RoundUp, 0.25},
+		{15.0 / 60, 15, "", 0.25}, // Up by default
+		{20.0 / 60, 15, timedb.RoundNearest, 0.25},
+		{24.0 / 60, 15, timedb.RoundNearest, 0.5},
+		{29.0 / 60, 15, timedb.RoundDown, 0.25},
+		{30.0 / 60, 15, timedb.RoundDown, 0.5},
+		{20.0 / 60, 6, timedb.RoundUp, 0.4},
+		{0, 15, timedb.RoundUp, 0},
+	}
+	for _, c := range cases {
+		if got := roundHours(c.hours, c.minutes, c.mode); math.Abs(got-c.expect) > 1e-9 {
+			t.Errorf("roundHours(%v, %v, %v): expected %v, got %v", c.hours, c.minutes, c.mode, c.expect, got)
+		}
+	}
+}
+
+func TestBuildLines(t *testing.T) {
+	day1 := time.Date(2024, 3, 4, 9, 0, 0, 0, time.Local)
+	day2 := day1.AddDate(0, 0, 1)
+	ticket := func(start time.Time, userid int64, minutes float64) *timedb.BillingEntry {
+		return &timedb.BillingEntry{Start: start, Seconds: minutes * 60, UserID: userid, TicketID: 1, TicketKey: "ABC-1", TicketTitle: "Invoices"}
+	}
+	// 30 minutes on the ticket, in entries of 10 and 5 minutes, and 7 minutes without a ticket
+	entries := []*timedb.BillingEntry{
+		ticket(day1, 1, 10),
+		ticket(day1, 1, 5),
+		ticket(day2, 1, 10),
+		ticket(day1, 2, 5),
+		{Start: day1, Seconds: 7 * 60, UserID: 1, Project: "Support"},
+	}
+	cases := []struct {
+		roundPer string
+		round    bool
+		expect   []Line
+	}{
+		{timedb.RoundPerEntry, true, []Line{{"ABC-1", "Invoices", 0.5, 1, 80.12}, {"", "Support", 7.0 / 60, 0.25, 20.03}}},
+		{timedb.RoundPerDay, true, []Line{{"ABC-1", "Invoices", 0.5, 0.75, 60.09}, {"", "Support", 7.0 / 60, 0.25, 20.03}}},
+		{timedb.RoundPerLine, true, []Line{{"ABC-1", "Invoices", 0.5, 0.5, 40.06}, {"", "Support", 7.0 / 60, 0.25, 20.03}}},
+		// Non-billable time is only rounded to hundredths, and has no amount
+		{timedb.RoundPerEntry, false, []Line{{"ABC-1", "Invoices", 0.5, 0.5, 0}, {"", "Support", 7.0 / 60, 0.12, 0}}},
+	}
+	for _, c := range cases {
+		contract := &timedb.Contract{HourlyRate: 80.12, RoundMinutes: 15, RoundMode: timedb.RoundUp, RoundPer: c.roundPer}
+		got := buildLines(contract, entries, c.round)
+		if len(got) != len(c.expect) {
+			t.Errorf("%v %v: expected %v, got %v", c.roundPer, c.round, c.expect, got)
+			continue
+		}
+		for i, l := range got {
+			e := c.expect[i]
+			if l.TicketKey != e.TicketKey || l.Description != e.Description || math.Abs(l.RawHours-e.RawHours) > 1e-9 ||
+				math.Abs(l.Hours-e.Hours) > 1e-9 || math.Abs(l.Amount-e.Amount) > 1e-9 {
+				t.Errorf("%v %v: expected %+v, got %+v", c.roundPer, c.round, e, l)
+			}
+		}
+	}
+}
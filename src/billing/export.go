@@ -0,0 +1,236 @@
+package billing
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"timedb"
+)
+
+const (
+	FormatCSV = "csv"
+	FormatPDF = "pdf"
+)
+
+// Returns the MIME type of an invoice format, or an empty string if the format is unknown
+func ContentType(format string) string {
+	switch format {
+	case FormatCSV:
+		return "text/csv"
+	case FormatPDF:
+		return "application/pdf"
+	}
+	return ""
+}
+
+// Write the line items of an invoice as CSV or PDF. The invoice must include its lines.
+func WriteInvoice(format string, w io.Writer, inv *timedb.Invoice) error {
+	switch format {
+	case FormatCSV:
+		return writeCSV(w, inv)
+	case FormatPDF:
+		return writePDF(w, inv)
+	}
+	return fmt.Errorf("Unknown invoice format '%v'. Use %v or %v", format, FormatCSV, FormatPDF)
+}
+
+func money(amount float64) string {
+	return strconv.FormatFloat(amount, 'f', 2, 64)
+}
+
+func writeCSV(w io.Writer, inv *timedb.Invoice) error {
+	c := csv.NewWriter(w)
+	c.Write([]string{"Invoice", "Client", "Contract", "PeriodStart", "PeriodEnd", "Ticket", "Description", "Hours", "Rate", "Amount", "Currency"})
+	// The period end is written inclusive, as people read it
+	start, end := inv.PeriodStart.Format("2006-01-02"), inv.PeriodEnd.AddDate(0, 0, -1).Format("2006-01-02")
+	for _, l := range inv.Lines {
+		c.Write([]string{inv.Number, inv.Client, inv.Contract, start, end, l.TicketKey, l.Description, money(l.Hours), money(l.Rate), money(l.Amount), inv.Currency})
+	}
+	c.Flush()
+	return c.Error()
+}
+
+// Page layout of the PDF, in points, on A4
+const (
+	pageWidth    = 595
+	pageHeight   = 842
+	pageMargin   = 50
+	lineHeight   = 14
+	tableSize    = 9
+	descriptionN = 70 // Characters of a description that fit in its column
+)
+
+// Widths of Helvetica characters, in thousandths of the font size, for the characters that right aligned
+// columns contain. Everything else is taken to be as wide as a digit.
+var helveticaWidths = map[rune]int{' ': 278, '.': 278, ',': 278, '-': 333}
+
+func textWidth(s string, size float64) float64 {
+	w := 0
+	for _, r := range s {
+		if cw, ok := helveticaWidths[r]; ok {
+			w += cw
+		} else {
+			w += 556
+		}
+	}
+	return float64(w) * size / 1000
+}
+
+// Escape a string for a PDF literal string, in WinAnsiEncoding
+func pdfString(s string) string {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('(')
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(byte(r))
+		case r >= 32 && r < 127, r >= 160 && r <= 255:
+			// Latin-1 matches WinAnsiEncoding in these ranges
+			buf.WriteByte(byte(r))
+		default:
+			buf.WriteByte('?')
+		}
+	}
+	buf.WriteByte(')')
+	return buf.String()
+}
+
+// A page's content stream
+type pdfPage struct {
+	bytes.Buffer
+	y float64 // Baseline of the next line
+}
+
+func (p *pdfPage) text(font string, size, x float64, s string) {
+	fmt.Fprintf(p, "BT /%v %v Tf %.2f %.2f Td %v Tj ET\n", font, size, x, p.y, pdfString(s))
+}
+
+func (p *pdfPage) right(font string, size, x float64, s string) {
+	p.text(font, size, x-textWidth(s, size), s)
+}
+
+func (p *pdfPage) rule() {
+	fmt.Fprintf(p, "0.5 w %v %.2f m %v %.2f l S\n", pageMargin, p.y+lineHeight-4, pageWidth-pageMargin, p.y+lineHeight-4)
+}
+
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-3]) + "..."
+}
+
+// Columns of the line items, as the x of their left edge, or of their right edge for numbers
+const (
+	colTicket      = pageMargin
+	colDescription = pageMargin + 70
+	colHours       = pageWidth - pageMargin - 150
+	colRate        = pageWidth - pageMargin - 75
+	colAmount      = pageWidth - pageMargin
+)
+
+func tableHeader(p *pdfPage) {
+	p.text("F2", tableSize, colTicket, "Ticket")
+	p.text("F2", tableSize, colDescription, "Description")
+	p.right("F2", tableSize, colHours, "Hours")
+	p.right("F2", tableSize, colRate, "Rate")
+	p.right("F2", tableSize, colAmount, "Amount")
+	p.y -= lineHeight
+	p.rule()
+}
+
+// Write a PDF of the invoice, with the standard Helvetica fonts, so that nothing needs to be embedded
+func writePDF(w io.Writer, inv *timedb.Invoice) error {
+	pages := []*pdfPage{}
+	newPage := func() *pdfPage {
+		p := &pdfPage{y: pageHeight - pageMargin}
+		pages = append(pages, p)
+		return p
+	}
+
+	p := newPage()
+	p.text("F2", 18, pageMargin, "Invoice "+inv.Number)
+	if inv.VoidedAt != nil {
+		p.right("F2", 18, pageWidth-pageMargin, "VOID")
+	}
+	p.y -= 30
+	details := [][2]string{
+		{"Client", inv.Client},
+		{"Contract", inv.Contract},
+		{"Period", inv.PeriodStart.Format("2 Jan 2006") + " to " + inv.PeriodEnd.AddDate(0, 0, -1).Format("2 Jan 2006")},
+		{"Issued", inv.IssuedAt.Format("2 Jan 2006")},
+	}
+	if inv.Currency != "" {
+		details = append(details, [2]string{"Currency", inv.Currency})
+	}
+	for _, d := range details {
+		p.text("F2", 10, pageMargin, d[0])
+		p.text("F1", 10, pageMargin+70, d[1])
+		p.y -= lineHeight
+	}
+	p.y -= lineHeight
+	tableHeader(p)
+
+	for _, l := range inv.Lines {
+		if p.y < pageMargin+3*lineHeight {
+			p = newPage()
+			tableHeader(p)
+		}
+		p.text("F1", tableSize, colTicket, l.TicketKey)
+		p.text("F1", tableSize, colDescription, truncate(l.Description, descriptionN))
+		p.right("F1", tableSize, colHours, money(l.Hours))
+		p.right("F1", tableSize, colRate, money(l.Rate))
+		p.right("F1", tableSize, colAmount, money(l.Amount))
+		p.y -= lineHeight
+	}
+
+	if p.y < pageMargin+4*lineHeight {
+		p = newPage()
+	}
+	p.rule()
+	p.text("F2", 10, colDescription, "Total")
+	p.right("F2", 10, colHours, money(inv.BillableHours))
+	p.right("F2", 10, colAmount, money(inv.Amount))
+	if inv.NonBillableHours != 0 {
+		p.y -= lineHeight
+		p.text("F1", tableSize, colDescription, fmt.Sprintf("%v non-billable hours are not charged", money(inv.NonBillableHours)))
+	}
+
+	// Objects 1 and 2 are the catalog and the page tree, 3 and 4 the fonts, and then each page and its content
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>",
+	}
+	kids := &bytes.Buffer{}
+	for _, page := range pages {
+		pageObj := len(objects) + 1
+		fmt.Fprintf(kids, "%v 0 R ", pageObj)
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %v %v] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %v 0 R >>",
+				pageWidth, pageHeight, pageObj+1),
+			fmt.Sprintf("<< /Length %v >>\nstream\n%v\nendstream", page.Len(), page.String()))
+	}
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%v] /Count %v >>", kids.String(), len(pages))
+
+	out := &bytes.Buffer{}
+	out.WriteString("%PDF-1.4\n")
+	offsets := []int{}
+	for i, obj := range objects {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(out, "%v 0 obj\n%v\nendobj\n", i+1, obj)
+	}
+	xref := out.Len()
+	fmt.Fprintf(out, "xref\n0 %v\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(out, "trailer\n<< /Size %v /Root 1 0 R >>\nstartxref\n%v\n%%%%EOF\n", len(objects)+1, xref)
+	_, err := w.Write(out.Bytes())
+	return err
+}
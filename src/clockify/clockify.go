@@ -0,0 +1,214 @@
+package clockify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+	"timedb"
+)
+
+/*
+Clockify is authenticated with a per-user API key (Profile settings > API), which must belong to a workspace admin.
+
+Workspace users:
+
+GET https://api.clockify.me/api/v1/workspaces/{workspaceId}/users
+[{"id": "5a0ab5acb07987125438b60f", "email": "ben@imqs.co.za", "name": "Ben"}]
+
+Time entries of a user (paged, until an empty page is returned):
+
+GET https://api.clockify.me/api/v1/workspaces/{workspaceId}/user/{userId}/time-entries?start=...&end=...&hydrated=true&page=1&page-size=200
+[{"id": "...", "description": "ABC-123 Fix the login page", "project": {"name": "Team Infrastructure"}, "task": {"name": "..."},
+  "timeInterval": {"start": "2016-12-05T08:00:00Z", "end": "2016-12-05T11:21:00Z"}}]
+*/
+
+const APIURL = "https://api.clockify.me/api/v1"
+
+const APIDateFormat = "2006-01-02T15:04:05Z"
+
+const pageSize = 200
+
+type Config struct {
+	APIKey      string
+	WorkspaceID string
+}
+
+func (c *Config) LoadFile(filename string) error {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("Error loading config file %v: %v", filename, err)
+	}
+	if err := json.Unmarshal(bytes, c); err != nil {
+		return fmt.Errorf("Error decoding config file %v: %v", filename, err)
+	}
+	return nil
+}
+
+type Fetcher struct {
+	Config Config
+}
+
+func (f *Fetcher) Name() string {
+	return "Clockify"
+}
+
+func (f *Fetcher) Scope() string {
+	return "workspace " + f.Config.WorkspaceID
+}
+
+func (f *Fetcher) LoadConfig() error {
+	return f.Config.LoadFile("config/clockify.json")
+}
+
+type clockifyJsonUser struct {
+	Id    string `json:"id"`
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+type clockifyJsonNamed struct {
+	Name string `json:"name"`
+}
+
+type clockifyJsonInterval struct {
+	Start string `json:"start"`
+	End   string `json:"end"` // Empty if the timer is still running
+}
+
+type clockifyJsonTimeEntry struct {
+	Id           string               `json:"id"`
+	Description  string               `json:"description"`
+	Project      *clockifyJsonNamed   `json:"project"`
+	Task         *clockifyJsonNamed   `json:"task"`
+	TimeInterval clockifyJsonInterval `json:"timeInterval"`
+}
+
+// The description is what people type in, which is most likely to mention the ticket
+func (e *clockifyJsonTimeEntry) title() string {
+	if e.Description != "" {
+		return e.Description
+	}
+	if e.Task != nil && e.Task.Name != "" {
+		return e.Task.Name
+	}
+	if e.Project != nil {
+		return e.Project.Name
+	}
+	return ""
+}
+
+func (f *Fetcher) Fetch(db *timedb.TimeDB, start, end time.Time) error {
+	users, err := f.fetchUsers()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		email := user.Email
+		fmt.Printf("Fetching Clockify time entries of %v\n", email)
+		if err := f.fetchUserEntries(db, user.Id, email, start, end); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *Fetcher) fetchUsers() ([]clockifyJsonUser, error) {
+	raw, err := f.fetchUrl(fmt.Sprintf("%v/workspaces/%v/users", APIURL, f.Config.WorkspaceID))
+	if err != nil {
+		return nil, err
+	}
+	users := []clockifyJsonUser{}
+	if err := json.Unmarshal(raw, &users); err != nil {
+		return nil, fmt.Errorf("Error decoding Clockify workspace users: %v", err)
+	}
+	return users, nil
+}
+
+func (f *Fetcher) fetchUserEntries(db *timedb.TimeDB, userID, email string, start, end time.Time) error {
+	for page := 1; ; page++ {
+		raw, err := f.fetchPage(userID, start, end, page)
+		if err != nil {
+			return err
+		}
+		entries := []clockifyJsonTimeEntry{}
+		if err := json.Unmarshal(raw, &entries); err != nil {
+			return fmt.Errorf("Error decoding Clockify time entries: %v", err)
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		times := []timedb.TimeFormat2{}
+		for _, e := range entries {
+			if e.TimeInterval.End == "" {
+				continue
+			}
+			tstart, err := time.Parse(time.RFC3339, e.TimeInterval.Start)
+			if err != nil {
+				return fmt.Errorf("Invalid start time '%v' in Clockify time entry %v", e.TimeInterval.Start, e.Id)
+			}
+			tend, err := time.Parse(time.RFC3339, e.TimeInterval.End)
+			if err != nil {
+				return fmt.Errorf("Invalid end time '%v' in Clockify time entry %v", e.TimeInterval.End, e.Id)
+			}
+			project := ""
+			if e.Project != nil {
+				project = e.Project.Name
+			}
+			times = append(times, timedb.TimeFormat2{
+				System:    timedb.SystemTypeClockify,
+				SystemID:  e.Id,
+				Email:     email,
+				TaskTitle: e.title(),
+				Project:   project,
+				Start:     tstart,
+				End:       tend,
+			})
+		}
+		if err := db.InsertTimes2(times); err != nil {
+			return err
+		}
+	}
+}
+
+func (f *Fetcher) fetchPage(userID string, start, end time.Time, page int) ([]byte, error) {
+	params := url.Values{}
+	params.Set("start", start.UTC().Format(APIDateFormat))
+	params.Set("end", end.UTC().Format(APIDateFormat))
+	params.Set("hydrated", "true")
+	params.Set("page", fmt.Sprintf("%v", page))
+	params.Set("page-size", fmt.Sprintf("%v", pageSize))
+	return f.fetchUrl(fmt.Sprintf("%v/workspaces/%v/user/%v/time-entries?%v", APIURL, f.Config.WorkspaceID, userID, params.Encode()))
+}
+
+// Returns the first page of time entries of the first user in the workspace
+func (f *Fetcher) FetchRaw(start, end time.Time) ([]byte, error) {
+	users, err := f.fetchUsers()
+	if err != nil || len(users) == 0 {
+		return nil, err
+	}
+	return f.fetchPage(users[0].Id, start, end, 1)
+}
+
+func (f *Fetcher) fetchUrl(url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Api-Key", f.Config.APIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP Error: %v", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading body: %v", err)
+	}
+	return body, nil
+}
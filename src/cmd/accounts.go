@@ -0,0 +1,133 @@
+package main
+
+import (
+	"auth"
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/IMQS/log"
+	"os"
+	"strings"
+	"time"
+	"timedb"
+)
+
+/*
+Manage dashboard accounts. Use this to create the first admin, who can then manage the other accounts at /admin.
+
+go run src/cmd/accounts.go -add ben.harper@imqs.co.za -role admin
+go run src/cmd/accounts.go -passwd ben.harper@imqs.co.za
+go run src/cmd/accounts.go -list
+go run src/cmd/accounts.go -token ben.harper@imqs.co.za -days 365
+
+The password is read from stdin. Use -oidc to create an account that can only sign in through OIDC.
+-token prints a bearer token for a tool that uses /api/v1. It sees the same data as the account.
+*/
+
+func readPassword() string {
+	fmt.Printf("Password: ")
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimRight(line, "\r\n")
+}
+
+func main() {
+	add := flag.String("add", "", "Email address of a new account")
+	role := flag.String("role", auth.RoleViewer, "Role of the new account: "+strings.Join(auth.Roles, ", "))
+	oidcOnly := flag.Bool("oidc", false, "The new account has no password, and can only sign in through OIDC")
+	passwd := flag.String("passwd", "", "Email address of an account whose password to change")
+	list := flag.Bool("list", false, "List all accounts")
+	token := flag.String("token", "", "Email address of an account to create an API token for")
+	days := flag.Int("days", 365, "Lifetime of the API token")
+	flag.Parse()
+
+	if *add == "" && *passwd == "" && !*list && *token == "" {
+		fmt.Printf("Usage: accounts [-add email [-role role] [-oidc]] [-passwd email] [-list] [-token email [-days n]]\n")
+		os.Exit(1)
+	}
+	if !auth.ValidRole(*role) {
+		fmt.Printf("Invalid role '%v'. Valid roles are %v\n", *role, strings.Join(auth.Roles, ", "))
+		os.Exit(1)
+	}
+
+	db := &timedb.TimeDB{}
+	db.Log = log.New("accounts.log")
+	if err := db.LoadConfig(); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	if err := db.Connect(); err != nil {
+		fmt.Printf("Error connecting to time db: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *add != "" {
+		hash := ""
+		if !*oidcOnly {
+			var err error
+			if hash, err = auth.HashPassword(readPassword()); err != nil {
+				fmt.Printf("%v\n", err)
+				os.Exit(1)
+			}
+		}
+		if _, err := db.CreateAccount(*add, *role, hash); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Created %v account %v\n", *role, *add)
+	}
+
+	if *passwd != "" {
+		account, _, err := db.AccountByEmail(*passwd)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		if account == nil {
+			fmt.Printf("Unknown account %v\n", *passwd)
+			os.Exit(1)
+		}
+		hash, err := auth.HashPassword(readPassword())
+		if err == nil {
+			err = db.SetAccountPassword(account.AccountID, hash)
+		}
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Changed the password of %v\n", *passwd)
+	}
+
+	if *token != "" {
+		account, _, err := db.AccountByEmail(*token)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		if account == nil {
+			fmt.Printf("Unknown account %v\n", *token)
+			os.Exit(1)
+		}
+		a := &auth.Auth{DB: db}
+		t, err := a.CreateToken(account, time.Duration(*days)*24*time.Hour)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%v\n", t)
+	}
+
+	if *list {
+		accounts, err := db.Accounts()
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		for _, a := range accounts {
+			login := "password"
+			if !a.HasPassword {
+				login = "OIDC only"
+			}
+			fmt.Printf("%-40v %-10v %v\n", a.Email, a.Role, login)
+		}
+	}
+}
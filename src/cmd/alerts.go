@@ -0,0 +1,86 @@
+package main
+
+import (
+	"alert"
+	"flag"
+	"fmt"
+	"github.com/IMQS/log"
+	"os"
+	"time"
+	"timedb"
+)
+
+/*
+Threshold alerts on team metrics. The rules in config/alerts.json are evaluated after every fetch,
+so this is for trying out rules, and for looking back at the alert history.
+
+go run src/cmd/alerts.go -evaluate
+go run src/cmd/alerts.go -history
+go run src/cmd/alerts.go -test
+
+-test posts a test message to the webhook.
+*/
+
+func main() {
+	evaluate := flag.Bool("evaluate", false, "Evaluate the alert rules now")
+	history := flag.Bool("history", false, "List recent alerts")
+	limit := flag.Int("limit", 50, "Number of alerts to list")
+	test := flag.Bool("test", false, "Post a test message to the webhook")
+	flag.Parse()
+
+	if !*evaluate && !*history && !*test {
+		fmt.Printf("Usage: alerts [-evaluate] [-history [-limit n]] [-test]\n")
+		os.Exit(1)
+	}
+
+	db := &timedb.TimeDB{}
+	db.Log = log.New("alerts.log")
+	if err := db.LoadConfig(); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	evaluator := &alert.Evaluator{DB: db}
+	if enabled, err := evaluator.LoadConfig(); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	} else if !enabled && (*evaluate || *test) {
+		fmt.Printf("config/alerts.json is needed to evaluate alerts\n")
+		os.Exit(1)
+	}
+	if err := db.Connect(); err != nil {
+		fmt.Printf("Error connecting to time db: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *test {
+		if err := evaluator.Notify("This is a test message from the time tracker", true); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Posted a test message\n")
+	}
+
+	if *evaluate {
+		result, err := evaluator.Evaluate(time.Now())
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%v alerts fired, %v resolved\n", result.Fired, result.Resolved)
+	}
+
+	if *history {
+		alerts, err := db.RecentAlerts(*limit)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		for _, a := range alerts {
+			status := "open"
+			if a.ResolvedAt != nil {
+				status = "resolved " + a.ResolvedAt.Format("2006-01-02")
+			}
+			fmt.Printf("%v  %-20v %v\n", a.FiredAt.Format("2006-01-02 15:04"), status, a.Message)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"billing"
+	"flag"
+	"fmt"
+	"github.com/IMQS/log"
+	"os"
+	"strings"
+	"time"
+	"timedb"
+)
+
+/*
+Client billing. Sets up clients and contracts, and previews, issues and exports invoices.
+Statements and invoices are also available at /admin.
+
+go run src/cmd/billing.go -list
+go run src/cmd/billing.go -client Acme -contract "Acme support 2024" -rate 950 -currency ZAR -from 2024-01-01 -round 15
+go run src/cmd/billing.go -contract "Acme support 2024" -scope jira:ACME
+go run src/cmd/billing.go -contract "Acme support 2024" -scope epic:ACME-12 -nonbillable
+go run src/cmd/billing.go -contract "Acme support 2024" -from 2024-03-01 -to 2024-03-31 -preview
+go run src/cmd/billing.go -contract "Acme support 2024" -from 2024-03-01 -to 2024-03-31 -issue -number INV-0042
+go run src/cmd/billing.go -invoice INV-0042 -format pdf -out INV-0042.pdf
+go run src/cmd/billing.go -void INV-0042
+
+With -client, the contract is created, or updated, and -from and -to are the first and last days of the
+contract. Otherwise -from and -to are the first and last days of the billing period.
+A scope is project:<name>, as recorded by the time source, jira:<project key>, or epic:<key>.
+Rounding is -roundmode up, nearest or down, to a multiple of -round minutes, per -roundper entry, day or line.
+*/
+
+func fail(err error) {
+	fmt.Printf("%v\n", err)
+	os.Exit(1)
+}
+
+func parseBillingDate(name, s string) time.Time {
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		fmt.Printf("Invalid %v date '%v'. Use YYYY-MM-DD\n", name, s)
+		os.Exit(1)
+	}
+	return t
+}
+
+func printStatement(s *billing.Statement) {
+	fmt.Printf("%v: %v, %v to %v\n", s.Contract.Client, s.Contract.Name, s.Start.Format("2006-01-02"), s.End.AddDate(0, 0, -1).Format("2006-01-02"))
+	if s.Invoice != nil {
+		fmt.Printf("Locked by invoice %v, of %.2f hours and %.2f %v\n", s.Invoice.Number, s.Invoice.BillableHours, s.Invoice.Amount, s.Invoice.Currency)
+	}
+	fmt.Printf("\n%-12v %-60v %8v %8v %12v\n", "Ticket", "Description", "Logged", "Billed", "Amount")
+	for _, l := range s.Lines {
+		fmt.Printf("%-12v %-60v %8.2f %8.2f %12.2f\n", l.TicketKey, l.Description, l.RawHours, l.Hours, l.Amount)
+	}
+	fmt.Printf("%-12v %-60v %8v %8.2f %12.2f %v\n", "", "Billable", "", s.BillableHours, s.Amount, s.Contract.Currency)
+	if len(s.NonBillable) != 0 {
+		fmt.Printf("\nNon-billable\n")
+		for _, l := range s.NonBillable {
+			fmt.Printf("%-12v %-60v %8.2f\n", l.TicketKey, l.Description, l.RawHours)
+		}
+		fmt.Printf("%-12v %-60v %8.2f\n", "", "Non-billable", s.NonBillableHours)
+	}
+}
+
+func main() {
+	list := flag.Bool("list", false, "List contracts and invoices")
+	client := flag.String("client", "", "Create or update the contract, for this client")
+	contract := flag.String("contract", "", "Name of the contract")
+	rate := flag.Float64("rate", 0, "Hourly rate of the contract")
+	currency := flag.String("currency", "", "Currency of the contract")
+	round := flag.Int("round", 0, "Round billed time to a multiple of this many minutes")
+	roundMode := flag.String("roundmode", timedb.RoundUp, "Round up, nearest or down")
+	roundPer := flag.String("roundper", timedb.RoundPerEntry, "Round each entry, day (per person and ticket) or line")
+	from := flag.String("from", "", "First day (YYYY-MM-DD) of the contract or billing period")
+	to := flag.String("to", "", "Last day (YYYY-MM-DD) of the contract or billing period")
+	scope := flag.String("scope", "", "Add a scope to the contract, as kind:value")
+	unscope := flag.String("unscope", "", "Remove a scope from the contract, as kind:value")
+	nonBillable := flag.Bool("nonbillable", false, "With -scope, the scope's time is reported, but not billed")
+	preview := flag.Bool("preview", false, "Show the statement of the contract for the period")
+	issue := flag.Bool("issue", false, "Issue an invoice for the contract for the period, which locks the period")
+	number := flag.String("number", "", "Number of the invoice to issue. Optional.")
+	invoice := flag.String("invoice", "", "Number of the invoice to export")
+	format := flag.String("format", billing.FormatPDF, "Export format: csv or pdf")
+	out := flag.String("out", "", "File to export the invoice to")
+	void := flag.String("void", "", "Number of the invoice to void, which unlocks its period")
+	flag.Parse()
+
+	if !*list && *contract == "" && *invoice == "" && *void == "" {
+		fmt.Printf("Usage: billing -list | -client name -contract name -rate amount -from date [-to date] [-currency code] [-round minutes -roundmode mode -roundper per]\n")
+		fmt.Printf("  | -contract name -scope kind:value [-nonbillable] | -contract name -unscope kind:value\n")
+		fmt.Printf("  | -contract name -from date -to date -preview | -issue [-number number]\n")
+		fmt.Printf("  | -invoice number [-format csv|pdf] -out file | -void number\n")
+		os.Exit(1)
+	}
+
+	db := &timedb.TimeDB{}
+	db.Log = log.New("billing.log")
+	if err := db.LoadConfig(); err != nil {
+		fail(err)
+	}
+	if err := db.Connect(); err != nil {
+		fmt.Printf("Error connecting to time db: %v\n", err)
+		os.Exit(1)
+	}
+
+	invoiceID := func(number string) int64 {
+		invoiceid, err := db.InvoiceIDFromNumber(number)
+		if err != nil {
+			fail(err)
+		}
+		if invoiceid == 0 {
+			fmt.Printf("Unknown invoice %v\n", number)
+			os.Exit(1)
+		}
+		return invoiceid
+	}
+
+	if *client != "" {
+		if *contract == "" || *from == "" {
+			fmt.Printf("A contract needs -contract and -from\n")
+			os.Exit(1)
+		}
+		c := &timedb.Contract{Name: *contract, HourlyRate: *rate, Currency: *currency, Start: parseBillingDate("from", *from),
+			RoundMinutes: *round, RoundMode: *roundMode, RoundPer: *roundPer}
+		if *to != "" {
+			end := parseBillingDate("to", *to).AddDate(0, 0, 1)
+			c.End = &end
+		}
+		var err error
+		if c.ClientID, err = db.ClientID(*client); err != nil {
+			fail(err)
+		}
+		if _, err := db.SetContract(c); err != nil {
+			fail(err)
+		}
+		fmt.Printf("Saved contract %v\n", c.Name)
+	}
+
+	if *scope != "" || *unscope != "" || *preview || *issue {
+		contractid, err := db.ContractIDFromName(*contract)
+		if err != nil {
+			fail(err)
+		}
+		if contractid == 0 {
+			fmt.Printf("Unknown contract '%v'\n", *contract)
+			os.Exit(1)
+		}
+		for _, s := range []string{*scope, *unscope} {
+			if s == "" {
+				continue
+			}
+			parts := strings.SplitN(s, ":", 2)
+			if len(parts) != 2 {
+				fmt.Printf("Invalid scope '%v'. Use kind:value, such as jira:ACME\n", s)
+				os.Exit(1)
+			}
+			if s == *scope {
+				err = db.SetContractScope(contractid, parts[0], parts[1], !*nonBillable)
+			} else {
+				err = db.DeleteContractScope(contractid, parts[0], parts[1])
+			}
+			if err != nil {
+				fail(err)
+			}
+		}
+		if *preview || *issue {
+			if *from == "" || *to == "" {
+				fmt.Printf("The billing period needs -from and -to\n")
+				os.Exit(1)
+			}
+			start, end := parseBillingDate("from", *from), parseBillingDate("to", *to).AddDate(0, 0, 1)
+			if *issue {
+				inv, err := billing.Issue(db, contractid, start, end, *number, "command line")
+				if err != nil {
+					fail(err)
+				}
+				fmt.Printf("Issued invoice %v, of %.2f hours and %.2f %v\n", inv.Number, inv.BillableHours, inv.Amount, inv.Currency)
+			} else {
+				s, err := billing.Compute(db, contractid, start, end)
+				if err != nil {
+					fail(err)
+				}
+				printStatement(s)
+			}
+		}
+	}
+
+	if *invoice != "" {
+		if *out == "" {
+			fmt.Printf("Specify the file to export to with -out\n")
+			os.Exit(1)
+		}
+		inv, err := db.Invoice(invoiceID(*invoice))
+		if err != nil {
+			fail(err)
+		}
+		f, err := os.Create(*out)
+		if err != nil {
+			fail(err)
+		}
+		err = billing.WriteInvoice(*format, f, inv)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			fail(err)
+		}
+	}
+
+	if *void != "" {
+		if err := db.VoidInvoice(invoiceID(*void)); err != nil {
+			fail(err)
+		}
+		fmt.Printf("Voided invoice %v\n", *void)
+	}
+
+	if *list {
+		contracts, err := db.Contracts()
+		if err != nil {
+			fail(err)
+		}
+		for _, c := range contracts {
+			end := ""
+			if c.End != nil {
+				end = c.End.AddDate(0, 0, -1).Format("2006-01-02")
+			}
+			fmt.Printf("%v: %v, %.2f %v per hour, %v to %v\n", c.Client, c.Name, c.HourlyRate, c.Currency, c.Start.Format("2006-01-02"), end)
+			for _, s := range c.Scopes {
+				billable := ""
+				if !s.Billable {
+					billable = " (non-billable)"
+				}
+				fmt.Printf("  %v:%v%v\n", s.Kind, s.Value, billable)
+			}
+		}
+		invoices, err := db.Invoices()
+		if err != nil {
+			fail(err)
+		}
+		fmt.Printf("\n%-16v %-30v %-23v %10v %12v\n", "Invoice", "Contract", "Period", "Hours", "Amount")
+		for _, i := range invoices {
+			voided := ""
+			if i.VoidedAt != nil {
+				voided = " (void)"
+			}
+			period := i.PeriodStart.Format("2006-01-02") + " to " + i.PeriodEnd.AddDate(0, 0, -1).Format("2006-01-02")
+			fmt.Printf("%-16v %-30v %-23v %10.2f %12.2f %v%v\n", i.Number, i.Contract, period, i.BillableHours, i.Amount, i.Currency, voided)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/IMQS/log"
+	"os"
+	"strings"
+	"time"
+	"timedb"
+)
+
+/*
+Capitalisation of engineering time, as CapEx or OpEx. The report, its sign-off, and the rules are also at /capitalisation.
+
+go run src/cmd/capitalisation.go -from 2024-03-01 -to 2024-03-31
+go run src/cmd/capitalisation.go -from 2024-03-01 -to 2024-03-31 -team Platform -cost
+go run src/cmd/capitalisation.go -rules
+go run src/cmd/capitalisation.go -set epic:PLAT-120 -class capex -reason "New billing engine"
+go run src/cmd/capitalisation.go -set type:spike -class "" -reason "Spikes follow their epic"
+go run src/cmd/capitalisation.go -changes
+
+Time is CapEx or OpEx by the rule of its ticket (ticket:<key>), else of its epic (epic:<key>), else of its
+ticket type (type:<type>), else OpEx. Every change to the rules is recorded, with who made it, and why.
+*/
+
+func main() {
+	from := flag.String("from", "", "First day (YYYY-MM-DD) of the report")
+	to := flag.String("to", "", "Last day (YYYY-MM-DD) of the report")
+	team := flag.String("team", "", "Only this team")
+	cost := flag.Bool("cost", false, "Also show costs")
+	rules := flag.Bool("rules", false, "List the rules")
+	set := flag.String("set", "", "Set the rule of kind:value, such as epic:PLAT-120")
+	class := flag.String("class", "", "With -set, capex or opex, or empty to remove the rule")
+	reason := flag.String("reason", "", "With -set, the reason for the change")
+	changes := flag.Bool("changes", false, "List the changes to the rules")
+	flag.Parse()
+
+	if *from == "" && !*rules && *set == "" && !*changes {
+		fmt.Printf("Usage: capitalisation -from date -to date [-team name] [-cost] | -rules | -set kind:value -class class -reason text | -changes\n")
+		os.Exit(1)
+	}
+
+	db := &timedb.TimeDB{}
+	db.Log = log.New("capitalisation.log")
+	if err := db.LoadConfig(); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	if err := db.Connect(); err != nil {
+		fmt.Printf("Error connecting to time db: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *set != "" {
+		parts := strings.SplitN(*set, ":", 2)
+		if len(parts) != 2 || *reason == "" {
+			fmt.Printf("Use -set kind:value, with a -reason\n")
+			os.Exit(1)
+		}
+		changedBy := os.Getenv("USER")
+		if changedBy == "" {
+			changedBy = os.Getenv("USERNAME")
+		}
+		if err := db.SetCapitalisationRule(parts[0], parts[1], *class, changedBy, *reason); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *rules {
+		all, err := db.CapitalisationRules()
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		for _, r := range all {
+			fmt.Printf("%-30v %v\n", r.Kind+":"+r.Value, r.Class)
+		}
+	}
+
+	if *changes {
+		all, err := db.CapitalisationChanges(0)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		for _, c := range all {
+			fmt.Printf("%v %-20v %-30v %5v -> %-5v %v\n", c.ChangedAt.Format("2006-01-02 15:04"), c.ChangedBy, c.Kind+":"+c.Value, c.OldClass, c.NewClass, c.Reason)
+		}
+	}
+
+	if *from == "" {
+		return
+	}
+	start, err := time.ParseInLocation("2006-01-02", *from, time.Local)
+	if err == nil {
+		var end time.Time
+		if end, err = time.ParseInLocation("2006-01-02", *to, time.Local); err == nil {
+			err = report(db, start, end.AddDate(0, 0, 1), *team, *cost)
+		}
+	}
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func report(db *timedb.TimeDB, start, end time.Time, team string, cost bool) error {
+	var teamids []int64
+	if team != "" {
+		teamid, err := db.TeamIDFromName(team)
+		if err != nil {
+			return err
+		}
+		if teamid == 0 {
+			return fmt.Errorf("Unknown team %v", team)
+		}
+		teamids = []int64{teamid}
+	}
+	rows, err := db.QueryCapitalisation(start, end, teamids, cost)
+	if err != nil {
+		return err
+	}
+	signoff, err := db.CapitalisationSignOff(start, end)
+	if err != nil {
+		return err
+	}
+	if signoff != nil {
+		fmt.Printf("Signed off by %v on %v\n\n", signoff.SignedBy, signoff.SignedAt.Format("2006-01-02"))
+	}
+	fmt.Printf("%-20v %-30v %10v %10v %6v", "Team", "Project", "CapEx", "OpEx", "Share")
+	if cost {
+		fmt.Printf(" %14v %14v", "CapEx cost", "OpEx cost")
+	}
+	fmt.Printf("\n")
+	for _, r := range rows {
+		share := 0.0
+		if r.CapExSeconds+r.OpExSeconds != 0 {
+			share = 100 * r.CapExSeconds / (r.CapExSeconds + r.OpExSeconds)
+		}
+		name := r.Team
+		if name == "" {
+			name = "(no team)"
+		}
+		fmt.Printf("%-20v %-30v %10.1f %10.1f %5.0f%%", name, r.Project, r.CapExSeconds/3600, r.OpExSeconds/3600, share)
+		if cost {
+			fmt.Printf(" %14.2f %14.2f", r.CapExCost, r.OpExCost)
+		}
+		fmt.Printf("\n")
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"digest"
+	"flag"
+	"fmt"
+	"github.com/IMQS/log"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+	"timedb"
+)
+
+/*
+Weekly email digests of team metrics. The server sends them on the schedule in config/digest.json,
+so this is for previewing a digest, and for sending one by hand.
+
+go run src/cmd/digest.go -preview Platform -out digest.html
+go run src/cmd/digest.go -send Platform
+go run src/cmd/digest.go -send Platform -to ben.harper@imqs.co.za
+go run src/cmd/digest.go -due
+
+A digest covers the seven days before today, unless -from is given. -due sends the digests that are
+due, exactly like the server does, which suits a scheduled task if the server isn't running.
+To try it out without a real mail server, point SMTP at a local stand-in such as MailHog.
+*/
+
+func main() {
+	preview := flag.String("preview", "", "Name of a team whose digest to render")
+	out := flag.String("out", "digest.html", "File to write the preview to")
+	send := flag.String("send", "", "Name of a team whose digest to send now")
+	to := flag.String("to", "", "Comma separated recipients, instead of the configured ones")
+	from := flag.String("from", "", "First day of the digest (YYYY-MM-DD)")
+	due := flag.Bool("due", false, "Send the digests that are due")
+	flag.Parse()
+
+	if *preview == "" && *send == "" && !*due {
+		fmt.Printf("Usage: digest [-preview team [-out file]] [-send team [-to emails]] [-from date] [-due]\n")
+		os.Exit(1)
+	}
+
+	db := &timedb.TimeDB{}
+	db.Log = log.New("digest.log")
+	if err := db.LoadConfig(); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	sender := &digest.Sender{DB: db}
+	if ok, err := sender.LoadConfig(); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	} else if !ok && (*send != "" || *due) {
+		fmt.Printf("config/digest.json is needed to send email\n")
+		os.Exit(1)
+	}
+	if err := db.Connect(); err != nil {
+		fmt.Printf("Error connecting to time db: %v\n", err)
+		os.Exit(1)
+	}
+
+	periodStart := digest.PeriodStart(time.Now())
+	if *from != "" {
+		t, err := time.ParseInLocation("2006-01-02", *from, time.Local)
+		if err != nil {
+			fmt.Printf("Invalid date '%v'. Use YYYY-MM-DD\n", *from)
+			os.Exit(1)
+		}
+		periodStart = t
+	}
+
+	team := *preview
+	if team == "" {
+		team = *send
+	}
+	if team != "" {
+		teamid, recipients, err := sender.TeamRecipients(team)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		if teamid == 0 {
+			fmt.Printf("Unknown team %v\n", team)
+			os.Exit(1)
+		}
+		if *to != "" {
+			recipients = strings.Split(*to, ",")
+		}
+		d, err := sender.Build(teamid, team, periodStart)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		html, err := d.HTML()
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		if *preview != "" {
+			if err := ioutil.WriteFile(*out, []byte(html), 0644); err != nil {
+				fmt.Printf("%v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Wrote %v\n", *out)
+		}
+		if *send != "" {
+			if len(recipients) == 0 {
+				fmt.Printf("Team %v has no leads, and no recipients in config/digest.json. Use -to.\n", team)
+				os.Exit(1)
+			}
+			if err := sender.Send(recipients, d.Subject(), html); err != nil {
+				fmt.Printf("%v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Sent the digest of %v to %v\n", team, strings.Join(recipients, ", "))
+		}
+	}
+
+	if *due {
+		n, err := sender.SendDue(time.Now())
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Sent %v digests\n", n)
+	}
+}
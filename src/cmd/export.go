@@ -0,0 +1,110 @@
+package main
+
+import (
+	"export"
+	"flag"
+	"fmt"
+	"github.com/IMQS/log"
+	"os"
+	"strings"
+	"time"
+	"timedb"
+)
+
+/*
+Export raw time entries, joined to tickets and users, as CSV, JSON lines or XLSX.
+
+go run src/cmd/export.go -format xlsx -team "Team Infrastructure" -from 2016-01-01 -to 2016-12-31 -out 2016.xlsx
+*/
+
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func main() {
+	format := flag.String("format", export.FormatCSV, "csv, jsonl or xlsx")
+	outFile := flag.String("out", "", "Output file. Default is stdout")
+	team := flag.String("team", "", "Only export times of people while they were members of this team")
+	users := flag.String("users", "", "Only export times of these users (comma separated email addresses)")
+	from := flag.String("from", "", "First day to export (2006-01-02)")
+	to := flag.String("to", "", "Last day to export (2006-01-02)")
+	types := flag.String("type", "", "Only export these ticket types (comma separated, eg bug,feat)")
+	systems := flag.String("system", "", "Only export times from these systems (comma separated, eg tmet,harv)")
+	flag.Parse()
+
+	filter := &timedb.TimeFilter{
+		TicketTypes: splitList(*types),
+		Systems:     splitList(*systems),
+	}
+	var err error
+	if *from != "" {
+		if filter.Start, err = time.ParseInLocation("2006-01-02", *from, time.Local); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -from date: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *to != "" {
+		if filter.End, err = time.ParseInLocation("2006-01-02", *to, time.Local); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -to date: %v\n", err)
+			os.Exit(1)
+		}
+		filter.End = filter.End.AddDate(0, 0, 1)
+	}
+
+	db := &timedb.TimeDB{}
+	db.Log = log.New("export.log")
+	if err := db.LoadConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if err := db.Connect(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error connecting to time db: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *users != "" {
+		if filter.UserIDs, err = db.UserIDsFromEmails(splitList(*users)); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *team != "" {
+		teamid, err := db.TeamIDFromName(*team)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		} else if teamid == 0 {
+			fmt.Fprintf(os.Stderr, "Team '%v' not found\n", *team)
+			os.Exit(1)
+		}
+		filter.TeamIDs = []int64{teamid}
+	}
+
+	out := os.Stdout
+	if *outFile != "" {
+		if out, err = os.Create(*outFile); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		defer out.Close()
+	}
+	writer, err := export.NewWriter(*format, out)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if err := db.ExportTimes(filter, writer.WriteRow); err != nil {
+		fmt.Fprintf(os.Stderr, "Error exporting times: %v\n", err)
+		os.Exit(1)
+	}
+	if err := writer.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error exporting times: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -1,18 +1,25 @@
 package main
 
 import (
+	"alert"
+	"clockify"
 	"flag"
 	"fmt"
 	"github.com/IMQS/log"
+	"gitlog"
+	"harvest"
+	"ical"
 	"jira"
 	"os"
 	"time"
 	"timedb"
 	"tmetric"
+	"toggl"
 )
 
 type Fetcher interface {
 	Name() string
+	Scope() string // Describes which data is fetched, so that it can be recorded with each sync run
 	LoadConfig() error
 	Fetch(db *timedb.TimeDB, start, end time.Time) error
 	FetchRaw(start, end time.Time) ([]byte, error)
@@ -27,6 +34,11 @@ func main() {
 	historyDays := flag.Int("days", 0, "Number of days of history to fetch")
 	doJIRA := flag.Bool("jira", true, "Enable fetching JIRA tickets")
 	doTMetric := flag.Bool("tmetric", true, "Enable fetching TMetric values")
+	doToggl := flag.Bool("toggl", false, "Enable fetching Toggl time entries")
+	doClockify := flag.Bool("clockify", false, "Enable fetching Clockify time entries")
+	doHarvest := flag.Bool("harvest", false, "Enable fetching Harvest time entries")
+	doGit := flag.Bool("git", false, "Enable scanning local git repositories for commits")
+	doICal := flag.Bool("ical", false, "Enable importing meetings from iCalendar files")
 	flag.Parse()
 
 	if *historyDays <= 0 {
@@ -65,6 +77,26 @@ func main() {
 		fmt.Printf("TMetric enabled\n")
 		fetchers = append(fetchers, &tmetric.Fetcher{})
 	}
+	if *doToggl {
+		fmt.Printf("Toggl enabled\n")
+		fetchers = append(fetchers, &toggl.Fetcher{})
+	}
+	if *doClockify {
+		fmt.Printf("Clockify enabled\n")
+		fetchers = append(fetchers, &clockify.Fetcher{})
+	}
+	if *doHarvest {
+		fmt.Printf("Harvest enabled\n")
+		fetchers = append(fetchers, &harvest.Fetcher{})
+	}
+	if *doGit {
+		fmt.Printf("Git enabled\n")
+		fetchers = append(fetchers, &gitlog.Fetcher{})
+	}
+	if *doICal {
+		fmt.Printf("iCalendar enabled\n")
+		fetchers = append(fetchers, &ical.Fetcher{})
+	}
 
 	// We don't want to continue through errors, because if JIRA fetches fail, then
 	// tmetric will end up creating a whole bunch of anonymous tasks.
@@ -74,12 +106,36 @@ func main() {
 			logger.Errorf("Error loading config for %v:\n%v\n", f.Name(), err)
 			break
 		}
-		if err = f.Fetch(db, start_date, end_date); err != nil {
+		runid := int64(0)
+		if runid, err = db.BeginSyncRun(f.Name(), f.Scope(), start_date, end_date); err != nil {
+			logger.Errorf("Error recording sync run for %v:\n%v\n", f.Name(), err)
+			break
+		}
+		err = f.Fetch(db, start_date, end_date)
+		if endErr := db.EndSyncRun(runid, err); endErr != nil {
+			logger.Errorf("Error recording end of sync run for %v:\n%v\n", f.Name(), endErr)
+		}
+		if err != nil {
 			logger.Errorf("Error fetching from %v:\n%v\n", f.Name(), err)
 			break
 		}
 	}
 
+	// Alert rules look at complete weeks, so they are only evaluated once the data is complete
+	if err == nil {
+		evaluator := &alert.Evaluator{DB: db}
+		enabled := false
+		if enabled, err = evaluator.LoadConfig(); err == nil && enabled {
+			var result alert.Result
+			if result, err = evaluator.Evaluate(time.Now()); err == nil {
+				logger.Infof("Alerts: %v fired, %v resolved\n", result.Fired, result.Resolved)
+			}
+		}
+		if err != nil {
+			logger.Errorf("Error evaluating alerts:\n%v\n", err)
+		}
+	}
+
 	if err == nil {
 		logger.Infof("Finished successfully\n")
 	} else {
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"forecast"
+	"github.com/IMQS/log"
+	"os"
+	"strings"
+	"time"
+	"timedb"
+)
+
+/*
+Forecast of the unplanned work of each team, and the capacity that it leaves for planned work.
+The forecast of the selected team is also on the dashboard.
+
+go run src/cmd/forecast.go
+go run src/cmd/forecast.go -team Platform -from 2024-07-01 -weeks 13
+go run src/cmd/forecast.go -team Platform -types bug,intr -showweeks
+
+Unplanned work is bugs, BAU and interrupts, unless -types says otherwise. The forecast starts next Monday,
+unless -from says otherwise, and is fitted to the last -history weeks.
+*/
+
+func main() {
+	team := flag.String("team", "", "Only this team")
+	from := flag.String("from", "", "First day (YYYY-MM-DD) of the forecast. Default is next Monday.")
+	weeks := flag.Int("weeks", forecast.DefaultWeeks, "Number of weeks to forecast")
+	history := flag.Int("history", forecast.DefaultHistoryWeeks, "Number of past weeks to fit the forecast to")
+	types := flag.String("types", "", "Comma separated ticket types of unplanned work. Default is bug,bau,intr.")
+	showWeeks := flag.Bool("showweeks", false, "Show each week, rather than only the total")
+	flag.Parse()
+
+	db := &timedb.TimeDB{}
+	db.Log = log.New("forecast.log")
+	if err := db.LoadConfig(); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	if err := db.Connect(); err != nil {
+		fmt.Printf("Error connecting to time db: %v\n", err)
+		os.Exit(1)
+	}
+
+	q := &forecast.Query{Weeks: *weeks, HistoryWeeks: *history}
+	if *types != "" {
+		q.Types = strings.Split(*types, ",")
+	}
+	if *from != "" {
+		start, err := time.ParseInLocation("2006-01-02", *from, time.Local)
+		if err != nil {
+			fmt.Printf("Invalid -from '%v'. Use YYYY-MM-DD\n", *from)
+			os.Exit(1)
+		}
+		q.Start = start
+	} else {
+		now := time.Now()
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+		q.Start = today.AddDate(0, 0, 7-(int(today.Weekday())+6)%7)
+	}
+
+	teams, err := db.Teams()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	found := false
+	for _, t := range teams {
+		if *team != "" && t.Name != *team {
+			continue
+		}
+		found = true
+		q.TeamIDs, q.Team = []int64{t.TeamID}, t.Name
+		f, err := forecast.Compute(db, q)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		printForecast(f, *showWeeks)
+	}
+	if !found {
+		fmt.Printf("Unknown team %v\n", *team)
+		os.Exit(1)
+	}
+}
+
+func printForecast(f *forecast.Forecast, showWeeks bool) {
+	end := f.Total.Start.AddDate(0, 0, 7*len(f.Weeks)-1)
+	fmt.Printf("%v: %v to %v, unplanned work is %v\n", f.Team, f.Total.Start.Format("2006-01-02"), end.Format("2006-01-02"), strings.Join(f.Types, ", "))
+	fmt.Printf("  Smoothing factor %.2f, and typical weekly error %.1f hours\n", f.Alpha, f.ErrorHours)
+	if showWeeks {
+		fmt.Printf("  %-10v %10v %10v %19v %10v\n", "Week", "Capacity", "Unplanned", "80% band", "Available")
+		for _, w := range f.Weeks {
+			fmt.Printf("  %-10v %10.1f %10.1f %8.1f to %8.1f %10.1f\n", w.Start.Format("2006-01-02"), w.Capacity, w.Unplanned, w.Band80.Low, w.Band80.High, w.Available)
+		}
+	}
+	t := f.Total
+	fmt.Printf("  Capacity %.0f hours. Unplanned %.0f hours (80%%: %.0f to %.0f, 95%%: %.0f to %.0f). Available %.0f hours.\n\n",
+		t.Capacity, t.Unplanned, t.Band80.Low, t.Band80.High, t.Band95.Low, t.Band95.High, t.Available)
+}
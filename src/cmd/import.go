@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/IMQS/log"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"timedb"
+)
+
+/*
+Import time entries from CSV or JSON files, such as spreadsheets that a team has been keeping.
+
+go run src/cmd/import.go -mapping mapping.json hours-2016.csv hours-2017.csv
+
+The mapping file names the columns (or JSON object fields) that hold each value:
+
+{
+	"User": "Email",
+	"EmailSuffix": "@imqs.co.za",
+	"Ticket": "Task",
+	"Date": "Date",
+	"DateFormat": "2006-01-02",
+	"Start": "Start",
+	"End": "End",
+	"TimeFormat": "15:04",
+	"Duration": "Hours"
+}
+
+Ticket is either a JIRA key, or a title, which is linked to tickets in the same way as TMetric tasks.
+Every row needs a Date, and either Start and End, Start and Duration, or only Duration. Durations are
+either hours ("1.5"), hours and minutes ("1:30"), or a Go duration ("1h30m"). If there is no Start,
+then just like with TMetric, the entry starts at 1am.
+
+A JSON file is an array of objects. Every row is validated before anything is inserted, and re-importing
+the same rows has no further effect. Rows that are identical are separate entries, such as two entries of
+the same duration on the same day.
+*/
+
+type importMapping struct {
+	System      string // Goes into times.system. Default is "impt"
+	User        string
+	EmailSuffix string // Appended to users that are not email addresses
+	Ticket      string
+	Project     string
+	Date        string
+	DateFormat  string
+	Start       string
+	End         string
+	TimeFormat  string
+	Duration    string
+	Delimiter   string // CSV field delimiter. Default is ","
+}
+
+const importTaskStartHour = 1
+
+func (m *importMapping) load(filename string) error {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("Error loading mapping file %v: %v", filename, err)
+	}
+	if err := json.Unmarshal(bytes, m); err != nil {
+		return fmt.Errorf("Error decoding mapping file %v: %v", filename, err)
+	}
+	if m.System == "" {
+		m.System = timedb.SystemTypeImport
+	}
+	if m.DateFormat == "" {
+		m.DateFormat = "2006-01-02"
+	}
+	if m.TimeFormat == "" {
+		m.TimeFormat = "15:04"
+	}
+	if m.Delimiter == "" {
+		m.Delimiter = ","
+	}
+	if m.User == "" || m.Ticket == "" || m.Date == "" {
+		return fmt.Errorf("Mapping file %v must specify User, Ticket and Date", filename)
+	}
+	if m.Duration == "" && (m.Start == "" || m.End == "") {
+		return fmt.Errorf("Mapping file %v must specify Duration, or Start and End", filename)
+	}
+	return nil
+}
+
+// A single row of input, with the line number that it came from
+type importRow struct {
+	Line   int
+	Fields map[string]string
+}
+
+func readCSVRows(raw []byte, delimiter string) ([]importRow, error) {
+	reader := csv.NewReader(bytes.NewReader(raw))
+	reader.Comma = []rune(delimiter)[0]
+	reader.FieldsPerRecord = -1
+	header := []string{}
+	rows := []importRow{}
+	for {
+		rec, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		if len(header) == 0 {
+			header = rec
+			continue
+		}
+		row := importRow{Line: line, Fields: map[string]string{}}
+		for i, name := range header {
+			if i < len(rec) {
+				row.Fields[strings.TrimSpace(name)] = strings.TrimSpace(rec[i])
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func readJSONRows(raw []byte) ([]importRow, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	if tok, err := decoder.Token(); err != nil {
+		return nil, err
+	} else if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return nil, fmt.Errorf("Expected a JSON array of objects")
+	}
+	rows := []importRow{}
+	for decoder.More() {
+		// Count the lines up to the start of this object
+		offset := decoder.InputOffset()
+		line := 1 + bytes.Count(raw[:offset], []byte("\n"))
+		if next := bytes.IndexByte(raw[offset:], '{'); next != -1 {
+			line += bytes.Count(raw[offset:offset+int64(next)], []byte("\n"))
+		}
+		obj := map[string]interface{}{}
+		if err := decoder.Decode(&obj); err != nil {
+			return nil, fmt.Errorf("Line %v: %v", line, err)
+		}
+		row := importRow{Line: line, Fields: map[string]string{}}
+		for k, v := range obj {
+			if v != nil {
+				row.Fields[k] = strings.TrimSpace(fmt.Sprint(v))
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func parseImportDuration(s string) (time.Duration, error) {
+	if hours, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(hours * float64(time.Hour)), nil
+	}
+	if parts := strings.Split(s, ":"); len(parts) == 2 {
+		h, herr := strconv.Atoi(parts[0])
+		m, merr := strconv.Atoi(parts[1])
+		if herr == nil && merr == nil {
+			return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+// Returns the time of day as an offset from midnight
+func parseTimeOfDay(format, s string) (time.Duration, error) {
+	t, err := time.Parse(format, s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second, nil
+}
+
+func (m *importMapping) convert(row importRow) (timedb.TimeFormat2, error) {
+	tt := timedb.TimeFormat2{System: m.System}
+	field := func(name string) string {
+		if name == "" {
+			return ""
+		}
+		return row.Fields[name]
+	}
+
+	tt.Email = strings.ToLower(field(m.User))
+	if tt.Email == "" {
+		return tt, fmt.Errorf("%v is empty", m.User)
+	}
+	if !strings.Contains(tt.Email, "@") {
+		tt.Email += m.EmailSuffix
+	}
+	tt.TaskTitle = field(m.Ticket)
+	if tt.TaskTitle == "" {
+		return tt, fmt.Errorf("%v is empty", m.Ticket)
+	}
+	tt.Project = field(m.Project)
+
+	day, err := time.ParseInLocation(m.DateFormat, field(m.Date), time.Local)
+	if err != nil {
+		return tt, fmt.Errorf("Invalid %v '%v'. Expected format %v", m.Date, field(m.Date), m.DateFormat)
+	}
+
+	tt.Start = day.Add(importTaskStartHour * time.Hour)
+	if s := field(m.Start); s != "" {
+		offset, err := parseTimeOfDay(m.TimeFormat, s)
+		if err != nil {
+			return tt, fmt.Errorf("Invalid %v '%v'. Expected format %v", m.Start, s, m.TimeFormat)
+		}
+		tt.Start = day.Add(offset)
+	} else if m.Start != "" && field(m.Duration) == "" {
+		return tt, fmt.Errorf("%v is empty", m.Start)
+	}
+
+	if s := field(m.End); s != "" {
+		offset, err := parseTimeOfDay(m.TimeFormat, s)
+		if err != nil {
+			return tt, fmt.Errorf("Invalid %v '%v'. Expected format %v", m.End, s, m.TimeFormat)
+		}
+		tt.End = day.Add(offset)
+	} else if s := field(m.Duration); s != "" {
+		duration, err := parseImportDuration(s)
+		if err != nil {
+			return tt, fmt.Errorf("Invalid %v '%v'", m.Duration, s)
+		}
+		tt.End = tt.Start.Add(duration)
+	} else {
+		return tt, fmt.Errorf("Neither %v nor %v is populated", m.End, m.Duration)
+	}
+	if !tt.End.After(tt.Start) {
+		return tt, fmt.Errorf("End time is not after start time")
+	}
+
+	// Derive the systemid from the content, so that importing the same row twice has no effect
+	hash := sha1.Sum([]byte(strings.Join([]string{tt.Email, tt.TaskTitle, tt.Project, tt.Start.UTC().Format(time.RFC3339), tt.End.UTC().Format(time.RFC3339)}, "\x00")))
+	tt.SystemID = hex.EncodeToString(hash[:])
+	return tt, nil
+}
+
+func main() {
+	mappingFile := flag.String("mapping", "", "JSON file that maps columns to fields")
+	format := flag.String("format", "", "csv or json. Default is determined by the file extension")
+	dryRun := flag.Bool("dry-run", false, "Validate the files, but don't insert anything")
+	flag.Parse()
+
+	if *mappingFile == "" || flag.NArg() == 0 {
+		fmt.Printf("Usage: import -mapping mapping.json [-format csv|json] [-dry-run] file...\n")
+		os.Exit(1)
+	}
+	mapping := &importMapping{}
+	if err := mapping.load(*mappingFile); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+
+	times := []timedb.TimeFormat2{}
+	nerrors := 0
+	// The number of rows with each systemid so far, which tells apart the repeats of identical rows
+	repeats := map[string]int{}
+	for _, filename := range flag.Args() {
+		raw, err := ioutil.ReadFile(filename)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		fileFormat := *format
+		if fileFormat == "" {
+			fileFormat = strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+		}
+		rows := []importRow{}
+		switch fileFormat {
+		case "csv":
+			rows, err = readCSVRows(raw, mapping.Delimiter)
+		case "json":
+			rows, err = readJSONRows(raw)
+		default:
+			err = fmt.Errorf("Unknown format '%v'. Use -format csv or -format json", fileFormat)
+		}
+		if err != nil {
+			fmt.Printf("%v: %v\n", filename, err)
+			os.Exit(1)
+		}
+		for _, row := range rows {
+			tt, err := mapping.convert(row)
+			if err != nil {
+				fmt.Printf("%v:%v: %v\n", filename, row.Line, err)
+				nerrors++
+				continue
+			}
+			n := repeats[tt.SystemID]
+			repeats[tt.SystemID]++
+			if n != 0 {
+				tt.SystemID = fmt.Sprintf("%v/%v", tt.SystemID, n)
+			}
+			times = append(times, tt)
+		}
+	}
+
+	if nerrors != 0 {
+		fmt.Printf("%v invalid rows. Nothing was imported.\n", nerrors)
+		os.Exit(1)
+	}
+	fmt.Printf("%v valid rows\n", len(times))
+	if *dryRun {
+		return
+	}
+
+	db := &timedb.TimeDB{}
+	db.Log = log.New("import.log")
+	if err := db.LoadConfig(); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	if err := db.Connect(); err != nil {
+		fmt.Printf("Error connecting to time db: %v\n", err)
+		os.Exit(1)
+	}
+	if err := db.InsertTimes2(times); err != nil {
+		fmt.Printf("Error inserting times: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Imported %v rows\n", len(times))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/IMQS/log"
+	"os"
+	"time"
+	"timedb"
+)
+
+/*
+Hourly rates, which turn hours into costs. Rates are also managed at /admin.
+
+go run src/cmd/rates.go -list
+go run src/cmd/rates.go -user ben.harper@imqs.co.za -rate 650 -from 2024-03-01
+go run src/cmd/rates.go -role senior -rate 600 -from 2024-03-01
+go run src/cmd/rates.go -assign ben.harper@imqs.co.za -role senior -from 2024-03-01
+
+A person's own rate takes precedence over the rate of their job role. A rate, or a job role,
+applies from its date until the next one of the same person or role.
+*/
+
+func main() {
+	list := flag.Bool("list", false, "List rates and job roles")
+	user := flag.String("user", "", "Email address of the person whose rate to set")
+	role := flag.String("role", "", "Job role whose rate to set, or, with -assign, the job role to assign")
+	rate := flag.Float64("rate", -1, "Hourly rate")
+	from := flag.String("from", "", "First day (YYYY-MM-DD) on which the rate or job role applies. Default is today.")
+	assign := flag.String("assign", "", "Email address of the person to assign a job role to")
+	flag.Parse()
+
+	if !*list && *rate < 0 && *assign == "" {
+		fmt.Printf("Usage: rates [-list] [-user email | -role name] -rate amount [-from date] | -assign email -role name [-from date]\n")
+		os.Exit(1)
+	}
+
+	db := &timedb.TimeDB{}
+	db.Log = log.New("rates.log")
+	if err := db.LoadConfig(); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	if err := db.Connect(); err != nil {
+		fmt.Printf("Error connecting to time db: %v\n", err)
+		os.Exit(1)
+	}
+
+	day := time.Now()
+	if *from != "" {
+		var err error
+		if day, err = time.Parse("2006-01-02", *from); err != nil {
+			fmt.Printf("Invalid date '%v'. Use YYYY-MM-DD\n", *from)
+			os.Exit(1)
+		}
+	}
+
+	userID := func(email string) int64 {
+		userid, err := db.UserIDFromEmail(email)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		if userid == 0 {
+			fmt.Printf("Unknown user %v\n", email)
+			os.Exit(1)
+		}
+		return userid
+	}
+
+	if *rate >= 0 {
+		userid := int64(0)
+		if *user != "" {
+			userid = userID(*user)
+		}
+		if _, err := db.SetRate(userid, *role, day, *rate); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *assign != "" {
+		if _, err := db.SetJobRole(userID(*assign), *role, day); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *list {
+		rates, err := db.Rates()
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%-40v %-10v %10v\n", "Person or job role", "From", "Rate")
+		for _, r := range rates {
+			who := r.Email
+			if r.UserID == 0 {
+				who = "role " + r.Role
+			}
+			fmt.Printf("%-40v %-10v %10.2f\n", who, r.EffectiveFrom.Format("2006-01-02"), r.HourlyRate)
+		}
+		roles, err := db.JobRoles()
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("\n%-40v %-10v %v\n", "Person", "From", "Job role")
+		for _, j := range roles {
+			fmt.Printf("%-40v %-10v %v\n", j.Email, j.EffectiveFrom.Format("2006-01-02"), j.Role)
+		}
+	}
+}
@@ -1,11 +1,27 @@
 package main
 
 import (
+	"api"
+	"auth"
+	"billing"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"digest"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"export"
 	"fmt"
+	"forecast"
+	"github.com/IMQS/log"
 	"html/template"
+	"io"
 	"io/ioutil"
+	"jira"
 	"net/http"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -14,16 +30,23 @@ import (
 
 const listenPort = 3333
 const historyDays = 365
+const velocityHistoryWeeks = 26
+const focusHistoryWeeks = 26
 
 const teamAll = "all teams"
 
+// JIRA webhook bodies are small, so anything larger than this is not legitimate
+const maxWebhookBytes = 4 * 1024 * 1024
+
 type ConfigTeam struct {
 	Name         string
 	MembersEmail []string
 }
 
 type Config struct {
-	Teams []ConfigTeam
+	Teams         []ConfigTeam // Only used to seed the teams table in the database, if it is empty
+	WebhookSecret string       // Shared secret for /webhook/jira. If empty, webhooks are rejected.
+	JiraURL       string       // Base URL of links to JIRA tickets. Default is the URL in config/jira.json.
 }
 
 func (c *Config) Load() error {
@@ -56,6 +79,13 @@ const homeRaw = `
 </head>
 <body>
 
+<div class='signed-in'>
+	{{.Email}} ({{.Role}})
+	{{if .IsAdmin}}<a href='/admin'>Admin</a>{{end}}
+	{{if .CanSeeCosts}}<a href='/capitalisation'>Capitalisation</a>{{end}}
+	<form method='POST' action='/logout'><button>Sign out</button></form>
+</div>
+
 <select id='select_user' class='user-select'>
 	{{range .Users}}
 	<option value="{{.UserID}}">{{.Email}}</option>
@@ -68,21 +98,263 @@ const homeRaw = `
 	{{end}}
 </select>
 
+<select id='select_system'>
+	<option value="">All time sources</option>
+	<option value="tmet">TMetric</option>
+	<option value="togl">Toggl</option>
+	<option value="clck">Clockify</option>
+	<option value="harv">Harvest</option>
+	<option value="jira">JIRA worklogs</option>
+</select>
+
+<a id='export_link' href='/export?format=xlsx'>Export</a>
+{{if .CanSeeCosts}}<label><input type='checkbox' id='show_cost'> Show cost{{if .Currency}} ({{.Currency}}){{end}}</label>{{end}}
+
+{{if .Alerts}}
+<div class='alerts'>
+	{{range .Alerts}}
+	<div class='{{if .ResolvedAt}}resolved{{else}}open{{end}}'>{{.FiredAt.Format "2006-01-02"}} {{.Message}}{{if .ResolvedAt}} (resolved {{.ResolvedAt.Format "2006-01-02"}}){{end}}</div>
+	{{end}}
+</div>
+{{end}}
+
 <div class="ct-chart ct-golden-section" style="width:600px; height: 500px;" id="monthly_chart"></div>
 
 <div style="background-color: #5d5; width: 10em; height: 1.5em; padding: 3px">Features</div>
 <div style="background-color: #d55; width: 10em; height: 1.5em; padding: 3px">Bugs</div>
 
+<div id='velocity' style='display: none'>
+	<select id='select_velocity'>
+		<option value="Points">Story points resolved</option>
+		<option value="Tickets">Tickets resolved</option>
+		<option value="HoursPerPoint">Hours per story point</option>
+	</select>
+	<select id='select_velocity_weeks'>
+		<option value="1">per week</option>
+		<option value="2">per two week sprint</option>
+	</select>
+	<div class="ct-chart" id="velocity_chart"></div>
+	<div id='velocity_legend'></div>
+</div>
+
+<div id='cycletime' style='display: none'>
+	<select id='select_cycletime'>
+		<option value="LeadTime">Lead time (created to resolved)</option>
+		<option value="FirstWork">Time to first work (created to first time logged)</option>
+		<option value="ActiveSpan">Active work span (first to last time logged)</option>
+	</select>
+	<select id='select_cycletime_type'>
+		<option value="">All ticket types</option>
+		<option value="feat">Features</option>
+		<option value="bug">Bugs</option>
+		<option value="bau">BAU</option>
+		<option value="intr">Interrupts</option>
+		<option value="spike">Spikes</option>
+	</select>
+	<div class="ct-chart" id="cycletime_chart"></div>
+	<div id='cycletime_legend'></div>
+</div>
+
+<div id='focus' style='display: none'>
+	<select id='select_focus'>
+		<option value="SwitchesPerDay">Task switches per person per day</option>
+		<option value="TicketsPerDay">Tickets per person per day</option>
+		<option value="LongestBlockSeconds">Longest uninterrupted block (hours)</option>
+		<option value="InterruptShare">Share of interrupt work (%)</option>
+	</select>
+	<div class="ct-chart" id="focus_chart"></div>
+	<div id='focus_legend'></div>
+</div>
+
+<div id='forecast' style='display: none'>
+	<h3>Unplanned work (bugs, BAU and interrupts) and capacity, forecast for the next 13 weeks</h3>
+	<div class="ct-chart" id="forecast_chart"></div>
+	<div id='forecast_summary'></div>
+</div>
+
+<select id='select_rollup'>
+	<option value="story">Hours per story (including sub-tasks)</option>
+	<option value="epic">Hours per epic (including stories and sub-tasks)</option>
+	<option value="project">Hours per project</option>
+</select>
+<table id='rollup_table' class='rollup'></table>
+
+<div id='drilldown' style='display: none'>
+	<h3 id='drilldown_title'></h3>
+	<input id='drilldown_filter' placeholder='Filter by key, title, type or person'>
+	<table id='drilldown_table' class='rollup'></table>
+</div>
+<div id='ticket_activity'></div>
+
+<div id='timesheets' style='display: none'>
+	<h3>Timesheets of the last four weeks</h3>
+	<table id='timesheets_table' class='rollup'></table>
+	<div id='timesheet_days'></div>
+</div>
+
+<div class='sync-runs'>
+	{{range .SyncRuns}}
+	<div>{{.Source}} last synced {{.StartTime.Format "2006-01-02 15:04"}}, covering {{.WindowStart.Format "2006-01-02"}} to {{.WindowEnd.Format "2006-01-02"}} ({{.Scope}})</div>
+	{{end}}
+</div>
+
 </body>
 <script src='/js/main.js'></script>
 </script>
 </html>
 `
 
+const loginRaw = `
+<!DOCTYPE html>
+<html>
+<head>
+	<link rel='stylesheet' href='/css/main.css'>
+</head>
+<body>
+<form method='POST' action='/login' class='login'>
+	<h2>Sign in</h2>
+	{{if .Error}}<p class='error'>{{.Error}}</p>{{end}}
+	<input name='email' type='email' placeholder='Email' value='{{.Email}}' autofocus>
+	<input name='password' type='password' placeholder='Password'>
+	<button>Sign in</button>
+	{{if .OIDCName}}<p><a href='/auth/oidc/login'>Sign in with {{.OIDCName}}</a></p>{{end}}
+</form>
+</body>
+</html>
+`
+
+const adminRaw = `
+<!DOCTYPE html>
+<html>
+<head>
+	<script src='/js/jzed.js'></script>
+	<link rel='stylesheet' href='/css/main.css'>
+</head>
+<body>
+
+<h2>Teams</h2>
+<p>Membership dates are inclusive from, and exclusive to. Leave a date empty for an open-ended membership.</p>
+
+<div id='teams'></div>
+
+<h3>New team</h3>
+<input id='new_team_name' placeholder='Team name'>
+<button id='new_team_button'>Create</button>
+
+<h2>Accounts</h2>
+<p>Engineers see their own data, leads see the individuals of the teams they lead, and viewers only see team aggregates.
+Accounts are linked to time by email address. Accounts without a password can only sign in with OIDC.</p>
+<div id='accounts'></div>
+<input id='new_account_email' placeholder='Email'>
+<select id='new_account_role'>{{range .Roles}}<option>{{.}}</option>{{end}}</select>
+<input id='new_account_password' type='password' placeholder='Password (optional)'>
+<button id='new_account_button'>Create</button>
+
+{{if .CanSeeCosts}}
+<h2>Hourly rates</h2>
+<p>A rate applies from its date until the next rate of the same person or job role. A person's own rate takes
+precedence over the rate of their job role. Time of people without a rate is left out of costs, and reported as uncosted.</p>
+<div id='rates'></div>
+<input id='new_rate_email' placeholder='Email, or'>
+<input id='new_rate_role' placeholder='Job role'>
+<input id='new_rate_from' type='date'>
+<input id='new_rate_amount' type='number' step='any' placeholder='Hourly rate'>
+<button id='new_rate_button'>Set rate</button>
+
+<h3>Job roles</h3>
+<div id='job_roles'></div>
+<input id='new_job_role_email' placeholder='Email'>
+<input id='new_job_role_role' placeholder='Job role'>
+<input id='new_job_role_from' type='date'>
+<button id='new_job_role_button'>Set job role</button>
+
+<h2>Billing</h2>
+<p>Contracts, and the projects, JIRA projects and epics that they bill, are set up with src/cmd/billing.go.
+Issuing an invoice locks its period of the contract, until the invoice is voided.</p>
+<div id='contracts'></div>
+<select id='statement_contract'></select>
+<input id='statement_from' type='date'>
+<input id='statement_to' type='date'>
+<button id='statement_button'>Preview</button>
+<input id='invoice_number' placeholder='Invoice number (optional)'>
+<button id='invoice_button'>Issue invoice</button>
+<div id='statement'></div>
+<h3>Invoices</h3>
+<div id='invoices'></div>
+{{end}}
+
+<h2>Likely duplicate users</h2>
+<p>Merging moves all time to the other user. The merged email address becomes an alias, so future syncs attribute its time correctly.
+Identity rules in config/timedb.json can rewrite the email addresses of a source system before they are matched.</p>
+<div id='duplicates'></div>
+
+</body>
+<script src='/js/admin.js'></script>
+</html>
+`
+
+const capitalisationRaw = `
+<!DOCTYPE html>
+<html>
+<head>
+	<script src='/js/jzed.js'></script>
+	<link rel='stylesheet' href='/css/main.css'>
+</head>
+<body>
+
+<h2>Capitalisation</h2>
+<p>Time is CapEx or OpEx by the rule of its ticket, else of its epic, else of its ticket type. Time without a rule is OpEx.
+A person that was in more than one team has their time counted in each.</p>
+<select id='cap_team'>
+	<option value=''>All teams</option>
+	{{range .Teams}}<option value='{{.TeamID}}'>{{.Name}}</option>{{end}}
+</select>
+<input id='cap_from' type='date'>
+<input id='cap_to' type='date'>
+<button id='cap_button'>Show</button>
+<a id='cap_export' href='#'>Export CSV</a>
+<div id='cap_signoff'></div>
+<table id='cap_report' class='rollup'></table>
+<input id='cap_signoff_note' placeholder='Note (optional)'>
+<button id='cap_signoff_button'>Sign off this period</button>
+
+<h3>Rules</h3>
+<div id='cap_rules'></div>
+<select id='cap_rule_kind'>
+	<option value='type'>Ticket type</option>
+	<option value='epic'>Epic</option>
+	<option value='ticket'>Ticket</option>
+</select>
+<input id='cap_rule_value' placeholder='Type, or JIRA key'>
+<select id='cap_rule_class'>
+	<option value='capex'>CapEx</option>
+	<option value='opex'>OpEx</option>
+	<option value=''>No rule</option>
+</select>
+<input id='cap_rule_reason' placeholder='Reason'>
+<button id='cap_rule_button'>Set rule</button>
+
+<h3>Sign-offs</h3>
+<div id='cap_signoffs'></div>
+
+<h3>Changes to the rules</h3>
+<div id='cap_changes'></div>
+
+</body>
+<script src='/js/capitalisation.js'></script>
+</html>
+`
+
 var homeTemplate *template.Template
+var loginTemplate *template.Template
+var adminTemplate *template.Template
+var capitalisationTemplate *template.Template
 
 func init() {
 	homeTemplate = template.Must(template.New("home").Parse(homeRaw))
+	loginTemplate = template.Must(template.New("login").Parse(loginRaw))
+	adminTemplate = template.Must(template.New("admin").Parse(adminRaw))
+	capitalisationTemplate = template.Must(template.New("capitalisation").Parse(capitalisationRaw))
 }
 
 type user struct {
@@ -103,75 +375,100 @@ func (t *team) HtmlTitle() string {
 }
 
 type rootData struct {
-	Users     []user
-	Teams     []team
-	ShowUsers bool
+	Email       string
+	Role        string
+	IsAdmin     bool
+	Users       []user
+	Teams       []team
+	ShowUsers   bool
+	SyncRuns    []timedb.SyncRun
+	Alerts      []timedb.Alert
+	CanSeeCosts bool
+	Currency    string
 }
 
 type reportDataMonth struct {
 	Year           int
 	Month          string
+	MonthNumber    int // 1 to 12
 	BugSeconds     float64
 	FeatureSeconds float64
+	BugCost        float64
+	FeatureCost    float64
 }
 
-func (m *reportDataMonth) addTicket(ticketType string, duration time.Duration) {
+func (m *reportDataMonth) addTicket(ticketType string, duration time.Duration, cost float64) {
 	switch ticketType {
 	case timedb.TicketTypeBug:
 		m.BugSeconds += duration.Seconds()
+		m.BugCost += cost
 	case timedb.TicketTypeFeature:
 		m.FeatureSeconds += duration.Seconds()
+		m.FeatureCost += cost
 	}
 }
 
 type reportData struct {
-	Months []reportDataMonth
+	Months   []reportDataMonth
+	Cost     bool // True if the costs are populated
+	Currency string
+}
+
+// Returns true if the request asks for costs, with 'cost=1', and the session may see them.
+// The cost of one person's time reveals their rate, so only admins see costs per userid.
+func wantCost(r *http.Request) bool {
+	session := auth.FromRequest(r)
+	if r.FormValue("userid") != "" && !session.IsAdmin() {
+		return false
+	}
+	return r.FormValue("cost") == "1" && session.CanSeeCosts()
 }
 
 type serverState struct {
-	db            *timedb.TimeDB
-	config        Config
-	userEmailToID map[string]int64 // email addresses are lower case
+	db     *timedb.TimeDB
+	auth   *auth.Auth
+	config Config
+	jira   jira.Config // Empty if there is no config/jira.json
 }
 
 var state serverState
 
-func (s *serverState) buildUserEmailToID() error {
-	s.userEmailToID = map[string]int64{}
-	rows, err := state.db.Conn.Query("SELECT userid, email FROM users")
-	if err != nil {
-		return err
+// Returns the teamids of the given team, or of all teams if team is teamAll.
+// Returns an empty list if there is no such team.
+func (s *serverState) teamIDs(team string) ([]int64, error) {
+	if team == teamAll {
+		return s.db.AllTeamIDs()
 	}
-	defer rows.Close()
-	for rows.Next() {
-		user := user{}
-		if err = rows.Scan(&user.UserID, &user.Email); err != nil {
-			return err
-		}
-		s.userEmailToID[strings.ToLower(user.Email)] = user.UserID
+	teamid, err := s.db.TeamIDFromName(team)
+	if err != nil || teamid == 0 {
+		return []int64{}, err
 	}
-	return nil
+	return []int64{teamid}, nil
 }
 
-func (s *serverState) usersInTeam(team string) []int64 {
-	ids := []int64{}
+// Copy the teams from the server config into the database, if the database has no teams yet
+func (s *serverState) importConfigTeams() error {
+	teams := map[string][]string{}
 	for _, t := range s.config.Teams {
-		if t.Name == team || team == teamAll {
-			for _, email := range t.MembersEmail {
-				if id, ok := s.userEmailToID[strings.ToLower(email)]; ok {
-					ids = append(ids, id)
-				}
-			}
-		}
+		teams[t.Name] = t.MembersEmail
 	}
-	return ids
+	imported, err := s.db.ImportTeams(teams)
+	if imported {
+		s.db.Log.Infof("Imported %v teams from config/server.json", len(teams))
+	}
+	return err
 }
 
 func handleRoot(w http.ResponseWriter, r *http.Request) {
+	session := auth.FromRequest(r)
 	data := &rootData{}
-	data.ShowUsers = r.FormValue("foo") == "bar"
+	data.Email = session.Account.Email
+	data.Role = session.Account.Role
+	data.IsAdmin = session.IsAdmin()
+	data.CanSeeCosts = session.CanSeeCosts()
+	data.Currency = state.db.Config.Currency
 
-	// Add users
+	// Add the users whose individual data this session may see
 	rows, err := state.db.Conn.Query("SELECT userid, email FROM users ORDER BY lower(email)")
 	if err != nil {
 		panic(err)
@@ -182,101 +479,184 @@ func handleRoot(w http.ResponseWriter, r *http.Request) {
 		if err = rows.Scan(&user.UserID, &user.Email); err != nil {
 			panic(err)
 		}
-		data.Users = append(data.Users, user)
+		if session.CanSeeUser(user.UserID) {
+			data.Users = append(data.Users, user)
+		}
 	}
+	data.ShowUsers = len(data.Users) != 0
 
 	// Add teams
+	teams, err := state.db.Teams()
+	if err != nil {
+		panic(err)
+	}
 	data.Teams = append(data.Teams, team{Name: teamAll})
-	for _, t := range state.config.Teams {
+	for _, t := range teams {
 		jt := team{
 			Name: t.Name,
 		}
-		for _, email := range t.MembersEmail {
-			if _, ok := state.userEmailToID[strings.ToLower(email)]; !ok {
-				jt.MembersWithNoData = append(jt.MembersWithNoData, email)
+		noData := map[string]bool{}
+		for _, m := range t.Members {
+			if !m.HasData && !noData[m.Email] {
+				noData[m.Email] = true
+				jt.MembersWithNoData = append(jt.MembersWithNoData, m.Email)
 			}
 		}
 		data.Teams = append(data.Teams, jt)
 	}
 
-	homeTemplate.Execute(w, &data)
-}
+	// Add the scope of the data that the reports are built from
+	if data.SyncRuns, err = state.db.LatestSyncRuns(); err != nil {
+		panic(err)
+	}
+	if data.Alerts, err = state.db.RecentAlerts(10); err != nil {
+		panic(err)
+	}
 
-func parseDuration(src []byte) time.Duration {
-	parts := strings.Split(string(src), ":")
-	h, _ := strconv.ParseUint(parts[0], 10, 64)
-	m, _ := strconv.ParseUint(parts[1], 10, 64)
-	s, _ := strconv.ParseUint(parts[2], 10, 64)
-	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second
+	homeTemplate.Execute(w, &data)
 }
 
-func handleMonthlyReport(w http.ResponseWriter, r *http.Request) {
-	orgDate := time.Now().Add(-historyDays * 24 * time.Hour)
+// Returns a filter for the time entries of the 'userid' or 'team' request parameters.
+// For a team, this is the time of people while they were members of the team.
+// Returns nil, after sending a 403, if the session may not see the user.
+func reportFilter(w http.ResponseWriter, r *http.Request) *timedb.TimeFilter {
 	userid, _ := strconv.ParseInt(r.FormValue("userid"), 10, 64)
 	teamName := r.FormValue("team")
-	data := &reportData{}
-	data.Months = []reportDataMonth{}
-
-	users := []int64{}
+	filter := &timedb.TimeFilter{}
 	if userid != 0 {
-		users = append(users, userid)
+		if !auth.FromRequest(r).CanSeeUser(userid) {
+			http.Error(w, "You may not see the data of this person", http.StatusForbidden)
+			return nil
+		}
+		filter.UserIDs = []int64{userid}
 	} else if teamName != "" {
-		users = state.usersInTeam(teamName)
+		var err error
+		if filter.TeamIDs, err = state.teamIDs(teamName); err != nil {
+			panic(err)
+		}
 	} else {
 		panic("No team or userid specified")
 	}
+	return filter
+}
 
-	script := `
-SELECT EXTRACT(YEAR FROM t.start_time) AS year, EXTRACT(MONTH FROM t.start_time) AS month, sum(t.end_time - t.start_time) AS sum, k.ticket_type AS ticket_type FROM times AS t INNER JOIN
-tickets AS k ON k.ticketid = t.ticketid
-WHERE <useridClause> t.start_time > '<orgdate>'
-GROUP BY EXTRACT(YEAR FROM t.start_time), EXTRACT(MONTH FROM t.start_time), k.ticket_type
-ORDER BY EXTRACT(YEAR FROM t.start_time), EXTRACT(MONTH FROM t.start_time)`
+func handleMonthlyReport(w http.ResponseWriter, r *http.Request) {
+	orgDate := time.Now().Add(-historyDays * 24 * time.Hour)
+	data := &reportData{}
+	data.Months = []reportDataMonth{}
 
-	useridClause := ""
-	if len(users) != 0 {
-		useridClause = "t.userid IN ("
-		for _, uid := range users {
-			useridClause += fmt.Sprintf("%v,", uid)
-		}
-		if len(useridClause) != 0 {
-			// chop off trailing comma
-			useridClause = useridClause[:len(useridClause)-1]
-		}
-		useridClause += ") AND "
+	filter := reportFilter(w, r)
+	if filter == nil {
+		return
+	}
+	// Optionally restrict to times from a single source system, such as "tmet" or "harv"
+	if system := r.FormValue("system"); system != "" {
+		filter.Systems = []string{system}
 	}
 
-	script = strings.Replace(script, "<useridClause>", useridClause, -1)
-	script = strings.Replace(script, "<orgdate>", orgDate.Format("2006-01-02"), -1)
+	filter.Start = orgDate
+	data.Cost = wantCost(r)
+	data.Currency = state.db.Config.Currency
+	rows, err := state.db.QueryReport(&timedb.ReportQuery{
+		Filter:  *filter,
+		GroupBy: []timedb.ReportGroup{timedb.GroupTicketType},
+		Bucket:  timedb.BucketMonth,
+		Cost:    data.Cost,
+	})
+	if err != nil {
+		panic(err)
+	}
+	for _, row := range rows {
+		year := row.Bucket.Year()
+		mon := row.Bucket.Month().String()
+		if len(data.Months) == 0 || data.Months[len(data.Months)-1].Year != year || data.Months[len(data.Months)-1].Month != mon {
+			data.Months = append(data.Months, reportDataMonth{Year: year, Month: mon, MonthNumber: int(row.Bucket.Month())})
+		}
+		data.Months[len(data.Months)-1].addTicket(row.TicketType, time.Duration(row.Seconds*float64(time.Second)), row.Cost)
+	}
 
-	rows, err := state.db.Conn.Query(script)
+	raw, err := json.Marshal(data)
 	if err != nil {
 		panic(err)
 	}
-	defer rows.Close()
-	month := reportDataMonth{}
-	for rows.Next() {
-		year := 0
-		mon := 0
-		sum := []byte{}
-		ticket_type := ""
-		if err := rows.Scan(&year, &mon, &sum, &ticket_type); err != nil {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(raw)
+}
+
+type drillDownData struct {
+	JiraURL  string
+	Tickets  []timedb.DrillDownTicket
+	Currency string
+}
+
+// List the tickets of a single month of the monthly report, with the hours of each person.
+// Parameters: userid or team, year, month (1 to 12), and optionally type and system.
+func handleDrillDown(w http.ResponseWriter, r *http.Request) {
+	filter := reportFilter(w, r)
+	if filter == nil {
+		return
+	}
+	year, _ := strconv.Atoi(r.FormValue("year"))
+	month, _ := strconv.Atoi(r.FormValue("month"))
+	if year == 0 || month < 1 || month > 12 {
+		http.Error(w, "Invalid year or month", http.StatusBadRequest)
+		return
+	}
+	filter.Start = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.Local)
+	filter.End = filter.Start.AddDate(0, 1, 0)
+	filter.TicketTypes = formList(r, "type")
+	filter.Systems = formList(r, "system")
+
+	data := &drillDownData{JiraURL: state.config.JiraURL, Currency: state.db.Config.Currency}
+	var err error
+	if data.Tickets, err = state.db.QueryDrillDown(filter, wantCost(r)); err != nil {
+		panic(err)
+	}
+	session := auth.FromRequest(r)
+	for i := range data.Tickets {
+		data.Tickets[i].People = session.FilterPeople(data.Tickets[i].People)
+	}
+	sendJSON(w, data)
+}
+
+type rollupData struct {
+	Tickets  []timedb.TicketRollup
+	Projects []timedb.ReportRow // Only for the project level
+	Cost     bool
+	Currency string
+}
+
+// Rolls time up into the projects of the time sources, rather than up the ticket hierarchy
+const rollupProject = "project"
+
+// Aggregate hours of sub-tasks into their stories, of stories into their epics, or of time entries into their projects
+func handleRollupReport(w http.ResponseWriter, r *http.Request) {
+	orgDate := time.Now().Add(-historyDays * 24 * time.Hour)
+	level := timedb.RollupLevel(r.FormValue("level"))
+	if level == "" {
+		level = timedb.RollupStory
+	}
+	if level != timedb.RollupStory && level != timedb.RollupEpic && level != rollupProject {
+		http.Error(w, fmt.Sprintf("Invalid level '%v'. Expected story, epic or project", level), http.StatusBadRequest)
+		return
+	}
+	filter := reportFilter(w, r)
+	if filter == nil {
+		return
+	}
+	filter.Start = orgDate
+
+	data := &rollupData{Cost: wantCost(r), Currency: state.db.Config.Currency}
+	var err error
+	if level == rollupProject {
+		q := &timedb.ReportQuery{Filter: *filter, GroupBy: []timedb.ReportGroup{timedb.GroupProject}, Cost: data.Cost}
+		if data.Projects, err = state.db.QueryReport(q); err != nil {
 			panic(err)
 		}
-		monString := time.Month(mon).String()
-		if year != month.Year || monString != month.Month {
-			data.Months = append(data.Months, month)
-			month.Year = year
-			month.Month = monString
-		}
-		duration := parseDuration(sum)
-		if ticket_type == "bug" {
-			month.BugSeconds = duration.Seconds()
-		} else if ticket_type == "feat" {
-			month.FeatureSeconds = duration.Seconds()
-		}
+		sort.SliceStable(data.Projects, func(i, j int) bool { return data.Projects[i].Seconds > data.Projects[j].Seconds })
+	} else if data.Tickets, err = state.db.QueryRollup(level, filter, data.Cost); err != nil {
+		panic(err)
 	}
-	data.Months = append(data.Months, month)
 
 	raw, err := json.Marshal(data)
 	if err != nil {
@@ -286,82 +666,1219 @@ ORDER BY EXTRACT(YEAR FROM t.start_time), EXTRACT(MONTH FROM t.start_time)`
 	w.Write(raw)
 }
 
-/*
-One could use the following SQL to extract a monthly report:
+type timesheetData struct {
+	People []timedb.TimesheetSummary
+}
 
-SELECT EXTRACT(MONTH FROM t.start_time), sum(t.end_time - t.start_time), k.ticket_type FROM times AS t INNER JOIN
-tickets AS k ON k.ticketid = t.ticketid
-WHERE t.userid = 1 AND t.start_time > '2016-01-01'
-GROUP BY EXTRACT(MONTH FROM t.start_time), k.ticket_type
-ORDER BY EXTRACT(MONTH FROM t.start_time)
+// Logged against expected hours per person and working day. Defaults to the last four weeks.
+func handleTimesheets(w http.ResponseWriter, r *http.Request) {
+	filter := reportFilter(w, r)
+	if filter == nil {
+		return
+	}
+	q := &timedb.TimesheetQuery{UserIDs: filter.UserIDs, TeamIDs: filter.TeamIDs}
+	now := time.Now()
+	q.End = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	q.Start = q.End.AddDate(0, 0, -28)
+	if from, err := parseOptionalDate(r.FormValue("from")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if from != nil {
+		q.Start = *from
+	}
+	if to, err := parseOptionalDate(r.FormValue("to")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if to != nil {
+		q.End = *to
+	}
 
-However, I'm doing this in Go code to maintain flexibility
-*/
-// YEAH -- the SQL script is OK.
-/*
-func handleUserReport(w http.ResponseWriter, r *http.Request) {
-	orgDate := time.Now().Add(-historyDays * 24 * time.Hour)
-	userid, _ := strconv.ParseInt(r.FormValue("userid"), 10, 64)
-	data := &reportData{}
-	data.Months = make([]reportDataMonth, 0)
-	rows, err := state.db.Conn.Query(`SELECT t.start_time, t.end_time, k.ticket_type FROM times AS t INNER JOIN
-tickets AS k ON k.ticketid = t.ticketid
-WHERE t.userid = $1 AND t.start_time > $2
-ORDER BY t.start_time
-`, userid, orgDate)
+	summaries, err := state.db.QueryTimesheets(q)
 	if err != nil {
 		panic(err)
 	}
-	defer rows.Close()
-	month := reportDataMonth{}
-	for rows.Next() {
-		var start_time, end_time time.Time
-		var ticket_type string
-		if err := rows.Scan(&start_time, &end_time, &ticket_type); err != nil {
-			panic(err)
+	// Timesheets are about individuals, so people that the session may not see are left out entirely
+	session := auth.FromRequest(r)
+	data := &timesheetData{People: []timedb.TimesheetSummary{}}
+	for _, s := range summaries {
+		if session.CanSeeUser(s.UserID) {
+			data.People = append(data.People, s)
 		}
-		if month.Month == "" || start_time.Month().String() != month.Month {
-			// new month
-			if month.Month != "" {
-				data.Months = append(data.Months, month)
+	}
+	sendJSON(w, data)
+}
+
+type velocityData struct {
+	Weeks int
+	Teams []timedb.TeamVelocity
+}
+
+// Velocity, throughput and hours per point of the 'team' request parameter, over the last 26 weeks,
+// in periods of 'weeks' weeks that end with the current week
+func handleVelocity(w http.ResponseWriter, r *http.Request) {
+	teamName := r.FormValue("team")
+	if teamName == "" {
+		http.Error(w, "Specify a team", http.StatusBadRequest)
+		return
+	}
+	data := &velocityData{Weeks: 1}
+	var err error
+	if v := r.FormValue("weeks"); v != "" {
+		if data.Weeks, err = strconv.Atoi(v); err != nil || data.Weeks < 1 || data.Weeks > velocityHistoryWeeks {
+			http.Error(w, "Invalid weeks", http.StatusBadRequest)
+			return
+		}
+	}
+	teamids, err := state.teamIDs(teamName)
+	if err != nil {
+		panic(err)
+	}
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	end := today.AddDate(0, 0, 7-(int(today.Weekday())+6)%7)
+	start := end.AddDate(0, 0, -7*data.Weeks*(velocityHistoryWeeks/data.Weeks))
+	if data.Teams, err = state.db.QueryVelocity(start, end, data.Weeks, teamids); err != nil {
+		panic(err)
+	}
+	sendJSON(w, data)
+}
+
+type cycleTimeData struct {
+	Stats []timedb.CycleTimeStats
+}
+
+// Monthly percentiles of the cycle times of the tickets that the 'team' request parameter worked on, over the
+// last year. For all teams, a ticket that several teams worked on is counted once.
+func handleCycleTime(w http.ResponseWriter, r *http.Request) {
+	teamName := r.FormValue("team")
+	if teamName == "" {
+		http.Error(w, "Specify a team", http.StatusBadRequest)
+		return
+	}
+	teamids, err := state.teamIDs(teamName)
+	if err != nil {
+		panic(err)
+	}
+	end := time.Now()
+	tickets, err := state.db.QueryCycleTimes(end.Add(-historyDays*24*time.Hour), end, teamids, nil)
+	if err != nil {
+		panic(err)
+	}
+	sendJSON(w, &cycleTimeData{Stats: timedb.CycleTimeDistribution(tickets, timedb.BucketMonth, false)})
+}
+
+type focusData struct {
+	Weeks []timedb.TeamFocusWeek
+}
+
+// Context switching of the 'team' request parameter per week, over the last 26 weeks
+func handleFocus(w http.ResponseWriter, r *http.Request) {
+	teamName := r.FormValue("team")
+	if teamName == "" {
+		http.Error(w, "Specify a team", http.StatusBadRequest)
+		return
+	}
+	filter := &timedb.TimeFilter{}
+	var err error
+	if filter.TeamIDs, err = state.teamIDs(teamName); err != nil {
+		panic(err)
+	}
+	if system := r.FormValue("system"); system != "" {
+		filter.Systems = []string{system}
+	}
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	filter.Start = today.AddDate(0, 0, -(int(today.Weekday())+6)%7-7*(focusHistoryWeeks-1))
+	all, err := state.db.Teams()
+	if err != nil {
+		panic(err)
+	}
+	teams := []timedb.Team{}
+	for _, t := range all {
+		for _, id := range filter.TeamIDs {
+			if id == t.TeamID {
+				teams = append(teams, t)
 			}
-			month = reportDataMonth{}
-			month.Month = start_time.Month().String()
 		}
-		month.addTicket(ticket_type, end_time.Sub(start_time))
 	}
-	if month.Month != "" {
-		data.Months = append(data.Months, month)
+	days, err := state.db.QueryFocusDays(filter)
+	if err != nil {
+		panic(err)
 	}
-	raw, err := json.Marshal(data)
+	sendJSON(w, &focusData{Weeks: timedb.TeamFocusWeeks(days, teams)})
+}
+
+// Forecast of the unplanned work of the 'team' request parameter over the 13 weeks from next Monday,
+// and the capacity that it leaves. All teams are forecast together.
+func handleForecast(w http.ResponseWriter, r *http.Request) {
+	teamName := r.FormValue("team")
+	if teamName == "" {
+		http.Error(w, "Specify a team", http.StatusBadRequest)
+		return
+	}
+	q := &forecast.Query{Team: teamName}
+	var err error
+	if q.TeamIDs, err = state.teamIDs(teamName); err != nil {
+		panic(err)
+	}
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	q.Start = today.AddDate(0, 0, 7-(int(today.Weekday())+6)%7)
+	f, err := forecast.Compute(state.db, q)
+	if err != nil {
+		panic(err)
+	}
+	sendJSON(w, f)
+}
+
+func sendJSON(w http.ResponseWriter, v interface{}) {
+	raw, err := json.Marshal(v)
 	if err != nil {
 		panic(err)
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(raw)
 }
-*/
 
-func main() {
-	state.db = &timedb.TimeDB{}
-	if err := state.config.Load(); err != nil {
-		panic(fmt.Sprintf("Unable to load server config: %v", err))
+// Decode a JSON request body into v. Returns false, after sending an error response, if that fails.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return false
 	}
-	if err := state.db.LoadConfig(); err != nil {
-		panic(fmt.Sprintf("Unable to load db config: %v", err))
+	return true
+}
+
+// Parse an optional date (2006-01-02). An empty string is nil.
+func parseOptionalDate(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
 	}
-	if err := state.db.Connect(); err != nil {
-		panic(fmt.Sprintf("Unable to connect to db: %v", err))
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid date '%v'. Expected format 2006-01-02", s)
+	}
+	return &t, nil
+}
+
+type adminTeamRequest struct {
+	Name string
+}
+
+type adminMemberRequest struct {
+	TeamID        int64
+	Email         string
+	EffectiveFrom string // 2006-01-02, or empty
+	EffectiveTo   string // 2006-01-02, or empty
+}
+
+type adminIDResponse struct {
+	ID int64
+}
+
+type loginData struct {
+	Email    string
+	Error    string
+	OIDCName string
+}
+
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	data := &loginData{OIDCName: state.auth.OIDCName()}
+	if r.Method == "POST" {
+		data.Email = r.FormValue("email")
+		ok, err := state.auth.Login(w, data.Email, r.FormValue("password"))
+		if err != nil {
+			panic(err)
+		}
+		if ok {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		state.db.Log.Warnf("Failed sign in for %v from %v", data.Email, r.RemoteAddr)
+		data.Error = "Incorrect email or password"
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	loginTemplate.Execute(w, data)
+}
+
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := state.auth.Logout(w, r); err != nil {
+		panic(err)
+	}
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
+
+type adminPageData struct {
+	Roles       []string
+	CanSeeCosts bool
+}
+
+func handleAdminPage(w http.ResponseWriter, r *http.Request) {
+	adminTemplate.Execute(w, &adminPageData{Roles: auth.Roles, CanSeeCosts: auth.FromRequest(r).CanSeeCosts()})
+}
+
+// Rates, billing and capitalisation are only for roles that may see costs
+func requireCosts(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !auth.FromRequest(r).CanSeeCosts() {
+			http.Error(w, "You may not see costs", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+type adminAccountRequest struct {
+	Email       string
+	Role        string
+	Password    string // Empty to leave the password unchanged, or to create an OIDC-only account
+	LeadTeamIDs []int64
+}
+
+// GET lists all accounts. POST creates an account.
+func handleAdminAccounts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		accounts, err := state.db.Accounts()
+		if err != nil {
+			panic(err)
+		}
+		sendJSON(w, accounts)
+	case "POST":
+		req := adminAccountRequest{}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if !auth.ValidRole(req.Role) {
+			http.Error(w, "Invalid role '"+req.Role+"'", http.StatusBadRequest)
+			return
+		}
+		hash := ""
+		if req.Password != "" {
+			var err error
+			if hash, err = auth.HashPassword(req.Password); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		accountid, err := state.db.CreateAccount(req.Email, req.Role, hash)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sendJSON(w, &adminIDResponse{ID: accountid})
+	default:
+		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+// PUT changes the role, lead teams, and optionally the password of the account identified by 'accountid'. DELETE deletes it.
+func handleAdminAccount(w http.ResponseWriter, r *http.Request) {
+	accountid, _ := strconv.ParseInt(r.FormValue("accountid"), 10, 64)
+	var err error
+	switch r.Method {
+	case "PUT":
+		req := adminAccountRequest{}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if !auth.ValidRole(req.Role) {
+			http.Error(w, "Invalid role '"+req.Role+"'", http.StatusBadRequest)
+			return
+		}
+		if req.Password != "" {
+			hash := ""
+			if hash, err = auth.HashPassword(req.Password); err == nil {
+				err = state.db.SetAccountPassword(accountid, hash)
+			}
+		}
+		if err == nil {
+			err = state.db.UpdateAccount(accountid, req.Role, req.LeadTeamIDs)
+		}
+	case "DELETE":
+		if accountid == auth.FromRequest(r).Account.AccountID {
+			http.Error(w, "You cannot delete your own account", http.StatusBadRequest)
+			return
+		}
+		err = state.db.DeleteAccount(accountid)
+	default:
+		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+type adminRatesData struct {
+	Rates    []timedb.Rate
+	JobRoles []timedb.JobRole
+	Currency string
+}
+
+// Either Email or Role identifies whose rate it is
+type adminRateRequest struct {
+	Email         string
+	Role          string
+	EffectiveFrom string
+	HourlyRate    float64
+}
+
+type adminJobRoleRequest struct {
+	Email         string
+	Role          string
+	EffectiveFrom string
+}
+
+// Returns the userid of an email address, or 0 after sending an error response
+func adminUserID(w http.ResponseWriter, email string) int64 {
+	userid, err := state.db.UserIDFromEmail(email)
+	if err != nil {
+		panic(err)
+	}
+	if userid == 0 {
+		http.Error(w, "Unknown user "+email, http.StatusBadRequest)
+	}
+	return userid
+}
+
+// Parse a required date, or return nil after sending an error response
+func adminDate(w http.ResponseWriter, s string) *time.Time {
+	t, err := parseOptionalDate(s)
+	if err == nil && t == nil {
+		err = fmt.Errorf("A date is required")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	return t
+}
+
+// GET lists the rate cards and job roles. POST sets a rate.
+func handleAdminRates(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		data := &adminRatesData{Currency: state.db.Config.Currency}
+		var err error
+		if data.Rates, err = state.db.Rates(); err != nil {
+			panic(err)
+		}
+		if data.JobRoles, err = state.db.JobRoles(); err != nil {
+			panic(err)
+		}
+		sendJSON(w, data)
+	case "POST":
+		req := adminRateRequest{}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		from := adminDate(w, req.EffectiveFrom)
+		if from == nil {
+			return
+		}
+		userid := int64(0)
+		if req.Email != "" {
+			if userid = adminUserID(w, req.Email); userid == 0 {
+				return
+			}
+		}
+		rateid, err := state.db.SetRate(userid, req.Role, *from, req.HourlyRate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sendJSON(w, &adminIDResponse{ID: rateid})
+	default:
+		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+// DELETE deletes the rate identified by 'rateid'
+func handleAdminRate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	rateid, _ := strconv.ParseInt(r.FormValue("rateid"), 10, 64)
+	if err := state.db.DeleteRate(rateid); err != nil {
+		panic(err)
+	}
+	w.Write([]byte("OK"))
+}
+
+// POST sets the job role of a user. DELETE deletes the job role identified by 'jobroleid'.
+func handleAdminJobRoles(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		req := adminJobRoleRequest{}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		from := adminDate(w, req.EffectiveFrom)
+		if from == nil {
+			return
+		}
+		userid := adminUserID(w, req.Email)
+		if userid == 0 {
+			return
+		}
+		jobroleid, err := state.db.SetJobRole(userid, req.Role, *from)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sendJSON(w, &adminIDResponse{ID: jobroleid})
+	case "DELETE":
+		jobroleid, _ := strconv.ParseInt(r.FormValue("jobroleid"), 10, 64)
+		if err := state.db.DeleteJobRole(jobroleid); err != nil {
+			panic(err)
+		}
+		w.Write([]byte("OK"))
+	default:
+		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+type adminBillingData struct {
+	Contracts []timedb.Contract
+	Invoices  []timedb.Invoice
+}
+
+// The period of a statement or invoice, as inclusive dates
+type adminInvoiceRequest struct {
+	ContractID int64
+	From       string
+	To         string
+	Number     string // Optional
+}
+
+// Parse an inclusive period, such as a billing period, and return its exclusive end, or send an error response and return false
+func inclusivePeriod(w http.ResponseWriter, from, to string) (time.Time, time.Time, bool) {
+	start, err := time.ParseInLocation("2006-01-02", from, time.Local)
+	if err != nil {
+		http.Error(w, "Invalid 'from' date: "+err.Error(), http.StatusBadRequest)
+		return start, start, false
+	}
+	end, err := time.ParseInLocation("2006-01-02", to, time.Local)
+	if err != nil {
+		http.Error(w, "Invalid 'to' date: "+err.Error(), http.StatusBadRequest)
+		return start, end, false
+	}
+	return start, end.AddDate(0, 0, 1), true
+}
+
+// GET lists the contracts, with their scopes, and the invoices
+func handleAdminBilling(w http.ResponseWriter, r *http.Request) {
+	data := &adminBillingData{}
+	var err error
+	if data.Contracts, err = state.db.Contracts(); err != nil {
+		panic(err)
+	}
+	if data.Invoices, err = state.db.Invoices(); err != nil {
+		panic(err)
+	}
+	sendJSON(w, data)
+}
+
+// GET returns the statement of 'contractid' for the period 'from' to 'to'
+func handleAdminStatement(w http.ResponseWriter, r *http.Request) {
+	contractid, _ := strconv.ParseInt(r.FormValue("contractid"), 10, 64)
+	start, end, ok := inclusivePeriod(w, r.FormValue("from"), r.FormValue("to"))
+	if !ok {
+		return
+	}
+	statement, err := billing.Compute(state.db, contractid, start, end)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sendJSON(w, statement)
+}
+
+// POST issues an invoice, which locks its period. DELETE voids the invoice identified by 'invoiceid'.
+// GET downloads the invoice identified by 'invoiceid', in 'format' csv or pdf.
+func handleAdminInvoice(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		format := r.FormValue("format")
+		if billing.ContentType(format) == "" {
+			http.Error(w, "Unknown invoice format '"+format+"'", http.StatusBadRequest)
+			return
+		}
+		invoiceid, _ := strconv.ParseInt(r.FormValue("invoiceid"), 10, 64)
+		inv, err := state.db.Invoice(invoiceid)
+		if err != nil {
+			panic(err)
+		}
+		if inv == nil {
+			http.Error(w, "Unknown invoice", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", billing.ContentType(format))
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"invoice-%v.%v\"", strings.Replace(inv.Number, "\"", "", -1), format))
+		if err := billing.WriteInvoice(format, w, inv); err != nil {
+			state.db.Log.Errorf("Error writing invoice %v: %v", inv.Number, err)
+		}
+	case "POST":
+		req := adminInvoiceRequest{}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		start, end, ok := inclusivePeriod(w, req.From, req.To)
+		if !ok {
+			return
+		}
+		inv, err := billing.Issue(state.db, req.ContractID, start, end, req.Number, auth.FromRequest(r).Account.Email)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sendJSON(w, &adminIDResponse{ID: inv.InvoiceID})
+	case "DELETE":
+		invoiceid, _ := strconv.ParseInt(r.FormValue("invoiceid"), 10, 64)
+		if err := state.db.VoidInvoice(invoiceid); err != nil {
+			panic(err)
+		}
+		w.Write([]byte("OK"))
+	default:
+		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+type capitalisationPageData struct {
+	Teams []timedb.Team
+}
+
+func handleCapitalisationPage(w http.ResponseWriter, r *http.Request) {
+	teams, err := state.db.Teams()
+	if err != nil {
+		panic(err)
+	}
+	capitalisationTemplate.Execute(w, &capitalisationPageData{Teams: teams})
+}
+
+type capitalisationData struct {
+	Rows     []timedb.CapitalisationRow
+	SignOff  *timedb.CapitalisationSignOff // The sign-off of exactly this period, if any
+	Currency string
+}
+
+// Keep only the rows of a team, or all rows if teamid is 0
+func capitalisationTeam(rows []timedb.CapitalisationRow, teamid int64) []timedb.CapitalisationRow {
+	if teamid == 0 {
+		return rows
+	}
+	result := []timedb.CapitalisationRow{}
+	for _, row := range rows {
+		if row.TeamID == teamid {
+			result = append(result, row)
+		}
+	}
+	return result
+}
+
+// GET returns the capitalisation report of the period 'from' to 'to', of 'teamid', or of all teams.
+// With format=csv, the report is downloaded, as it was signed off, if the period has been signed off.
+func handleCapitalisationReport(w http.ResponseWriter, r *http.Request) {
+	start, end, ok := inclusivePeriod(w, r.FormValue("from"), r.FormValue("to"))
+	if !ok {
+		return
+	}
+	teamid, _ := strconv.ParseInt(r.FormValue("teamid"), 10, 64)
+	var teamids []int64
+	if teamid != 0 {
+		teamids = []int64{teamid}
+	}
+	data := &capitalisationData{Currency: state.db.Config.Currency}
+	var err error
+	if data.Rows, err = state.db.QueryCapitalisation(start, end, teamids, true); err != nil {
+		panic(err)
+	}
+	if data.SignOff, err = state.db.CapitalisationSignOff(start, end); err != nil {
+		panic(err)
+	}
+	if data.SignOff != nil {
+		data.SignOff.Rows = capitalisationTeam(data.SignOff.Rows, teamid)
+	}
+	if r.FormValue("format") != "csv" {
+		sendJSON(w, data)
+		return
+	}
+
+	rows, status := data.Rows, "Draft"
+	if data.SignOff != nil {
+		rows = data.SignOff.Rows
+		status = fmt.Sprintf("Signed off by %v on %v", data.SignOff.SignedBy, data.SignOff.SignedAt.Format("2006-01-02"))
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=capitalisation-%v.csv", start.Format("2006-01-02")))
+	c := csv.NewWriter(w)
+	c.Write([]string{"PeriodStart", "PeriodEnd", "Team", "Project", "CapExHours", "OpExHours", "CapExCost", "OpExCost", "UncostedHours", "Currency", "Status"})
+	hours := func(seconds float64) string { return strconv.FormatFloat(seconds/3600, 'f', 2, 64) }
+	money := func(amount float64) string { return strconv.FormatFloat(amount, 'f', 2, 64) }
+	for _, row := range rows {
+		c.Write([]string{start.Format("2006-01-02"), end.AddDate(0, 0, -1).Format("2006-01-02"), row.Team, row.Project,
+			hours(row.CapExSeconds), hours(row.OpExSeconds), money(row.CapExCost), money(row.OpExCost), hours(row.UncostedSeconds), data.Currency, status})
+	}
+	c.Flush()
+}
+
+type capitalisationRulesData struct {
+	Rules    []timedb.CapitalisationRule
+	Changes  []timedb.CapitalisationChange
+	SignOffs []timedb.CapitalisationSignOff
+}
+
+type capitalisationRuleRequest struct {
+	Kind   string
+	Value  string
+	Class  string // Empty to remove the rule
+	Reason string
+}
+
+// GET lists the rules, the changes to them, and the sign-offs. POST sets a rule.
+func handleCapitalisationRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		data := &capitalisationRulesData{}
+		var err error
+		if data.Rules, err = state.db.CapitalisationRules(); err != nil {
+			panic(err)
+		}
+		if data.Changes, err = state.db.CapitalisationChanges(0); err != nil {
+			panic(err)
+		}
+		if data.SignOffs, err = state.db.CapitalisationSignOffs(); err != nil {
+			panic(err)
+		}
+		sendJSON(w, data)
+	case "POST":
+		req := capitalisationRuleRequest{}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if strings.TrimSpace(req.Reason) == "" {
+			http.Error(w, "Give a reason for the change", http.StatusBadRequest)
+			return
+		}
+		if err := state.db.SetCapitalisationRule(req.Kind, req.Value, req.Class, auth.FromRequest(r).Account.Email, req.Reason); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("OK"))
+	default:
+		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+type capitalisationSignOffRequest struct {
+	From string
+	To   string
+	Note string
+}
+
+// POST signs off the capitalisation report of a period
+func handleCapitalisationSignOff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	req := capitalisationSignOffRequest{}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	start, end, ok := inclusivePeriod(w, req.From, req.To)
+	if !ok {
+		return
+	}
+	signoffid, err := state.db.SignOffCapitalisation(start, end, auth.FromRequest(r).Account.Email, req.Note)
+	if err != nil {
+		panic(err)
+	}
+	if signoffid == 0 {
+		http.Error(w, "This period has already been signed off", http.StatusConflict)
+		return
+	}
+	sendJSON(w, &adminIDResponse{ID: signoffid})
+}
+
+// GET lists all teams and their members. POST creates a team.
+func handleAdminTeams(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		teams, err := state.db.Teams()
+		if err != nil {
+			panic(err)
+		}
+		sendJSON(w, teams)
+	case "POST":
+		req := adminTeamRequest{}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		teamid, err := state.db.CreateTeam(req.Name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sendJSON(w, &adminIDResponse{ID: teamid})
+	default:
+		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+// PUT renames the team identified by 'teamid'. DELETE deletes it.
+func handleAdminTeam(w http.ResponseWriter, r *http.Request) {
+	teamid, _ := strconv.ParseInt(r.FormValue("teamid"), 10, 64)
+	var err error
+	switch r.Method {
+	case "PUT":
+		req := adminTeamRequest{}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		err = state.db.RenameTeam(teamid, req.Name)
+	case "DELETE":
+		err = state.db.DeleteTeam(teamid)
+	default:
+		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+// POST adds a member to a team. PUT changes the dates of the membership identified by 'memberid'. DELETE removes it.
+func handleAdminMembers(w http.ResponseWriter, r *http.Request) {
+	memberid, _ := strconv.ParseInt(r.FormValue("memberid"), 10, 64)
+	req := adminMemberRequest{}
+	if r.Method == "POST" || r.Method == "PUT" {
+		if !readJSON(w, r, &req) {
+			return
+		}
+	}
+	from, err := parseOptionalDate(req.EffectiveFrom)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseOptionalDate(req.EffectiveTo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case "POST":
+		if memberid, err = state.db.AddTeamMember(req.TeamID, req.Email, from, to); err == nil {
+			sendJSON(w, &adminIDResponse{ID: memberid})
+			return
+		}
+	case "PUT":
+		err = state.db.UpdateTeamMember(memberid, from, to)
+	case "DELETE":
+		err = state.db.RemoveTeamMember(memberid)
+	default:
+		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+type adminMergeRequest struct {
+	From int64
+	Into int64
+}
+
+// GET lists pairs of users that are probably the same person
+func handleAdminDuplicates(w http.ResponseWriter, r *http.Request) {
+	pairs, err := state.db.LikelyDuplicateUsers()
+	if err != nil {
+		panic(err)
+	}
+	sendJSON(w, pairs)
+}
+
+// POST merges one user into another
+func handleAdminMerge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	req := adminMergeRequest{}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if err := state.db.MergeUsers(req.From, req.Into); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+// Split a list parameter, which may be repeated (type=bug&type=feat), or comma separated (type=bug,feat)
+func formList(r *http.Request, name string) []string {
+	list := []string{}
+	r.ParseForm()
+	for _, v := range r.Form[name] {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+// Export raw time entries, joined to tickets and users.
+// Parameters: format (csv, jsonl, xlsx), userid or team, from and to (inclusive, 2006-01-02), type, system
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	format := r.FormValue("format")
+	if format == "" {
+		format = export.FormatCSV
+	}
+	// Exported rows are per person, so a team export needs permission to see the team's individuals
+	session := auth.FromRequest(r)
+	filter := &timedb.TimeFilter{}
+	if r.FormValue("userid") != "" || r.FormValue("team") != "" {
+		if filter = reportFilter(w, r); filter == nil {
+			return
+		}
+	}
+	allowed := false
+	switch {
+	case filter.UserIDs != nil:
+		allowed = true // Already checked by reportFilter
+	case filter.TeamIDs != nil:
+		allowed = session.CanSeeTeamIndividuals(filter.TeamIDs)
+	default:
+		allowed = session.IsAdmin()
+	}
+	if !allowed {
+		http.Error(w, "You may not export the data of these people", http.StatusForbidden)
+		return
+	}
+	filter.TicketTypes = formList(r, "type")
+	filter.Systems = formList(r, "system")
+	var err error
+	if from := r.FormValue("from"); from != "" {
+		if filter.Start, err = time.ParseInLocation("2006-01-02", from, time.Local); err != nil {
+			http.Error(w, "Invalid 'from' date: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if to := r.FormValue("to"); to != "" {
+		if filter.End, err = time.ParseInLocation("2006-01-02", to, time.Local); err != nil {
+			http.Error(w, "Invalid 'to' date: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter.End = filter.End.AddDate(0, 0, 1)
+	}
+
+	if export.ContentType(format) == "" {
+		http.Error(w, "Unknown export format '"+format+"'", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", export.ContentType(format))
+	w.Header().Set("Content-Disposition", "attachment; filename=times."+format)
+	writer, err := export.NewWriter(format, w)
+	if err != nil {
+		state.db.Log.Errorf("Error exporting times: %v", err)
+		return
+	}
+	// Once we've started writing, we can no longer report an error via the HTTP status
+	if err := state.db.ExportTimes(filter, writer.WriteRow); err != nil {
+		state.db.Log.Errorf("Error exporting times: %v", err)
+		return
+	}
+	if err := writer.Close(); err != nil {
+		state.db.Log.Errorf("Error exporting times: %v", err)
+	}
+}
+
+// A webhook must either be signed with the shared secret (X-Hub-Signature: sha256=<hex hmac of body>),
+// or include the shared secret in the URL (/webhook/jira?secret=<secret>).
+func verifyWebhookSecret(r *http.Request, body []byte) bool {
+	secret := state.config.WebhookSecret
+	if secret == "" {
+		return false
+	}
+	if sig := r.Header.Get("X-Hub-Signature"); sig != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		expect := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		return hmac.Equal([]byte(sig), []byte(expect))
+	}
+	return subtle.ConstantTimeCompare([]byte(r.FormValue("secret")), []byte(secret)) == 1
+}
+
+// JIRA identifies each webhook delivery, and uses the same identifier when it retries.
+// If that header is missing, then we use a hash of the body instead.
+func webhookEventID(r *http.Request, body []byte) string {
+	if id := r.Header.Get("X-Atlassian-Webhook-Identifier"); id != "" {
+		return "jira:" + id
+	}
+	hash := sha256.Sum256(body)
+	return "jira-sha256:" + hex.EncodeToString(hash[:])
+}
+
+// Apply real-time updates from JIRA. Failures return a 5xx status, so that JIRA will retry.
+func handleJiraWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Webhooks must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxWebhookBytes))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !verifyWebhookSecret(r, body) {
+		http.Error(w, "Invalid webhook secret", http.StatusUnauthorized)
+		return
+	}
+
+	eventID := webhookEventID(r, body)
+	seen, err := state.db.HasWebhookEvent(eventID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if seen {
+		w.Write([]byte("Already applied"))
+		return
+	}
+
+	ev, err := jira.ParseWebhook(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reason, err := ev.IgnoreReason(state.db, &state.jira)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if reason != "" {
+		state.db.Log.Infof("Ignoring JIRA webhook %v: %v", ev.WebhookEvent, reason)
+		if err := state.db.RecordWebhookEvent(eventID, ev.WebhookEvent); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("Ignored"))
+		return
+	}
+	if err := ev.Apply(state.db, &state.jira); err != nil {
+		state.db.Log.Errorf("Error applying JIRA webhook %v: %v", ev.WebhookEvent, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := state.db.RecordWebhookEvent(eventID, ev.WebhookEvent); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+// Logged hours per person, and commits, of a single ticket, identified by 'ticketid' or 'key'
+func handleTicketActivity(w http.ResponseWriter, r *http.Request) {
+	ticketid, _ := strconv.ParseInt(r.FormValue("ticketid"), 10, 64)
+	if key := r.FormValue("key"); key != "" {
+		var err error
+		if ticketid, err = state.db.TicketIDFromKey(key); err != nil {
+			panic(err)
+		}
+	}
+	if ticketid == 0 {
+		http.Error(w, "Ticket not found", http.StatusNotFound)
+		return
+	}
+	activity, err := state.db.QueryTicketActivity(ticketid)
+	if err != nil {
+		panic(err)
+	}
+	auth.FromRequest(r).FilterTicketActivity(activity)
+	raw, err := json.Marshal(activity)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(raw)
+}
+
+type syncRunData struct {
+	Runs []timedb.SyncRun
+}
+
+type alertData struct {
+	Alerts []timedb.Alert
+}
+
+// Alert history, newest first
+func handleAlerts(w http.ResponseWriter, r *http.Request) {
+	data := &alertData{}
+	var err error
+	if data.Alerts, err = state.db.RecentAlerts(100); err != nil {
+		panic(err)
+	}
+	sendJSON(w, data)
+}
+
+func handleSyncRuns(w http.ResponseWriter, r *http.Request) {
+	data := &syncRunData{}
+	var err error
+	if data.Runs, err = state.db.RecentSyncRuns(100); err != nil {
+		panic(err)
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(raw)
+}
+
+/*
+One could use the following SQL to extract a monthly report:
+
+SELECT EXTRACT(MONTH FROM t.start_time), sum(t.end_time - t.start_time), k.ticket_type FROM times AS t INNER JOIN
+tickets AS k ON k.ticketid = t.ticketid
+WHERE t.userid = 1 AND t.start_time > '2016-01-01'
+GROUP BY EXTRACT(MONTH FROM t.start_time), k.ticket_type
+ORDER BY EXTRACT(MONTH FROM t.start_time)
+
+However, I'm doing this in Go code to maintain flexibility
+*/
+// YEAH -- the SQL script is OK.
+/*
+func handleUserReport(w http.ResponseWriter, r *http.Request) {
+	orgDate := time.Now().Add(-historyDays * 24 * time.Hour)
+	userid, _ := strconv.ParseInt(r.FormValue("userid"), 10, 64)
+	data := &reportData{}
+	data.Months = make([]reportDataMonth, 0)
+	rows, err := state.db.Conn.Query(`SELECT t.start_time, t.end_time, k.ticket_type FROM times AS t INNER JOIN
+tickets AS k ON k.ticketid = t.ticketid
+WHERE t.userid = $1 AND t.start_time > $2
+ORDER BY t.start_time
+`, userid, orgDate)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	month := reportDataMonth{}
+	for rows.Next() {
+		var start_time, end_time time.Time
+		var ticket_type string
+		if err := rows.Scan(&start_time, &end_time, &ticket_type); err != nil {
+			panic(err)
+		}
+		if month.Month == "" || start_time.Month().String() != month.Month {
+			// new month
+			if month.Month != "" {
+				data.Months = append(data.Months, month)
+			}
+			month = reportDataMonth{}
+			month.Month = start_time.Month().String()
+		}
+		month.addTicket(ticket_type, end_time.Sub(start_time))
+	}
+	if month.Month != "" {
+		data.Months = append(data.Months, month)
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(raw)
+}
+*/
+
+func main() {
+	state.db = &timedb.TimeDB{}
+	state.db.Log = log.New("server.log")
+	state.auth = &auth.Auth{DB: state.db}
+	if err := state.config.Load(); err != nil {
+		panic(fmt.Sprintf("Unable to load server config: %v", err))
+	}
+	if err := state.db.LoadConfig(); err != nil {
+		panic(fmt.Sprintf("Unable to load db config: %v", err))
+	}
+	if err := state.jira.LoadFile("config/jira.json"); err != nil && !os.IsNotExist(err) {
+		panic(fmt.Sprintf("Unable to load JIRA config: %v", err))
+	}
+	if state.config.JiraURL == "" {
+		state.config.JiraURL = state.jira.URL
+	}
+	if err := state.auth.LoadConfig(); err != nil {
+		panic(fmt.Sprintf("Unable to load auth config: %v", err))
+	}
+	if err := state.db.Connect(); err != nil {
+		panic(fmt.Sprintf("Unable to connect to db: %v", err))
+	}
+	if err := state.importConfigTeams(); err != nil {
+		panic(fmt.Sprintf("Unable to import teams: %v", err))
 	}
-	if err := state.buildUserEmailToID(); err != nil {
-		panic(fmt.Sprintf("Unable to read user list: %v", err))
+	digests := &digest.Sender{DB: state.db}
+	if enabled, err := digests.LoadConfig(); err != nil {
+		panic(fmt.Sprintf("Unable to load digest config: %v", err))
+	} else if enabled {
+		go digests.Run()
 	}
 
 	http.Handle("/js/", http.StripPrefix("/js/", http.FileServer(http.Dir("www/js"))))
 	http.Handle("/css/", http.StripPrefix("/css/", http.FileServer(http.Dir("www/css"))))
-	http.HandleFunc("/user", handleMonthlyReport)
-	http.HandleFunc("/monthly", handleMonthlyReport)
-	http.HandleFunc("/", handleRoot)
+	http.HandleFunc("/login", handleLogin)
+	http.HandleFunc("/logout", handleLogout)
+	http.HandleFunc("/auth/oidc/login", state.auth.HandleOIDCLogin)
+	http.HandleFunc("/auth/oidc/callback", state.auth.HandleOIDCCallback)
+	http.HandleFunc("/webhook/jira", handleJiraWebhook)
+	http.Handle(api.Prefix+"/", &api.Server{DB: state.db, Auth: state.auth})
+	http.HandleFunc("/user", state.auth.RequireSession(handleMonthlyReport))
+	http.HandleFunc("/monthly", state.auth.RequireSession(handleMonthlyReport))
+	http.HandleFunc("/rollup", state.auth.RequireSession(handleRollupReport))
+	http.HandleFunc("/drilldown", state.auth.RequireSession(handleDrillDown))
+	http.HandleFunc("/timesheets", state.auth.RequireSession(handleTimesheets))
+	http.HandleFunc("/velocity", state.auth.RequireSession(handleVelocity))
+	http.HandleFunc("/cycletime", state.auth.RequireSession(handleCycleTime))
+	http.HandleFunc("/focus", state.auth.RequireSession(handleFocus))
+	http.HandleFunc("/forecast", state.auth.RequireSession(handleForecast))
+	http.HandleFunc("/ticket", state.auth.RequireSession(handleTicketActivity))
+	http.HandleFunc("/export", state.auth.RequireSession(handleExport))
+	http.HandleFunc("/syncruns", state.auth.RequireSession(handleSyncRuns))
+	http.HandleFunc("/alerts", state.auth.RequireSession(handleAlerts))
+	http.HandleFunc("/admin", state.auth.RequireAdmin(handleAdminPage))
+	http.HandleFunc("/admin/teams", state.auth.RequireAdmin(handleAdminTeams))
+	http.HandleFunc("/admin/team", state.auth.RequireAdmin(handleAdminTeam))
+	http.HandleFunc("/admin/members", state.auth.RequireAdmin(handleAdminMembers))
+	http.HandleFunc("/admin/duplicates", state.auth.RequireAdmin(handleAdminDuplicates))
+	http.HandleFunc("/admin/merge", state.auth.RequireAdmin(handleAdminMerge))
+	http.HandleFunc("/admin/accounts", state.auth.RequireAdmin(handleAdminAccounts))
+	http.HandleFunc("/admin/account", state.auth.RequireAdmin(handleAdminAccount))
+	http.HandleFunc("/admin/rates", state.auth.RequireAdmin(requireCosts(handleAdminRates)))
+	http.HandleFunc("/admin/rate", state.auth.RequireAdmin(requireCosts(handleAdminRate)))
+	http.HandleFunc("/admin/jobroles", state.auth.RequireAdmin(requireCosts(handleAdminJobRoles)))
+	http.HandleFunc("/admin/billing", state.auth.RequireAdmin(requireCosts(handleAdminBilling)))
+	http.HandleFunc("/admin/statement", state.auth.RequireAdmin(requireCosts(handleAdminStatement)))
+	http.HandleFunc("/admin/invoice", state.auth.RequireAdmin(requireCosts(handleAdminInvoice)))
+	http.HandleFunc("/capitalisation", state.auth.RequireSession(requireCosts(handleCapitalisationPage)))
+	http.HandleFunc("/capitalisation/report", state.auth.RequireSession(requireCosts(handleCapitalisationReport)))
+	http.HandleFunc("/capitalisation/rules", state.auth.RequireSession(requireCosts(handleCapitalisationRules)))
+	http.HandleFunc("/capitalisation/signoff", state.auth.RequireSession(requireCosts(handleCapitalisationSignOff)))
+	http.HandleFunc("/", state.auth.RequireSession(handleRoot))
 	if err := http.ListenAndServe(fmt.Sprintf(":%v", listenPort), nil); err != nil {
 		fmt.Printf("Error listening on %v: %v\n", listenPort, err)
 	}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"github.com/IMQS/log"
+	"ical"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"timedb"
+)
+
+/*
+Timesheet completeness. Compares the hours that people logged per working day against the hours
+that they were expected to log, and lists the gaps, and the days that are under or over logged.
+
+go run src/cmd/timesheets.go -team Platform
+go run src/cmd/timesheets.go -user ben.harper@imqs.co.za -from 2024-03-01 -to 2024-04-01 -all
+
+Public holidays and leave are imported with:
+
+go run src/cmd/timesheets.go -holidays holidays-2024.ics
+go run src/cmd/timesheets.go -holidays holidays-2024.csv
+go run src/cmd/timesheets.go -leave leave.csv
+
+A holidays CSV file has the columns Date,Name. A leave CSV file has the columns Email,From,To,Kind,Hours,
+where To is the last day of leave, and Hours is the time off per day, or empty for full days.
+Dates are 2006-01-02. Importing the same row again updates it, instead of adding it twice.
+The expected hours per day, and the working days, are configured under Timesheets in timedb.json.
+*/
+
+// Read the rows of a CSV file with a header, as maps of column name to value
+func readTimesheetCSV(filename string) ([]map[string]string, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	reader := csv.NewReader(bytes.NewReader(raw))
+	reader.FieldsPerRecord = -1
+	header := []string{}
+	rows := []map[string]string{}
+	for {
+		rec, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", filename, err)
+		}
+		if len(header) == 0 {
+			header = rec
+			continue
+		}
+		row := map[string]string{}
+		for i, name := range header {
+			if i < len(rec) {
+				row[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(rec[i])
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func readHolidays(filename string) ([]timedb.Holiday, error) {
+	holidays := []timedb.Holiday{}
+	if strings.ToLower(filepath.Ext(filename)) == ".ics" {
+		raw, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		// Calendars usually cover a year or two, so this window is generous
+		now := time.Now()
+		days, err := ical.AllDayEvents(string(raw), now.AddDate(-5, 0, 0), now.AddDate(5, 0, 0))
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing %v: %v", filename, err)
+		}
+		for _, d := range days {
+			holidays = append(holidays, timedb.Holiday{Day: d.Day, Name: d.Summary})
+		}
+		return holidays, nil
+	}
+
+	rows, err := readTimesheetCSV(filename)
+	if err != nil {
+		return nil, err
+	}
+	for i, row := range rows {
+		day, err := time.Parse("2006-01-02", row["date"])
+		if err != nil {
+			return nil, fmt.Errorf("%v row %v: Invalid date '%v'", filename, i+1, row["date"])
+		}
+		holidays = append(holidays, timedb.Holiday{Day: day, Name: row["name"]})
+	}
+	return holidays, nil
+}
+
+func readLeave(filename string) ([]timedb.LeaveFormat1, error) {
+	rows, err := readTimesheetCSV(filename)
+	if err != nil {
+		return nil, err
+	}
+	leave := []timedb.LeaveFormat1{}
+	for i, row := range rows {
+		l := timedb.LeaveFormat1{
+			System: timedb.SystemTypeImport,
+			Email:  row["email"],
+			Kind:   row["kind"],
+		}
+		if l.Email == "" {
+			return nil, fmt.Errorf("%v row %v: Email is empty", filename, i+1)
+		}
+		if l.Start, err = time.Parse("2006-01-02", row["from"]); err != nil {
+			return nil, fmt.Errorf("%v row %v: Invalid date '%v'", filename, i+1, row["from"])
+		}
+		if l.End, err = time.Parse("2006-01-02", row["to"]); err != nil {
+			return nil, fmt.Errorf("%v row %v: Invalid date '%v'", filename, i+1, row["to"])
+		}
+		if row["hours"] != "" {
+			if l.Hours, err = strconv.ParseFloat(row["hours"], 64); err != nil {
+				return nil, fmt.Errorf("%v row %v: Invalid hours '%v'", filename, i+1, row["hours"])
+			}
+		}
+		// Leave files have no IDs, so a row is identified by who is away, and when
+		l.SystemID = fmt.Sprintf("%x", sha1.Sum([]byte(strings.ToLower(l.Email)+"/"+row["from"]+"/"+row["to"])))
+		leave = append(leave, l)
+	}
+	return leave, nil
+}
+
+func parseTimesheetDate(name, s string) time.Time {
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		fmt.Printf("Invalid %v date '%v'. Use YYYY-MM-DD\n", name, s)
+		os.Exit(1)
+	}
+	return t
+}
+
+func main() {
+	team := flag.String("team", "", "Name of the team to report on")
+	user := flag.String("user", "", "Email address of the person to report on")
+	from := flag.String("from", "", "First day of the report (YYYY-MM-DD). Default is four weeks ago.")
+	to := flag.String("to", "", "Day after the last day of the report (YYYY-MM-DD). Default is today.")
+	all := flag.Bool("all", false, "List every day, instead of only the days with problems")
+	holidaysFile := flag.String("holidays", "", "Import public holidays from a .csv or .ics file")
+	leaveFile := flag.String("leave", "", "Import leave from a .csv file")
+	flag.Parse()
+
+	if *team == "" && *user == "" && *holidaysFile == "" && *leaveFile == "" {
+		fmt.Printf("Usage: timesheets [-team name | -user email] [-from date] [-to date] [-all] [-holidays file] [-leave file]\n")
+		os.Exit(1)
+	}
+
+	db := &timedb.TimeDB{}
+	db.Log = log.New("timesheets.log")
+	if err := db.LoadConfig(); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	if err := db.Connect(); err != nil {
+		fmt.Printf("Error connecting to time db: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *holidaysFile != "" {
+		holidays, err := readHolidays(*holidaysFile)
+		if err == nil {
+			err = db.SetHolidays(holidays)
+		}
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Imported %v public holidays\n", len(holidays))
+	}
+
+	if *leaveFile != "" {
+		leave, err := readLeave(*leaveFile)
+		if err == nil {
+			err = db.InsertLeave1(leave)
+		}
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Imported %v periods of leave\n", len(leave))
+	}
+
+	if *team == "" && *user == "" {
+		return
+	}
+
+	q := &timedb.TimesheetQuery{}
+	now := time.Now()
+	q.End = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	q.Start = q.End.AddDate(0, 0, -28)
+	if *from != "" {
+		q.Start = parseTimesheetDate("from", *from)
+	}
+	if *to != "" {
+		q.End = parseTimesheetDate("to", *to)
+	}
+	if *team != "" {
+		teamid, err := db.TeamIDFromName(*team)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		if teamid == 0 {
+			fmt.Printf("Unknown team %v\n", *team)
+			os.Exit(1)
+		}
+		q.TeamIDs = []int64{teamid}
+	}
+	if *user != "" {
+		userid, err := db.UserIDFromEmail(*user)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		if userid == 0 {
+			fmt.Printf("Unknown user %v\n", *user)
+			os.Exit(1)
+		}
+		q.UserIDs = []int64{userid}
+	}
+
+	summaries, err := db.QueryTimesheets(q)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%-40v %9v %9v %5v %6v %5v\n", "Person", "Expected", "Logged", "Gaps", "Under", "Over")
+	for _, s := range summaries {
+		fmt.Printf("%-40v %9.1f %9.1f %5v %6v %5v\n", s.Email, s.ExpectedHours, s.LoggedHours, s.Gaps, s.Under, s.Over)
+	}
+	for _, s := range summaries {
+		lines := []string{}
+		for _, d := range s.Days {
+			if !*all && d.Status != timedb.TimesheetGap && d.Status != timedb.TimesheetUnder && d.Status != timedb.TimesheetOver {
+				continue
+			}
+			note := d.Holiday
+			if d.Leave != "" {
+				note = strings.TrimSpace(note + " leave " + d.Leave)
+			}
+			lines = append(lines, fmt.Sprintf("  %v %v %5.1f / %4.1f  %-5v %v", d.Day.Format("2006-01-02"), d.Day.Format("Mon"), d.LoggedHours, d.ExpectedHours, d.Status, note))
+		}
+		if len(lines) != 0 {
+			fmt.Printf("\n%v\n%v\n", s.Email, strings.Join(lines, "\n"))
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/IMQS/log"
+	"os"
+	"strings"
+	"timedb"
+)
+
+/*
+Find and merge users that are the same person, but arrived with different email addresses.
+
+go run src/cmd/users.go -duplicates
+go run src/cmd/users.go -merge ben@imqs.co.za,ben.harper@imqs.co.za
+go run src/cmd/users.go -alias ben.h@gmail.com,ben.harper@imqs.co.za
+
+-merge moves all of the time of the first user to the second user, and deletes the first user.
+Its email address becomes an alias of the second user, so future syncs attribute its time correctly.
+-alias does the same for an email address that has not been seen yet.
+*/
+
+// Split "a,b" into two email addresses
+func splitUserPair(s string) (string, string, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+		return "", "", fmt.Errorf("Expected two comma separated email addresses, but got '%v'", s)
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]), nil
+}
+
+func requireUserID(db *timedb.TimeDB, email string) int64 {
+	userid, err := db.UserIDFromEmail(email)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	if userid == 0 {
+		fmt.Printf("Unknown user %v\n", email)
+		os.Exit(1)
+	}
+	return userid
+}
+
+func main() {
+	duplicates := flag.Bool("duplicates", false, "List users that are probably the same person")
+	list := flag.Bool("list", false, "List all users and their aliases")
+	merge := flag.String("merge", "", "from,into: Merge the first user into the second")
+	alias := flag.String("alias", "", "alias,user: Add an email address alias to a user")
+	flag.Parse()
+
+	if !*duplicates && !*list && *merge == "" && *alias == "" {
+		fmt.Printf("Usage: users [-list] [-duplicates] [-merge from,into] [-alias alias,user]\n")
+		os.Exit(1)
+	}
+
+	db := &timedb.TimeDB{}
+	db.Log = log.New("users.log")
+	if err := db.LoadConfig(); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	if err := db.Connect(); err != nil {
+		fmt.Printf("Error connecting to time db: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *list {
+		users, err := db.Users()
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		for _, u := range users {
+			fmt.Printf("%-40v %8.1f hours  %v\n", u.Email, u.Seconds/3600, strings.Join(u.Aliases, ", "))
+		}
+	}
+
+	if *duplicates {
+		pairs, err := db.LikelyDuplicateUsers()
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		for _, p := range pairs {
+			fmt.Printf("%v (%.1f hours) and %v (%.1f hours): %v\n", p.A.Email, p.A.Seconds/3600, p.B.Email, p.B.Seconds/3600, p.Reason)
+		}
+		fmt.Printf("%v likely duplicates\n", len(pairs))
+	}
+
+	if *merge != "" {
+		from, into, err := splitUserPair(*merge)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		if err := db.MergeUsers(requireUserID(db, from), requireUserID(db, into)); err != nil {
+			fmt.Printf("Error merging %v into %v: %v\n", from, into, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Merged %v into %v\n", from, into)
+	}
+
+	if *alias != "" {
+		email, user, err := splitUserPair(*alias)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		if err := db.AddUserAlias(requireUserID(db, user), email); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%v is now an alias of %v\n", email, user)
+	}
+}
@@ -0,0 +1,295 @@
+package digest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"timedb"
+)
+
+/*
+Package digest emails a weekly summary of each team's metrics to the people that lead it: hours per
+ticket type, the trend of the bug ratio, the tickets that took the most time, and timesheet gaps.
+
+The optional config file config/digest.json:
+
+{
+	"SMTP": {
+		"Host": "smtp.office365.com",
+		"Port": 587,
+		"Username": "timetracker@imqs.co.za",
+		"Password": "PASSWORD",
+		"From": "timetracker@imqs.co.za"
+	},
+	"Weekday": "Monday",
+	"Hour": 7,
+	"Weeks": 8,
+	"DashboardURL": "http://timetracker:3333",
+	"Teams": [
+		{"Team": "Platform", "To": ["ben.harper@imqs.co.za"]}
+	]
+}
+
+A digest covers the seven days before the day on which it is sent. If Teams is empty, every team gets
+a digest. If a team has no To addresses, its digest goes to the accounts that lead it (see /admin).
+Without a Username, mail is sent without authentication, which suits a local SMTP stand-in such as
+MailHog (Host "localhost", Port 1025) during development.
+*/
+
+type SMTPConfig struct {
+	Host     string
+	Port     int // Default is 25
+	Username string
+	Password string
+	From     string
+}
+
+type TeamConfig struct {
+	Team string
+	To   []string
+}
+
+type Config struct {
+	SMTP         SMTPConfig
+	Weekday      string // Default is Monday
+	Hour         int    // Local hour of the day at which digests are sent
+	Weeks        int    // Number of weeks in the bug ratio trend. Default is 8.
+	DashboardURL string // Linked from the digest. Optional.
+	Teams        []TeamConfig
+}
+
+const defaultWeeks = 8
+
+// A digest that is due is only sent within this long of its scheduled time, so that a server
+// which was down for a while doesn't send stale digests when it comes back.
+const sendWindow = 24 * time.Hour
+
+// How often the scheduler checks for digests that are due
+const pollInterval = 10 * time.Minute
+
+type Sender struct {
+	Config  Config
+	DB      *timedb.TimeDB
+	weekday time.Weekday
+}
+
+// Load config/digest.json. Returns false if the file does not exist, in which case digests are disabled.
+func (s *Sender) LoadConfig() (bool, error) {
+	filename := "config/digest.json"
+	raw, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("Error loading config file %v: %v", filename, err)
+	}
+	if err := json.Unmarshal(raw, &s.Config); err != nil {
+		return false, fmt.Errorf("Error decoding config file %v: %v", filename, err)
+	}
+	if s.Config.SMTP.Host == "" || s.Config.SMTP.From == "" {
+		return false, fmt.Errorf("%v must specify SMTP.Host and SMTP.From", filename)
+	}
+	if s.Config.SMTP.Port == 0 {
+		s.Config.SMTP.Port = 25
+	}
+	if s.Config.Weeks <= 0 {
+		s.Config.Weeks = defaultWeeks
+	}
+	if s.Config.Hour < 0 || s.Config.Hour > 23 {
+		return false, fmt.Errorf("Invalid Hour %v in %v", s.Config.Hour, filename)
+	}
+	s.weekday = time.Monday
+	if s.Config.Weekday != "" {
+		found := false
+		for d := time.Sunday; d <= time.Saturday; d++ {
+			if strings.EqualFold(s.Config.Weekday, d.String()) || strings.EqualFold(s.Config.Weekday, d.String()[:3]) {
+				s.weekday = d
+				found = true
+			}
+		}
+		if !found {
+			return false, fmt.Errorf("Invalid Weekday '%v' in %v", s.Config.Weekday, filename)
+		}
+	}
+	return true, nil
+}
+
+// Returns the most recent scheduled send time that is not after 'now'
+func (s *Sender) lastSlot(now time.Time) time.Time {
+	slot := time.Date(now.Year(), now.Month(), now.Day(), s.Config.Hour, 0, 0, 0, time.Local)
+	for slot.Weekday() != s.weekday || slot.After(now) {
+		slot = slot.AddDate(0, 0, -1)
+	}
+	return slot
+}
+
+// Returns the start of the period that a digest sent at 'slot' covers. The period ends at midnight before the slot.
+func PeriodStart(slot time.Time) time.Time {
+	return time.Date(slot.Year(), slot.Month(), slot.Day(), 0, 0, 0, 0, time.Local).AddDate(0, 0, -7)
+}
+
+type recipientTeam struct {
+	teamid int64
+	name   string
+	to     []string
+}
+
+// Returns the teamid of a team, and the recipients of its digest. Returns a teamid of 0 if there is no such team.
+func (s *Sender) TeamRecipients(team string) (int64, []string, error) {
+	teamid, err := s.DB.TeamIDFromName(team)
+	if err != nil || teamid == 0 {
+		return 0, nil, err
+	}
+	for _, tc := range s.Config.Teams {
+		if tc.Team == team && len(tc.To) != 0 {
+			return teamid, tc.To, nil
+		}
+	}
+	to, err := s.DB.TeamLeadEmails(teamid)
+	return teamid, to, err
+}
+
+// Returns the teams that get a digest, and their recipients
+func (s *Sender) recipients() ([]recipientTeam, error) {
+	names := []string{}
+	for _, tc := range s.Config.Teams {
+		names = append(names, tc.Team)
+	}
+	if len(names) == 0 {
+		teams, err := s.DB.Teams()
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range teams {
+			names = append(names, t.Name)
+		}
+	}
+	result := []recipientTeam{}
+	for _, name := range names {
+		teamid, to, err := s.TeamRecipients(name)
+		if err != nil {
+			return nil, err
+		}
+		if teamid == 0 {
+			s.DB.Log.Warnf("Digest: unknown team %v", name)
+			continue
+		}
+		if len(to) != 0 {
+			result = append(result, recipientTeam{teamid: teamid, name: name, to: to})
+		}
+	}
+	return result, nil
+}
+
+// SendDue sends the digests whose scheduled time has passed, and which have not been sent yet.
+// Returns the number of digests that were sent.
+func (s *Sender) SendDue(now time.Time) (int, error) {
+	slot := s.lastSlot(now)
+	if now.Sub(slot) > sendWindow {
+		return 0, nil
+	}
+	start := PeriodStart(slot)
+	teams, err := s.recipients()
+	if err != nil {
+		return 0, err
+	}
+	nsent := 0
+	for _, t := range teams {
+		claimed, err := s.DB.ClaimDigest(t.teamid, start, t.to)
+		if err != nil {
+			return nsent, err
+		}
+		if !claimed {
+			continue
+		}
+		if err := s.SendTeam(t.teamid, t.name, start, t.to); err != nil {
+			if rerr := s.DB.ReleaseDigest(t.teamid, start); rerr != nil {
+				s.DB.Log.Errorf("Digest: unable to release the digest of %v: %v", t.name, rerr)
+			}
+			return nsent, err
+		}
+		nsent++
+	}
+	return nsent, nil
+}
+
+// Run sends digests as they become due. It never returns.
+func (s *Sender) Run() {
+	for {
+		if n, err := s.SendDue(time.Now()); err != nil {
+			s.DB.Log.Errorf("Digest: %v", err)
+		} else if n != 0 {
+			s.DB.Log.Infof("Digest: sent %v digests", n)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// SendTeam builds the digest of a team, for the seven days from periodStart, and emails it
+func (s *Sender) SendTeam(teamid int64, teamName string, periodStart time.Time, to []string) error {
+	d, err := s.Build(teamid, teamName, periodStart)
+	if err != nil {
+		return err
+	}
+	html, err := d.HTML()
+	if err != nil {
+		return err
+	}
+	return s.Send(to, d.Subject(), html)
+}
+
+// Send an HTML email
+func (s *Sender) Send(to []string, subject, html string) error {
+	cfg := &s.Config.SMTP
+	msg, err := buildMessage(cfg.From, to, subject, html)
+	if err != nil {
+		return err
+	}
+	var a smtp.Auth
+	if cfg.Username != "" {
+		a = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	if err := smtp.SendMail(addr, a, cfg.From, to, msg); err != nil {
+		return fmt.Errorf("Error sending email to %v via %v: %v", strings.Join(to, ", "), addr, err)
+	}
+	return nil
+}
+
+func buildMessage(from string, to []string, subject, html string) ([]byte, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at != -1 {
+		domain = from[at+1:]
+	}
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: %v\r\n", from)
+	fmt.Fprintf(buf, "To: %v\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(buf, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(buf, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "Message-ID: <%v@%v>\r\n", hex.EncodeToString(id), domain)
+	fmt.Fprintf(buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(buf, "Content-Type: text/html; charset=utf-8\r\n")
+	fmt.Fprintf(buf, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(buf)
+	if _, err := qp.Write([]byte(html)); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
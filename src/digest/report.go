@@ -0,0 +1,212 @@
+package digest
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"sort"
+	"time"
+	"timedb"
+)
+
+// Number of tickets in the list of the tickets that took the most time
+const topTickets = 10
+
+type TypeHours struct {
+	Type    string
+	Hours   float64
+	Percent float64
+}
+
+// The bug ratio of a week, which is the share of bug hours in bug and feature hours, as on the dashboard
+type WeekTrend struct {
+	Start      time.Time
+	Hours      float64
+	BugPercent float64
+}
+
+// Digest is the content of the email of a single team
+type Digest struct {
+	Team         string
+	Start        time.Time
+	End          time.Time // Exclusive
+	TotalHours   float64
+	Types        []TypeHours
+	Trend        []WeekTrend // Oldest first, ending with the digest's own week
+	TopTickets   []timedb.DrillDownTicket
+	Timesheets   []timedb.TimesheetSummary // Only the people with gaps, or under logged days
+	DashboardURL string
+}
+
+func (d *Digest) Subject() string {
+	return fmt.Sprintf("%v: week of %v", d.Team, d.Start.Format("2 Jan 2006"))
+}
+
+// Build the digest of a team, for the seven days from periodStart
+func (s *Sender) Build(teamid int64, teamName string, periodStart time.Time) (*Digest, error) {
+	d := &Digest{
+		Team:         teamName,
+		Start:        periodStart,
+		End:          periodStart.AddDate(0, 0, 7),
+		DashboardURL: s.Config.DashboardURL,
+	}
+	filter := timedb.TimeFilter{TeamIDs: []int64{teamid}, Start: d.Start, End: d.End}
+
+	rows, err := s.DB.QueryReport(&timedb.ReportQuery{Filter: filter, GroupBy: []timedb.ReportGroup{timedb.GroupTicketType}})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		d.TotalHours += r.Seconds / 3600
+		d.Types = append(d.Types, TypeHours{Type: r.TicketType, Hours: r.Seconds / 3600})
+	}
+	for i := range d.Types {
+		if d.TotalHours != 0 {
+			d.Types[i].Percent = 100 * d.Types[i].Hours / d.TotalHours
+		}
+	}
+	sort.SliceStable(d.Types, func(i, j int) bool { return d.Types[i].Hours > d.Types[j].Hours })
+
+	// Weeks are aligned to the digest's period, rather than to Mondays, so that the last week matches the rest of the digest
+	for w := s.Config.Weeks - 1; w >= 0; w-- {
+		week := filter
+		week.Start = d.Start.AddDate(0, 0, -7*w)
+		week.End = week.Start.AddDate(0, 0, 7)
+		rows, err := s.DB.QueryReport(&timedb.ReportQuery{Filter: week, GroupBy: []timedb.ReportGroup{timedb.GroupTicketType}})
+		if err != nil {
+			return nil, err
+		}
+		t := WeekTrend{Start: week.Start}
+		bugs, features := 0.0, 0.0
+		for _, r := range rows {
+			t.Hours += r.Seconds / 3600
+			switch r.TicketType {
+			case timedb.TicketTypeBug:
+				bugs += r.Seconds
+			case timedb.TicketTypeFeature:
+				features += r.Seconds
+			}
+		}
+		if bugs+features != 0 {
+			t.BugPercent = 100 * bugs / (bugs + features)
+		}
+		d.Trend = append(d.Trend, t)
+	}
+
+	tickets, err := s.DB.QueryDrillDown(&filter, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(tickets) > topTickets {
+		tickets = tickets[:topTickets]
+	}
+	d.TopTickets = tickets
+
+	summaries, err := s.DB.QueryTimesheets(&timedb.TimesheetQuery{TeamIDs: []int64{teamid}, Start: d.Start, End: d.End})
+	if err != nil {
+		return nil, err
+	}
+	for _, ts := range summaries {
+		if ts.Gaps != 0 || ts.Under != 0 {
+			d.Timesheets = append(d.Timesheets, ts)
+		}
+	}
+	return d, nil
+}
+
+func (d *Digest) HTML() (string, error) {
+	buf := &bytes.Buffer{}
+	if err := digestTemplate.Execute(buf, d); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+var typeNames = map[string]string{
+	timedb.TicketTypeBug:       "Bugs",
+	timedb.TicketTypeFeature:   "Features",
+	timedb.TicketTypeBAU:       "Business as usual",
+	timedb.TicketTypeTest:      "Testing",
+	timedb.TicketTypeInterrupt: "Interrupts",
+	timedb.TicketTypeEpic:      "Epics",
+	timedb.TicketTypeSubtask:   "Sub-tasks",
+	timedb.TicketTypeMeeting:   "Meetings",
+	timedb.TicketTypeSpike:     "Spikes",
+	timedb.TicketTypeOther:     "Other",
+	timedb.TicketTypeAnon:      "Untracked tasks",
+}
+
+var digestFuncs = template.FuncMap{
+	"hours":   func(h float64) string { return fmt.Sprintf("%.1f", h) },
+	"seconds": func(s float64) string { return fmt.Sprintf("%.1f", s/3600) },
+	"percent": func(p float64) string { return fmt.Sprintf("%.0f%%", p) },
+	"typeName": func(t string) string {
+		if name, ok := typeNames[t]; ok {
+			return name
+		}
+		return t
+	},
+	"day": func(t time.Time) string { return t.Format("Mon 2 Jan") },
+	// Width of a bar, in pixels. Email clients ignore most CSS, so bars are sized table cells.
+	"bar":     func(percent float64) int { return 1 + int(2*percent) },
+	"lastDay": func(end time.Time) time.Time { return end.AddDate(0, 0, -1) },
+}
+
+var digestTemplate = template.Must(template.New("digest").Funcs(digestFuncs).Parse(digestRaw))
+
+const digestRaw = `<!DOCTYPE html>
+<html>
+<body style="font-family: Arial, sans-serif; font-size: 14px; color: #222">
+<h2 style="margin-bottom: 0">{{.Team}}</h2>
+<p style="color: #777; margin-top: 0">{{day .Start}} to {{day (lastDay .End)}}. {{hours .TotalHours}} hours logged.
+{{if .DashboardURL}}<a href="{{.DashboardURL}}">Open the dashboard</a>{{end}}</p>
+
+<h3>Hours by ticket type</h3>
+{{if .Types}}
+<table cellpadding="3" cellspacing="0">
+{{range .Types}}
+<tr><td>{{typeName .Type}}</td><td align="right">{{hours .Hours}}</td><td align="right">{{percent .Percent}}</td>
+<td><table cellpadding="0" cellspacing="0"><tr><td width="{{bar .Percent}}" height="10" bgcolor="#5d5"></td></tr></table></td></tr>
+{{end}}
+</table>
+{{else}}
+<p>No time was logged.</p>
+{{end}}
+
+<h3>Bug ratio</h3>
+<table cellpadding="3" cellspacing="0">
+<tr><th align="left">Week of</th><th align="right">Hours</th><th align="right">Bugs</th><th></th></tr>
+{{range .Trend}}
+<tr><td>{{day .Start}}</td><td align="right">{{hours .Hours}}</td><td align="right">{{percent .BugPercent}}</td>
+<td><table cellpadding="0" cellspacing="0"><tr><td width="{{bar .BugPercent}}" height="10" bgcolor="#d55"></td></tr></table></td></tr>
+{{end}}
+</table>
+
+<h3>Top tickets</h3>
+{{if .TopTickets}}
+<table cellpadding="3" cellspacing="0">
+<tr><th align="left">Ticket</th><th align="left">Type</th><th align="right">Hours</th><th align="left">People</th></tr>
+{{range .TopTickets}}
+<tr><td>{{if .Key}}{{.Key}} {{end}}{{.Title}}</td><td>{{typeName .Type}}</td><td align="right">{{seconds .Seconds}}</td>
+<td>{{range $i, $p := .People}}{{if $i}}, {{end}}{{$p.Email}}{{end}}</td></tr>
+{{end}}
+</table>
+{{else}}
+<p>No tickets.</p>
+{{end}}
+
+<h3>Timesheet gaps</h3>
+{{if .Timesheets}}
+<table cellpadding="3" cellspacing="0">
+<tr><th align="left">Person</th><th align="right">Expected</th><th align="right">Logged</th><th align="right">Days missing</th><th align="right">Days under</th></tr>
+{{range .Timesheets}}
+<tr><td>{{.Email}}</td><td align="right">{{hours .ExpectedHours}}</td><td align="right">{{hours .LoggedHours}}</td>
+<td align="right">{{.Gaps}}</td><td align="right">{{.Under}}</td></tr>
+{{end}}
+</table>
+{{else}}
+<p>Everybody logged their time.</p>
+{{end}}
+</body>
+</html>
+`
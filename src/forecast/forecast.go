@@ -0,0 +1,211 @@
+package forecast
+
+import (
+	"math"
+	"time"
+	"timedb"
+)
+
+/*
+Package forecast projects how many hours a team will spend on unplanned work (bugs, business as usual and
+interrupts, by default) in the coming weeks, and how much of the team's nominal capacity that leaves for
+planned work.
+
+The weekly hours of unplanned work are forecast with simple exponential smoothing. The smoothing factor is
+the one that best predicted each week of the history from the weeks before it, and the confidence bands come
+from the errors of those predictions, widening further into the future. Nominal capacity is the hours that
+the team's members are expected to work (see timedb.TimesheetConfig), less public holidays and leave that has
+already been imported.
+*/
+
+// The ticket types that are forecast, unless the query says otherwise
+var UnplannedTypes = []string{timedb.TicketTypeBug, timedb.TicketTypeBAU, timedb.TicketTypeInterrupt}
+
+const DefaultWeeks = 13 // A quarter
+const DefaultHistoryWeeks = 52
+
+// Normal quantiles of the two sided 80% and 95% confidence bands
+const z80 = 1.2816
+const z95 = 1.96
+
+// Query selects the team, or teams taken together, and the weeks to forecast
+type Query struct {
+	TeamIDs      []int64
+	Team         string    // Name of the forecast
+	Start        time.Time // First day of the forecast. Weeks start on this day.
+	Weeks        int       // Default is DefaultWeeks
+	HistoryWeeks int       // Complete weeks before today that the forecast is fitted to. Default is DefaultHistoryWeeks.
+	Types        []string  // Default is UnplannedTypes
+}
+
+// A confidence band, in hours
+type Band struct {
+	Low  float64
+	High float64
+}
+
+// Unplanned hours of a week of history
+type HistoryWeek struct {
+	Start     time.Time
+	Hours     float64
+	TypeHours map[string]float64
+}
+
+// A forecast week, or the total of the forecast
+type Week struct {
+	Start     time.Time
+	Capacity  float64 // Nominal hours of the team
+	Unplanned float64 // Forecast hours of unplanned work
+	Band80    Band    // Of Unplanned
+	Band95    Band
+	Available float64 // Capacity less Unplanned, and not less than zero
+}
+
+type Forecast struct {
+	TeamIDs    []int64
+	Team       string
+	Types      []string
+	Alpha      float64            // Smoothing factor
+	ErrorHours float64            // Root mean square error of the one week ahead predictions of the history
+	TypeHours  map[string]float64 // Forecast weekly hours per type, which are smoothed separately, so they need not add up to Unplanned
+	History    []HistoryWeek
+	Weeks      []Week
+	Total      Week // Of all the forecast weeks
+}
+
+// Fit simple exponential smoothing to the series, choosing the smoothing factor that minimises the squared
+// errors of the one step ahead predictions. Returns the factor, the final level, and the root mean square error.
+func fit(series []float64) (alpha, level, rmse float64) {
+	if len(series) == 0 {
+		return 0.5, 0, 0
+	}
+	best := math.Inf(1)
+	for a := 0.05; a < 0.96; a += 0.05 {
+		l, sse := series[0], 0.0
+		for _, y := range series[1:] {
+			sse += (y - l) * (y - l)
+			l = a*y + (1-a)*l
+		}
+		if sse < best {
+			best, alpha, level = sse, a, l
+		}
+	}
+	if len(series) > 1 {
+		rmse = math.Sqrt(best / float64(len(series)-1))
+	}
+	return alpha, level, rmse
+}
+
+func band(level, sd, z float64) Band {
+	return Band{Low: math.Max(0, level-z*sd), High: level + z*sd}
+}
+
+// Days between two days, ignoring time zones and daylight saving
+func daysBetween(a, b time.Time) int {
+	da := time.Date(a.Year(), a.Month(), a.Day(), 0, 0, 0, 0, time.UTC)
+	db := time.Date(b.Year(), b.Month(), b.Day(), 0, 0, 0, 0, time.UTC)
+	return int(db.Sub(da).Hours()/24 + 0.5)
+}
+
+// Compute the forecast of the query
+func Compute(db *timedb.TimeDB, q *Query) (*Forecast, error) {
+	weeks, historyWeeks, types := q.Weeks, q.HistoryWeeks, q.Types
+	if weeks <= 0 {
+		weeks = DefaultWeeks
+	}
+	if historyWeeks <= 0 {
+		historyWeeks = DefaultHistoryWeeks
+	}
+	if len(types) == 0 {
+		types = UnplannedTypes
+	}
+	f := &Forecast{TeamIDs: q.TeamIDs, Team: q.Team, Types: types, TypeHours: map[string]float64{}, History: []HistoryWeek{}, Weeks: []Week{}}
+
+	// The history is the complete weeks before the current one, which start on the same weekday as the forecast
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	start := time.Date(q.Start.Year(), q.Start.Month(), q.Start.Day(), 0, 0, 0, 0, time.Local)
+	historyEnd := today.AddDate(0, 0, -((daysBetween(start, today)%7)+7)%7)
+	historyStart := historyEnd.AddDate(0, 0, -7*historyWeeks)
+	for i := 0; i < historyWeeks; i++ {
+		f.History = append(f.History, HistoryWeek{Start: historyStart.AddDate(0, 0, 7*i), TypeHours: map[string]float64{}})
+	}
+	filter := timedb.TimeFilter{TeamIDs: q.TeamIDs, Start: historyStart, End: historyEnd, TicketTypes: types}
+	// Days, rather than weeks, because report weeks start on Mondays
+	rows, err := db.QueryReport(&timedb.ReportQuery{Filter: filter, GroupBy: []timedb.ReportGroup{timedb.GroupTicketType}, Bucket: timedb.BucketDay})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		i := daysBetween(historyStart, r.Bucket) / 7
+		if i < 0 || i >= len(f.History) {
+			continue
+		}
+		f.History[i].Hours += r.Seconds / 3600
+		f.History[i].TypeHours[r.TicketType] += r.Seconds / 3600
+	}
+
+	// Weeks before the team logged any unplanned work, such as before it existed, are left out of the fit
+	first := 0
+	for first < len(f.History) && f.History[first].Hours == 0 {
+		first++
+	}
+	series := []float64{}
+	typeSeries := map[string][]float64{}
+	for _, w := range f.History[first:] {
+		series = append(series, w.Hours)
+		for _, t := range types {
+			typeSeries[t] = append(typeSeries[t], w.TypeHours[t])
+		}
+	}
+	alpha, level, rmse := fit(series)
+	f.Alpha, f.ErrorHours = alpha, rmse
+	for _, t := range types {
+		_, f.TypeHours[t], _ = fit(typeSeries[t])
+	}
+
+	end := start.AddDate(0, 0, 7*weeks)
+	capacity, err := db.NominalHours(q.TeamIDs, start, end)
+	if err != nil {
+		return nil, err
+	}
+	// Steps ahead of the end of the history, of each forecast week
+	steps := []int{}
+	for i := 0; i < weeks; i++ {
+		w := Week{Start: start.AddDate(0, 0, 7*i), Unplanned: level}
+		for d := 7 * i; d < 7*(i+1) && d < len(capacity); d++ {
+			w.Capacity += capacity[d]
+		}
+		h := daysBetween(historyEnd, w.Start)/7 + 1
+		if h < 1 {
+			h = 1
+		}
+		steps = append(steps, h)
+		sd := rmse * math.Sqrt(1+float64(h-1)*alpha*alpha)
+		w.Band80 = band(level, sd, z80)
+		w.Band95 = band(level, sd, z95)
+		w.Available = math.Max(0, w.Capacity-w.Unplanned)
+		f.Weeks = append(f.Weeks, w)
+		f.Total.Capacity += w.Capacity
+		f.Total.Unplanned += w.Unplanned
+	}
+
+	// The error of a week h steps ahead is e(h) + alpha * (e(1) + ... + e(h-1)), for independent one step errors e,
+	// so the error of the total has a weight per one step error, which is the sum of its weights in each week
+	weights := map[int]float64{}
+	for _, h := range steps {
+		weights[h]++
+		for j := 1; j < h; j++ {
+			weights[j] += alpha
+		}
+	}
+	variance := 0.0
+	for _, w := range weights {
+		variance += w * w
+	}
+	f.Total.Start = start
+	f.Total.Band80 = band(f.Total.Unplanned, rmse*math.Sqrt(variance), z80)
+	f.Total.Band95 = band(f.Total.Unplanned, rmse*math.Sqrt(variance), z95)
+	f.Total.Available = math.Max(0, f.Total.Capacity-f.Total.Unplanned)
+	return f, nil
+}
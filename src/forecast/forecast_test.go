@@ -0,0 +1,38 @@
+package forecast
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFit(t *testing.T) {
+	cases := []struct {
+		name                string
+		series              []float64
+		minAlpha, maxAlpha  float64
+		level, levelEpsilon float64
+		rmse, rmseEpsilon   float64
+	}{
+		{"empty", nil, 0.5, 0.5, 0, 1e-9, 0, 1e-9},
+		{"single week", []float64{7}, 0.05, 0.05, 7, 1e-9, 0, 1e-9},
+		// Every factor fits a constant series perfectly, so the smoothest one is chosen
+		{"constant", []float64{10, 10, 10, 10}, 0.05, 0.05, 10, 1e-9, 0, 1e-9},
+		// A step is followed fastest by the least smoothing
+		{"step", []float64{0, 0, 0, 10, 10, 10, 10}, 0.95, 0.95, 10, 0.001, math.Sqrt(100.2506 / 6), 0.001},
+		{"trend", []float64{1, 2, 3, 4, 5, 6}, 0.95, 0.95, 5.95, 0.01, 1.04, 0.01},
+		// Noise is smoothed out, leaving the level near the mean
+		{"alternating", []float64{10, 0, 10, 0, 10, 0, 10, 0}, 0.05, 0.5, 5, 0.5, 6.5, 0.5},
+	}
+	for _, c := range cases {
+		alpha, level, rmse := fit(c.series)
+		if alpha < c.minAlpha-1e-9 || alpha > c.maxAlpha+1e-9 {
+			t.Errorf("%v: expected alpha in [%v, %v], got %v", c.name, c.minAlpha, c.maxAlpha, alpha)
+		}
+		if math.Abs(level-c.level) > c.levelEpsilon {
+			t.Errorf("%v: expected level %v, got %v", c.name, c.level, level)
+		}
+		if math.Abs(rmse-c.rmse) > c.rmseEpsilon {
+			t.Errorf("%v: expected rmse %v, got %v", c.name, c.rmse, rmse)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package gitlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+	"timedb"
+)
+
+/*
+Scan local git repositories for commits. This needs no network access, so it's up to
+somebody else to keep the clones up to date (eg a 'git fetch --all' before running the fetcher).
+
+We run:
+
+git -C <repo> log --all --since=<start> --until=<end> --format=%H%x1f%ae%x1f%aI%x1f%B%x1e
+
+Which produces records separated by 0x1e, with fields separated by 0x1f:
+hash, author email, author time (strict ISO 8601), raw commit message
+*/
+
+const (
+	recordSeparator = "\x1e"
+	fieldSeparator  = "\x1f"
+)
+
+type Config struct {
+	Repos []string // Paths to local clones. The repo name is the last path element.
+}
+
+func (c *Config) LoadFile(filename string) error {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("Error loading config file %v: %v", filename, err)
+	}
+	if err := json.Unmarshal(bytes, c); err != nil {
+		return fmt.Errorf("Error decoding config file %v: %v", filename, err)
+	}
+	return nil
+}
+
+type Fetcher struct {
+	Config Config
+}
+
+func (f *Fetcher) Name() string {
+	return "Git"
+}
+
+func (f *Fetcher) Scope() string {
+	return strings.Join(f.Config.Repos, ", ")
+}
+
+func (f *Fetcher) LoadConfig() error {
+	return f.Config.LoadFile("config/git.json")
+}
+
+func (f *Fetcher) Fetch(db *timedb.TimeDB, start, end time.Time) error {
+	for _, repo := range f.Config.Repos {
+		fmt.Printf("Scanning git repo %v\n", repo)
+		raw, err := f.gitLog(repo, start, end)
+		if err != nil {
+			return err
+		}
+		commits, err := f.parseLog(filepath.Base(filepath.Clean(repo)), raw)
+		if err != nil {
+			return fmt.Errorf("Error parsing git log of %v: %v", repo, err)
+		}
+		if err := db.InsertCommits1(commits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *Fetcher) parseLog(repoName string, raw []byte) ([]timedb.CommitFormat1, error) {
+	commits := []timedb.CommitFormat1{}
+	for _, rec := range strings.Split(string(raw), recordSeparator) {
+		rec = strings.TrimLeft(rec, "\n")
+		if rec == "" {
+			continue
+		}
+		fields := strings.Split(rec, fieldSeparator)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("Expected 4 fields in git log record, but found %v: '%v'", len(fields), rec)
+		}
+		commitTime, err := time.Parse(time.RFC3339, fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid time '%v' in commit %v", fields[2], fields[0])
+		}
+		message := strings.TrimSpace(fields[3])
+		summary := message
+		if nl := strings.Index(summary, "\n"); nl != -1 {
+			summary = summary[:nl]
+		}
+		commits = append(commits, timedb.CommitFormat1{
+			Repo:       repoName,
+			Hash:       fields[0],
+			Email:      fields[1],
+			Time:       commitTime,
+			Summary:    summary,
+			TicketKeys: timedb.FindTicketKeys(message),
+		})
+	}
+	return commits, nil
+}
+
+func (f *Fetcher) gitLog(repo string, start, end time.Time) ([]byte, error) {
+	cmd := exec.Command("git", "-C", repo, "log", "--all",
+		"--since="+start.Format(time.RFC3339),
+		"--until="+end.Format(time.RFC3339),
+		"--format=%H%x1f%ae%x1f%aI%x1f%B%x1e")
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Error running git log in %v: %v %v", repo, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// Returns the raw log of the first repo
+func (f *Fetcher) FetchRaw(start, end time.Time) ([]byte, error) {
+	if len(f.Config.Repos) == 0 {
+		return nil, nil
+	}
+	return f.gitLog(f.Config.Repos[0], start, end)
+}
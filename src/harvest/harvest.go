@@ -0,0 +1,208 @@
+package harvest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+	"timedb"
+)
+
+/*
+Harvest is authenticated with a personal access token (https://id.getharvest.com/developers), which must
+belong to an administrator, together with the account id.
+
+Users (paged, following next_page):
+
+GET https://api.harvestapp.com/v2/users?page=1
+{"users": [{"id": 123, "email": "ben@imqs.co.za"}], "next_page": null}
+
+Time entries (paged, following next_page):
+
+GET https://api.harvestapp.com/v2/time_entries?from=2016-12-05&to=2016-12-06&page=1
+{"time_entries": [{"id": 456, "spent_date": "2016-12-05", "hours": 3.35, "notes": "ABC-123 Fix the login page",
+  "user": {"id": 123}, "project": {"name": "..."}, "task": {"name": "Development"}}], "next_page": 2}
+*/
+
+const APIURL = "https://api.harvestapp.com/v2"
+
+const APIDateFormat = "2006-01-02"
+
+// Harvest gives us durations per day, not start/stop times (unless the timer was used),
+// so just like with TMetric, we make all tasks start at 1am.
+const TaskStartHour = 1
+
+type Config struct {
+	AccessToken string
+	AccountID   string
+}
+
+func (c *Config) LoadFile(filename string) error {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("Error loading config file %v: %v", filename, err)
+	}
+	if err := json.Unmarshal(bytes, c); err != nil {
+		return fmt.Errorf("Error decoding config file %v: %v", filename, err)
+	}
+	return nil
+}
+
+type Fetcher struct {
+	Config Config
+}
+
+func (f *Fetcher) Name() string {
+	return "Harvest"
+}
+
+func (f *Fetcher) Scope() string {
+	return "account " + f.Config.AccountID
+}
+
+func (f *Fetcher) LoadConfig() error {
+	return f.Config.LoadFile("config/harvest.json")
+}
+
+type harvestJsonUser struct {
+	Id    int64  `json:"id"`
+	Email string `json:"email"`
+}
+
+type harvestJsonUsers struct {
+	Users    []harvestJsonUser `json:"users"`
+	NextPage *int              `json:"next_page"`
+}
+
+type harvestJsonRef struct {
+	Id   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+type harvestJsonTimeEntry struct {
+	Id        int64          `json:"id"`
+	SpentDate string         `json:"spent_date"`
+	Hours     float64        `json:"hours"`
+	Notes     string         `json:"notes"`
+	User      harvestJsonRef `json:"user"`
+	Project   harvestJsonRef `json:"project"`
+	Task      harvestJsonRef `json:"task"`
+}
+
+type harvestJsonTimeEntries struct {
+	TimeEntries []harvestJsonTimeEntry `json:"time_entries"`
+	NextPage    *int                   `json:"next_page"`
+}
+
+// The notes are what people type in, which is most likely to mention the ticket.
+// Harvest tasks are usually generic, such as "Development".
+func (e *harvestJsonTimeEntry) title() string {
+	if e.Notes != "" {
+		return e.Notes
+	}
+	return e.Task.Name
+}
+
+func (f *Fetcher) Fetch(db *timedb.TimeDB, start, end time.Time) error {
+	userToEmail, err := f.fetchUsers()
+	if err != nil {
+		return err
+	}
+
+	for page := 1; page != 0; {
+		fmt.Printf("Fetching Harvest time entries page %v\n", page)
+		raw, err := f.fetchPage(start, end, page)
+		if err != nil {
+			return err
+		}
+		resp := harvestJsonTimeEntries{}
+		if err := json.Unmarshal(raw, &resp); err != nil {
+			return fmt.Errorf("Error decoding Harvest time entries: %v", err)
+		}
+		times := []timedb.TimeFormat2{}
+		for _, e := range resp.TimeEntries {
+			email, ok := userToEmail[e.User.Id]
+			if !ok {
+				return fmt.Errorf("Harvest time entry %v belongs to unknown user %v", e.Id, e.User.Id)
+			}
+			day, err := time.ParseInLocation(APIDateFormat, e.SpentDate, time.Local)
+			if err != nil {
+				return fmt.Errorf("Invalid spent_date '%v' in Harvest time entry %v", e.SpentDate, e.Id)
+			}
+			tstart := day.Add(TaskStartHour * time.Hour)
+			times = append(times, timedb.TimeFormat2{
+				System:    timedb.SystemTypeHarvest,
+				SystemID:  strconv.FormatInt(e.Id, 10),
+				Email:     email,
+				TaskTitle: e.title(),
+				Project:   e.Project.Name,
+				Start:     tstart,
+				End:       tstart.Add(time.Duration(e.Hours * float64(time.Hour))),
+			})
+		}
+		if err := db.InsertTimes2(times); err != nil {
+			return err
+		}
+		page = 0
+		if resp.NextPage != nil {
+			page = *resp.NextPage
+		}
+	}
+	return nil
+}
+
+// Returns a map from Harvest user id to email address
+func (f *Fetcher) fetchUsers() (map[int64]string, error) {
+	userToEmail := map[int64]string{}
+	for page := 1; page != 0; {
+		raw, err := f.fetchUrl(fmt.Sprintf("%v/users?page=%v", APIURL, page))
+		if err != nil {
+			return nil, err
+		}
+		resp := harvestJsonUsers{}
+		if err := json.Unmarshal(raw, &resp); err != nil {
+			return nil, fmt.Errorf("Error decoding Harvest users: %v", err)
+		}
+		for _, u := range resp.Users {
+			userToEmail[u.Id] = u.Email
+		}
+		page = 0
+		if resp.NextPage != nil {
+			page = *resp.NextPage
+		}
+	}
+	return userToEmail, nil
+}
+
+func (f *Fetcher) fetchPage(start, end time.Time, page int) ([]byte, error) {
+	return f.fetchUrl(fmt.Sprintf("%v/time_entries?from=%v&to=%v&page=%v", APIURL, start.Format(APIDateFormat), end.Format(APIDateFormat), page))
+}
+
+func (f *Fetcher) FetchRaw(start, end time.Time) ([]byte, error) {
+	return f.fetchPage(start, end, 1)
+}
+
+func (f *Fetcher) fetchUrl(url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+f.Config.AccessToken)
+	req.Header.Set("Harvest-Account-Id", f.Config.AccountID)
+	req.Header.Set("User-Agent", "IMQS InternalTimeTracker")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP Error: %v", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading body: %v", err)
+	}
+	return body, nil
+}
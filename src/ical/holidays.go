@@ -0,0 +1,62 @@
+package ical
+
+import (
+	"time"
+)
+
+// A day that is covered by an all-day event, such as a public holiday
+type DayEvent struct {
+	Day     time.Time // Midnight UTC
+	Summary string
+}
+
+// AllDayEvents returns the days in [start, end) that are covered by the all-day events of an
+// .ics file, such as a public holiday calendar. Recurring events are expanded, and cancelled
+// events are ignored. Events that span several days produce one DayEvent per day.
+func AllDayEvents(raw string, start, end time.Time) ([]DayEvent, error) {
+	events, err := parseEvents(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	overridden := map[string]bool{}
+	for _, ev := range events {
+		if ev.RecurrenceID != "" {
+			overridden[ev.UID+"/"+ev.RecurrenceID] = true
+		}
+	}
+
+	days := []DayEvent{}
+	add := func(ev *event, occ time.Time) {
+		if !ev.AllDay || ev.Status == "CANCELLED" {
+			return
+		}
+		first := time.Date(occ.Year(), occ.Month(), occ.Day(), 0, 0, 0, 0, time.UTC)
+		ndays := int(ev.End.Sub(ev.Start).Hours()/24 + 0.5) // DTEND of an all-day event is exclusive
+		if ndays < 1 {
+			ndays = 1
+		}
+		for i := 0; i < ndays; i++ {
+			day := first.AddDate(0, 0, i)
+			if !day.Before(start) && day.Before(end) {
+				days = append(days, DayEvent{Day: day, Summary: ev.Summary})
+			}
+		}
+	}
+
+	// Look back a little, so that multi-day events that begin before the window are included
+	lookBack := start.AddDate(0, 0, -31)
+	for _, ev := range events {
+		if ev.RecurrenceID != "" {
+			add(ev, ev.Start)
+			continue
+		}
+		for _, occ := range ev.occurrences(lookBack, end) {
+			if ev.RRule != nil && overridden[ev.UID+"/"+occurrenceKey(occ)] {
+				continue
+			}
+			add(ev, occ)
+		}
+	}
+	return days, nil
+}
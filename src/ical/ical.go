@@ -0,0 +1,251 @@
+package ical
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"timedb"
+)
+
+/*
+Import meetings from iCalendar (.ics) files, as time entries against a single "Meetings" ticket.
+
+Every user has a list of sources, which are either .ics files, directories of .ics files,
+or http(s) URLs that return an .ics file (eg an Outlook calendar export, or a CalDAV collection).
+
+Only meetings that the user organized, or accepted, are imported. A time entry is identified by the
+user, the event UID, and (for recurring meetings) the original start time of the occurrence.
+When a meeting is moved, the existing time entry is updated. When it is cancelled, declined, or
+disappears from the calendar, the time entry is deleted.
+*/
+
+type ConfigUser struct {
+	Email    string
+	Sources  []string // Files, directories, or URLs
+	Username string   // Optional basic auth credentials for URL sources
+	Password string
+}
+
+type Config struct {
+	TicketTitle string // The ticket that meetings are logged against. Default is "Meetings".
+	TicketType  string // Default is timedb.TicketTypeMeeting.
+	Users       []ConfigUser
+}
+
+func (c *Config) LoadFile(filename string) error {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("Error loading config file %v: %v", filename, err)
+	}
+	if err := json.Unmarshal(bytes, c); err != nil {
+		return fmt.Errorf("Error decoding config file %v: %v", filename, err)
+	}
+	if c.TicketTitle == "" {
+		c.TicketTitle = "Meetings"
+	}
+	if c.TicketType == "" {
+		c.TicketType = timedb.TicketTypeMeeting
+	}
+	return nil
+}
+
+type Fetcher struct {
+	Config Config
+}
+
+func (f *Fetcher) Name() string {
+	return "iCalendar"
+}
+
+func (f *Fetcher) Scope() string {
+	users := []string{}
+	for _, u := range f.Config.Users {
+		users = append(users, u.Email)
+	}
+	return "meetings of " + strings.Join(users, ", ")
+}
+
+func (f *Fetcher) LoadConfig() error {
+	return f.Config.LoadFile("config/ical.json")
+}
+
+func (f *Fetcher) Fetch(db *timedb.TimeDB, start, end time.Time) error {
+	ticket := timedb.IssueFormat1{
+		System:     timedb.SystemTypeICal,
+		SystemID:   f.Config.TicketTitle,
+		Title:      f.Config.TicketTitle,
+		Type:       f.Config.TicketType,
+		CreateTime: time.Now(),
+	}
+	if err := db.InsertIssues1([]timedb.IssueFormat1{ticket}); err != nil {
+		return err
+	}
+
+	for _, user := range f.Config.Users {
+		fmt.Printf("Importing meetings of %v\n", user.Email)
+		if err := f.fetchUser(db, &user, start, end); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *Fetcher) fetchUser(db *timedb.TimeDB, user *ConfigUser, start, end time.Time) error {
+	email := strings.ToLower(user.Email)
+	events := []*event{}
+	for _, src := range user.Sources {
+		raws, err := readSource(user, src)
+		if err != nil {
+			return err
+		}
+		for _, raw := range raws {
+			evs, err := parseEvents(raw)
+			if err != nil {
+				return fmt.Errorf("Error parsing %v: %v", src, err)
+			}
+			events = append(events, evs...)
+		}
+	}
+
+	// Overrides of individual occurrences of recurring meetings, keyed by UID and then occurrence
+	overrides := map[string]map[string]*event{}
+	for _, ev := range events {
+		if ev.RecurrenceID != "" {
+			if overrides[ev.UID] == nil {
+				overrides[ev.UID] = map[string]*event{}
+			}
+			overrides[ev.UID][ev.RecurrenceID] = ev
+		}
+	}
+
+	// Overrides don't always repeat the attendees, in which case they're inherited from the recurring meeting
+	for _, ev := range events {
+		if ev.RecurrenceID != "" || ev.RRule == nil {
+			continue
+		}
+		for _, o := range overrides[ev.UID] {
+			if len(o.Attendees) == 0 {
+				o.Organizer = ev.Organizer
+				o.Attendees = ev.Attendees
+			}
+		}
+	}
+
+	// Keyed by systemid, so that an event which appears in more than one source is only imported once
+	times := map[string]timedb.TimeFormat2{}
+	add := func(ev *event, systemid string, tstart time.Time) {
+		if ev.AllDay || !ev.acceptedBy(email) {
+			return
+		}
+		times[systemid] = timedb.TimeFormat2{
+			System:         timedb.SystemTypeICal,
+			SystemID:       systemid,
+			Email:          email,
+			TicketSystem:   timedb.SystemTypeICal,
+			TicketSystemID: f.Config.TicketTitle,
+			Start:          tstart,
+			End:            tstart.Add(ev.End.Sub(ev.Start)),
+		}
+	}
+
+	for _, ev := range events {
+		if ev.RecurrenceID != "" {
+			if !ev.Start.Before(start) && ev.Start.Before(end) {
+				add(ev, email+"/"+ev.UID+"/"+ev.RecurrenceID, ev.Start)
+			}
+			continue
+		}
+		for _, occ := range ev.occurrences(start, end) {
+			if ev.RRule == nil {
+				add(ev, email+"/"+ev.UID, occ)
+				continue
+			}
+			key := occurrenceKey(occ)
+			if _, overridden := overrides[ev.UID][key]; overridden {
+				continue
+			}
+			add(ev, email+"/"+ev.UID+"/"+key, occ)
+		}
+	}
+
+	list := []timedb.TimeFormat2{}
+	keep := map[string]bool{}
+	for systemid, tt := range times {
+		list = append(list, tt)
+		keep[systemid] = true
+	}
+	if err := db.InsertTimes2(list); err != nil {
+		return err
+	}
+	// Remove meetings that have been cancelled, declined, or moved out of the window
+	return db.DeleteTimesNotIn(timedb.SystemTypeICal, email, start, end, keep)
+}
+
+// Returns the contents of all of the .ics files of a source
+func readSource(user *ConfigUser, src string) ([]string, error) {
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		raw, err := fetchUrl(user, src)
+		if err != nil {
+			return nil, err
+		}
+		return []string{raw}, nil
+	}
+
+	files := []string{src}
+	if info, err := os.Stat(src); err != nil {
+		return nil, err
+	} else if info.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(src, "*.ics")); err != nil {
+			return nil, err
+		}
+	}
+	raws := []string{}
+	for _, file := range files {
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		raws = append(raws, string(raw))
+	}
+	return raws, nil
+}
+
+func fetchUrl(user *ConfigUser, url string) (string, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	if user.Username != "" {
+		req.SetBasicAuth(user.Username, user.Password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("HTTP Error fetching %v: %v", url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("Error reading body: %v", err)
+	}
+	return string(body), nil
+}
+
+// Returns the first source of the first user
+func (f *Fetcher) FetchRaw(start, end time.Time) ([]byte, error) {
+	if len(f.Config.Users) == 0 || len(f.Config.Users[0].Sources) == 0 {
+		return nil, nil
+	}
+	raws, err := readSource(&f.Config.Users[0], f.Config.Users[0].Sources[0])
+	if err != nil || len(raws) == 0 {
+		return nil, err
+	}
+	return []byte(raws[0]), nil
+}
@@ -0,0 +1,544 @@
+package ical
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+A minimal iCalendar (RFC 5545) parser, which only understands what we need in order to
+turn meetings into time entries: VEVENTs with their start/end, status, attendees and
+simple recurrence rules (FREQ, INTERVAL, COUNT, UNTIL, WKST, BYDAY, BYMONTHDAY, BYMONTH, EXDATE,
+RECURRENCE-ID).
+*/
+
+type property struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+type attendee struct {
+	Email    string
+	PartStat string
+}
+
+type event struct {
+	UID          string
+	Summary      string
+	Status       string // TENTATIVE, CONFIRMED, CANCELLED
+	Start        time.Time
+	End          time.Time
+	AllDay       bool
+	RRule        *rrule
+	ExDates      map[string]bool // keys are occurrenceKey()
+	RecurrenceID string          // occurrenceKey() of the occurrence that this event overrides
+	Organizer    string
+	Attendees    []attendee
+}
+
+// A BYDAY value, such as MO, 2TU or -1FR
+type weekdayNum struct {
+	Ordinal int // The nth such weekday of the month, counting back from the end if negative. 0 for every one.
+	Weekday time.Weekday
+}
+
+type rrule struct {
+	Freq       string
+	Interval   int
+	Count      int
+	Until      time.Time
+	ByDay      []weekdayNum
+	ByMonthDay []int // Counting back from the end of the month if negative
+	ByMonth    []time.Month
+	WeekStart  time.Weekday
+}
+
+// Identifies an occurrence of a recurring event by its original start time
+func occurrenceKey(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// Join lines that have been folded onto continuation lines (which start with a space or tab)
+func unfold(raw string) []string {
+	raw = strings.Replace(raw, "\r\n", "\n", -1)
+	lines := []string{}
+	for _, line := range strings.Split(raw, "\n") {
+		if len(line) != 0 && (line[0] == ' ' || line[0] == '\t') && len(lines) != 0 {
+			lines[len(lines)-1] += line[1:]
+		} else {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Parse "NAME;PARAM=VALUE;PARAM=\"QUOTED:VALUE\":VALUE"
+func parseProperty(line string) (property, error) {
+	p := property{Params: map[string]string{}}
+	inQuote := false
+	colon := -1
+	for i := 0; i < len(line) && colon == -1; i++ {
+		switch line[i] {
+		case '"':
+			inQuote = !inQuote
+		case ':':
+			if !inQuote {
+				colon = i
+			}
+		}
+	}
+	if colon == -1 {
+		return p, fmt.Errorf("Invalid iCalendar line '%v'", line)
+	}
+	p.Value = line[colon+1:]
+	parts := strings.Split(line[:colon], ";")
+	p.Name = strings.ToUpper(parts[0])
+	for _, param := range parts[1:] {
+		eq := strings.Index(param, "=")
+		if eq == -1 {
+			continue
+		}
+		p.Params[strings.ToUpper(param[:eq])] = strings.Trim(param[eq+1:], `"`)
+	}
+	return p, nil
+}
+
+// Parse a DATE or DATE-TIME value. Returns allDay = true for DATE values.
+func parseDateTime(p property) (t time.Time, allDay bool, err error) {
+	value := p.Value
+	if p.Params["VALUE"] == "DATE" || len(value) == 8 {
+		t, err = time.ParseInLocation("20060102", value, time.Local)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err = time.Parse("20060102T150405Z", value)
+		return t, false, err
+	}
+	loc := time.Local
+	if tzid := p.Params["TZID"]; tzid != "" {
+		// Outlook uses Windows time zone names, which we can't load, so we fall back to local time
+		if l, lerr := time.LoadLocation(tzid); lerr == nil {
+			loc = l
+		}
+	}
+	t, err = time.ParseInLocation("20060102T150405", value, loc)
+	return t, false, err
+}
+
+var durationRegex = regexp.MustCompile(`^P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// Parse an iCalendar duration, such as PT1H30M
+func parseDuration(value string) (time.Duration, error) {
+	m := durationRegex.FindStringSubmatch(strings.TrimPrefix(value, "+"))
+	if m == nil {
+		return 0, fmt.Errorf("Invalid duration '%v'", value)
+	}
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	d := time.Duration(0)
+	for i, unit := range units {
+		if m[i+1] != "" {
+			n, _ := strconv.Atoi(m[i+1])
+			d += time.Duration(n) * unit
+		}
+	}
+	return d, nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+var byDayRegex = regexp.MustCompile(`^([+-]?\d{1,2})?(SU|MO|TU|WE|TH|FR|SA)$`)
+
+// Parse a comma separated list of integers in [min, max], or [-max, -min] if negative is true
+func parseIntList(val string, min, max int, negative bool) ([]int, error) {
+	list := []int{}
+	for _, v := range strings.Split(val, ",") {
+		n, err := strconv.Atoi(v)
+		if err != nil || !(n >= min && n <= max || negative && n <= -min && n >= -max) {
+			return nil, fmt.Errorf("Invalid value '%v'", v)
+		}
+		list = append(list, n)
+	}
+	return list, nil
+}
+
+// Parse a recurrence rule. Rather than get a meeting's days wrong, we refuse the parts of RFC 5545 that we
+// don't implement, such as BYSETPOS, and BYDAY ordinals other than in MONTHLY and YEARLY rules.
+func parseRRule(value string, loc *time.Location) (*rrule, error) {
+	r := &rrule{Interval: 1, WeekStart: time.Monday}
+	for _, part := range strings.Split(value, ";") {
+		eq := strings.Index(part, "=")
+		if eq == -1 {
+			continue
+		}
+		key, val := strings.ToUpper(part[:eq]), strings.ToUpper(part[eq+1:])
+		switch key {
+		case "FREQ":
+			r.Freq = val
+		case "INTERVAL":
+			r.Interval, _ = strconv.Atoi(val)
+			if r.Interval < 1 {
+				r.Interval = 1
+			}
+		case "COUNT":
+			r.Count, _ = strconv.Atoi(val)
+		case "UNTIL":
+			until, _, err := parseDateTime(property{Value: val, Params: map[string]string{}})
+			if err != nil {
+				return nil, fmt.Errorf("Invalid UNTIL in RRULE '%v'", value)
+			}
+			if len(val) == 8 {
+				// A DATE value includes the whole day
+				until = time.Date(until.Year(), until.Month(), until.Day(), 23, 59, 59, 0, loc)
+			}
+			r.Until = until
+		case "WKST":
+			wd, ok := weekdays[val]
+			if !ok {
+				return nil, fmt.Errorf("Invalid WKST in RRULE '%v'", value)
+			}
+			r.WeekStart = wd
+		case "BYDAY":
+			for _, day := range strings.Split(val, ",") {
+				m := byDayRegex.FindStringSubmatch(day)
+				if m == nil {
+					return nil, fmt.Errorf("Invalid BYDAY in RRULE '%v'", value)
+				}
+				wd := weekdayNum{Weekday: weekdays[m[2]]}
+				if m[1] != "" {
+					wd.Ordinal, _ = strconv.Atoi(m[1])
+					if wd.Ordinal == 0 || wd.Ordinal > 5 || wd.Ordinal < -5 {
+						return nil, fmt.Errorf("Unsupported BYDAY in RRULE '%v'", value)
+					}
+				}
+				r.ByDay = append(r.ByDay, wd)
+			}
+		case "BYMONTHDAY":
+			days, err := parseIntList(val, 1, 31, true)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid BYMONTHDAY in RRULE '%v'", value)
+			}
+			r.ByMonthDay = days
+		case "BYMONTH":
+			months, err := parseIntList(val, 1, 12, false)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid BYMONTH in RRULE '%v'", value)
+			}
+			for _, m := range months {
+				r.ByMonth = append(r.ByMonth, time.Month(m))
+			}
+		default:
+			return nil, fmt.Errorf("Unsupported %v in RRULE '%v'", key, value)
+		}
+	}
+
+	ordinals := false
+	for _, wd := range r.ByDay {
+		ordinals = ordinals || wd.Ordinal != 0
+	}
+	switch r.Freq {
+	case "DAILY":
+		if ordinals {
+			return nil, fmt.Errorf("Unsupported BYDAY in RRULE '%v'", value)
+		}
+	case "WEEKLY":
+		if ordinals || len(r.ByMonthDay) != 0 {
+			return nil, fmt.Errorf("Unsupported BYDAY or BYMONTHDAY in RRULE '%v'", value)
+		}
+	case "MONTHLY", "YEARLY":
+		// The nth weekday of a year, or the nth weekday that is also one of the days of the month, are rare
+		if (ordinals && len(r.ByMonthDay) != 0) || (r.Freq == "YEARLY" && len(r.ByDay) != 0 && len(r.ByMonth) == 0) {
+			return nil, fmt.Errorf("Unsupported BYDAY in RRULE '%v'", value)
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported RRULE frequency in '%v'", value)
+	}
+	return r, nil
+}
+
+// Parse all of the VEVENTs in an iCalendar file
+func parseEvents(raw string) ([]*event, error) {
+	events := []*event{}
+	var ev *event
+	var duration time.Duration
+	// Components such as VALARM can be nested inside a VEVENT. We ignore their properties.
+	nested := 0
+	for lineNum, line := range unfold(raw) {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		p, err := parseProperty(line)
+		if err != nil {
+			return nil, fmt.Errorf("Line %v: %v", lineNum+1, err)
+		}
+		value := strings.ToUpper(p.Value)
+		switch {
+		case p.Name == "BEGIN" && value == "VEVENT":
+			ev = &event{ExDates: map[string]bool{}}
+			duration = 0
+			continue
+		case p.Name == "END" && value == "VEVENT":
+			if ev != nil {
+				if ev.End.IsZero() {
+					ev.End = ev.Start.Add(duration)
+				}
+				events = append(events, ev)
+			}
+			ev = nil
+			continue
+		case p.Name == "BEGIN" && ev != nil:
+			nested++
+			continue
+		case p.Name == "END" && ev != nil:
+			nested--
+			continue
+		}
+		if ev == nil || nested != 0 {
+			continue
+		}
+		switch p.Name {
+		case "UID":
+			ev.UID = p.Value
+		case "SUMMARY":
+			ev.Summary = p.Value
+		case "STATUS":
+			ev.Status = value
+		case "DTSTART":
+			if ev.Start, ev.AllDay, err = parseDateTime(p); err != nil {
+				return nil, fmt.Errorf("Line %v: Invalid DTSTART: %v", lineNum+1, err)
+			}
+		case "DTEND":
+			if ev.End, _, err = parseDateTime(p); err != nil {
+				return nil, fmt.Errorf("Line %v: Invalid DTEND: %v", lineNum+1, err)
+			}
+		case "DURATION":
+			if duration, err = parseDuration(p.Value); err != nil {
+				return nil, fmt.Errorf("Line %v: %v", lineNum+1, err)
+			}
+		case "RRULE":
+			if ev.RRule, err = parseRRule(p.Value, time.Local); err != nil {
+				return nil, fmt.Errorf("Line %v: %v", lineNum+1, err)
+			}
+		case "EXDATE":
+			for _, v := range strings.Split(p.Value, ",") {
+				ex, _, err := parseDateTime(property{Name: p.Name, Params: p.Params, Value: v})
+				if err != nil {
+					return nil, fmt.Errorf("Line %v: Invalid EXDATE: %v", lineNum+1, err)
+				}
+				ev.ExDates[occurrenceKey(ex)] = true
+			}
+		case "RECURRENCE-ID":
+			rid, _, err := parseDateTime(p)
+			if err != nil {
+				return nil, fmt.Errorf("Line %v: Invalid RECURRENCE-ID: %v", lineNum+1, err)
+			}
+			ev.RecurrenceID = occurrenceKey(rid)
+		case "ORGANIZER":
+			ev.Organizer = mailtoEmail(p.Value)
+		case "ATTENDEE":
+			ev.Attendees = append(ev.Attendees, attendee{
+				Email:    mailtoEmail(p.Value),
+				PartStat: strings.ToUpper(p.Params["PARTSTAT"]),
+			})
+		}
+	}
+	return events, nil
+}
+
+func mailtoEmail(value string) string {
+	if len(value) > 7 && strings.ToLower(value[:7]) == "mailto:" {
+		value = value[7:]
+	}
+	return strings.ToLower(value)
+}
+
+// Returns true if the person with the given email organized the meeting, or accepted the invitation.
+// Events without any attendees are personal appointments, not meetings.
+func (e *event) acceptedBy(email string) bool {
+	if e.Status == "CANCELLED" || len(e.Attendees) == 0 {
+		return false
+	}
+	if e.Organizer == email {
+		return true
+	}
+	for _, a := range e.Attendees {
+		if a.Email == email {
+			return a.PartStat == "ACCEPTED"
+		}
+	}
+	return false
+}
+
+// Prevent pathological rules from running forever
+const maxRecurrenceIterations = 100000
+
+// Returns the start times of all occurrences of the event that start within [winStart, winEnd).
+// Occurrences that are excluded by EXDATE are omitted. Occurrences are in the time zone of the event,
+// so that their weekdays, and their times across daylight saving changes, are those of the organizer.
+func (e *event) occurrences(winStart, winEnd time.Time) []time.Time {
+	if e.RRule == nil {
+		if !e.Start.Before(winStart) && e.Start.Before(winEnd) {
+			return []time.Time{e.Start}
+		}
+		return nil
+	}
+
+	r := e.RRule
+	result := []time.Time{}
+	count := 0
+	// Returns false when there can be no more occurrences
+	emit := func(t time.Time) bool {
+		if t.Before(e.Start) {
+			return true
+		}
+		if !r.Until.IsZero() && t.After(r.Until) {
+			return false
+		}
+		if !t.Before(winEnd) {
+			return false
+		}
+		count++
+		if r.Count != 0 && count > r.Count {
+			return false
+		}
+		if !t.Before(winStart) && !e.ExDates[occurrenceKey(t)] {
+			result = append(result, t)
+		}
+		return true
+	}
+
+	for i := 0; i < maxRecurrenceIterations; i++ {
+		for _, t := range r.period(e.Start, i) {
+			if !emit(t) {
+				return result
+			}
+		}
+	}
+	return result
+}
+
+// Returns the days of the i'th day, week, month or year of the rule that match it, in order, at the time of
+// day of start. The days of the first period can be before start.
+func (r *rrule) period(start time.Time, i int) []time.Time {
+	days := []time.Time{}
+	switch r.Freq {
+	case "DAILY":
+		day := r.day(start, start.Year(), start.Month(), start.Day()+i*r.Interval)
+		if (len(r.ByDay) == 0 || r.onWeekday(day.Weekday())) && (len(r.ByMonthDay) == 0 || r.onMonthDay(day)) {
+			days = append(days, day)
+		}
+	case "WEEKLY":
+		// Weeks start on WKST
+		first := start.Day() - (int(start.Weekday())-int(r.WeekStart)+7)%7 + 7*i*r.Interval
+		for d := 0; d < 7; d++ {
+			day := r.day(start, start.Year(), start.Month(), first+d)
+			if (len(r.ByDay) == 0 && day.Weekday() == start.Weekday()) || r.onWeekday(day.Weekday()) {
+				days = append(days, day)
+			}
+		}
+	case "MONTHLY":
+		days = r.monthDays(start, start.Year(), start.Month()+time.Month(i*r.Interval))
+	case "YEARLY":
+		months := r.ByMonth
+		if len(months) == 0 && len(r.ByMonthDay) != 0 {
+			months = []time.Month{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+		} else if len(months) == 0 {
+			months = []time.Month{start.Month()}
+		}
+		sorted := append([]time.Month{}, months...)
+		sort.Slice(sorted, func(a, b int) bool { return sorted[a] < sorted[b] })
+		for _, m := range sorted {
+			days = append(days, r.monthDays(start, start.Year()+i*r.Interval, m)...)
+		}
+		return days
+	}
+	if len(r.ByMonth) == 0 {
+		return days
+	}
+	inMonths := []time.Time{}
+	for _, day := range days {
+		for _, m := range r.ByMonth {
+			if day.Month() == m {
+				inMonths = append(inMonths, day)
+				break
+			}
+		}
+	}
+	return inMonths
+}
+
+// The day, which may be past the end of the month, at the time of day of start
+func (r *rrule) day(start time.Time, year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, start.Hour(), start.Minute(), start.Second(), 0, start.Location())
+}
+
+func (r *rrule) onWeekday(wd time.Weekday) bool {
+	for _, d := range r.ByDay {
+		if d.Weekday == wd {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rrule) onMonthDay(t time.Time) bool {
+	last := time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	for _, d := range r.ByMonthDay {
+		if d == t.Day() || d == t.Day()-last-1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the days of the month that match the rule, in order. Without BYDAY or BYMONTHDAY, that is the
+// day of the month of start, if the month has that day.
+func (r *rrule) monthDays(start time.Time, year int, month time.Month) []time.Time {
+	first := r.day(start, year, month, 1)
+	last := r.day(start, year, month+1, 0).Day()
+	include := make([]bool, last+1)
+	weekday := func(d int) time.Weekday {
+		return time.Weekday((int(first.Weekday()) + d - 1) % 7)
+	}
+	switch {
+	case len(r.ByMonthDay) != 0:
+		for d := 1; d <= last; d++ {
+			include[d] = r.onMonthDay(r.day(start, first.Year(), first.Month(), d)) && (len(r.ByDay) == 0 || r.onWeekday(weekday(d)))
+		}
+	case len(r.ByDay) != 0:
+		for _, wd := range r.ByDay {
+			matches := []int{}
+			for d := 1; d <= last; d++ {
+				if weekday(d) == wd.Weekday {
+					matches = append(matches, d)
+				}
+			}
+			switch {
+			case wd.Ordinal == 0:
+				for _, d := range matches {
+					include[d] = true
+				}
+			case wd.Ordinal > 0 && wd.Ordinal <= len(matches):
+				include[matches[wd.Ordinal-1]] = true
+			case wd.Ordinal < 0 && -wd.Ordinal <= len(matches):
+				include[matches[len(matches)+wd.Ordinal]] = true
+			}
+		}
+	case start.Day() <= last:
+		include[start.Day()] = true
+	}
+	days := []time.Time{}
+	for d := 1; d <= last; d++ {
+		if include[d] {
+			days = append(days, r.day(start, first.Year(), first.Month(), d))
+		}
+	}
+	return days
+}
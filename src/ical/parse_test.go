@@ -0,0 +1,123 @@
+package ical
+
+import (
+	"testing"
+	"time"
+)
+
+func day(year int, month time.Month, d, hour int) time.Time {
+	return time.Date(year, month, d, hour, 0, 0, 0, time.UTC)
+}
+
+func TestParseRRuleUnsupported(t *testing.T) {
+	for _, rule := range []string{
+		"FREQ=HOURLY",
+		"FREQ=DAILY;BYDAY=1MO",
+		"FREQ=WEEKLY;BYDAY=2TU",
+		"FREQ=WEEKLY;BYMONTHDAY=1",
+		"FREQ=WEEKLY;BYDAY=XX",
+		"FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1",
+		"FREQ=MONTHLY;BYDAY=1MO;BYMONTHDAY=1,2,3",
+		"FREQ=MONTHLY;BYDAY=6MO",
+		"FREQ=YEARLY;BYDAY=20MO",
+		"FREQ=WEEKLY;WKST=XX",
+	} {
+		if _, err := parseRRule(rule, time.UTC); err == nil {
+			t.Errorf("%v: expected an error", rule)
+		}
+	}
+}
+
+func TestOccurrences(t *testing.T) {
+	cases := []struct {
+		rule     string
+		start    time.Time
+		exdates  []time.Time
+		winStart time.Time
+		winEnd   time.Time
+		expect   []time.Time
+	}{
+		{
+			"FREQ=DAILY;BYDAY=MO,TU,WE,TH,FR", day(2024, 3, 1, 9), nil, day(2024, 3, 1, 0), day(2024, 3, 6, 0),
+			[]time.Time{day(2024, 3, 1, 9), day(2024, 3, 4, 9), day(2024, 3, 5, 9)},
+		},
+		{
+			"FREQ=DAILY;UNTIL=20240306T090000Z", day(2024, 3, 4, 9), nil, day(2024, 3, 1, 0), day(2024, 4, 1, 0),
+			[]time.Time{day(2024, 3, 4, 9), day(2024, 3, 5, 9), day(2024, 3, 6, 9)},
+		},
+		{
+			"FREQ=WEEKLY;COUNT=3", day(2024, 3, 4, 9), []time.Time{day(2024, 3, 11, 9)}, day(2024, 3, 1, 0), day(2024, 4, 1, 0),
+			[]time.Time{day(2024, 3, 4, 9), day(2024, 3, 18, 9)},
+		},
+		{
+			// Weeks start on Monday by default
+			"FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,SU", day(2024, 3, 4, 9), nil, day(2024, 3, 1, 0), day(2024, 3, 25, 0),
+			[]time.Time{day(2024, 3, 4, 9), day(2024, 3, 10, 9), day(2024, 3, 18, 9), day(2024, 3, 24, 9)},
+		},
+		{
+			"FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,SU;WKST=SU", day(2024, 3, 4, 9), nil, day(2024, 3, 1, 0), day(2024, 3, 25, 0),
+			[]time.Time{day(2024, 3, 4, 9), day(2024, 3, 17, 9), day(2024, 3, 18, 9)},
+		},
+		{
+			"FREQ=MONTHLY;BYDAY=2TU", day(2024, 1, 9, 10), nil, day(2024, 1, 1, 0), day(2024, 5, 1, 0),
+			[]time.Time{day(2024, 1, 9, 10), day(2024, 2, 13, 10), day(2024, 3, 12, 10), day(2024, 4, 9, 10)},
+		},
+		{
+			"FREQ=MONTHLY;BYDAY=-1FR", day(2024, 1, 26, 10), nil, day(2024, 1, 1, 0), day(2024, 4, 1, 0),
+			[]time.Time{day(2024, 1, 26, 10), day(2024, 2, 23, 10), day(2024, 3, 29, 10)},
+		},
+		{
+			// Months without the 31st are skipped
+			"FREQ=MONTHLY", day(2024, 1, 31, 10), nil, day(2024, 1, 1, 0), day(2024, 4, 1, 0),
+			[]time.Time{day(2024, 1, 31, 10), day(2024, 3, 31, 10)},
+		},
+		{
+			"FREQ=MONTHLY;BYMONTHDAY=-1", day(2024, 1, 31, 10), nil, day(2024, 1, 1, 0), day(2024, 4, 1, 0),
+			[]time.Time{day(2024, 1, 31, 10), day(2024, 2, 29, 10), day(2024, 3, 31, 10)},
+		},
+		{
+			"FREQ=YEARLY;BYMONTH=3,9;BYDAY=1MO", day(2024, 3, 4, 10), nil, day(2024, 1, 1, 0), day(2025, 4, 1, 0),
+			[]time.Time{day(2024, 3, 4, 10), day(2024, 9, 2, 10), day(2025, 3, 3, 10)},
+		},
+	}
+	for _, c := range cases {
+		r, err := parseRRule(c.rule, time.UTC)
+		if err != nil {
+			t.Errorf("%v: %v", c.rule, err)
+			continue
+		}
+		ev := &event{Start: c.start, End: c.start.Add(time.Hour), RRule: r, ExDates: map[string]bool{}}
+		for _, ex := range c.exdates {
+			ev.ExDates[occurrenceKey(ex)] = true
+		}
+		got := ev.occurrences(c.winStart, c.winEnd)
+		if len(got) != len(c.expect) {
+			t.Errorf("%v: expected %v, got %v", c.rule, c.expect, got)
+			continue
+		}
+		for i := range got {
+			if !got[i].Equal(c.expect[i]) {
+				t.Errorf("%v: expected %v, got %v", c.rule, c.expect, got)
+				break
+			}
+		}
+	}
+}
+
+// A weekly meeting at 09:00 in its organizer's time zone stays at 09:00 across a daylight saving change
+func TestOccurrencesInTimeZone(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip("No time zone database")
+	}
+	ev, err := parseEvents("BEGIN:VEVENT\nDTSTART;TZID=Europe/London:20240325T090000\nDTEND;TZID=Europe/London:20240325T100000\n" +
+		"RRULE:FREQ=WEEKLY;COUNT=2\nEND:VEVENT\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := ev[0].occurrences(day(2024, 3, 1, 0), day(2024, 5, 1, 0))
+	if len(got) != 2 || !got[0].Equal(time.Date(2024, 3, 25, 9, 0, 0, 0, loc)) ||
+		!got[1].Equal(time.Date(2024, 4, 1, 9, 0, 0, 0, loc)) {
+		t.Errorf("Expected 09:00 London time on 25 March and 1 April, got %v", got)
+	}
+}
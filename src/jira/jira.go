@@ -5,14 +5,80 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 	"timedb"
 )
 
 type Config struct {
-	URL      string // "https://imqssoftware.atlassian.net"
-	Username string
-	Password string
+	URL             string // "https://imqssoftware.atlassian.net"
+	Username        string
+	Password        string
+	JQL             string   // Optional base JQL, such as "issuetype != Test"
+	Projects        []string // If not empty, only fetch issues from these projects (eg "ABC")
+	ExcludeProjects []string // Never fetch issues from these projects
+	// JIRA Cloud hides the email address of people with the default privacy settings. This maps the account ids
+	// of their worklogs to email addresses (eg {"5b10ac8d82e05b22cc7d4ef5": "jane@example.com"}).
+	AccountEmails map[string]string
+}
+
+func quoteJQLList(items []string) string {
+	quoted := []string{}
+	for _, item := range items {
+		quoted = append(quoted, `"`+strings.Replace(item, `"`, `\"`, -1)+`"`)
+	}
+	return strings.Join(quoted, ",")
+}
+
+// ScopeJQL returns the JQL that limits which issues we fetch, excluding the date window.
+// Returns an empty string if we fetch issues from the whole site.
+func (c *Config) ScopeJQL() string {
+	clauses := []string{}
+	if c.JQL != "" {
+		clauses = append(clauses, "("+c.JQL+")")
+	}
+	if len(c.Projects) != 0 {
+		clauses = append(clauses, "project IN ("+quoteJQLList(c.Projects)+")")
+	}
+	if len(c.ExcludeProjects) != 0 {
+		clauses = append(clauses, "project NOT IN ("+quoteJQLList(c.ExcludeProjects)+")")
+	}
+	return strings.Join(clauses, " AND ")
+}
+
+// Returns the full JQL for fetching issues created or resolved between start and end.
+// Older issues that are resolved in the window are fetched again, to pick up their resolution.
+// Returns true if the scope includes the issue with the given key (eg "ABC-1"), by its project.
+// Only Projects and ExcludeProjects are checked, because JQL can only be evaluated by JIRA.
+func (c *Config) KeyInScope(key string) bool {
+	project := key
+	if i := strings.LastIndex(key, "-"); i != -1 {
+		project = key[:i]
+	}
+	for _, p := range c.ExcludeProjects {
+		if strings.EqualFold(p, project) {
+			return false
+		}
+	}
+	if len(c.Projects) == 0 {
+		return true
+	}
+	for _, p := range c.Projects {
+		if strings.EqualFold(p, project) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) windowJQL(start, end time.Time) string {
+	from, to := start.Format("2006-01-02"), end.Format("2006-01-02")
+	jql := fmt.Sprintf(`((created>="%v" AND created<="%v") OR (resolved>="%v" AND resolved<="%v"))`, from, to, from, to)
+	if scope := c.ScopeJQL(); scope != "" {
+		jql = scope + " AND " + jql
+	}
+	return jql
 }
 
 func (c *Config) LoadFile(filename string) error {
@@ -37,18 +103,27 @@ func (f *Fetcher) Fetch(db *timedb.TimeDB, start, end time.Time) error {
 
 type jiraJsonAssignee struct {
 	EmailAddress string
+	AccountId    string `json:"accountId"`
 }
 
 type jiraJsonIssueType struct {
 	Name string `json:"name"`
 }
 
+type jiraJsonParent struct {
+	Id  string `json:"id"`
+	Key string `json:"key"`
+}
+
 type jiraJsonFields struct {
 	Assignee    jiraJsonAssignee  `json:"assignee"`
 	Summary     string            `json:"summary"`
 	StoryPoints float64           `json:"customfield_10004"`
+	EpicLink    string            `json:"customfield_10008"` // Key of the epic, such as "ABC-123"
+	Parent      *jiraJsonParent   `json:"parent"`            // Only populated for sub-tasks
 	IssueType   jiraJsonIssueType `json:"issuetype"`
-	Created     string            `json:"created"` //  "2016-12-05T09:55:24.000+0200"
+	Created     string            `json:"created"`        //  "2016-12-05T09:55:24.000+0200"
+	Resolved    string            `json:"resolutiondate"` // Same format as Created. Empty while unresolved.
 }
 
 type jiraJsonIssue struct {
@@ -63,10 +138,11 @@ type jiraJsonResponse struct {
 	Issues  []jiraJsonIssue `json:"issues"`
 }
 
+// Times are returned in local time, which is how they are stored, and compared to the times of time entries
 func parseTime(jiraTime string) time.Time {
 	//fmt.Printf("Parsing '%v'\n", jiraTime)
 	t, _ := time.Parse("2006-01-02T15:04:05.000Z0700", jiraTime)
-	return t
+	return t.Local()
 }
 
 func parseIssueType(jiraType string) string {
@@ -85,17 +161,49 @@ func parseIssueType(jiraType string) string {
 		return timedb.TicketTypeSpike
 	case "Epic":
 		return timedb.TicketTypeEpic
+	case "Sub-task", "Subtask":
+		return timedb.TicketTypeSubtask
 	}
 	fmt.Printf("Unrecognized issue type %v\n", jiraType)
 	return timedb.TicketTypeOther
 }
 
+// Sub-tasks have a parent. Stories (and anything else) may belong to an epic.
+func parentKey(fields *jiraJsonFields) string {
+	if fields.Parent != nil {
+		return fields.Parent.Key
+	}
+	return fields.EpicLink
+}
+
+func resolveTime(fields *jiraJsonFields) *time.Time {
+	if fields.Resolved == "" {
+		return nil
+	}
+	t := parseTime(fields.Resolved)
+	return &t
+}
+
+func issueToFormat1(issue *jiraJsonIssue) timedb.IssueFormat1 {
+	return timedb.IssueFormat1{
+		System:      timedb.SystemTypeJira,
+		SystemID:    issue.Id,
+		Key:         issue.Key,
+		ParentKey:   parentKey(&issue.Fields),
+		Title:       issue.Fields.Summary,
+		Type:        parseIssueType(issue.Fields.IssueType.Name),
+		StoryPoints: int(issue.Fields.StoryPoints),
+		CreateTime:  parseTime(issue.Fields.Created),
+		ResolveTime: resolveTime(&issue.Fields),
+	}
+}
+
 func (f *Fetcher) fetchIssues(db *timedb.TimeDB, start, end time.Time) error {
 	// https://imqssoftware.atlassian.net/rest/api/2/search?startAt=0&jql=created>"2016-12-07"
 	offset := 0
 	//start := time.Date(2016, time.November, 22, 0, 0, 0, 0, time.UTC)
 	for {
-		body, err := f.fetchUrl(f.Config.URL + fmt.Sprintf(`/rest/api/2/search?startAt=%v&jql=created>="%v"+AND+created<="%v"`, offset, start.Format("2006-01-02"), end.Format("2006-01-02")))
+		body, err := f.fetchUrl(f.Config.URL + fmt.Sprintf(`/rest/api/2/search?startAt=%v&jql=%v`, offset, url.QueryEscape(f.Config.windowJQL(start, end))))
 		//body, err := ioutil.ReadFile("ben-issues.json")
 		if err != nil {
 			return err
@@ -113,15 +221,8 @@ func (f *Fetcher) fetchIssues(db *timedb.TimeDB, start, end time.Time) error {
 		//break
 
 		issues := []timedb.IssueFormat1{}
-		for _, issue := range resp.Issues {
-			issues = append(issues, timedb.IssueFormat1{
-				System:      timedb.SystemTypeJira,
-				SystemID:    issue.Id,
-				Title:       issue.Fields.Summary,
-				Type:        parseIssueType(issue.Fields.IssueType.Name),
-				StoryPoints: int(issue.Fields.StoryPoints),
-				CreateTime:  parseTime(issue.Fields.Created),
-			})
+		for i := range resp.Issues {
+			issues = append(issues, issueToFormat1(&resp.Issues[i]))
 		}
 		if err = db.InsertIssues1(issues); err != nil {
 			return err
@@ -135,6 +236,14 @@ func (f *Fetcher) Name() string {
 	return "JIRA"
 }
 
+func (f *Fetcher) Scope() string {
+	scope := f.Config.ScopeJQL()
+	if scope == "" {
+		scope = "all projects"
+	}
+	return f.Config.URL + " " + scope
+}
+
 func (f *Fetcher) FetchRaw(start, end time.Time) ([]byte, error) {
 	return f.fetchUrl(f.Config.URL + "/")
 }
@@ -151,6 +260,10 @@ func (f *Fetcher) fetchUrl(url string) ([]byte, error) {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	// An invalid JQL query is a 400, whose body would otherwise decode as no issues
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP Error: %v", resp.Status)
+	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("Error reading JIRA HTTP response body: %v", err)
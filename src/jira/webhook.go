@@ -0,0 +1,168 @@
+package jira
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+	"timedb"
+)
+
+/*
+JIRA webhooks are registered under System > WebHooks, pointing at our server's /webhook/jira endpoint.
+We handle these events:
+
+jira:issue_created, jira:issue_updated, jira:issue_deleted
+	{"timestamp": 1481180000000, "webhookEvent": "jira:issue_updated", "issue": {"id": "10002", "key": "ABC-1", "fields": {...}}}
+
+worklog_created, worklog_updated, worklog_deleted
+	{"timestamp": 1481180000000, "webhookEvent": "worklog_created", "worklog": {"id": "100", "issueId": "10002", "author": {...}, "started": "...", "timeSpentSeconds": 3600}}
+*/
+
+const (
+	WebhookIssueCreated  = "jira:issue_created"
+	WebhookIssueUpdated  = "jira:issue_updated"
+	WebhookIssueDeleted  = "jira:issue_deleted"
+	WebhookWorklogCreate = "worklog_created"
+	WebhookWorklogUpdate = "worklog_updated"
+	WebhookWorklogDelete = "worklog_deleted"
+)
+
+type jiraJsonWorklog struct {
+	Id               string           `json:"id"`
+	IssueId          string           `json:"issueId"`
+	Author           jiraJsonAssignee `json:"author"`
+	Started          string           `json:"started"` //  "2016-12-05T09:55:24.000+0200"
+	TimeSpentSeconds int64            `json:"timeSpentSeconds"`
+}
+
+type WebhookEvent struct {
+	Timestamp    int64            `json:"timestamp"`
+	WebhookEvent string           `json:"webhookEvent"`
+	Issue        *jiraJsonIssue   `json:"issue"`
+	Worklog      *jiraJsonWorklog `json:"worklog"`
+}
+
+func ParseWebhook(body []byte) (*WebhookEvent, error) {
+	ev := &WebhookEvent{}
+	if err := json.Unmarshal(body, ev); err != nil {
+		return nil, fmt.Errorf("Error decoding JIRA webhook: %v", err)
+	}
+	switch ev.WebhookEvent {
+	case WebhookIssueCreated, WebhookIssueUpdated, WebhookIssueDeleted:
+		if ev.Issue == nil {
+			return nil, fmt.Errorf("JIRA webhook %v has no issue", ev.WebhookEvent)
+		}
+	case WebhookWorklogCreate, WebhookWorklogUpdate, WebhookWorklogDelete:
+		if ev.Worklog == nil {
+			return nil, fmt.Errorf("JIRA webhook %v has no worklog", ev.WebhookEvent)
+		}
+		if ev.WebhookEvent != WebhookWorklogDelete {
+			if _, err := parseWorklogStarted(ev.Worklog.Started); err != nil {
+				return nil, fmt.Errorf("JIRA webhook %v: %v", ev.WebhookEvent, err)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported JIRA webhook event '%v'", ev.WebhookEvent)
+	}
+	return ev, nil
+}
+
+// Worklog start times are in the author's time zone
+func parseWorklogStarted(started string) (time.Time, error) {
+	t, err := time.Parse("2006-01-02T15:04:05.000Z0700", started)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid worklog start time '%v'", started)
+	}
+	return t, nil
+}
+
+// The email address of the author of a worklog, which JIRA Cloud leaves out for most people,
+// in which case it is looked up by their account id. Returns an empty string if it is unknown.
+func (e *WebhookEvent) authorEmail(cfg *Config) string {
+	if author := e.Worklog.Author; author.EmailAddress != "" {
+		return author.EmailAddress
+	} else if author.AccountId != "" {
+		return cfg.AccountEmails[author.AccountId]
+	}
+	return ""
+}
+
+// IgnoreReason returns why the event is not applied, or an empty string if it is applied.
+// An ignored event is still valid, so JIRA must not be asked to deliver it again.
+// Issues outside of the projects of the config are ignored, like they are when fetching. A worklog event
+// only identifies its issue by id, so when projects are scoped, worklogs of issues that we don't have are ignored.
+func (e *WebhookEvent) IgnoreReason(db *timedb.TimeDB, cfg *Config) (string, error) {
+	if e.Issue != nil && !cfg.KeyInScope(e.Issue.Key) {
+		return fmt.Sprintf("Issue %v is not in the projects of config/jira.json", e.Issue.Key), nil
+	}
+	if e.Worklog != nil && (len(cfg.Projects) != 0 || len(cfg.ExcludeProjects) != 0) {
+		key, err := db.TicketKeyFromSystemID(timedb.SystemTypeJira, e.Worklog.IssueId)
+		if err != nil {
+			return "", err
+		}
+		if key == "" || !cfg.KeyInScope(key) {
+			return fmt.Sprintf("The issue of worklog %v is not in the projects of config/jira.json", e.Worklog.Id), nil
+		}
+	}
+	if e.WebhookEvent == WebhookWorklogCreate || e.WebhookEvent == WebhookWorklogUpdate {
+		if e.authorEmail(cfg) == "" {
+			return fmt.Sprintf("The author of worklog %v has no email address. Add their account id '%v' to AccountEmails in config/jira.json",
+				e.Worklog.Id, e.Worklog.Author.AccountId), nil
+		}
+	}
+	return "", nil
+}
+
+// The kind and id of the issue or worklog that the event is about
+func (e *WebhookEvent) object() (kind, systemid string) {
+	if e.Worklog != nil {
+		return "worklog", e.Worklog.Id
+	}
+	return "issue", e.Issue.Id
+}
+
+// Apply the event to the database. Applying the same event more than once has no further effect.
+// JIRA doesn't deliver events in order, particularly when it retries, so an event that is older than one
+// that has already been applied to the same issue or worklog is ignored.
+func (e *WebhookEvent) Apply(db *timedb.TimeDB, cfg *Config) error {
+	kind, systemid := e.object()
+	newer, err := db.HasNewerWebhookEvent(kind, systemid, e.Timestamp)
+	if err != nil {
+		return err
+	}
+	if newer {
+		return nil
+	}
+	if err := e.apply(db, cfg); err != nil {
+		return err
+	}
+	return db.RecordWebhookObject(kind, systemid, e.Timestamp)
+}
+
+func (e *WebhookEvent) apply(db *timedb.TimeDB, cfg *Config) error {
+	switch e.WebhookEvent {
+	case WebhookIssueCreated, WebhookIssueUpdated:
+		return db.InsertIssues1([]timedb.IssueFormat1{issueToFormat1(e.Issue)})
+	case WebhookIssueDeleted:
+		return db.DeleteTicket(timedb.SystemTypeJira, e.Issue.Id)
+	case WebhookWorklogCreate, WebhookWorklogUpdate:
+		start, err := parseWorklogStarted(e.Worklog.Started)
+		if err != nil {
+			return err
+		}
+		return db.InsertTimes2([]timedb.TimeFormat2{
+			{
+				System:         timedb.SystemTypeJira,
+				SystemID:       e.Worklog.Id,
+				Email:          e.authorEmail(cfg),
+				TicketSystem:   timedb.SystemTypeJira,
+				TicketSystemID: e.Worklog.IssueId,
+				Start:          start,
+				End:            start.Add(time.Duration(e.Worklog.TimeSpentSeconds) * time.Second),
+			},
+		})
+	case WebhookWorklogDelete:
+		return db.DeleteTime(timedb.SystemTypeJira, e.Worklog.Id)
+	}
+	return nil
+}
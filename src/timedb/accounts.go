@@ -0,0 +1,165 @@
+package timedb
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// An account is a login to the dashboard. It is linked to a user (ie the person whose time is tracked)
+// by email address, so UserID is 0 if no time has been recorded for the account's email address yet.
+type Account struct {
+	AccountID   int64
+	Email       string
+	Role        string
+	HasPassword bool    // False for accounts that can only sign in with OIDC
+	LeadTeamIDs []int64 // The teams that this account leads
+	UserID      int64
+}
+
+const accountSelect = `
+SELECT a.accountid, a.email, a.role, a.password_hash IS NOT NULL,
+	COALESCE((SELECT userid FROM users WHERE lower(users.email) = lower(a.email)),
+		(SELECT userid FROM user_aliases WHERE lower(user_aliases.email) = lower(a.email)), 0),
+	COALESCE(l.teamid, 0)
+FROM accounts AS a
+LEFT JOIN account_lead_teams AS l ON l.accountid = a.accountid`
+
+func scanAccounts(rows *sql.Rows) ([]Account, error) {
+	defer rows.Close()
+	accounts := []Account{}
+	for rows.Next() {
+		a := Account{LeadTeamIDs: []int64{}}
+		teamid := int64(0)
+		if err := rows.Scan(&a.AccountID, &a.Email, &a.Role, &a.HasPassword, &a.UserID, &teamid); err != nil {
+			return nil, err
+		}
+		if len(accounts) == 0 || accounts[len(accounts)-1].AccountID != a.AccountID {
+			accounts = append(accounts, a)
+		}
+		if teamid != 0 {
+			last := &accounts[len(accounts)-1]
+			last.LeadTeamIDs = append(last.LeadTeamIDs, teamid)
+		}
+	}
+	return accounts, rows.Err()
+}
+
+// Returns all accounts, ordered by email
+func (t *TimeDB) Accounts() ([]Account, error) {
+	rows, err := t.Conn.Query(accountSelect + " ORDER BY lower(a.email), a.accountid")
+	if err != nil {
+		return nil, err
+	}
+	return scanAccounts(rows)
+}
+
+// Returns the account with the given email address, and its password hash, or nil if there is no such account
+func (t *TimeDB) AccountByEmail(email string) (*Account, string, error) {
+	var hash sql.NullString
+	err := t.Conn.QueryRow("SELECT password_hash FROM accounts WHERE lower(email) = lower($1)", email).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return nil, "", nil
+	} else if err != nil {
+		return nil, "", err
+	}
+	rows, err := t.Conn.Query(accountSelect+" WHERE lower(a.email) = lower($1)", email)
+	if err != nil {
+		return nil, "", err
+	}
+	accounts, err := scanAccounts(rows)
+	if err != nil || len(accounts) == 0 {
+		return nil, "", err
+	}
+	return &accounts[0], hash.String, nil
+}
+
+// Returns the accountid of the new account. passwordHash may be empty for an OIDC-only account.
+func (t *TimeDB) CreateAccount(email, role, passwordHash string) (int64, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return 0, fmt.Errorf("Email may not be empty")
+	}
+	accountid := int64(0)
+	err := t.Conn.QueryRow("INSERT INTO accounts (email, role, password_hash) VALUES ($1, $2, $3) RETURNING accountid",
+		email, role, nullString(passwordHash)).Scan(&accountid)
+	if err != nil && isKeyViolation(err) {
+		return 0, fmt.Errorf("An account for '%v' already exists", email)
+	}
+	return accountid, err
+}
+
+// Change the role of an account, and the teams that it leads
+func (t *TimeDB) UpdateAccount(accountid int64, role string, leadTeamIDs []int64) error {
+	tx, err := t.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE accounts SET role = $1 WHERE accountid = $2", role, accountid); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM account_lead_teams WHERE accountid = $1", accountid); err != nil {
+		return err
+	}
+	for _, teamid := range leadTeamIDs {
+		if _, err := tx.Exec("INSERT INTO account_lead_teams (accountid, teamid) VALUES ($1, $2)", accountid, teamid); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Set the password hash of an account. An empty hash disables password login.
+// All existing sessions of the account are ended.
+func (t *TimeDB) SetAccountPassword(accountid int64, passwordHash string) error {
+	if _, err := t.Conn.Exec("UPDATE accounts SET password_hash = $1 WHERE accountid = $2", nullString(passwordHash), accountid); err != nil {
+		return err
+	}
+	_, err := t.Conn.Exec("DELETE FROM sessions WHERE accountid = $1", accountid)
+	return err
+}
+
+// Delete an account, and end its sessions
+func (t *TimeDB) DeleteAccount(accountid int64) error {
+	tx, err := t.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range []string{"sessions", "account_lead_teams", "accounts"} {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %v WHERE accountid = $1", table), accountid); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Sessions are identified by the hash of their token, so that the tokens themselves are never stored
+func (t *TimeDB) CreateSession(tokenHash string, accountid int64, expires time.Time) error {
+	if _, err := t.Conn.Exec("DELETE FROM sessions WHERE expires < $1", time.Now().UTC()); err != nil {
+		return err
+	}
+	_, err := t.Conn.Exec("INSERT INTO sessions (token_hash, accountid, expires) VALUES ($1, $2, $3)", tokenHash, accountid, expires.UTC())
+	return err
+}
+
+// Returns the account of an unexpired session, or nil
+func (t *TimeDB) SessionAccount(tokenHash string) (*Account, error) {
+	rows, err := t.Conn.Query(accountSelect+" WHERE a.accountid = (SELECT accountid FROM sessions WHERE token_hash = $1 AND expires > $2)",
+		tokenHash, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	accounts, err := scanAccounts(rows)
+	if err != nil || len(accounts) == 0 {
+		return nil, err
+	}
+	return &accounts[0], nil
+}
+
+func (t *TimeDB) DeleteSession(tokenHash string) error {
+	_, err := t.Conn.Exec("DELETE FROM sessions WHERE token_hash = $1", tokenHash)
+	return err
+}
@@ -0,0 +1,97 @@
+package timedb
+
+import (
+	"database/sql"
+	"time"
+)
+
+// An alert that was raised when an alert rule's condition held for a team
+type Alert struct {
+	AlertID    int64
+	Rule       string
+	TeamID     int64
+	Team       string
+	FirstWeek  time.Time // Start of the first week in which the condition held
+	Value      float64   // The most recent value of the rule's metric
+	Threshold  float64
+	Message    string
+	FiredAt    time.Time
+	NotifiedAt *time.Time // nil until the notification has been delivered
+	ResolvedAt *time.Time // nil while the condition still holds
+}
+
+const alertFields = `a.alertid, a.rule, a.teamid, COALESCE(t.name, ''), a.first_week, a.value, a.threshold, a.message,
+	a.fired_at, a.notified_at, a.resolved_at`
+
+func scanAlerts(rows *sql.Rows) ([]Alert, error) {
+	defer rows.Close()
+	alerts := []Alert{}
+	for rows.Next() {
+		a := Alert{}
+		if err := rows.Scan(&a.AlertID, &a.Rule, &a.TeamID, &a.Team, &a.FirstWeek, &a.Value, &a.Threshold, &a.Message,
+			&a.FiredAt, &a.NotifiedAt, &a.ResolvedAt); err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, a)
+	}
+	return alerts, rows.Err()
+}
+
+// Returns the open alert of a rule and team, or nil if there is none
+func (t *TimeDB) OpenAlert(rule string, teamid int64) (*Alert, error) {
+	rows, err := t.Conn.Query("SELECT "+alertFields+" FROM alerts AS a LEFT JOIN teams AS t ON t.teamid = a.teamid WHERE a.rule = $1 AND a.teamid = $2 AND a.resolved_at IS NULL", rule, teamid)
+	if err != nil {
+		return nil, err
+	}
+	alerts, err := scanAlerts(rows)
+	if err != nil || len(alerts) == 0 {
+		return nil, err
+	}
+	return &alerts[0], nil
+}
+
+// Returns all open alerts
+func (t *TimeDB) OpenAlerts() ([]Alert, error) {
+	rows, err := t.Conn.Query("SELECT " + alertFields + " FROM alerts AS a LEFT JOIN teams AS t ON t.teamid = a.teamid WHERE a.resolved_at IS NULL ORDER BY a.alertid")
+	if err != nil {
+		return nil, err
+	}
+	return scanAlerts(rows)
+}
+
+// Raise a new alert. Returns an alertid of 0 if the rule already has an open alert for the team.
+func (t *TimeDB) InsertAlert(a *Alert) (int64, error) {
+	alertid := int64(0)
+	err := t.Conn.QueryRow(`INSERT INTO alerts (rule, teamid, first_week, value, threshold, message, fired_at) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING alertid`,
+		a.Rule, a.TeamID, a.FirstWeek.Format("2006-01-02"), a.Value, a.Threshold, a.Message, a.FiredAt).Scan(&alertid)
+	if err != nil && isKeyViolation(err) {
+		return 0, nil
+	}
+	return alertid, err
+}
+
+// Update the value and message of an open alert, as the condition continues to hold
+func (t *TimeDB) UpdateAlert(alertid int64, value float64, message string) error {
+	_, err := t.Conn.Exec("UPDATE alerts SET value = $1, message = $2 WHERE alertid = $3", value, message, alertid)
+	return err
+}
+
+func (t *TimeDB) SetAlertNotified(alertid int64) error {
+	_, err := t.Conn.Exec("UPDATE alerts SET notified_at = $1 WHERE alertid = $2", time.Now(), alertid)
+	return err
+}
+
+func (t *TimeDB) ResolveAlert(alertid int64) error {
+	_, err := t.Conn.Exec("UPDATE alerts SET resolved_at = $1 WHERE alertid = $2", time.Now(), alertid)
+	return err
+}
+
+// Returns the most recent alerts, open and resolved, newest first. A limit of 0 returns all alerts.
+func (t *TimeDB) RecentAlerts(limit int) ([]Alert, error) {
+	limitSQL := sql.NullInt64{Int64: int64(limit), Valid: limit > 0}
+	rows, err := t.Conn.Query("SELECT "+alertFields+" FROM alerts AS a LEFT JOIN teams AS t ON t.teamid = a.teamid ORDER BY a.fired_at DESC LIMIT $1", limitSQL)
+	if err != nil {
+		return nil, err
+	}
+	return scanAlerts(rows)
+}
@@ -0,0 +1,426 @@
+package timedb
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Kinds of contract scope, which decide which time a contract bills
+const (
+	ScopeProject     = "project" // The project, as recorded by the time source
+	ScopeJiraProject = "jira"    // A JIRA project, which is the prefix of its ticket keys
+	ScopeEpic        = "epic"    // A JIRA epic, with its stories and their sub-tasks
+)
+
+// How contracts round billed time
+const (
+	RoundUp      = "up"
+	RoundNearest = "nearest"
+	RoundDown    = "down"
+
+	RoundPerEntry = "entry" // Each time entry
+	RoundPerDay   = "day"   // The time of a person, on a ticket, in a day
+	RoundPerLine  = "line"  // Each line of the invoice
+)
+
+type Client struct {
+	ClientID int64
+	Name     string
+}
+
+// A contract with a client, which bills the time of its scopes at its hourly rate
+type Contract struct {
+	ContractID   int64
+	ClientID     int64
+	Client       string
+	Name         string
+	HourlyRate   float64
+	Currency     string
+	Start        time.Time
+	End          *time.Time // Exclusive. nil for an open ended contract.
+	RoundMinutes int        // Billed time is rounded to a multiple of this. 0 for no rounding.
+	RoundMode    string
+	RoundPer     string
+	Scopes       []ContractScope
+}
+
+// A project, JIRA project or epic whose time belongs to a contract. The time of a non-billable scope is
+// reported, but not invoiced, such as an epic of warranty work inside a client's JIRA project.
+type ContractScope struct {
+	ScopeID  int64
+	Kind     string
+	Value    string
+	Billable bool
+}
+
+// An invoice, which locks its period of the contract until it is voided
+type Invoice struct {
+	InvoiceID        int64
+	ContractID       int64
+	Contract         string
+	Client           string
+	Number           string
+	PeriodStart      time.Time
+	PeriodEnd        time.Time // Exclusive
+	IssuedAt         time.Time
+	IssuedBy         string
+	Currency         string
+	BillableHours    float64
+	NonBillableHours float64
+	Amount           float64
+	VoidedAt         *time.Time
+	Lines            []InvoiceLine `json:",omitempty"` // Only populated by Invoice()
+}
+
+type InvoiceLine struct {
+	TicketKey   string
+	Description string
+	RawHours    float64 // Before rounding
+	Hours       float64
+	Rate        float64
+	Amount      float64
+}
+
+// A time entry that may be billable, with everything that contract scopes match on
+type BillingEntry struct {
+	Start       time.Time
+	Seconds     float64
+	UserID      int64
+	Email       string
+	Project     string
+	TicketID    int64
+	TicketKey   string
+	TicketTitle string
+	JiraProject string
+	EpicKey     string // The nearest epic above the ticket, or the ticket itself if it is an epic
+}
+
+func ValidScopeKind(kind string) bool {
+	return kind == ScopeProject || kind == ScopeJiraProject || kind == ScopeEpic
+}
+
+// Returns the clientid of a client, creating the client if it does not exist
+func (t *TimeDB) ClientID(name string) (int64, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return 0, fmt.Errorf("Client name is empty")
+	}
+	clientid := int64(0)
+	err := t.Conn.QueryRow("SELECT clientid FROM clients WHERE name = $1", name).Scan(&clientid)
+	if err == sql.ErrNoRows {
+		err = t.Conn.QueryRow("INSERT INTO clients (name) VALUES ($1) RETURNING clientid", name).Scan(&clientid)
+	}
+	return clientid, err
+}
+
+const contractFields = `c.contractid, c.clientid, COALESCE(l.name, ''), c.name, c.hourly_rate, COALESCE(c.currency, ''),
+	c.start_day, c.end_day, c.round_minutes, c.round_mode, c.round_per`
+
+// Returns all contracts, with their scopes, ordered by client and name
+func (t *TimeDB) Contracts() ([]Contract, error) {
+	rows, err := t.Conn.Query("SELECT " + contractFields + " FROM contracts AS c LEFT JOIN clients AS l ON l.clientid = c.clientid ORDER BY l.name, c.name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	contracts := []Contract{}
+	index := map[int64]int{}
+	for rows.Next() {
+		c := Contract{Scopes: []ContractScope{}}
+		if err := rows.Scan(&c.ContractID, &c.ClientID, &c.Client, &c.Name, &c.HourlyRate, &c.Currency,
+			&c.Start, &c.End, &c.RoundMinutes, &c.RoundMode, &c.RoundPer); err != nil {
+			return nil, err
+		}
+		index[c.ContractID] = len(contracts)
+		contracts = append(contracts, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	scopes, err := t.Conn.Query("SELECT scopeid, contractid, kind, value, billable FROM contract_scopes ORDER BY kind, value")
+	if err != nil {
+		return nil, err
+	}
+	defer scopes.Close()
+	for scopes.Next() {
+		s := ContractScope{}
+		contractid := int64(0)
+		if err := scopes.Scan(&s.ScopeID, &contractid, &s.Kind, &s.Value, &s.Billable); err != nil {
+			return nil, err
+		}
+		if i, ok := index[contractid]; ok {
+			contracts[i].Scopes = append(contracts[i].Scopes, s)
+		}
+	}
+	return contracts, scopes.Err()
+}
+
+// Returns a contract, with its scopes, or nil if there is no such contract
+func (t *TimeDB) Contract(contractid int64) (*Contract, error) {
+	all, err := t.Contracts()
+	if err != nil {
+		return nil, err
+	}
+	for i := range all {
+		if all[i].ContractID == contractid {
+			return &all[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// Returns the contractid of a contract, or 0 if there is no such contract
+func (t *TimeDB) ContractIDFromName(name string) (int64, error) {
+	contractid := int64(0)
+	err := t.Conn.QueryRow("SELECT contractid FROM contracts WHERE name = $1", name).Scan(&contractid)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return contractid, err
+}
+
+// Create a contract, or update the contract of the same name. The scopes of c are ignored.
+func (t *TimeDB) SetContract(c *Contract) (int64, error) {
+	c.Name = strings.TrimSpace(c.Name)
+	if c.Name == "" || c.ClientID == 0 {
+		return 0, fmt.Errorf("A contract needs a name and a client")
+	}
+	if c.HourlyRate < 0 || c.RoundMinutes < 0 {
+		return 0, fmt.Errorf("The rate and rounding of a contract may not be negative")
+	}
+	if c.RoundMode == "" {
+		c.RoundMode = RoundUp
+	}
+	if c.RoundPer == "" {
+		c.RoundPer = RoundPerEntry
+	}
+	if c.RoundMode != RoundUp && c.RoundMode != RoundNearest && c.RoundMode != RoundDown {
+		return 0, fmt.Errorf("Invalid rounding mode '%v'. Expected up, nearest or down", c.RoundMode)
+	}
+	if c.RoundPer != RoundPerEntry && c.RoundPer != RoundPerDay && c.RoundPer != RoundPerLine {
+		return 0, fmt.Errorf("Invalid rounding '%v'. Expected entry, day or line", c.RoundPer)
+	}
+	var end interface{}
+	if c.End != nil {
+		end = c.End.Format("2006-01-02")
+	}
+	contractid, err := t.ContractIDFromName(c.Name)
+	if err != nil {
+		return 0, err
+	}
+	if contractid == 0 {
+		err = t.Conn.QueryRow(`INSERT INTO contracts (clientid, name, hourly_rate, currency, start_day, end_day, round_minutes, round_mode, round_per)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING contractid`,
+			c.ClientID, c.Name, c.HourlyRate, nullString(c.Currency), c.Start.Format("2006-01-02"), end, c.RoundMinutes, c.RoundMode, c.RoundPer).Scan(&contractid)
+		return contractid, err
+	}
+	_, err = t.Conn.Exec(`UPDATE contracts SET clientid = $1, hourly_rate = $2, currency = $3, start_day = $4, end_day = $5, round_minutes = $6,
+		round_mode = $7, round_per = $8 WHERE contractid = $9`,
+		c.ClientID, c.HourlyRate, nullString(c.Currency), c.Start.Format("2006-01-02"), end, c.RoundMinutes, c.RoundMode, c.RoundPer, contractid)
+	return contractid, err
+}
+
+// Add a scope to a contract, or change whether an existing scope is billable
+func (t *TimeDB) SetContractScope(contractid int64, kind, value string, billable bool) error {
+	value = strings.TrimSpace(value)
+	if !ValidScopeKind(kind) || value == "" {
+		return fmt.Errorf("Invalid scope '%v:%v'. Expected project, jira or epic, and a name or key", kind, value)
+	}
+	res, err := t.Conn.Exec("UPDATE contract_scopes SET billable = $1 WHERE contractid = $2 AND kind = $3 AND value = $4", billable, contractid, kind, value)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n != 0 {
+		return nil
+	}
+	_, err = t.Conn.Exec("INSERT INTO contract_scopes (contractid, kind, value, billable) VALUES ($1, $2, $3, $4)", contractid, kind, value, billable)
+	return err
+}
+
+func (t *TimeDB) DeleteContractScope(contractid int64, kind, value string) error {
+	_, err := t.Conn.Exec("DELETE FROM contract_scopes WHERE contractid = $1 AND kind = $2 AND value = $3", contractid, kind, strings.TrimSpace(value))
+	return err
+}
+
+// Returns the time entries that start in [start, end), with their project, JIRA project and epic
+const billingEntriesQuery = `
+WITH RECURSIVE chain (origin, ticket_key, parent_key, ticket_type, depth) AS (
+	SELECT ticketid, ticket_key, parent_key, ticket_type, 0 FROM tickets
+	WHERE system = $3 AND ticketid IN (SELECT ticketid FROM times WHERE start_time >= $1 AND start_time < $2)
+	UNION ALL
+	SELECT c.origin, p.ticket_key, p.parent_key, p.ticket_type, c.depth + 1
+	FROM chain AS c INNER JOIN tickets AS p ON p.system = $3 AND p.ticket_key = c.parent_key
+	WHERE c.depth < $4
+),
+epic AS (
+	SELECT DISTINCT ON (origin) origin, ticket_key FROM chain WHERE ticket_type = $5 ORDER BY origin, depth
+)
+SELECT t.start_time, EXTRACT(EPOCH FROM t.end_time - t.start_time), t.userid, COALESCE(u.email, ''), COALESCE(t.project, ''),
+	COALESCE(k.ticketid, 0), COALESCE(k.ticket_key, ''), COALESCE(k.title, ''), COALESCE(k.system, ''), COALESCE(e.ticket_key, '')
+FROM times AS t
+LEFT JOIN tickets AS k ON k.ticketid = t.ticketid
+LEFT JOIN users AS u ON u.userid = t.userid
+LEFT JOIN epic AS e ON e.origin = t.ticketid
+WHERE t.start_time >= $1 AND t.start_time < $2
+ORDER BY t.start_time`
+
+// Returns the time entries that start in [start, end), for matching against contract scopes
+func (t *TimeDB) BillingEntries(start, end time.Time) ([]BillingEntry, error) {
+	rows, err := t.Conn.Query(billingEntriesQuery, start, end, SystemTypeJira, maxHierarchyDepth, TicketTypeEpic)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []BillingEntry{}
+	for rows.Next() {
+		e := BillingEntry{}
+		system := ""
+		if err := rows.Scan(&e.Start, &e.Seconds, &e.UserID, &e.Email, &e.Project, &e.TicketID, &e.TicketKey, &e.TicketTitle, &system, &e.EpicKey); err != nil {
+			return nil, err
+		}
+		if system == SystemTypeJira {
+			if dash := strings.LastIndex(e.TicketKey, "-"); dash > 0 {
+				e.JiraProject = e.TicketKey[:dash]
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Returned by InsertInvoice when the contract already has an invoice for part of the period
+type PeriodLockedError struct {
+	Number string
+}
+
+func (e *PeriodLockedError) Error() string {
+	return fmt.Sprintf("The period is locked by invoice %v. Void that invoice first.", e.Number)
+}
+
+// Returns the invoice that locks part of [start, end) of a contract, or nil if the period is open
+func (t *TimeDB) LockingInvoice(contractid int64, start, end time.Time) (*Invoice, error) {
+	rows, err := t.Conn.Query("SELECT "+invoiceFields+" "+invoiceFrom+` WHERE i.contractid = $1 AND i.voided_at IS NULL
+		AND i.period_start < $3 AND $2 < i.period_end ORDER BY i.period_start LIMIT 1`, contractid, start.Format("2006-01-02"), end.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	invoices, err := scanInvoices(rows)
+	if err != nil || len(invoices) == 0 {
+		return nil, err
+	}
+	return &invoices[0], nil
+}
+
+// Insert an invoice and its lines, which locks its period of the contract.
+// Returns a *PeriodLockedError if another invoice already covers part of the period.
+func (t *TimeDB) InsertInvoice(inv *Invoice) (int64, error) {
+	tx, err := t.Conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	// Serialize the invoices of a contract, so that two invoices can't lock the same period
+	if _, err := tx.Exec("SELECT contractid FROM contracts WHERE contractid = $1 FOR UPDATE", inv.ContractID); err != nil {
+		return 0, err
+	}
+	start, end := inv.PeriodStart.Format("2006-01-02"), inv.PeriodEnd.Format("2006-01-02")
+	number := ""
+	err = tx.QueryRow(`SELECT number FROM invoices WHERE contractid = $1 AND voided_at IS NULL AND period_start < $3 AND $2 < period_end LIMIT 1`,
+		inv.ContractID, start, end).Scan(&number)
+	if err == nil {
+		return 0, &PeriodLockedError{Number: number}
+	} else if err != sql.ErrNoRows {
+		return 0, err
+	}
+	invoiceid := int64(0)
+	err = tx.QueryRow(`INSERT INTO invoices (contractid, number, period_start, period_end, issued_at, issued_by, currency, billable_hours, nonbillable_hours, amount)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING invoiceid`,
+		inv.ContractID, inv.Number, start, end, inv.IssuedAt, inv.IssuedBy, nullString(inv.Currency), inv.BillableHours, inv.NonBillableHours, inv.Amount).Scan(&invoiceid)
+	if err != nil {
+		if isKeyViolation(err) {
+			return 0, fmt.Errorf("Invoice number %v is already in use", inv.Number)
+		}
+		return 0, err
+	}
+	for i, l := range inv.Lines {
+		if _, err := tx.Exec("INSERT INTO invoice_lines (invoiceid, line, ticket_key, description, raw_hours, hours, rate, amount) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+			invoiceid, i+1, l.TicketKey, l.Description, l.RawHours, l.Hours, l.Rate, l.Amount); err != nil {
+			return 0, err
+		}
+	}
+	return invoiceid, tx.Commit()
+}
+
+// Void an invoice, which unlocks its period
+func (t *TimeDB) VoidInvoice(invoiceid int64) error {
+	_, err := t.Conn.Exec("UPDATE invoices SET voided_at = $1 WHERE invoiceid = $2 AND voided_at IS NULL", time.Now(), invoiceid)
+	return err
+}
+
+const invoiceFields = `i.invoiceid, i.contractid, COALESCE(c.name, ''), COALESCE(l.name, ''), i.number, i.period_start, i.period_end,
+	i.issued_at, i.issued_by, COALESCE(i.currency, ''), i.billable_hours, i.nonbillable_hours, i.amount, i.voided_at`
+
+const invoiceFrom = `FROM invoices AS i LEFT JOIN contracts AS c ON c.contractid = i.contractid LEFT JOIN clients AS l ON l.clientid = c.clientid`
+
+func scanInvoices(rows *sql.Rows) ([]Invoice, error) {
+	defer rows.Close()
+	invoices := []Invoice{}
+	for rows.Next() {
+		i := Invoice{}
+		if err := rows.Scan(&i.InvoiceID, &i.ContractID, &i.Contract, &i.Client, &i.Number, &i.PeriodStart, &i.PeriodEnd,
+			&i.IssuedAt, &i.IssuedBy, &i.Currency, &i.BillableHours, &i.NonBillableHours, &i.Amount, &i.VoidedAt); err != nil {
+			return nil, err
+		}
+		invoices = append(invoices, i)
+	}
+	return invoices, rows.Err()
+}
+
+// Returns all invoices, newest period first, without their lines
+func (t *TimeDB) Invoices() ([]Invoice, error) {
+	rows, err := t.Conn.Query("SELECT " + invoiceFields + " " + invoiceFrom + " ORDER BY i.period_start DESC, l.name, c.name")
+	if err != nil {
+		return nil, err
+	}
+	return scanInvoices(rows)
+}
+
+// Returns an invoice, with its lines, or nil if there is no such invoice
+func (t *TimeDB) Invoice(invoiceid int64) (*Invoice, error) {
+	rows, err := t.Conn.Query("SELECT "+invoiceFields+" "+invoiceFrom+" WHERE i.invoiceid = $1", invoiceid)
+	if err != nil {
+		return nil, err
+	}
+	invoices, err := scanInvoices(rows)
+	if err != nil || len(invoices) == 0 {
+		return nil, err
+	}
+	inv := &invoices[0]
+	lines, err := t.Conn.Query("SELECT ticket_key, description, raw_hours, hours, rate, amount FROM invoice_lines WHERE invoiceid = $1 ORDER BY line", invoiceid)
+	if err != nil {
+		return nil, err
+	}
+	defer lines.Close()
+	inv.Lines = []InvoiceLine{}
+	for lines.Next() {
+		l := InvoiceLine{}
+		if err := lines.Scan(&l.TicketKey, &l.Description, &l.RawHours, &l.Hours, &l.Rate, &l.Amount); err != nil {
+			return nil, err
+		}
+		inv.Lines = append(inv.Lines, l)
+	}
+	return inv, lines.Err()
+}
+
+// Returns the invoiceid of an invoice number, or 0 if there is no such invoice
+func (t *TimeDB) InvoiceIDFromNumber(number string) (int64, error) {
+	invoiceid := int64(0)
+	err := t.Conn.QueryRow("SELECT invoiceid FROM invoices WHERE number = $1", number).Scan(&invoiceid)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return invoiceid, err
+}
@@ -0,0 +1,284 @@
+package timedb
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Capitalisation classes
+const (
+	ClassCapEx = "capex" // Capitalisable development
+	ClassOpEx  = "opex"  // Operating expense
+)
+
+// Kinds of capitalisation rule, from the least to the most specific
+const (
+	RuleTicketType = "type"
+	RuleEpic       = "epic"
+	RuleTicket     = "ticket"
+)
+
+// A capitalisation rule classifies the time of a ticket type, an epic (with its stories and sub-tasks), or a single ticket
+type CapitalisationRule struct {
+	Kind  string
+	Value string // Ticket type, or JIRA key
+	Class string
+}
+
+// A change to a capitalisation rule. An empty class means that there was, or is, no rule.
+type CapitalisationChange struct {
+	ChangeID  int64
+	Kind      string
+	Value     string
+	OldClass  string
+	NewClass  string
+	ChangedBy string
+	ChangedAt time.Time
+	Reason    string
+}
+
+// A row of the capitalisation report, which is the time of a team on a project
+type CapitalisationRow struct {
+	TeamID          int64 // 0 for the time of people that were in no team
+	Team            string
+	Project         string
+	CapExSeconds    float64
+	OpExSeconds     float64
+	CapExCost       float64 `json:",omitempty"` // Costs are only populated by a cost query
+	OpExCost        float64 `json:",omitempty"`
+	UncostedSeconds float64 `json:",omitempty"`
+}
+
+// A sign-off of the capitalisation report of a period, with a copy of the report as it was signed
+type CapitalisationSignOff struct {
+	SignOffID   int64
+	PeriodStart time.Time
+	PeriodEnd   time.Time // Exclusive
+	SignedBy    string
+	SignedAt    time.Time
+	Note        string
+	Rows        []CapitalisationRow `json:",omitempty"` // Only populated by CapitalisationSignOff()
+}
+
+func ValidCapitalisationRule(kind, class string) bool {
+	return (kind == RuleTicketType || kind == RuleEpic || kind == RuleTicket) && (class == ClassCapEx || class == ClassOpEx || class == "")
+}
+
+// Returns all capitalisation rules, ordered by kind and value
+func (t *TimeDB) CapitalisationRules() ([]CapitalisationRule, error) {
+	rows, err := t.Conn.Query("SELECT kind, value, class FROM capitalisation_rules ORDER BY kind, value")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rules := []CapitalisationRule{}
+	for rows.Next() {
+		r := CapitalisationRule{}
+		if err := rows.Scan(&r.Kind, &r.Value, &r.Class); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+// Set the class of a ticket type, epic or ticket, and record the change. An empty class removes the rule,
+// so that the time falls back to the next, less specific, rule.
+func (t *TimeDB) SetCapitalisationRule(kind, value, class, changedBy, reason string) error {
+	value = strings.TrimSpace(value)
+	if !ValidCapitalisationRule(kind, class) || value == "" {
+		return fmt.Errorf("Invalid rule '%v:%v' = '%v'. Expected type, epic or ticket, and capex, opex or nothing", kind, value, class)
+	}
+	if kind != RuleTicketType {
+		value = strings.ToUpper(value)
+	}
+	tx, err := t.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	old := ""
+	err = tx.QueryRow("SELECT class FROM capitalisation_rules WHERE kind = $1 AND value = $2 FOR UPDATE", kind, value).Scan(&old)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if old == class {
+		return nil
+	}
+	if _, err := tx.Exec("DELETE FROM capitalisation_rules WHERE kind = $1 AND value = $2", kind, value); err != nil {
+		return err
+	}
+	if class != "" {
+		if _, err := tx.Exec("INSERT INTO capitalisation_rules (kind, value, class) VALUES ($1, $2, $3)", kind, value, class); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO capitalisation_changes (kind, value, old_class, new_class, changed_by, changed_at, reason) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		kind, value, old, class, changedBy, time.Now(), reason); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Returns the changes to capitalisation rules, newest first. A limit of 0 returns all changes.
+func (t *TimeDB) CapitalisationChanges(limit int) ([]CapitalisationChange, error) {
+	limitSQL := sql.NullInt64{Int64: int64(limit), Valid: limit > 0}
+	rows, err := t.Conn.Query(`SELECT changeid, kind, value, old_class, new_class, changed_by, changed_at, COALESCE(reason, '')
+		FROM capitalisation_changes ORDER BY changed_at DESC, changeid DESC LIMIT $1`, limitSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	changes := []CapitalisationChange{}
+	for rows.Next() {
+		c := CapitalisationChange{}
+		if err := rows.Scan(&c.ChangeID, &c.Kind, &c.Value, &c.OldClass, &c.NewClass, &c.ChangedBy, &c.ChangedAt, &c.Reason); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// QueryCapitalisation sums the CapEx and OpEx time of [start, end) per team and project, of the given teams,
+// or of everybody if teamids is nil. With cost, it also sums the cost of the time. A person that was in
+// several teams has their time counted in each.
+func (t *TimeDB) QueryCapitalisation(start, end time.Time, teamids []int64, cost bool) ([]CapitalisationRow, error) {
+	if teamids != nil && len(teamids) == 0 {
+		return []CapitalisationRow{}, nil
+	}
+	q := newSelectQuery("classified AS t")
+	startArg, endArg, jiraArg := q.arg(start), q.arg(end), q.arg(SystemTypeJira)
+
+	// The nearest epic of every JIRA ticket that has time logged against it in the period
+	first := q.sub("tickets").columns("ticketid", "ticket_key", "parent_key", "ticket_type", "0").
+		where("system = " + jiraArg).
+		where("ticketid IN (SELECT ticketid FROM times WHERE start_time >= " + startArg + " AND start_time < " + endArg + ")")
+	parents := q.sub("chain AS c").columns("c.origin", "p.ticket_key", "p.parent_key", "p.ticket_type", "c.depth + 1").
+		join("INNER JOIN tickets AS p ON p.system = " + jiraArg + " AND p.ticket_key = c.parent_key").
+		where("c.depth < " + q.arg(maxHierarchyDepth))
+	q.withRecursive("chain (origin, ticket_key, parent_key, ticket_type, depth)", first.unionAll(parents))
+	q.with("epic", q.sub("chain").columns("DISTINCT ON (origin) origin", "ticket_key").
+		where("ticket_type = "+q.arg(TicketTypeEpic)).orderBy("origin", "depth"))
+
+	// Every time entry of the period, classified by the rule of its ticket, else of its epic, else of its ticket type
+	q.with("classified", q.sub("times AS t").
+		columns("t.userid", "t.start_time", "t.end_time", "COALESCE(t.project, '') AS project",
+			"COALESCE(rk.class, re.class, rt.class, "+q.arg(ClassOpEx)+") AS class").
+		join("LEFT JOIN tickets AS k ON k.ticketid = t.ticketid").
+		join("LEFT JOIN epic AS e ON e.origin = t.ticketid").
+		join("LEFT JOIN capitalisation_rules AS rk ON rk.kind = 'ticket' AND k.system = "+jiraArg+" AND rk.value = upper(k.ticket_key)").
+		join("LEFT JOIN capitalisation_rules AS re ON re.kind = 'epic' AND re.value = upper(e.ticket_key)").
+		join("LEFT JOIN capitalisation_rules AS rt ON rt.kind = 'type' AND rt.value = k.ticket_type").
+		where("t.start_time >= "+startArg).where("t.start_time < "+endArg))
+
+	q.columns("COALESCE(tm.teamid, 0)", "COALESCE(tm.name, '')", "t.project",
+		"COALESCE(sum("+secondsExpr+") FILTER (WHERE t.class = 'capex'), 0)",
+		"COALESCE(sum("+secondsExpr+") FILTER (WHERE t.class <> 'capex'), 0)")
+	q.join(`LEFT JOIN team_members AS m ON m.userid = t.userid
+	AND (m.effective_from IS NULL OR m.effective_from <= t.start_time) AND (m.effective_to IS NULL OR t.start_time < m.effective_to)`)
+	q.join("LEFT JOIN teams AS tm ON tm.teamid = m.teamid")
+	if cost {
+		q.columns("COALESCE(sum("+costExpr+") FILTER (WHERE t.class = 'capex'), 0)",
+			"COALESCE(sum("+costExpr+") FILTER (WHERE t.class <> 'capex'), 0)", "COALESCE(sum("+uncostedExpr+"), 0)")
+		q.join(rateJoin)
+	} else {
+		q.columns("0", "0", "0")
+	}
+	if teamids != nil {
+		q.whereIn("tm.teamid", teamids)
+	}
+	q.groupBy("tm.teamid", "tm.name", "t.project").orderBy("tm.name NULLS LAST", "t.project")
+
+	rows, err := t.Conn.Query(q.sql(), q.args()...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := []CapitalisationRow{}
+	for rows.Next() {
+		r := CapitalisationRow{}
+		if err := rows.Scan(&r.TeamID, &r.Team, &r.Project, &r.CapExSeconds, &r.OpExSeconds, &r.CapExCost, &r.OpExCost, &r.UncostedSeconds); err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+// Sign off the capitalisation report of [start, end), keeping a copy of it, with costs.
+// Returns a signoffid of 0 if the period has already been signed off.
+func (t *TimeDB) SignOffCapitalisation(start, end time.Time, signedBy, note string) (int64, error) {
+	report, err := t.QueryCapitalisation(start, end, nil, true)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := t.Conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	signoffid := int64(0)
+	err = tx.QueryRow("INSERT INTO capitalisation_signoffs (period_start, period_end, signed_by, signed_at, note) VALUES ($1, $2, $3, $4, $5) RETURNING signoffid",
+		start.Format("2006-01-02"), end.Format("2006-01-02"), signedBy, time.Now(), nullString(note)).Scan(&signoffid)
+	if err != nil {
+		if isKeyViolation(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	for _, r := range report {
+		if _, err := tx.Exec(`INSERT INTO capitalisation_signoff_rows (signoffid, teamid, team, project, capex_seconds, opex_seconds, capex_cost, opex_cost, uncosted_seconds)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`, signoffid, r.TeamID, r.Team, r.Project, r.CapExSeconds, r.OpExSeconds, r.CapExCost, r.OpExCost, r.UncostedSeconds); err != nil {
+			return 0, err
+		}
+	}
+	return signoffid, tx.Commit()
+}
+
+// Returns all sign-offs, newest period first, without their rows
+func (t *TimeDB) CapitalisationSignOffs() ([]CapitalisationSignOff, error) {
+	rows, err := t.Conn.Query("SELECT signoffid, period_start, period_end, signed_by, signed_at, COALESCE(note, '') FROM capitalisation_signoffs ORDER BY period_start DESC, period_end DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	signoffs := []CapitalisationSignOff{}
+	for rows.Next() {
+		s := CapitalisationSignOff{}
+		if err := rows.Scan(&s.SignOffID, &s.PeriodStart, &s.PeriodEnd, &s.SignedBy, &s.SignedAt, &s.Note); err != nil {
+			return nil, err
+		}
+		signoffs = append(signoffs, s)
+	}
+	return signoffs, rows.Err()
+}
+
+// Returns the sign-off of exactly the period [start, end), with its rows, or nil if the period has not been signed off
+func (t *TimeDB) CapitalisationSignOff(start, end time.Time) (*CapitalisationSignOff, error) {
+	s := &CapitalisationSignOff{}
+	err := t.Conn.QueryRow("SELECT signoffid, period_start, period_end, signed_by, signed_at, COALESCE(note, '') FROM capitalisation_signoffs WHERE period_start = $1 AND period_end = $2",
+		start.Format("2006-01-02"), end.Format("2006-01-02")).Scan(&s.SignOffID, &s.PeriodStart, &s.PeriodEnd, &s.SignedBy, &s.SignedAt, &s.Note)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	rows, err := t.Conn.Query(`SELECT teamid, team, project, capex_seconds, opex_seconds, capex_cost, opex_cost, uncosted_seconds
+		FROM capitalisation_signoff_rows WHERE signoffid = $1 ORDER BY team = '', team, project`, s.SignOffID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	s.Rows = []CapitalisationRow{}
+	for rows.Next() {
+		r := CapitalisationRow{}
+		if err := rows.Scan(&r.TeamID, &r.Team, &r.Project, &r.CapExSeconds, &r.OpExSeconds, &r.CapExCost, &r.OpExCost, &r.UncostedSeconds); err != nil {
+			return nil, err
+		}
+		s.Rows = append(s.Rows, r)
+	}
+	return s, rows.Err()
+}
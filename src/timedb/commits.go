@@ -0,0 +1,162 @@
+package timedb
+
+import (
+	"database/sql"
+	"time"
+)
+
+// This format was built to work with 'git log' output
+type CommitFormat1 struct {
+	Repo       string
+	Hash       string
+	Email      string
+	Time       time.Time // In any time zone. It is stored as local wall clock time, like the times of time entries.
+	Summary    string    // First line of the commit message
+	TicketKeys []string  // JIRA keys mentioned in the commit message
+}
+
+type Commit struct {
+	Repo    string
+	Hash    string
+	UserID  int64  // 0 if the author is not a user
+	Email   string // Of the user, or else of the author
+	Time    time.Time
+	Summary string
+}
+
+type TicketUserHours struct {
+	UserID  int64
+	Email   string
+	Seconds float64
+	Commits int
+}
+
+// TicketActivity is the logged time and commits of a single ticket
+type TicketActivity struct {
+	TicketID    int64
+	Key         string
+	Title       string
+	Type        string
+	StoryPoints int
+	Users       []TicketUserHours
+	Commits     []Commit
+}
+
+// Insert commits, and link them to the tickets that they mention.
+// Keys that don't match any ticket are ignored. Authors that are not users (such as bots and outside
+// contributors) are not made users, but their email addresses are kept on the commits.
+func (t *TimeDB) InsertCommits1(commits []CommitFormat1) error {
+	cache := newCaches()
+	tx, err := t.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	for _, c := range commits {
+		userid := int64(0)
+		if userid, err = t.existingEmailToUser(tx, cache, SystemTypeGit, c.Email); err != nil {
+			break
+		}
+		dbUserID := sql.NullInt64{Int64: userid, Valid: userid != 0}
+		commitTime := c.Time.Local()
+		commitid := int64(0)
+		err = tx.QueryRow(`UPDATE commits SET userid = $1, author_email = $2, commit_time = $3, summary = $4 WHERE repo = $5 AND hash = $6
+			RETURNING commitid`, dbUserID, c.Email, commitTime, c.Summary, c.Repo, c.Hash).Scan(&commitid)
+		if err == sql.ErrNoRows {
+			err = tx.QueryRow(`INSERT INTO commits (repo, hash, userid, author_email, commit_time, summary) VALUES ($1, $2, $3, $4, $5, $6)
+				RETURNING commitid`, c.Repo, c.Hash, dbUserID, c.Email, commitTime, c.Summary).Scan(&commitid)
+		}
+		if err != nil {
+			break
+		}
+		if _, err = tx.Exec("DELETE FROM commit_tickets WHERE commitid = $1", commitid); err != nil {
+			break
+		}
+		linked := map[int64]bool{}
+		for _, key := range c.TicketKeys {
+			ticketid := int64(0)
+			if ticketid, err = t.keyToTicket(tx, cache, key); err != nil {
+				break
+			}
+			if ticketid == 0 || linked[ticketid] {
+				continue
+			}
+			linked[ticketid] = true
+			if _, err = tx.Exec("INSERT INTO commit_tickets (commitid, ticketid) VALUES ($1, $2)", commitid, ticketid); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	} else {
+		return tx.Commit()
+	}
+}
+
+// Returns the ticketid of the JIRA ticket with the given key, or 0 if there is no such ticket
+func (t *TimeDB) TicketIDFromKey(key string) (int64, error) {
+	ticketid := int64(0)
+	err := t.Conn.QueryRow("SELECT ticketid FROM tickets WHERE system = $1 AND ticket_key = $2", SystemTypeJira, key).Scan(&ticketid)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return ticketid, err
+}
+
+// Returns the hours logged per user against a ticket, alongside the commits that mention the ticket
+func (t *TimeDB) QueryTicketActivity(ticketid int64) (*TicketActivity, error) {
+	a := &TicketActivity{TicketID: ticketid}
+	err := t.Conn.QueryRow("SELECT COALESCE(ticket_key, ''), title, ticket_type, COALESCE(story_points, 0) FROM tickets WHERE ticketid = $1", ticketid).Scan(
+		&a.Key, &a.Title, &a.Type, &a.StoryPoints)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := t.Conn.Query(`
+SELECT u.userid, u.email, COALESCE(h.seconds, 0), COALESCE(c.commits, 0) FROM users AS u
+LEFT JOIN (SELECT userid, sum(EXTRACT(EPOCH FROM end_time - start_time)) AS seconds FROM times WHERE ticketid = $1 GROUP BY userid) AS h ON h.userid = u.userid
+LEFT JOIN (SELECT c.userid, count(*) AS commits FROM commits AS c INNER JOIN commit_tickets AS ct ON ct.commitid = c.commitid
+	WHERE ct.ticketid = $1 GROUP BY c.userid) AS c ON c.userid = u.userid
+WHERE h.userid IS NOT NULL OR c.userid IS NOT NULL
+ORDER BY COALESCE(h.seconds, 0) DESC`, ticketid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	a.Users = []TicketUserHours{}
+	for rows.Next() {
+		u := TicketUserHours{}
+		if err := rows.Scan(&u.UserID, &u.Email, &u.Seconds, &u.Commits); err != nil {
+			return nil, err
+		}
+		a.Users = append(a.Users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	crows, err := t.Conn.Query(`
+SELECT c.repo, c.hash, COALESCE(c.userid, 0), COALESCE(u.email, c.author_email, ''), c.commit_time, c.summary FROM commits AS c
+INNER JOIN commit_tickets AS ct ON ct.commitid = c.commitid
+LEFT JOIN users AS u ON u.userid = c.userid
+WHERE ct.ticketid = $1
+ORDER BY c.commit_time`, ticketid)
+	if err != nil {
+		return nil, err
+	}
+	defer crows.Close()
+	a.Commits = []Commit{}
+	for crows.Next() {
+		c := Commit{}
+		if err := crows.Scan(&c.Repo, &c.Hash, &c.UserID, &c.Email, &c.Time, &c.Summary); err != nil {
+			return nil, err
+		}
+		a.Commits = append(a.Commits, c)
+	}
+	return a, crows.Err()
+}
@@ -0,0 +1,229 @@
+package timedb
+
+import (
+	"sort"
+	"time"
+)
+
+// A team that worked on a ticket
+type TicketTeam struct {
+	TeamID int64
+	Team   string
+}
+
+// The lead time, time to first work, and active work span of a resolved ticket.
+// Work is the time logged against the ticket, and against its sub-tasks.
+type TicketCycleTime struct {
+	TicketID         int64
+	Key              string
+	Title            string
+	Type             string
+	StoryPoints      int
+	CreateTime       time.Time
+	ResolveTime      time.Time
+	FirstWork        *time.Time // Start of the first time entry. nil if no time was logged.
+	LastWork         *time.Time // End of the last time entry
+	LeadSeconds      float64    // From created to resolved
+	FirstWorkSeconds *float64   // From created to the first work, or 0 if work started before the ticket was created
+	ActiveSeconds    float64    // From the first work to the last work
+	WorkSeconds      float64    // Time logged
+	Teams            []TicketTeam
+}
+
+// Percentiles of a duration, in seconds
+type Percentiles struct {
+	P50 float64
+	P85 float64
+	P95 float64
+}
+
+// The distribution of the cycle times of the tickets of a team and ticket type that were resolved in a period
+type CycleTimeStats struct {
+	TeamID     int64  // 0 for tickets of no team, or for all teams together
+	Team       string // Empty for all teams together
+	TicketType string // Empty for all ticket types together
+	Period     time.Time
+	Tickets    int
+	Worked     int // Tickets that have time logged against them, which FirstWork and ActiveSpan are of
+	LeadTime   Percentiles
+	FirstWork  Percentiles
+	ActiveSpan Percentiles
+}
+
+// QueryCycleTimes returns the cycle times of the tickets resolved in [start, end), in order of resolution.
+// If teamids is not nil, only the tickets that these teams worked on are returned, and if types is not
+// empty, only tickets of these types. Sub-tasks and epics are left out, because their work is that of
+// their stories. The teams of a ticket are those whose members logged time against it while they were members.
+func (t *TimeDB) QueryCycleTimes(start, end time.Time, teamids []int64, types []string) ([]TicketCycleTime, error) {
+	if teamids != nil && len(teamids) == 0 {
+		return []TicketCycleTime{}, nil
+	}
+	q := newSelectQuery("resolved AS r")
+	subtaskArg := q.arg(TicketTypeSubtask)
+	resolved := q.sub("tickets").
+		columns("ticketid", "ticket_key", "title", "ticket_type", "story_points", "create_time", "resolve_time").
+		where("resolve_time >= " + q.arg(start)).where("resolve_time < " + q.arg(end)).where("create_time IS NOT NULL").
+		where("ticket_type NOT IN (" + subtaskArg + ", " + q.arg(TicketTypeEpic) + ")")
+	if len(types) != 0 {
+		resolved.whereInStrings("ticket_type", types)
+	}
+	q.with("resolved", resolved)
+	// The time logged against each ticket, and against its sub-tasks
+	q.with("work", q.sub("resolved AS r").
+		columns("r.ticketid", "t.userid", "t.start_time", "t.end_time").
+		join("INNER JOIN tickets AS k ON k.ticketid = r.ticketid OR (k.system = "+q.arg(SystemTypeJira)+
+			" AND k.ticket_type = "+subtaskArg+" AND k.parent_key = r.ticket_key)").
+		join("INNER JOIN times AS t ON t.ticketid = k.ticketid"))
+	q.with("span", q.sub("work").
+		columns("ticketid", "min(start_time) AS first_work", "max(end_time) AS last_work",
+			"sum(EXTRACT(EPOCH FROM end_time - start_time)) AS seconds").
+		groupBy("ticketid"))
+	q.with("ticket_teams", q.sub("work AS w").columns("DISTINCT w.ticketid", "m.teamid").join(workTeamJoin))
+
+	q.columns("r.ticketid", "COALESCE(r.ticket_key, '')", "r.title", "r.ticket_type", "COALESCE(r.story_points, 0)",
+		"r.create_time", "r.resolve_time", "s.first_work", "s.last_work", "COALESCE(s.seconds, 0)",
+		"COALESCE(tm.teamid, 0)", "COALESCE(tm.name, '')").
+		join("LEFT JOIN span AS s ON s.ticketid = r.ticketid").
+		join("LEFT JOIN ticket_teams AS tt ON tt.ticketid = r.ticketid").
+		join("LEFT JOIN teams AS tm ON tm.teamid = tt.teamid").
+		orderBy("r.resolve_time", "r.ticketid", "tm.name")
+	if teamids != nil {
+		q.whereIn("tt.teamid", teamids)
+	}
+	rows, err := t.Conn.Query(q.sql(), q.args()...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tickets := []TicketCycleTime{}
+	for rows.Next() {
+		k := TicketCycleTime{}
+		team := TicketTeam{}
+		if err := rows.Scan(&k.TicketID, &k.Key, &k.Title, &k.Type, &k.StoryPoints, &k.CreateTime, &k.ResolveTime,
+			&k.FirstWork, &k.LastWork, &k.WorkSeconds, &team.TeamID, &team.Team); err != nil {
+			return nil, err
+		}
+		// A ticket has a row per team
+		if n := len(tickets); n != 0 && tickets[n-1].TicketID == k.TicketID {
+			tickets[n-1].Teams = append(tickets[n-1].Teams, team)
+			continue
+		}
+		k.Teams = []TicketTeam{}
+		if team.TeamID != 0 {
+			k.Teams = append(k.Teams, team)
+		}
+		k.LeadSeconds = k.ResolveTime.Sub(k.CreateTime).Seconds()
+		if k.FirstWork != nil {
+			first := k.FirstWork.Sub(k.CreateTime).Seconds()
+			if first < 0 {
+				first = 0
+			}
+			k.FirstWorkSeconds = &first
+			k.ActiveSeconds = k.LastWork.Sub(*k.FirstWork).Seconds()
+		}
+		tickets = append(tickets, k)
+	}
+	return tickets, rows.Err()
+}
+
+// Returns the start of the bucket that contains t, or the zero time for BucketNone
+func (b ReportBucket) start(t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	switch b {
+	case BucketDay:
+		return day
+	case BucketWeek:
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case BucketMonth:
+		return day.AddDate(0, 0, 1-day.Day())
+	case BucketQuarter:
+		return time.Date(t.Year(), t.Month()-(t.Month()-1)%3, 1, 0, 0, 0, 0, t.Location())
+	case BucketYear:
+		return time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, t.Location())
+	}
+	return time.Time{}
+}
+
+// The value at fraction p of the sorted values, interpolated between the nearest two
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	pos := p * float64(len(sorted)-1)
+	i := int(pos)
+	if i+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[i] + (pos-float64(i))*(sorted[i+1]-sorted[i])
+}
+
+func percentiles(values []float64) Percentiles {
+	sort.Float64s(values)
+	return Percentiles{P50: percentile(values, 0.5), P85: percentile(values, 0.85), P95: percentile(values, 0.95)}
+}
+
+// CycleTimeDistribution returns the percentiles of the cycle times of the tickets, by the bucket that they were
+// resolved in, and by ticket type, as well as for all ticket types together. With byTeam, it is also by team,
+// and a ticket that several teams worked on counts for each of them. Otherwise all of the tickets are taken
+// together. The result is ordered by team, period and ticket type.
+func CycleTimeDistribution(tickets []TicketCycleTime, bucket ReportBucket, byTeam bool) []CycleTimeStats {
+	type key struct {
+		team       TicketTeam
+		period     time.Time
+		ticketType string
+	}
+	type values struct {
+		lead, first, active []float64
+	}
+	groups := map[key]*values{}
+	add := func(k key, t *TicketCycleTime) {
+		v := groups[k]
+		if v == nil {
+			v = &values{}
+			groups[k] = v
+		}
+		v.lead = append(v.lead, t.LeadSeconds)
+		if t.FirstWorkSeconds != nil {
+			v.first = append(v.first, *t.FirstWorkSeconds)
+			v.active = append(v.active, t.ActiveSeconds)
+		}
+	}
+	for i := range tickets {
+		t := &tickets[i]
+		teams := []TicketTeam{{}}
+		if byTeam && len(t.Teams) != 0 {
+			teams = t.Teams
+		}
+		period := bucket.start(t.ResolveTime)
+		for _, team := range teams {
+			add(key{team, period, t.Type}, t)
+			add(key{team, period, ""}, t)
+		}
+	}
+
+	stats := []CycleTimeStats{}
+	for k, v := range groups {
+		stats = append(stats, CycleTimeStats{
+			TeamID:     k.team.TeamID,
+			Team:       k.team.Team,
+			TicketType: k.ticketType,
+			Period:     k.period,
+			Tickets:    len(v.lead),
+			Worked:     len(v.first),
+			LeadTime:   percentiles(v.lead),
+			FirstWork:  percentiles(v.first),
+			ActiveSpan: percentiles(v.active),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		a, b := &stats[i], &stats[j]
+		if a.Team != b.Team {
+			return a.Team != "" && (b.Team == "" || a.Team < b.Team)
+		}
+		if !a.Period.Equal(b.Period) {
+			return a.Period.Before(b.Period)
+		}
+		return a.TicketType < b.TicketType
+	})
+	return stats
+}
@@ -0,0 +1,44 @@
+package timedb
+
+import (
+	"strings"
+	"time"
+)
+
+// Returns the email addresses of the accounts that lead the team
+func (t *TimeDB) TeamLeadEmails(teamid int64) ([]string, error) {
+	rows, err := t.Conn.Query(`
+SELECT a.email FROM accounts AS a
+INNER JOIN account_lead_teams AS l ON l.accountid = a.accountid
+WHERE l.teamid = $1 ORDER BY lower(a.email)`, teamid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	emails := []string{}
+	for rows.Next() {
+		email := ""
+		if err := rows.Scan(&email); err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+	return emails, rows.Err()
+}
+
+// Claim the digest of the team, for the period that starts on the given day, before sending it.
+// Returns false if it has already been claimed, so that each digest is sent only once, even by several servers.
+func (t *TimeDB) ClaimDigest(teamid int64, periodStart time.Time, recipients []string) (bool, error) {
+	_, err := t.Conn.Exec("INSERT INTO digest_sends (teamid, period_start, sent_at, recipients) VALUES ($1, $2, $3, $4)",
+		teamid, periodStart.Format("2006-01-02"), time.Now(), strings.Join(recipients, ", "))
+	if err != nil && isKeyViolation(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Release a claim, after failing to send the digest, so that it is tried again
+func (t *TimeDB) ReleaseDigest(teamid int64, periodStart time.Time) error {
+	_, err := t.Conn.Exec("DELETE FROM digest_sends WHERE teamid = $1 AND period_start = $2", teamid, periodStart.Format("2006-01-02"))
+	return err
+}
@@ -0,0 +1,192 @@
+package timedb
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeFilter selects time entries. Zero values mean "no restriction", except for UserIDs and TeamIDs,
+// where nil means all users, but an empty (non-nil) slice means no users.
+// TeamIDs selects the time entries of people who were members of one of the teams at the time.
+type TimeFilter struct {
+	UserIDs     []int64
+	TeamIDs     []int64
+	Start       time.Time // Inclusive
+	End         time.Time // Exclusive
+	TicketTypes []string
+	Systems     []string
+	Projects    []string
+}
+
+// Returns the WHERE clause (without the WHERE keyword) for a query where 't' is the times table,
+// and 'k' is the tickets table. Returns "TRUE" if there are no restrictions.
+func (f *TimeFilter) Where(args []interface{}) (string, []interface{}) {
+	clauses := []string{}
+	if f.UserIDs != nil {
+		if len(f.UserIDs) == 0 {
+			clauses = append(clauses, "FALSE")
+		} else {
+			clause := ""
+			clause, args = inClause("t.userid", f.UserIDs, args)
+			clauses = append(clauses, clause)
+		}
+	}
+	if f.TeamIDs != nil {
+		if len(f.TeamIDs) == 0 {
+			clauses = append(clauses, "FALSE")
+		} else {
+			clause := ""
+			clause, args = inClause("m.teamid", f.TeamIDs, args)
+			clauses = append(clauses, `EXISTS (SELECT 1 FROM team_members AS m WHERE m.userid = t.userid AND `+clause+`
+				AND (m.effective_from IS NULL OR m.effective_from <= t.start_time) AND (m.effective_to IS NULL OR t.start_time < m.effective_to))`)
+		}
+	}
+	if !f.Start.IsZero() {
+		args = append(args, f.Start)
+		clauses = append(clauses, "t.start_time >= $"+strconv.Itoa(len(args)))
+	}
+	if !f.End.IsZero() {
+		args = append(args, f.End)
+		clauses = append(clauses, "t.start_time < $"+strconv.Itoa(len(args)))
+	}
+	if len(f.TicketTypes) != 0 {
+		clause := ""
+		clause, args = inClauseStrings("k.ticket_type", f.TicketTypes, args)
+		clauses = append(clauses, clause)
+	}
+	if len(f.Systems) != 0 {
+		clause := ""
+		clause, args = inClauseStrings("t.system", f.Systems, args)
+		clauses = append(clauses, clause)
+	}
+	if len(f.Projects) != 0 {
+		clause := ""
+		clause, args = inClauseStrings("t.project", f.Projects, args)
+		clauses = append(clauses, clause)
+	}
+	if len(clauses) == 0 {
+		return "TRUE", args
+	}
+	return strings.Join(clauses, " AND "), args
+}
+
+// A time entry, joined to its ticket and user
+type ExportRow struct {
+	Email       string
+	System      string
+	SystemID    string
+	Start       time.Time
+	End         time.Time
+	Hours       float64
+	Project     string
+	TicketKey   string
+	TicketTitle string
+	TicketType  string
+	StoryPoints int
+}
+
+// ExportTimes calls fn for every time entry that matches the filter, in order of start time.
+// Rows are streamed from the database, so this is suitable for large exports.
+func (t *TimeDB) ExportTimes(filter *TimeFilter, fn func(row *ExportRow) error) error {
+	where, args := filter.Where(nil)
+	rows, err := t.Conn.Query(`
+SELECT u.email, t.system, COALESCE(t.systemid, ''), t.start_time, t.end_time, EXTRACT(EPOCH FROM t.end_time - t.start_time) / 3600,
+	COALESCE(t.project, ''), COALESCE(k.ticket_key, ''), COALESCE(k.title, ''), COALESCE(k.ticket_type, ''), COALESCE(k.story_points, 0)
+FROM times AS t
+INNER JOIN users AS u ON u.userid = t.userid
+INNER JOIN tickets AS k ON k.ticketid = t.ticketid
+WHERE `+where+`
+ORDER BY t.start_time, u.email`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	row := ExportRow{}
+	for rows.Next() {
+		if err := rows.Scan(&row.Email, &row.System, &row.SystemID, &row.Start, &row.End, &row.Hours,
+			&row.Project, &row.TicketKey, &row.TicketTitle, &row.TicketType, &row.StoryPoints); err != nil {
+			return err
+		}
+		if err := fn(&row); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Returns the userids of the given email addresses. Unknown addresses are ignored.
+func (t *TimeDB) UserIDsFromEmails(emails []string) ([]int64, error) {
+	lower := []string{}
+	for _, e := range emails {
+		lower = append(lower, strings.ToLower(e))
+	}
+	ids := []int64{}
+	clause, args := inClauseStrings("lower(email)", lower, nil)
+	if clause == "" {
+		return ids, nil
+	}
+	rows, err := t.Conn.Query("SELECT userid FROM users WHERE "+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		id := int64(0)
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// A time entry, as returned by QueryTimes
+type TimeEntry struct {
+	UserID      int64
+	Email       string
+	System      string
+	SystemID    string
+	Start       time.Time
+	End         time.Time
+	Hours       float64
+	Project     string
+	TicketID    int64
+	TicketKey   string
+	TicketTitle string
+	TicketType  string
+}
+
+// QueryTimes returns a page of the time entries that match the filter, in order of start time,
+// and the total number of entries that match the filter.
+func (t *TimeDB) QueryTimes(filter *TimeFilter, limit, offset int) ([]TimeEntry, int, error) {
+	where, args := filter.Where(nil)
+	total := 0
+	if err := t.Conn.QueryRow("SELECT count(*) FROM times AS t INNER JOIN tickets AS k ON k.ticketid = t.ticketid WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	args = append(args, limit, offset)
+	rows, err := t.Conn.Query(`
+SELECT t.userid, u.email, t.system, COALESCE(t.systemid, ''), t.start_time, t.end_time, EXTRACT(EPOCH FROM t.end_time - t.start_time) / 3600,
+	COALESCE(t.project, ''), k.ticketid, COALESCE(k.ticket_key, ''), COALESCE(k.title, ''), COALESCE(k.ticket_type, '')
+FROM times AS t
+INNER JOIN users AS u ON u.userid = t.userid
+INNER JOIN tickets AS k ON k.ticketid = t.ticketid
+WHERE `+where+`
+ORDER BY t.start_time, u.email, t.system, t.systemid
+LIMIT $`+strconv.Itoa(len(args)-1)+` OFFSET $`+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	entries := []TimeEntry{}
+	for rows.Next() {
+		e := TimeEntry{}
+		if err := rows.Scan(&e.UserID, &e.Email, &e.System, &e.SystemID, &e.Start, &e.End, &e.Hours,
+			&e.Project, &e.TicketID, &e.TicketKey, &e.TicketTitle, &e.TicketType); err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, total, rows.Err()
+}
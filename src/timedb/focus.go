@@ -0,0 +1,169 @@
+package timedb
+
+import (
+	"sort"
+	"time"
+)
+
+// Time entries of the same ticket that are at most this far apart are one uninterrupted block of work
+const focusBlockGap = 5 * time.Minute
+
+// Time sources that only record hours per ticket per day, as entries that all start at 01:00. Their entries
+// overlap, and their order says nothing about when the work was done, so they are left out of focus.
+var focusDaySystems = []string{SystemTypeTMetric, SystemTypeHarvest}
+
+// How fragmented the work of a person was on a day. Only time sources that record when the work was done
+// count, so the time of focusDaySystems is left out.
+type FocusDay struct {
+	UserID              int64
+	Email               string
+	Day                 time.Time
+	Tickets             int     // Distinct tickets worked on
+	Switches            int     // Changes from one ticket to another, in order of time
+	LongestBlockSeconds float64 // Longest uninterrupted block of work on one ticket
+	Seconds             float64
+	InterruptSeconds    float64 // Time on interrupt tickets
+	InterruptShare      float64 // InterruptSeconds as a fraction of Seconds
+}
+
+// The focus days of the members of a team in a week, while they were members. The per-day figures are averages
+// over the days that members logged time.
+type TeamFocusWeek struct {
+	TeamID              int64
+	Team                string
+	Week                time.Time // Monday
+	People              int
+	Days                int // Days on which members logged time
+	TicketsPerDay       float64
+	SwitchesPerDay      float64
+	LongestBlockSeconds float64 // Average of the longest block of each day
+	Seconds             float64
+	InterruptSeconds    float64
+	InterruptShare      float64
+}
+
+type focusEntry struct {
+	start, end time.Time
+	ticketid   int64
+	ticketType string
+}
+
+func newFocusDay(userid int64, email string, entries []focusEntry) FocusDay {
+	d := FocusDay{UserID: userid, Email: email, Day: BucketDay.start(entries[0].start)}
+	tickets := map[int64]bool{}
+	var block time.Duration
+	for i, e := range entries {
+		length := e.end.Sub(e.start)
+		d.Seconds += length.Seconds()
+		if e.ticketType == TicketTypeInterrupt {
+			d.InterruptSeconds += length.Seconds()
+		}
+		tickets[e.ticketid] = true
+		if i != 0 && e.ticketid == entries[i-1].ticketid && e.start.Sub(entries[i-1].end) <= focusBlockGap {
+			block += length
+		} else {
+			if i != 0 && e.ticketid != entries[i-1].ticketid {
+				d.Switches++
+			}
+			block = length
+		}
+		if block.Seconds() > d.LongestBlockSeconds {
+			d.LongestBlockSeconds = block.Seconds()
+		}
+	}
+	d.Tickets = len(tickets)
+	if d.Seconds != 0 {
+		d.InterruptShare = d.InterruptSeconds / d.Seconds
+	}
+	return d
+}
+
+// QueryFocusDays returns the focus of every person on every day that they logged time selected by the filter,
+// other than in focusDaySystems, in order of person and day
+func (t *TimeDB) QueryFocusDays(filter *TimeFilter) ([]FocusDay, error) {
+	q := newSelectQuery("times AS t").
+		columns("t.userid", "u.email", "t.start_time", "t.end_time", "COALESCE(t.ticketid, 0)", "COALESCE(k.ticket_type, '')").
+		join("INNER JOIN users AS u ON u.userid = t.userid").
+		join("LEFT JOIN tickets AS k ON k.ticketid = t.ticketid").
+		whereTimes(filter)
+	for _, system := range focusDaySystems {
+		q.where("t.system <> " + q.arg(system))
+	}
+	q.orderBy("t.userid", "t.start_time", "t.end_time")
+	rows, err := t.Conn.Query(q.sql(), q.args()...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	days := []FocusDay{}
+	entries := []focusEntry{}
+	userid, email := int64(0), ""
+	for rows.Next() {
+		e := focusEntry{}
+		var rowUserID int64
+		var rowEmail string
+		if err := rows.Scan(&rowUserID, &rowEmail, &e.start, &e.end, &e.ticketid, &e.ticketType); err != nil {
+			return nil, err
+		}
+		if len(entries) != 0 && (rowUserID != userid || !BucketDay.start(e.start).Equal(BucketDay.start(entries[0].start))) {
+			days = append(days, newFocusDay(userid, email, entries))
+			entries = entries[:0]
+		}
+		userid, email = rowUserID, rowEmail
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) != 0 {
+		days = append(days, newFocusDay(userid, email, entries))
+	}
+	return days, nil
+}
+
+// TeamFocusWeeks sums the focus days of the members of each team per week, while they were members.
+// A person that was in several teams counts in each. The result is ordered by team and week.
+func TeamFocusWeeks(days []FocusDay, teams []Team) []TeamFocusWeek {
+	weeks := []TeamFocusWeek{}
+	for _, team := range teams {
+		byWeek := map[time.Time]*TeamFocusWeek{}
+		people := map[time.Time]map[int64]bool{}
+		for _, d := range days {
+			member := false
+			for _, m := range team.Members {
+				member = member || (m.UserID == d.UserID && m.ActiveAt(d.Day))
+			}
+			if !member {
+				continue
+			}
+			start := BucketWeek.start(d.Day)
+			w := byWeek[start]
+			if w == nil {
+				w = &TeamFocusWeek{TeamID: team.TeamID, Team: team.Name, Week: start}
+				byWeek[start] = w
+				people[start] = map[int64]bool{}
+			}
+			people[start][d.UserID] = true
+			w.Days++
+			w.TicketsPerDay += float64(d.Tickets)
+			w.SwitchesPerDay += float64(d.Switches)
+			w.LongestBlockSeconds += d.LongestBlockSeconds
+			w.Seconds += d.Seconds
+			w.InterruptSeconds += d.InterruptSeconds
+		}
+		teamWeeks := []TeamFocusWeek{}
+		for start, w := range byWeek {
+			w.People = len(people[start])
+			w.TicketsPerDay /= float64(w.Days)
+			w.SwitchesPerDay /= float64(w.Days)
+			w.LongestBlockSeconds /= float64(w.Days)
+			if w.Seconds != 0 {
+				w.InterruptShare = w.InterruptSeconds / w.Seconds
+			}
+			teamWeeks = append(teamWeeks, *w)
+		}
+		sort.Slice(teamWeeks, func(i, j int) bool { return teamWeeks[i].Week.Before(teamWeeks[j].Week) })
+		weeks = append(weeks, teamWeeks...)
+	}
+	return weeks
+}
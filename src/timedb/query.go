@@ -0,0 +1,143 @@
+package timedb
+
+import (
+	"strconv"
+	"strings"
+)
+
+// The duration of the time entry 't', in seconds
+const secondsExpr = "EXTRACT(EPOCH FROM t.end_time - t.start_time)"
+
+// selectQuery composes a SELECT statement from its clauses, so that optional parts, such as filters and
+// groups, are added by code rather than pasted into a template. Values are only ever parameters,
+// which are shared by the query and all of its common table expressions.
+type selectQuery struct {
+	params     *[]interface{}
+	recursive  bool
+	ctes       []string
+	selects    []string
+	from       string
+	joins      []string
+	conditions []string
+	groups     []string
+	orders     []string
+	union      *selectQuery // UNION ALL
+}
+
+func newSelectQuery(from string) *selectQuery {
+	return &selectQuery{params: &[]interface{}{}, from: from}
+}
+
+// Returns a query that shares the parameters of q, such as for a common table expression
+func (q *selectQuery) sub(from string) *selectQuery {
+	return &selectQuery{params: q.params, from: from}
+}
+
+// Adds a parameter, and returns its placeholder
+func (q *selectQuery) arg(v interface{}) string {
+	*q.params = append(*q.params, v)
+	return "$" + strconv.Itoa(len(*q.params))
+}
+
+func (q *selectQuery) args() []interface{} {
+	return *q.params
+}
+
+func (q *selectQuery) columns(exprs ...string) *selectQuery {
+	q.selects = append(q.selects, exprs...)
+	return q
+}
+
+func (q *selectQuery) join(join string) *selectQuery {
+	q.joins = append(q.joins, join)
+	return q
+}
+
+// Adds a condition, which is ANDed with the others
+func (q *selectQuery) where(condition string) *selectQuery {
+	q.conditions = append(q.conditions, condition)
+	return q
+}
+
+// Restricts column to the ids. No ids match nothing.
+func (q *selectQuery) whereIn(column string, ids []int64) *selectQuery {
+	clause := ""
+	clause, *q.params = inClause(column, ids, *q.params)
+	if clause == "" {
+		clause = "FALSE"
+	}
+	return q.where(clause)
+}
+
+// Same as whereIn, but for strings
+func (q *selectQuery) whereInStrings(column string, strs []string) *selectQuery {
+	clause := ""
+	clause, *q.params = inClauseStrings(column, strs, *q.params)
+	if clause == "" {
+		clause = "FALSE"
+	}
+	return q.where(clause)
+}
+
+// Restricts the time entries 't', with their tickets 'k', to those selected by the filter
+func (q *selectQuery) whereTimes(f *TimeFilter) *selectQuery {
+	clause := ""
+	clause, *q.params = f.Where(*q.params)
+	return q.where(clause)
+}
+
+func (q *selectQuery) groupBy(exprs ...string) *selectQuery {
+	q.groups = append(q.groups, exprs...)
+	return q
+}
+
+func (q *selectQuery) orderBy(exprs ...string) *selectQuery {
+	q.orders = append(q.orders, exprs...)
+	return q
+}
+
+func (q *selectQuery) unionAll(other *selectQuery) *selectQuery {
+	q.union = other
+	return q
+}
+
+// Adds a common table expression. The name can include a column list, such as "chain (a, b)".
+func (q *selectQuery) with(name string, cte *selectQuery) *selectQuery {
+	q.ctes = append(q.ctes, name+" AS (\n"+cte.sql()+"\n)")
+	return q
+}
+
+// Same as with, for a common table expression that refers to itself
+func (q *selectQuery) withRecursive(name string, cte *selectQuery) *selectQuery {
+	q.recursive = true
+	return q.with(name, cte)
+}
+
+func (q *selectQuery) sql() string {
+	s := ""
+	if len(q.ctes) != 0 {
+		s = "WITH "
+		if q.recursive {
+			s = "WITH RECURSIVE "
+		}
+		s += strings.Join(q.ctes, ",\n") + "\n"
+	}
+	s += "SELECT " + strings.Join(q.selects, ", ")
+	s += "\nFROM " + q.from
+	for _, j := range q.joins {
+		s += "\n" + j
+	}
+	if len(q.conditions) != 0 {
+		s += "\nWHERE " + strings.Join(q.conditions, " AND ")
+	}
+	if len(q.groups) != 0 {
+		s += "\nGROUP BY " + strings.Join(q.groups, ", ")
+	}
+	if q.union != nil {
+		s += "\nUNION ALL\n" + q.union.sql()
+	}
+	if len(q.orders) != 0 {
+		s += "\nORDER BY " + strings.Join(q.orders, ", ")
+	}
+	return s
+}
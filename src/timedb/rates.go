@@ -0,0 +1,145 @@
+package timedb
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// An hourly rate of either a single user (UserID != 0), or of everybody in a job role.
+// A rate applies from EffectiveFrom until the next rate of the same user or role.
+type Rate struct {
+	RateID        int64
+	UserID        int64
+	Email         string
+	Role          string
+	EffectiveFrom time.Time
+	HourlyRate    float64
+}
+
+// A person's job role, from EffectiveFrom until their next job role. Job roles pick the rate of people without a rate of their own.
+type JobRole struct {
+	JobRoleID     int64
+	UserID        int64
+	Email         string
+	Role          string
+	EffectiveFrom time.Time
+}
+
+// Joins the hourly rate that applies to each time entry 't' as rt.rate, which is NULL if there is no rate
+const rateJoin = `LEFT JOIN LATERAL (SELECT COALESCE(
+	(SELECT r.hourly_rate FROM rates AS r WHERE r.userid = t.userid AND r.effective_from <= t.start_time ORDER BY r.effective_from DESC LIMIT 1),
+	(SELECT r.hourly_rate FROM rates AS r WHERE r.userid IS NULL AND r.effective_from <= t.start_time AND r.role = (
+		SELECT j.role FROM job_roles AS j WHERE j.userid = t.userid AND j.effective_from <= t.start_time ORDER BY j.effective_from DESC LIMIT 1)
+		ORDER BY r.effective_from DESC LIMIT 1)) AS rate) AS rt ON TRUE`
+
+// The cost of a time entry, and its duration if it has no rate
+const costExpr = "EXTRACT(EPOCH FROM t.end_time - t.start_time) / 3600 * rt.rate"
+const uncostedExpr = "CASE WHEN rt.rate IS NULL THEN EXTRACT(EPOCH FROM t.end_time - t.start_time) ELSE 0 END"
+
+// Returns all rates, ordered by role, user, and then date
+func (t *TimeDB) Rates() ([]Rate, error) {
+	rows, err := t.Conn.Query(`
+SELECT r.rateid, COALESCE(r.userid, 0), COALESCE(u.email, ''), COALESCE(r.role, ''), r.effective_from, r.hourly_rate
+FROM rates AS r LEFT JOIN users AS u ON u.userid = r.userid
+ORDER BY r.role NULLS LAST, u.email, r.effective_from`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rates := []Rate{}
+	for rows.Next() {
+		r := Rate{}
+		if err := rows.Scan(&r.RateID, &r.UserID, &r.Email, &r.Role, &r.EffectiveFrom, &r.HourlyRate); err != nil {
+			return nil, err
+		}
+		rates = append(rates, r)
+	}
+	return rates, rows.Err()
+}
+
+// Set the rate of a user (userid != 0) or of a job role, from the given day. Replaces a rate of the same user or role on the same day.
+func (t *TimeDB) SetRate(userid int64, role string, effectiveFrom time.Time, hourlyRate float64) (int64, error) {
+	role = strings.TrimSpace(role)
+	if (userid == 0) == (role == "") {
+		return 0, fmt.Errorf("A rate belongs to either a user or a job role")
+	}
+	if hourlyRate < 0 {
+		return 0, fmt.Errorf("Rates may not be negative")
+	}
+	tx, err := t.Conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	day := effectiveFrom.Format("2006-01-02")
+	if userid != 0 {
+		_, err = tx.Exec("DELETE FROM rates WHERE userid = $1 AND effective_from = $2", userid, day)
+	} else {
+		_, err = tx.Exec("DELETE FROM rates WHERE userid IS NULL AND role = $1 AND effective_from = $2", role, day)
+	}
+	if err != nil {
+		return 0, err
+	}
+	rateid := int64(0)
+	err = tx.QueryRow("INSERT INTO rates (userid, role, effective_from, hourly_rate) VALUES ($1, $2, $3, $4) RETURNING rateid",
+		sql.NullInt64{Int64: userid, Valid: userid != 0}, nullString(role), day, hourlyRate).Scan(&rateid)
+	if err != nil {
+		return 0, err
+	}
+	return rateid, tx.Commit()
+}
+
+func (t *TimeDB) DeleteRate(rateid int64) error {
+	_, err := t.Conn.Exec("DELETE FROM rates WHERE rateid = $1", rateid)
+	return err
+}
+
+// Returns all job role assignments, ordered by user and then date
+func (t *TimeDB) JobRoles() ([]JobRole, error) {
+	rows, err := t.Conn.Query(`
+SELECT j.jobroleid, j.userid, u.email, j.role, j.effective_from
+FROM job_roles AS j INNER JOIN users AS u ON u.userid = j.userid
+ORDER BY u.email, j.effective_from`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	roles := []JobRole{}
+	for rows.Next() {
+		j := JobRole{}
+		if err := rows.Scan(&j.JobRoleID, &j.UserID, &j.Email, &j.Role, &j.EffectiveFrom); err != nil {
+			return nil, err
+		}
+		roles = append(roles, j)
+	}
+	return roles, rows.Err()
+}
+
+// Set the job role of a user, from the given day. Replaces a job role of the user on the same day.
+func (t *TimeDB) SetJobRole(userid int64, role string, effectiveFrom time.Time) (int64, error) {
+	role = strings.TrimSpace(role)
+	if role == "" {
+		return 0, fmt.Errorf("Job role is empty")
+	}
+	tx, err := t.Conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	day := effectiveFrom.Format("2006-01-02")
+	if _, err := tx.Exec("DELETE FROM job_roles WHERE userid = $1 AND effective_from = $2", userid, day); err != nil {
+		return 0, err
+	}
+	jobroleid := int64(0)
+	if err := tx.QueryRow("INSERT INTO job_roles (userid, role, effective_from) VALUES ($1, $2, $3) RETURNING jobroleid", userid, role, day).Scan(&jobroleid); err != nil {
+		return 0, err
+	}
+	return jobroleid, tx.Commit()
+}
+
+func (t *TimeDB) DeleteJobRole(jobroleid int64) error {
+	_, err := t.Conn.Exec("DELETE FROM job_roles WHERE jobroleid = $1", jobroleid)
+	return err
+}
@@ -0,0 +1,244 @@
+package timedb
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ReportGroup is a dimension that report hours can be grouped by
+type ReportGroup string
+
+const (
+	GroupTicketType ReportGroup = "type"
+	GroupUser       ReportGroup = "user"
+	GroupSystem     ReportGroup = "system"
+	GroupProject    ReportGroup = "project"
+	GroupTicket     ReportGroup = "ticket"
+)
+
+// ReportBucket is the period that report hours are summed over
+type ReportBucket string
+
+const (
+	BucketNone    ReportBucket = ""
+	BucketDay     ReportBucket = "day"
+	BucketWeek    ReportBucket = "week" // Weeks start on Monday
+	BucketMonth   ReportBucket = "month"
+	BucketQuarter ReportBucket = "quarter"
+	BucketYear    ReportBucket = "year"
+)
+
+// ReportQuery sums the time selected by Filter, per Bucket and per combination of GroupBy.
+// With Cost, it also sums the cost of the time, at the hourly rate of each person on each day.
+type ReportQuery struct {
+	Filter  TimeFilter
+	GroupBy []ReportGroup
+	Bucket  ReportBucket
+	Cost    bool
+}
+
+// ReportRow is a single row of a report. Only the fields of the query's groups, and its bucket, are populated.
+type ReportRow struct {
+	Bucket          time.Time // Start of the bucket
+	TicketType      string
+	UserID          int64
+	Email           string
+	System          string
+	Project         string
+	TicketID        int64
+	TicketKey       string
+	TicketTitle     string
+	StoryPoints     int
+	Seconds         float64
+	Entries         int
+	Cost            float64 // Only populated by a Cost query
+	UncostedSeconds float64 // Time of people that had no rate, which is not included in Cost
+}
+
+// The SQL expressions of a group, and the fields that they are scanned into
+type reportColumns struct {
+	exprs   []string
+	join    string
+	targets func(r *ReportRow) []interface{}
+}
+
+var reportGroups = map[ReportGroup]reportColumns{
+	GroupTicketType: {
+		exprs:   []string{"k.ticket_type"},
+		targets: func(r *ReportRow) []interface{} { return []interface{}{&r.TicketType} },
+	},
+	GroupUser: {
+		exprs:   []string{"t.userid", "u.email"},
+		join:    "INNER JOIN users AS u ON u.userid = t.userid",
+		targets: func(r *ReportRow) []interface{} { return []interface{}{&r.UserID, &r.Email} },
+	},
+	GroupSystem: {
+		exprs:   []string{"t.system"},
+		targets: func(r *ReportRow) []interface{} { return []interface{}{&r.System} },
+	},
+	GroupProject: {
+		exprs:   []string{"COALESCE(t.project, '')"},
+		targets: func(r *ReportRow) []interface{} { return []interface{}{&r.Project} },
+	},
+	GroupTicket: {
+		exprs: []string{"k.ticketid", "COALESCE(k.ticket_key, '')", "k.title", "COALESCE(k.story_points, 0)"},
+		targets: func(r *ReportRow) []interface{} {
+			return []interface{}{&r.TicketID, &r.TicketKey, &r.TicketTitle, &r.StoryPoints}
+		},
+	},
+}
+
+func ValidReportGroup(g ReportGroup) bool {
+	_, ok := reportGroups[g]
+	return ok
+}
+
+func ValidReportBucket(b ReportBucket) bool {
+	switch b {
+	case BucketNone, BucketDay, BucketWeek, BucketMonth, BucketQuarter, BucketYear:
+		return true
+	}
+	return false
+}
+
+// Compose the SQL of the query. Every value is a parameter, and the groups are
+// referred to by position, so nothing from the caller is pasted into the SQL.
+func (q *ReportQuery) sql() (string, []interface{}, error) {
+	if !ValidReportBucket(q.Bucket) {
+		return "", nil, fmt.Errorf("Unknown report bucket '%v'", q.Bucket)
+	}
+	s := newSelectQuery("times AS t").join("INNER JOIN tickets AS k ON k.ticketid = t.ticketid")
+	if q.Bucket != BucketNone {
+		s.columns("date_trunc(" + s.arg(string(q.Bucket)) + "::TEXT, t.start_time)")
+	}
+	seen := map[ReportGroup]bool{}
+	for _, g := range q.GroupBy {
+		cols, ok := reportGroups[g]
+		if !ok {
+			return "", nil, fmt.Errorf("Unknown report group '%v'", g)
+		}
+		if seen[g] {
+			continue
+		}
+		seen[g] = true
+		s.columns(cols.exprs...)
+		if cols.join != "" {
+			s.join(cols.join)
+		}
+	}
+	for i := range s.selects {
+		s.groupBy(strconv.Itoa(i + 1))
+		s.orderBy(strconv.Itoa(i + 1))
+	}
+	s.whereTimes(&q.Filter)
+
+	s.columns("sum("+secondsExpr+")", "count(*)")
+	if q.Cost {
+		s.columns("COALESCE(sum("+costExpr+"), 0)", "sum("+uncostedExpr+")")
+		s.join(rateJoin)
+	}
+	return s.sql(), s.args(), nil
+}
+
+// QueryReport runs a report query, and returns its rows in order of bucket, and then of the groups
+func (t *TimeDB) QueryReport(q *ReportQuery) ([]ReportRow, error) {
+	script, args, err := q.sql()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := t.Conn.Query(script, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := []ReportRow{}
+	for rows.Next() {
+		r := ReportRow{}
+		targets := []interface{}{}
+		if q.Bucket != BucketNone {
+			targets = append(targets, &r.Bucket)
+		}
+		seen := map[ReportGroup]bool{}
+		for _, g := range q.GroupBy {
+			if !seen[g] {
+				seen[g] = true
+				targets = append(targets, reportGroups[g].targets(&r)...)
+			}
+		}
+		targets = append(targets, &r.Seconds, &r.Entries)
+		if q.Cost {
+			targets = append(targets, &r.Cost, &r.UncostedSeconds)
+		}
+		if err := rows.Scan(targets...); err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+// Hours of a single ticket type in a month
+type MonthlyHours struct {
+	Year       int
+	Month      int
+	TicketType string
+	Seconds    float64
+	Cost       float64 `json:",omitempty"`
+}
+
+// QueryMonthlyHours sums the time selected by the filter per month and ticket type, in order of month.
+// With cost, it also sums the cost of the time.
+func (t *TimeDB) QueryMonthlyHours(filter *TimeFilter, cost bool) ([]MonthlyHours, error) {
+	rows, err := t.QueryReport(&ReportQuery{Filter: *filter, GroupBy: []ReportGroup{GroupTicketType}, Bucket: BucketMonth, Cost: cost})
+	if err != nil {
+		return nil, err
+	}
+	result := []MonthlyHours{}
+	for _, r := range rows {
+		result = append(result, MonthlyHours{Year: r.Bucket.Year(), Month: int(r.Bucket.Month()), TicketType: r.TicketType, Seconds: r.Seconds, Cost: r.Cost})
+	}
+	return result, nil
+}
+
+// A ticket in a drill-down, with the hours of each person that logged time against it
+type DrillDownTicket struct {
+	TicketID    int64
+	Key         string
+	Title       string
+	Type        string
+	StoryPoints int
+	Seconds     float64
+	Cost        float64 `json:",omitempty"`
+	People      []TicketUserHours
+}
+
+// QueryDrillDown returns the tickets that the time selected by the filter was logged against,
+// with the hours of each person, in order of most hours first. With cost, it also sums the cost
+// of each ticket, but not of each person, whose rate would be evident from it.
+func (t *TimeDB) QueryDrillDown(filter *TimeFilter, cost bool) ([]DrillDownTicket, error) {
+	rows, err := t.QueryReport(&ReportQuery{Filter: *filter, GroupBy: []ReportGroup{GroupTicket, GroupTicketType, GroupUser}, Cost: cost})
+	if err != nil {
+		return nil, err
+	}
+	tickets := []DrillDownTicket{}
+	index := map[int64]int{}
+	for _, r := range rows {
+		i, ok := index[r.TicketID]
+		if !ok {
+			i = len(tickets)
+			index[r.TicketID] = i
+			tickets = append(tickets, DrillDownTicket{TicketID: r.TicketID, Key: r.TicketKey, Title: r.TicketTitle, Type: r.TicketType, StoryPoints: r.StoryPoints, People: []TicketUserHours{}})
+		}
+		tickets[i].Seconds += r.Seconds
+		tickets[i].Cost += r.Cost
+		tickets[i].People = append(tickets[i].People, TicketUserHours{UserID: r.UserID, Email: r.Email, Seconds: r.Seconds})
+	}
+	for i := range tickets {
+		people := tickets[i].People
+		sort.SliceStable(people, func(a, b int) bool { return people[a].Seconds > people[b].Seconds })
+	}
+	sort.SliceStable(tickets, func(a, b int) bool { return tickets[a].Seconds > tickets[b].Seconds })
+	return tickets, nil
+}
@@ -0,0 +1,93 @@
+package timedb
+
+import (
+	"fmt"
+)
+
+// RollupLevel determines which ticket in the hierarchy logged hours are aggregated into
+type RollupLevel string
+
+const (
+	RollupStory RollupLevel = "story" // Sub-tasks roll up into their parent
+	RollupEpic  RollupLevel = "epic"  // Sub-tasks and stories roll up into their epic
+)
+
+// We only ever expect epic > story > sub-task, so this is just protection against cycles
+const maxHierarchyDepth = 4
+
+// TicketRollup is the total time logged against a ticket, and all of its descendants
+type TicketRollup struct {
+	TicketID     int64
+	Key          string
+	Title        string
+	Type         string
+	StoryPoints  int
+	OwnSeconds   float64 // Time logged directly against this ticket
+	ChildSeconds float64 // Time logged against descendants of this ticket
+	Children     int     // Number of descendants that have time logged against them
+	OwnCost      float64 `json:",omitempty"` // Only populated by a cost query
+	ChildCost    float64 `json:",omitempty"`
+}
+
+func (r *TicketRollup) TotalSeconds() float64 {
+	return r.OwnSeconds + r.ChildSeconds
+}
+
+// QueryRollup aggregates the time selected by the filter up the ticket hierarchy.
+// The filter's ticket types apply to the ticket that time is rolled up into.
+// For RollupStory, a sub-task whose parent has not been fetched is its own story.
+// For RollupEpic, time logged against tickets that do not belong to an epic is omitted.
+// With cost, the cost of the time is also summed.
+func (t *TimeDB) QueryRollup(level RollupLevel, filter *TimeFilter, cost bool) ([]TicketRollup, error) {
+	q := newSelectQuery("times AS t")
+
+	// Walk up the parent chain of every ticket that has time logged against it since the start of the filter,
+	// and pick the nearest ancestor (or the ticket itself) that is of the level. A sub-task without a story
+	// in its chain falls back to itself, so that its time is not lost.
+	first := q.sub("tickets").columns("ticketid", "ticketid", "parent_key", "ticket_type", "0").
+		where("ticketid IN (SELECT ticketid FROM times WHERE start_time >= " + q.arg(filter.Start) + ")")
+	parents := q.sub("chain AS c").columns("c.origin", "p.ticketid", "p.parent_key", "p.ticket_type", "c.depth + 1").
+		join("INNER JOIN tickets AS p ON p.system = " + q.arg(SystemTypeJira) + " AND p.ticket_key = c.parent_key").
+		where("c.depth < " + q.arg(maxHierarchyDepth))
+	q.withRecursive("chain (origin, ticketid, parent_key, ticket_type, depth)", first.unionAll(parents))
+	target := q.sub("chain").columns("DISTINCT ON (origin) origin", "ticketid")
+	switch level {
+	case RollupStory:
+		target.orderBy("origin", "ticket_type = "+q.arg(TicketTypeSubtask), "depth")
+	case RollupEpic:
+		target.where("ticket_type = "+q.arg(TicketTypeEpic)).orderBy("origin", "depth")
+	default:
+		return nil, fmt.Errorf("Unknown rollup level '%v'", level)
+	}
+	q.with("target", target)
+
+	q.columns("k.ticketid", "COALESCE(k.ticket_key, '')", "k.title", "k.ticket_type", "COALESCE(k.story_points, 0)",
+		"COALESCE(sum("+secondsExpr+") FILTER (WHERE t.ticketid = k.ticketid), 0)",
+		"COALESCE(sum("+secondsExpr+") FILTER (WHERE t.ticketid <> k.ticketid), 0)",
+		"count(DISTINCT t.ticketid) FILTER (WHERE t.ticketid <> k.ticketid)")
+	q.join("INNER JOIN target AS g ON g.origin = t.ticketid")
+	q.join("INNER JOIN tickets AS k ON k.ticketid = g.ticketid")
+	if cost {
+		q.columns("COALESCE(sum("+costExpr+") FILTER (WHERE t.ticketid = k.ticketid), 0)",
+			"COALESCE(sum("+costExpr+") FILTER (WHERE t.ticketid <> k.ticketid), 0)")
+		q.join(rateJoin)
+	} else {
+		q.columns("0", "0")
+	}
+	q.whereTimes(filter).groupBy("k.ticketid").orderBy("sum(" + secondsExpr + ") DESC")
+
+	rows, err := t.Conn.Query(q.sql(), q.args()...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := []TicketRollup{}
+	for rows.Next() {
+		r := TicketRollup{}
+		if err := rows.Scan(&r.TicketID, &r.Key, &r.Title, &r.Type, &r.StoryPoints, &r.OwnSeconds, &r.ChildSeconds, &r.Children, &r.OwnCost, &r.ChildCost); err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
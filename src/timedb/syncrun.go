@@ -0,0 +1,70 @@
+package timedb
+
+import (
+	"database/sql"
+	"time"
+)
+
+type SyncRun struct {
+	RunID       int64
+	Source      string
+	Scope       string
+	WindowStart time.Time
+	WindowEnd   time.Time
+	StartTime   time.Time
+	EndTime     *time.Time // nil if the run has not finished (or crashed)
+	Error       string
+}
+
+// Record the start of a fetch from 'source'. Returns the runid, which must be passed to EndSyncRun.
+func (t *TimeDB) BeginSyncRun(source, scope string, windowStart, windowEnd time.Time) (int64, error) {
+	runid := int64(0)
+	err := t.Conn.QueryRow("INSERT INTO sync_runs (source, scope, window_start, window_end, start_time) VALUES ($1, $2, $3, $4, $5) RETURNING runid",
+		source, scope, windowStart, windowEnd, time.Now()).Scan(&runid)
+	return runid, err
+}
+
+// Record the end of a fetch. fetchErr is the result of the fetch, which may be nil.
+func (t *TimeDB) EndSyncRun(runid int64, fetchErr error) error {
+	errMsg := sql.NullString{}
+	if fetchErr != nil {
+		errMsg = nullString(fetchErr.Error())
+	}
+	_, err := t.Conn.Exec("UPDATE sync_runs SET end_time = $1, error = $2 WHERE runid = $3", time.Now(), errMsg, runid)
+	return err
+}
+
+func scanSyncRuns(rows *sql.Rows) ([]SyncRun, error) {
+	defer rows.Close()
+	runs := []SyncRun{}
+	for rows.Next() {
+		r := SyncRun{}
+		var errMsg sql.NullString
+		if err := rows.Scan(&r.RunID, &r.Source, &r.Scope, &r.WindowStart, &r.WindowEnd, &r.StartTime, &r.EndTime, &errMsg); err != nil {
+			return nil, err
+		}
+		r.Error = errMsg.String
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+const syncRunFields = "runid, source, COALESCE(scope, ''), window_start, window_end, start_time, end_time, error"
+
+// Returns the most recent sync runs, newest first
+func (t *TimeDB) RecentSyncRuns(limit int) ([]SyncRun, error) {
+	rows, err := t.Conn.Query("SELECT "+syncRunFields+" FROM sync_runs ORDER BY start_time DESC LIMIT $1", limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanSyncRuns(rows)
+}
+
+// Returns the most recent successful sync run of every source
+func (t *TimeDB) LatestSyncRuns() ([]SyncRun, error) {
+	rows, err := t.Conn.Query("SELECT DISTINCT ON (source) " + syncRunFields + " FROM sync_runs WHERE end_time IS NOT NULL AND error IS NULL ORDER BY source, start_time DESC")
+	if err != nil {
+		return nil, err
+	}
+	return scanSyncRuns(rows)
+}
@@ -0,0 +1,232 @@
+package timedb
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// A team member is a member of a team from EffectiveFrom (inclusive) until EffectiveTo (exclusive).
+// A nil date means that the membership is unbounded on that side. A person can be a member of the
+// same team more than once, for example if they leave and later return.
+type TeamMember struct {
+	MemberID      int64
+	TeamID        int64
+	UserID        int64
+	Email         string
+	EffectiveFrom *time.Time
+	EffectiveTo   *time.Time
+	HasData       bool // True if the user has any time entries
+}
+
+type Team struct {
+	TeamID  int64
+	Name    string
+	Members []TeamMember
+}
+
+// Returns true if the membership covers the day of the given time.
+// The dates are compared as strings, because the driver reads DATE columns as midnight UTC, while days are local.
+func (m *TeamMember) ActiveAt(t time.Time) bool {
+	day := t.Format("2006-01-02")
+	return (m.EffectiveFrom == nil || day >= m.EffectiveFrom.Format("2006-01-02")) && (m.EffectiveTo == nil || day < m.EffectiveTo.Format("2006-01-02"))
+}
+
+// Returns all teams, and their members, ordered by name
+func (t *TimeDB) Teams() ([]Team, error) {
+	rows, err := t.Conn.Query(`
+SELECT tm.teamid, tm.name, m.memberid, m.userid, u.email, m.effective_from, m.effective_to,
+	EXISTS (SELECT 1 FROM times WHERE times.userid = m.userid)
+FROM teams AS tm
+LEFT JOIN team_members AS m ON m.teamid = tm.teamid
+LEFT JOIN users AS u ON u.userid = m.userid
+ORDER BY tm.name, lower(u.email), m.effective_from`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	teams := []Team{}
+	for rows.Next() {
+		teamid := int64(0)
+		name := ""
+		var memberid, userid sql.NullInt64
+		var email sql.NullString
+		m := TeamMember{}
+		if err := rows.Scan(&teamid, &name, &memberid, &userid, &email, &m.EffectiveFrom, &m.EffectiveTo, &m.HasData); err != nil {
+			return nil, err
+		}
+		if len(teams) == 0 || teams[len(teams)-1].TeamID != teamid {
+			teams = append(teams, Team{TeamID: teamid, Name: name, Members: []TeamMember{}})
+		}
+		if memberid.Valid {
+			m.MemberID = memberid.Int64
+			m.TeamID = teamid
+			m.UserID = userid.Int64
+			m.Email = email.String
+			team := &teams[len(teams)-1]
+			team.Members = append(team.Members, m)
+		}
+	}
+	return teams, rows.Err()
+}
+
+// Returns the teamid of the team with the given name, or 0 if there is no such team
+func (t *TimeDB) TeamIDFromName(name string) (int64, error) {
+	teamid := int64(0)
+	err := t.Conn.QueryRow("SELECT teamid FROM teams WHERE name = $1", name).Scan(&teamid)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return teamid, err
+}
+
+// Returns the teamids of all teams
+func (t *TimeDB) AllTeamIDs() ([]int64, error) {
+	rows, err := t.Conn.Query("SELECT teamid FROM teams")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []int64{}
+	for rows.Next() {
+		id := int64(0)
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Returns the users that are, or ever were, members of the given teams
+func (t *TimeDB) TeamMemberUserIDs(teamids []int64) ([]int64, error) {
+	if len(teamids) == 0 {
+		return []int64{}, nil
+	}
+	clause, args := inClause("teamid", teamids, nil)
+	rows, err := t.Conn.Query("SELECT DISTINCT userid FROM team_members WHERE "+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []int64{}
+	for rows.Next() {
+		id := int64(0)
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (t *TimeDB) CreateTeam(name string) (int64, error) {
+	if name == "" {
+		return 0, fmt.Errorf("Team name may not be empty")
+	}
+	teamid := int64(0)
+	err := t.Conn.QueryRow("INSERT INTO teams (name) VALUES ($1) RETURNING teamid", name).Scan(&teamid)
+	if err != nil && isKeyViolation(err) {
+		return 0, fmt.Errorf("A team named '%v' already exists", name)
+	}
+	return teamid, err
+}
+
+func (t *TimeDB) RenameTeam(teamid int64, name string) error {
+	if name == "" {
+		return fmt.Errorf("Team name may not be empty")
+	}
+	_, err := t.Conn.Exec("UPDATE teams SET name = $1 WHERE teamid = $2", name, teamid)
+	if err != nil && isKeyViolation(err) {
+		return fmt.Errorf("A team named '%v' already exists", name)
+	}
+	return err
+}
+
+// Delete a team, and all of its memberships
+func (t *TimeDB) DeleteTeam(teamid int64) error {
+	tx, err := t.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"team_members", "account_lead_teams", "teams"} {
+		if _, err = tx.Exec(fmt.Sprintf("DELETE FROM %v WHERE teamid = $1", table), teamid); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func checkEffectiveDates(from, to *time.Time) error {
+	if from != nil && to != nil && !to.After(*from) {
+		return fmt.Errorf("Membership must end after it starts")
+	}
+	return nil
+}
+
+// Add a user to a team, creating the user if necessary. Returns the memberid.
+func (t *TimeDB) AddTeamMember(teamid int64, email string, from, to *time.Time) (int64, error) {
+	if email == "" {
+		return 0, fmt.Errorf("Email may not be empty")
+	}
+	if err := checkEffectiveDates(from, to); err != nil {
+		return 0, err
+	}
+	tx, err := t.Conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	memberid := int64(0)
+	userid := int64(0)
+	if userid, err = t.emailToUser(tx, newCaches(), "", email); err == nil {
+		err = tx.QueryRow("INSERT INTO team_members (teamid, userid, effective_from, effective_to) VALUES ($1, $2, $3, $4) RETURNING memberid",
+			teamid, userid, from, to).Scan(&memberid)
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return memberid, tx.Commit()
+}
+
+func (t *TimeDB) UpdateTeamMember(memberid int64, from, to *time.Time) error {
+	if err := checkEffectiveDates(from, to); err != nil {
+		return err
+	}
+	_, err := t.Conn.Exec("UPDATE team_members SET effective_from = $1, effective_to = $2 WHERE memberid = $3", from, to, memberid)
+	return err
+}
+
+func (t *TimeDB) RemoveTeamMember(memberid int64) error {
+	_, err := t.Conn.Exec("DELETE FROM team_members WHERE memberid = $1", memberid)
+	return err
+}
+
+// Seed the teams table from a map of team name to member emails, but only if there are no teams yet.
+// This is used to migrate from the teams that used to be defined in the server config.
+// Returns true if the teams were imported.
+func (t *TimeDB) ImportTeams(teams map[string][]string) (bool, error) {
+	count := 0
+	if err := t.Conn.QueryRow("SELECT count(*) FROM teams").Scan(&count); err != nil {
+		return false, err
+	}
+	if count != 0 || len(teams) == 0 {
+		return false, nil
+	}
+	for name, emails := range teams {
+		teamid, err := t.CreateTeam(name)
+		if err != nil {
+			return false, err
+		}
+		for _, email := range emails {
+			if _, err := t.AddTeamMember(teamid, email, nil, nil); err != nil {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
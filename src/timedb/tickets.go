@@ -0,0 +1,127 @@
+package timedb
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Ticket struct {
+	TicketID    int64
+	System      string
+	SystemID    string
+	Key         string
+	ParentKey   string
+	Title       string
+	Type        string
+	StoryPoints int
+	CreateTime  *time.Time
+	ResolveTime *time.Time // nil if the ticket is not resolved
+	UserID      int64      // Only populated for anonymous tasks
+}
+
+// TicketQuery selects tickets. Zero values mean "no restriction".
+type TicketQuery struct {
+	Search      string // Case insensitive substring of the key or title
+	Keys        []string
+	ParentKey   string
+	Types       []string
+	Systems     []string
+	AnonUserIDs []int64 // Anonymous tasks are personal. If not nil, only the anonymous tasks of these users are included.
+}
+
+func (q *TicketQuery) where(args []interface{}) (string, []interface{}) {
+	clauses := []string{"TRUE"}
+	clause := ""
+	if q.Search != "" {
+		args = append(args, "%"+strings.ToLower(q.Search)+"%")
+		n := strconv.Itoa(len(args))
+		clauses = append(clauses, "(lower(k.title) LIKE $"+n+" OR lower(k.ticket_key) LIKE $"+n+")")
+	}
+	if len(q.Keys) != 0 {
+		clause, args = inClauseStrings("k.ticket_key", q.Keys, args)
+		clauses = append(clauses, clause)
+	}
+	if q.ParentKey != "" {
+		args = append(args, q.ParentKey)
+		clauses = append(clauses, "k.parent_key = $"+strconv.Itoa(len(args)))
+	}
+	if len(q.Types) != 0 {
+		clause, args = inClauseStrings("k.ticket_type", q.Types, args)
+		clauses = append(clauses, clause)
+	}
+	if len(q.Systems) != 0 {
+		clause, args = inClauseStrings("k.system", q.Systems, args)
+		clauses = append(clauses, clause)
+	}
+	if q.AnonUserIDs != nil {
+		args = append(args, SystemTypeAnon)
+		anon := "k.system <> $" + strconv.Itoa(len(args))
+		if len(q.AnonUserIDs) != 0 {
+			clause, args = inClause("k.userid", q.AnonUserIDs, args)
+			anon = "(" + anon + " OR " + clause + ")"
+		}
+		clauses = append(clauses, anon)
+	}
+	return strings.Join(clauses, " AND "), args
+}
+
+const ticketSelect = `
+SELECT k.ticketid, k.system, COALESCE(k.systemid, ''), COALESCE(k.ticket_key, ''), COALESCE(k.parent_key, ''), k.title,
+	k.ticket_type, COALESCE(k.story_points, 0), k.create_time, k.resolve_time, COALESCE(k.userid, 0)
+FROM tickets AS k`
+
+func scanTickets(rows *sql.Rows) ([]Ticket, error) {
+	defer rows.Close()
+	tickets := []Ticket{}
+	for rows.Next() {
+		k := Ticket{}
+		if err := rows.Scan(&k.TicketID, &k.System, &k.SystemID, &k.Key, &k.ParentKey, &k.Title, &k.Type, &k.StoryPoints, &k.CreateTime, &k.ResolveTime, &k.UserID); err != nil {
+			return nil, err
+		}
+		tickets = append(tickets, k)
+	}
+	return tickets, rows.Err()
+}
+
+// QueryTickets returns a page of the tickets that match the query, ordered by key and title,
+// and the total number of tickets that match the query.
+func (t *TimeDB) QueryTickets(q *TicketQuery, limit, offset int) ([]Ticket, int, error) {
+	where, args := q.where(nil)
+	total := 0
+	if err := t.Conn.QueryRow("SELECT count(*) FROM tickets AS k WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	args = append(args, limit, offset)
+	rows, err := t.Conn.Query(ticketSelect+" WHERE "+where+" ORDER BY k.ticket_key, k.title, k.ticketid LIMIT $"+strconv.Itoa(len(args)-1)+" OFFSET $"+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	tickets, err := scanTickets(rows)
+	return tickets, total, err
+}
+
+// Returns the ticket, or nil if there is no such ticket
+func (t *TimeDB) Ticket(ticketid int64) (*Ticket, error) {
+	rows, err := t.Conn.Query(ticketSelect+" WHERE k.ticketid = $1", ticketid)
+	if err != nil {
+		return nil, err
+	}
+	tickets, err := scanTickets(rows)
+	if err != nil || len(tickets) == 0 {
+		return nil, err
+	}
+	return &tickets[0], nil
+}
+
+// Returns the key of the ticket of a source system, or an empty string if there is no such ticket,
+// or it has no key, such as a placeholder for a ticket that has not been fetched yet
+func (t *TimeDB) TicketKeyFromSystemID(system, systemid string) (string, error) {
+	key := ""
+	err := t.Conn.QueryRow("SELECT COALESCE(ticket_key, '') FROM tickets WHERE system = $1 AND systemid = $2", system, systemid).Scan(&key)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return key, err
+}
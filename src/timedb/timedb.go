@@ -8,16 +8,31 @@ import (
 	"github.com/IMQS/log"
 	_ "github.com/lib/pq"
 	"io/ioutil"
+	"regexp"
 	"strings"
 	"time"
 )
 
 type Config struct {
-	Driver   string
-	Host     string
-	Database string
-	Username string
-	Password string
+	Driver        string
+	Host          string
+	Database      string
+	Username      string
+	Password      string
+	IdentityRules []IdentityRule
+	Timesheets    TimesheetConfig
+	Currency      string // Shown alongside costs, eg "ZAR"
+}
+
+// IdentityRule rewrites the email addresses that come from a source system, before they are matched to users.
+// System is a system type (eg "tmet"), or empty for all systems. Match is a regular expression, which is
+// matched against the lower case email address, and Replace is its replacement, which may refer to
+// groups (eg "$1.harper@imqs.co.za"). The first matching rule wins.
+type IdentityRule struct {
+	System  string
+	Match   string
+	Replace string
+	re      *regexp.Regexp
 }
 
 type TimeDB struct {
@@ -28,21 +43,37 @@ type TimeDB struct {
 
 type caches struct {
 	titleToTicket map[string]int64
+	keyToTicket   map[string]int64
 	emailToUser   map[string]int64
 }
 
 func newCaches() *caches {
 	c := &caches{}
 	c.titleToTicket = map[string]int64{}
+	c.keyToTicket = map[string]int64{}
 	c.emailToUser = map[string]int64{}
 	return c
 }
 
+// Matches JIRA ticket keys, such as ABC-123
+var ticketKeyRegex = regexp.MustCompile(`\b[A-Z][A-Z0-9]+-[0-9]+\b`)
+
+// Returns all of the JIRA ticket keys (eg ABC-123) mentioned in s
+func FindTicketKeys(s string) []string {
+	return ticketKeyRegex.FindAllString(s, -1)
+}
+
 // These don't strictly belong in here, but where else?
 const (
-	SystemTypeAnon    = "anon"
-	SystemTypeJira    = "jira"
-	SystemTypeTMetric = "tmet"
+	SystemTypeAnon     = "anon"
+	SystemTypeJira     = "jira"
+	SystemTypeTMetric  = "tmet"
+	SystemTypeToggl    = "togl"
+	SystemTypeClockify = "clck"
+	SystemTypeHarvest  = "harv"
+	SystemTypeICal     = "ical"
+	SystemTypeImport   = "impt"
+	SystemTypeGit      = "git"
 )
 
 const (
@@ -52,6 +83,8 @@ const (
 	TicketTypeTest      = "test"
 	TicketTypeInterrupt = "intr"
 	TicketTypeEpic      = "epic"
+	TicketTypeSubtask   = "subtask"
+	TicketTypeMeeting   = "meet"
 	TicketTypeSpike     = "spike"
 	TicketTypeOther     = "other"
 	TicketTypeAnon      = "anon"
@@ -68,20 +101,80 @@ type TimeFormat1 struct {
 	End       time.Time
 }
 
+// This format is for systems that give every time entry its own unique id, such as JIRA worklogs.
+// The ticket is identified by TicketSystem and TicketSystemID if those are populated, otherwise by TaskTitle.
+// If TicketSystemID refers to a ticket that we have not seen yet, then we create a placeholder ticket,
+// which gets filled in when that ticket is next fetched. Start and End may be in any time zone, because
+// times are stored as local wall clock time.
+type TimeFormat2 struct {
+	System         string
+	SystemID       string
+	Email          string
+	TicketSystem   string
+	TicketSystemID string
+	TaskTitle      string
+	Project        string // Project name in the source system. Optional.
+	Start          time.Time
+	End            time.Time
+}
+
 // This format was built to work with JIRA output
+// ParentKey is the key of the parent ticket (for sub-tasks), or of the epic (for stories).
 type IssueFormat1 struct {
 	System      string
 	SystemID    string
+	Key         string
+	ParentKey   string
 	Title       string
 	Type        string
 	StoryPoints int
 	CreateTime  time.Time
+	ResolveTime *time.Time // nil if the issue is not resolved
 }
 
 func isKeyViolation(err error) bool {
 	return strings.Index(err.Error(), "duplicate key value violates unique constraint") != -1
 }
 
+// Returns NULL for an empty string
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// Appends ids to args, and returns a clause of the form "column IN ($n,$n+1,...)".
+// Returns an empty string if ids is empty.
+func inClause(column string, ids []int64, args []interface{}) (string, []interface{}) {
+	values := []interface{}{}
+	for _, id := range ids {
+		values = append(values, id)
+	}
+	return inClauseValues(column, values, args)
+}
+
+// Same as inClause, but for strings
+func inClauseStrings(column string, strs []string, args []interface{}) (string, []interface{}) {
+	values := []interface{}{}
+	for _, s := range strs {
+		values = append(values, s)
+	}
+	return inClauseValues(column, values, args)
+}
+
+func inClauseValues(column string, values []interface{}, args []interface{}) (string, []interface{}) {
+	if len(values) == 0 {
+		return "", args
+	}
+	clause := column + " IN ("
+	for i, v := range values {
+		if i != 0 {
+			clause += ","
+		}
+		args = append(args, v)
+		clause += fmt.Sprintf("$%v", len(args))
+	}
+	return clause + ")", args
+}
+
 func (t *TimeDB) LoadConfig() error {
 	filename := "config/timedb.json"
 	bytes, err := ioutil.ReadFile(filename)
@@ -91,9 +184,26 @@ func (t *TimeDB) LoadConfig() error {
 	if err := json.Unmarshal(bytes, &t.Config); err != nil {
 		return fmt.Errorf("Error decoding config file %v: %v", filename, err)
 	}
+	for i := range t.Config.IdentityRules {
+		rule := &t.Config.IdentityRules[i]
+		if rule.re, err = regexp.Compile(rule.Match); err != nil {
+			return fmt.Errorf("Invalid identity rule '%v' in %v: %v", rule.Match, filename, err)
+		}
+	}
 	return nil
 }
 
+// Apply the identity rules to an email address from the given system
+func (t *TimeDB) canonicalEmail(system, email string) string {
+	email = strings.ToLower(email)
+	for _, rule := range t.Config.IdentityRules {
+		if (rule.System == "" || rule.System == system) && rule.re != nil && rule.re.MatchString(email) {
+			return rule.re.ReplaceAllString(email, rule.Replace)
+		}
+	}
+	return email
+}
+
 func (t *TimeDB) Connect() error {
 	migrations := []string{
 		`
@@ -110,6 +220,145 @@ func (t *TimeDB) Connect() error {
 		CREATE INDEX idx_times_ticket ON times (ticketid);
 		CREATE UNIQUE INDEX idx_times_systemid ON times (system, systemid);
 		`,
+		`
+		-- ticket_key is the human readable key, such as ABC-123.
+		-- parent_key is the ticket_key of the parent (for sub-tasks), or of the epic (for stories).
+		ALTER TABLE tickets ADD COLUMN ticket_key VARCHAR;
+		ALTER TABLE tickets ADD COLUMN parent_key VARCHAR;
+		CREATE INDEX idx_tickets_key ON tickets (ticket_key);
+		`,
+		`
+		-- Every webhook event that we have applied, so that redelivered events can be ignored
+		CREATE TABLE webhook_events (eventid VARCHAR PRIMARY KEY, event_type VARCHAR, received_time TIMESTAMP);
+		`,
+		`
+		-- Every run of the fetcher, per source, so that we know what data a report is built from.
+		-- scope describes which data was fetched (eg the JIRA JQL), and window_start/window_end is the date range.
+		CREATE TABLE sync_runs (runid BIGSERIAL PRIMARY KEY, source VARCHAR, scope VARCHAR, window_start TIMESTAMP, window_end TIMESTAMP,
+			start_time TIMESTAMP, end_time TIMESTAMP, error VARCHAR);
+		CREATE INDEX idx_sync_runs_source ON sync_runs (source, start_time);
+		`,
+		`
+		-- The project that the time was logged against, in the source system
+		ALTER TABLE times ADD COLUMN project VARCHAR;
+		`,
+		`
+		-- Commits from git repositories. A commit can mention several tickets, which are linked via commit_tickets.
+		CREATE TABLE commits (commitid BIGSERIAL PRIMARY KEY, repo VARCHAR, hash VARCHAR, userid BIGINT, commit_time TIMESTAMP, summary VARCHAR);
+		CREATE UNIQUE INDEX idx_commits_hash ON commits (repo, hash);
+		CREATE INDEX idx_commits_userid ON commits (userid);
+
+		CREATE TABLE commit_tickets (commitid BIGINT, ticketid BIGINT, PRIMARY KEY (commitid, ticketid));
+		CREATE INDEX idx_commit_tickets_ticketid ON commit_tickets (ticketid);
+		`,
+		`
+		-- effective_from is inclusive, and effective_to is exclusive. NULL means unbounded.
+		CREATE TABLE teams (teamid BIGSERIAL PRIMARY KEY, name VARCHAR);
+		CREATE UNIQUE INDEX idx_teams_name ON teams (name);
+		CREATE TABLE team_members (memberid BIGSERIAL PRIMARY KEY, teamid BIGINT, userid BIGINT, effective_from DATE, effective_to DATE);
+		CREATE INDEX idx_team_members_teamid ON team_members (teamid);
+		CREATE INDEX idx_team_members_userid ON team_members (userid);
+		`,
+		`
+		-- Other email addresses of a user, typically left behind when two users are merged
+		CREATE TABLE user_aliases (email VARCHAR, userid BIGINT);
+		CREATE UNIQUE INDEX idx_user_aliases_email ON user_aliases (lower(email));
+		CREATE INDEX idx_user_aliases_userid ON user_aliases (userid);
+		`,
+		`
+		-- Dashboard logins. password_hash is NULL for accounts that only sign in with OIDC.
+		CREATE TABLE accounts (accountid BIGSERIAL PRIMARY KEY, email VARCHAR, role VARCHAR, password_hash VARCHAR);
+		CREATE UNIQUE INDEX idx_accounts_email ON accounts (lower(email));
+		CREATE TABLE account_lead_teams (accountid BIGINT, teamid BIGINT, PRIMARY KEY (accountid, teamid));
+		CREATE TABLE sessions (token_hash VARCHAR PRIMARY KEY, accountid BIGINT, expires TIMESTAMP);
+		CREATE INDEX idx_sessions_accountid ON sessions (accountid);
+		`,
+		`
+		-- Days on which no time is expected. end_day is inclusive, and hours is NULL for full days of leave.
+		CREATE TABLE holidays (day DATE PRIMARY KEY, name VARCHAR);
+		CREATE TABLE leave (leaveid BIGSERIAL PRIMARY KEY, userid BIGINT, system VARCHAR, systemid VARCHAR, start_day DATE, end_day DATE, kind VARCHAR, hours REAL);
+		CREATE UNIQUE INDEX idx_leave_systemid ON leave (system, systemid);
+		CREATE INDEX idx_leave_userid ON leave (userid);
+		`,
+		`
+		-- Email digests that have been sent, so that a digest is sent once per team and period
+		CREATE TABLE digest_sends (teamid BIGINT, period_start DATE, sent_at TIMESTAMP, recipients VARCHAR, PRIMARY KEY (teamid, period_start));
+		`,
+		`
+		-- Alerts raised by alert rules. An alert is open until resolved_at is set, and a rule has at most one open alert per team.
+		-- notified_at is NULL until the notification has been delivered.
+		CREATE TABLE alerts (alertid BIGSERIAL PRIMARY KEY, rule VARCHAR, teamid BIGINT, first_week DATE, value REAL, threshold REAL, message VARCHAR,
+			fired_at TIMESTAMP, notified_at TIMESTAMP, resolved_at TIMESTAMP);
+		CREATE UNIQUE INDEX idx_alerts_open ON alerts (rule, teamid) WHERE resolved_at IS NULL;
+		CREATE INDEX idx_alerts_fired_at ON alerts (fired_at);
+		`,
+		`
+		-- Hourly rates, of either a user or a job role, from effective_from until the next rate of the same user or role.
+		-- A user's own rate takes precedence over the rate of their job role.
+		CREATE TABLE rates (rateid BIGSERIAL PRIMARY KEY, userid BIGINT, role VARCHAR, effective_from DATE, hourly_rate NUMERIC(14,2));
+		CREATE INDEX idx_rates_userid ON rates (userid, effective_from);
+		CREATE INDEX idx_rates_role ON rates (role, effective_from);
+		CREATE TABLE job_roles (jobroleid BIGSERIAL PRIMARY KEY, userid BIGINT, role VARCHAR, effective_from DATE);
+		CREATE INDEX idx_job_roles_userid ON job_roles (userid, effective_from);
+		`,
+		`
+		-- Client billing. A contract bills the time of its scopes (projects, JIRA projects or epics) at its hourly rate.
+		-- end_day and period_end are exclusive. An invoice, until it is voided, locks its period of the contract,
+		-- and keeps a copy of its lines, so that later changes to times, scopes or rates don't change it.
+		CREATE TABLE clients (clientid BIGSERIAL PRIMARY KEY, name VARCHAR);
+		CREATE UNIQUE INDEX idx_clients_name ON clients (name);
+		CREATE TABLE contracts (contractid BIGSERIAL PRIMARY KEY, clientid BIGINT, name VARCHAR, hourly_rate NUMERIC(14,2), currency VARCHAR,
+			start_day DATE, end_day DATE, round_minutes INTEGER, round_mode VARCHAR, round_per VARCHAR);
+		CREATE UNIQUE INDEX idx_contracts_name ON contracts (name);
+		CREATE TABLE contract_scopes (scopeid BIGSERIAL PRIMARY KEY, contractid BIGINT, kind VARCHAR, value VARCHAR, billable BOOLEAN);
+		CREATE UNIQUE INDEX idx_contract_scopes ON contract_scopes (contractid, kind, value);
+		CREATE TABLE invoices (invoiceid BIGSERIAL PRIMARY KEY, contractid BIGINT, number VARCHAR, period_start DATE, period_end DATE,
+			issued_at TIMESTAMP, issued_by VARCHAR, currency VARCHAR, billable_hours DOUBLE PRECISION, nonbillable_hours DOUBLE PRECISION,
+			amount NUMERIC(14,2), voided_at TIMESTAMP);
+		CREATE UNIQUE INDEX idx_invoices_number ON invoices (number);
+		CREATE INDEX idx_invoices_contractid ON invoices (contractid, period_start);
+		CREATE TABLE invoice_lines (invoiceid BIGINT, line INTEGER, ticket_key VARCHAR, description VARCHAR,
+			raw_hours DOUBLE PRECISION, hours DOUBLE PRECISION, rate NUMERIC(14,2), amount NUMERIC(14,2), PRIMARY KEY (invoiceid, line));
+		`,
+		`
+		-- Capitalisation policy. Time is CapEx or OpEx by the rule of its ticket, else of its epic, else of its ticket type,
+		-- else OpEx. Every change to a rule is kept in capitalisation_changes. A sign-off keeps a copy of the report.
+		CREATE TABLE capitalisation_rules (kind VARCHAR, value VARCHAR, class VARCHAR, PRIMARY KEY (kind, value));
+		INSERT INTO capitalisation_rules (kind, value, class) VALUES ('type', 'feat', 'capex');
+		CREATE TABLE capitalisation_changes (changeid BIGSERIAL PRIMARY KEY, kind VARCHAR, value VARCHAR, old_class VARCHAR, new_class VARCHAR,
+			changed_by VARCHAR, changed_at TIMESTAMP, reason VARCHAR);
+		CREATE TABLE capitalisation_signoffs (signoffid BIGSERIAL PRIMARY KEY, period_start DATE, period_end DATE, signed_by VARCHAR,
+			signed_at TIMESTAMP, note VARCHAR);
+		CREATE UNIQUE INDEX idx_capitalisation_signoffs ON capitalisation_signoffs (period_start, period_end);
+		CREATE TABLE capitalisation_signoff_rows (signoffid BIGINT, teamid BIGINT, team VARCHAR, project VARCHAR,
+			capex_seconds DOUBLE PRECISION, opex_seconds DOUBLE PRECISION, capex_cost NUMERIC(14,2), opex_cost NUMERIC(14,2),
+			uncosted_seconds DOUBLE PRECISION);
+		`,
+		`
+		-- When the ticket was resolved, in the source system. NULL while it is unresolved, including after it is reopened.
+		ALTER TABLE tickets ADD COLUMN resolve_time TIMESTAMP;
+		CREATE INDEX idx_tickets_resolve_time ON tickets (resolve_time);
+		`,
+		`
+		-- The timestamp of the latest webhook event that has been applied to each JIRA issue and worklog, so that an older
+		-- event that is delivered late doesn't undo a newer one. The row of a deleted object is kept, so that it stays deleted.
+		CREATE TABLE webhook_objects (kind VARCHAR, systemid VARCHAR, event_time BIGINT, PRIMARY KEY (kind, systemid));
+		`,
+		`
+		-- Commit authors are no longer made users, because many of them are bots or outside contributors. userid is NULL
+		-- unless author_email is that of an existing user. The users that were only made for commit authors are removed.
+		ALTER TABLE commits ADD COLUMN author_email VARCHAR;
+		UPDATE commits AS c SET author_email = u.email FROM users AS u WHERE u.userid = c.userid;
+		DELETE FROM users AS u WHERE EXISTS (SELECT 1 FROM commits AS c WHERE c.userid = u.userid)
+			AND NOT EXISTS (SELECT 1 FROM times AS t WHERE t.userid = u.userid)
+			AND NOT EXISTS (SELECT 1 FROM tickets AS k WHERE k.userid = u.userid)
+			AND NOT EXISTS (SELECT 1 FROM team_members AS m WHERE m.userid = u.userid)
+			AND NOT EXISTS (SELECT 1 FROM user_aliases AS a WHERE a.userid = u.userid)
+			AND NOT EXISTS (SELECT 1 FROM leave AS l WHERE l.userid = u.userid)
+			AND NOT EXISTS (SELECT 1 FROM rates AS r WHERE r.userid = u.userid)
+			AND NOT EXISTS (SELECT 1 FROM job_roles AS j WHERE j.userid = u.userid);
+		UPDATE commits SET userid = NULL WHERE userid NOT IN (SELECT userid FROM users);
+		`,
 	}
 
 	migs := []migration.Migrator{}
@@ -157,13 +406,13 @@ func (t *TimeDB) InsertIssues1(issues []IssueFormat1) error {
 
 	for _, issue := range issues {
 		var res sql.Result
-		if res, err = tx.Exec("UPDATE tickets SET title = $1, ticket_type = $2, story_points = $3 WHERE system = $4 AND systemid = $5",
-			issue.Title, issue.Type, issue.StoryPoints, issue.System, issue.SystemID); err != nil {
+		if res, err = tx.Exec("UPDATE tickets SET title = $1, ticket_type = $2, story_points = $3, ticket_key = $4, parent_key = $5, create_time = $6, resolve_time = $7 WHERE system = $8 AND systemid = $9",
+			issue.Title, issue.Type, issue.StoryPoints, issue.Key, nullString(issue.ParentKey), issue.CreateTime, issue.ResolveTime, issue.System, issue.SystemID); err != nil {
 			break
 		}
 		if affected, _ := res.RowsAffected(); affected == 0 {
-			if _, err = tx.Exec("INSERT INTO tickets (system, systemid, title, ticket_type, story_points, create_time) VALUES ($1, $2, $3, $4, $5, $6)",
-				issue.System, issue.SystemID, issue.Title, issue.Type, issue.StoryPoints, issue.CreateTime); err != nil {
+			if _, err = tx.Exec("INSERT INTO tickets (system, systemid, ticket_key, parent_key, title, ticket_type, story_points, create_time, resolve_time) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+				issue.System, issue.SystemID, issue.Key, nullString(issue.ParentKey), issue.Title, issue.Type, issue.StoryPoints, issue.CreateTime, issue.ResolveTime); err != nil {
 				break
 			}
 		}
@@ -189,7 +438,7 @@ func (t *TimeDB) InsertTimes1(times []TimeFormat1) error {
 	}
 	for _, tt := range times {
 		userid := int64(0)
-		if userid, err = t.emailToUser(tx, cache, tt.Email); err != nil {
+		if userid, err = t.emailToUser(tx, cache, tt.System, tt.Email); err != nil {
 			break
 		}
 		ticketid := int64(0)
@@ -223,6 +472,143 @@ func (t *TimeDB) InsertTimes1(times []TimeFormat1) error {
 	}
 }
 
+func (t *TimeDB) InsertTimes2(times []TimeFormat2) error {
+	cache := newCaches()
+	tx, err := t.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	for _, tt := range times {
+		userid := int64(0)
+		if userid, err = t.emailToUser(tx, cache, tt.System, tt.Email); err != nil {
+			break
+		}
+		ticketid := int64(0)
+		if tt.TicketSystemID != "" {
+			ticketid, err = t.systemIDToTicket(tx, tt.TicketSystem, tt.TicketSystemID)
+		} else {
+			ticketid, err = t.titleToTicket(tx, cache, userid, tt.TaskTitle, true)
+		}
+		if err != nil {
+			break
+		}
+		start, end := tt.Start.Local(), tt.End.Local()
+		var resp sql.Result
+		resp, err = tx.Exec("UPDATE times SET userid = $1, start_time = $2, end_time = $3, ticketid = $4, project = $5 WHERE system = $6 AND systemid = $7",
+			userid, start, end, ticketid, nullString(tt.Project), tt.System, tt.SystemID)
+		if err != nil {
+			break
+		}
+		rows_affected := int64(0)
+		if rows_affected, err = resp.RowsAffected(); err != nil {
+			break
+		}
+		if rows_affected == 0 {
+			_, err = tx.Exec("INSERT INTO times (userid, system, systemid, start_time, end_time, ticketid, project) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+				userid, tt.System, tt.SystemID, start, end, ticketid, nullString(tt.Project))
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	} else {
+		return tx.Commit()
+	}
+}
+
+// Delete a ticket. Time entries that refer to this ticket are left alone, but
+// they will no longer show up in any reports.
+func (t *TimeDB) DeleteTicket(system, systemid string) error {
+	_, err := t.Conn.Exec("DELETE FROM tickets WHERE system = $1 AND systemid = $2", system, systemid)
+	return err
+}
+
+func (t *TimeDB) DeleteTime(system, systemid string) error {
+	_, err := t.Conn.Exec("DELETE FROM times WHERE system = $1 AND systemid = $2", system, systemid)
+	return err
+}
+
+// Deletes the times of a user, from the given system, which started within [start, end), and whose
+// systemid is not in keep. This is for sources such as calendars, where entries simply disappear.
+// The user is found like emailToUser finds them, through the identity rules and aliases.
+func (t *TimeDB) DeleteTimesNotIn(system, email string, start, end time.Time, keep map[string]bool) error {
+	tx, err := t.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	userid, err := findUser(tx, t.canonicalEmail(system, email))
+	if err != nil || userid == 0 {
+		return err
+	}
+	rows, err := tx.Query("SELECT systemid FROM times WHERE system = $1 AND userid = $2 AND start_time >= $3 AND start_time < $4",
+		system, userid, start.Local(), end.Local())
+	if err != nil {
+		return err
+	}
+	stale := []string{}
+	for rows.Next() {
+		systemid := ""
+		if err := rows.Scan(&systemid); err != nil {
+			rows.Close()
+			return err
+		}
+		if !keep[systemid] {
+			stale = append(stale, systemid)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, systemid := range stale {
+		if _, err := tx.Exec("DELETE FROM times WHERE system = $1 AND systemid = $2", system, systemid); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Returns true if the webhook event has already been recorded
+func (t *TimeDB) HasWebhookEvent(eventid string) (bool, error) {
+	count := 0
+	if err := t.Conn.QueryRow("SELECT count(*) FROM webhook_events WHERE eventid = $1", eventid).Scan(&count); err != nil {
+		return false, err
+	}
+	return count != 0, nil
+}
+
+// Record that a webhook event has been applied. Recording the same event twice is not an error.
+func (t *TimeDB) RecordWebhookEvent(eventid, eventType string) error {
+	_, err := t.Conn.Exec("INSERT INTO webhook_events (eventid, event_type, received_time) VALUES ($1, $2, $3)", eventid, eventType, time.Now().UTC())
+	if err != nil && isKeyViolation(err) {
+		return nil
+	}
+	return err
+}
+
+// Returns true if an event newer than timestamp has already been applied to the object of the given kind
+func (t *TimeDB) HasNewerWebhookEvent(kind, systemid string, timestamp int64) (bool, error) {
+	count := 0
+	if err := t.Conn.QueryRow("SELECT count(*) FROM webhook_objects WHERE kind = $1 AND systemid = $2 AND event_time > $3",
+		kind, systemid, timestamp).Scan(&count); err != nil {
+		return false, err
+	}
+	return count != 0, nil
+}
+
+// Record that an event with the given timestamp has been applied to the object of the given kind
+func (t *TimeDB) RecordWebhookObject(kind, systemid string, timestamp int64) error {
+	_, err := t.Conn.Exec(`INSERT INTO webhook_objects (kind, systemid, event_time) VALUES ($1, $2, $3)
+		ON CONFLICT (kind, systemid) DO UPDATE SET event_time = GREATEST(webhook_objects.event_time, EXCLUDED.event_time)`,
+		kind, systemid, timestamp)
+	return err
+}
+
 func generateAnonTaskName(userid int64, title string) string {
 	return fmt.Sprintf("anon(%v): %v", userid, title)
 }
@@ -241,6 +627,10 @@ func (t *TimeDB) createAnonymousTask(tx *sql.Tx, userid int64, title string) (in
 	return ticketid, nil
 }
 
+// If there is no ticket with exactly the given title, but the title mentions a JIRA key
+// (eg "ABC-123 Fix the login page"), then we link to that ticket. An existing anonymous task
+// takes precedence over the key, so that time which has already been imported keeps its ticket
+// (the TMetric systemid is derived from the ticketid).
 func (t *TimeDB) titleToTicket(tx *sql.Tx, cache *caches, userid int64, title string, createAnon bool) (int64, error) {
 	ticket, err := t.titleToTicketRaw(tx, cache, title)
 	if ticket != 0 || err != nil {
@@ -250,6 +640,12 @@ func (t *TimeDB) titleToTicket(tx *sql.Tx, cache *caches, userid int64, title st
 	if ticket != 0 || err != nil {
 		return ticket, err
 	}
+	for _, key := range FindTicketKeys(title) {
+		ticket, err = t.keyToTicket(tx, cache, key)
+		if ticket != 0 || err != nil {
+			return ticket, err
+		}
+	}
 
 	if !createAnon {
 		return 0, nil
@@ -259,6 +655,19 @@ func (t *TimeDB) titleToTicket(tx *sql.Tx, cache *caches, userid int64, title st
 	return t.createAnonymousTask(tx, userid, title)
 }
 
+// Returns the ticketid of the ticket with the given system id, creating a placeholder ticket if necessary
+func (t *TimeDB) systemIDToTicket(tx *sql.Tx, system, systemid string) (int64, error) {
+	ticketid := int64(0)
+	err := tx.QueryRow("SELECT ticketid FROM tickets WHERE system = $1 AND systemid = $2", system, systemid).Scan(&ticketid)
+	if err != sql.ErrNoRows {
+		return ticketid, err
+	}
+	t.Log.Infof("Unable to find ticket %v:%v. Creating a placeholder", system, systemid)
+	err = tx.QueryRow("INSERT INTO tickets (system, systemid, title, ticket_type) VALUES ($1, $2, $3, $4) RETURNING ticketid",
+		system, systemid, "", TicketTypeOther).Scan(&ticketid)
+	return ticketid, err
+}
+
 // Returns 0, nil  if no such ticket found
 // Returns !0, nil if ticket found
 // Return 0, err   if an error occurred
@@ -275,18 +684,35 @@ func (t *TimeDB) titleToTicketRaw(tx *sql.Tx, cache *caches, title string) (int6
 	return ticketid, nil
 }
 
+// Same return values as titleToTicketRaw
+func (t *TimeDB) keyToTicket(tx *sql.Tx, cache *caches, key string) (int64, error) {
+	if id, ok := cache.keyToTicket[key]; ok {
+		return id, nil
+	}
+	ticketid := int64(0)
+	err := tx.QueryRow("SELECT ticketid FROM tickets WHERE system = $1 AND ticket_key = $2", SystemTypeJira, key).Scan(&ticketid)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	cache.keyToTicket[key] = ticketid
+	return ticketid, nil
+}
+
 // Same return values as titleToTicket
-func (t *TimeDB) emailToUser(tx *sql.Tx, cache *caches, email string) (int64, error) {
-	if id, ok := cache.emailToUser[email]; ok {
+// The email address is first rewritten by the identity rules of the system, and then
+// looked up in the user aliases, before we look for (or create) a user with that address.
+func (t *TimeDB) emailToUser(tx *sql.Tx, cache *caches, system, email string) (int64, error) {
+	cacheKey := system + "\x00" + email
+	if id, ok := cache.emailToUser[cacheKey]; ok {
 		return id, nil
 	}
+	email = t.canonicalEmail(system, email)
 try_again:
-	userid := int64(0)
-	err := tx.QueryRow("SELECT userid FROM users WHERE lower(email) = lower($1)", email).Scan(&userid)
-	if err != nil && err != sql.ErrNoRows {
+	userid, err := findUser(tx, email)
+	if err != nil {
 		return 0, err
 	}
-	if err == sql.ErrNoRows {
+	if userid == 0 {
 		// insert user
 		_, err = tx.Exec("INSERT INTO users (email) VALUES (lower($1))", email)
 		if err != nil {
@@ -294,10 +720,37 @@ try_again:
 		}
 		goto try_again
 	}
-	cache.emailToUser[email] = userid
+	cache.emailToUser[cacheKey] = userid
 	return userid, nil
 }
 
+// Like emailToUser, but returns 0 instead of creating a user if there is no user with the email address
+func (t *TimeDB) existingEmailToUser(tx *sql.Tx, cache *caches, system, email string) (int64, error) {
+	cacheKey := system + "\x00" + email
+	if id, ok := cache.emailToUser[cacheKey]; ok {
+		return id, nil
+	}
+	userid, err := findUser(tx, t.canonicalEmail(system, email))
+	if err != nil {
+		return 0, err
+	}
+	cache.emailToUser[cacheKey] = userid
+	return userid, nil
+}
+
+// Returns the user with the email address, or alias, or 0 if there is none
+func findUser(tx *sql.Tx, email string) (int64, error) {
+	userid := int64(0)
+	err := tx.QueryRow("SELECT userid FROM user_aliases WHERE lower(email) = lower($1)", email).Scan(&userid)
+	if err == sql.ErrNoRows {
+		err = tx.QueryRow("SELECT userid FROM users WHERE lower(email) = lower($1)", email).Scan(&userid)
+	}
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return userid, err
+}
+
 // Generate a fake times systemid value, assuming that the system generates a summary report, where
 // each task is listed just one, so we'll only ever have a single entry per day, for any ticket.
 // This will break, and produce extra hours, if a user goes back and rewrites history to such a
@@ -0,0 +1,442 @@
+package timedb
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TimesheetConfig defines how much time people are expected to log
+type TimesheetConfig struct {
+	HoursPerDay float64  // Expected hours on a working day. Default is 8.
+	WorkDays    []string // Names of days, such as "Mon" or "Monday". Default is Monday to Friday.
+	Tolerance   float64  // A day is under or over logged if it differs by more than this many hours. Default is 1.
+}
+
+func (c *TimesheetConfig) hoursPerDay() float64 {
+	if c.HoursPerDay <= 0 {
+		return 8
+	}
+	return c.HoursPerDay
+}
+
+func (c *TimesheetConfig) tolerance() float64 {
+	if c.Tolerance <= 0 {
+		return 1
+	}
+	return c.Tolerance
+}
+
+func (c *TimesheetConfig) isWorkDay(day time.Weekday) bool {
+	if len(c.WorkDays) == 0 {
+		return day != time.Saturday && day != time.Sunday
+	}
+	for _, d := range c.WorkDays {
+		if strings.EqualFold(d, day.String()) || strings.EqualFold(d, day.String()[:3]) {
+			return true
+		}
+	}
+	return false
+}
+
+type Holiday struct {
+	Day  time.Time
+	Name string
+}
+
+// A period of leave, from the first to the last day, inclusive.
+// Hours is the time off per day, or zero for full days.
+type LeaveFormat1 struct {
+	System   string
+	SystemID string
+	Email    string
+	Start    time.Time
+	End      time.Time
+	Kind     string // eg "annual", "sick"
+	Hours    float64
+}
+
+// Insert or rename public holidays
+func (t *TimeDB) SetHolidays(holidays []Holiday) error {
+	tx, err := t.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, h := range holidays {
+		day := h.Day.Format("2006-01-02")
+		resp, err := tx.Exec("UPDATE holidays SET name = $1 WHERE day = $2", h.Name, day)
+		if err != nil {
+			return err
+		}
+		if n, err := resp.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			if _, err := tx.Exec("INSERT INTO holidays (day, name) VALUES ($1, $2)", day, h.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func (t *TimeDB) DeleteHoliday(day time.Time) error {
+	_, err := t.Conn.Exec("DELETE FROM holidays WHERE day = $1", day.Format("2006-01-02"))
+	return err
+}
+
+// Returns the public holidays within [start, end), keyed by 2006-01-02
+func (t *TimeDB) Holidays(start, end time.Time) (map[string]string, error) {
+	rows, err := t.Conn.Query("SELECT day, name FROM holidays WHERE day >= $1 AND day < $2", start.Format("2006-01-02"), end.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	holidays := map[string]string{}
+	for rows.Next() {
+		day := time.Time{}
+		name := ""
+		if err := rows.Scan(&day, &name); err != nil {
+			return nil, err
+		}
+		holidays[day.Format("2006-01-02")] = name
+	}
+	return holidays, rows.Err()
+}
+
+// Insert or update periods of leave, identified by (system, systemid)
+func (t *TimeDB) InsertLeave1(leave []LeaveFormat1) error {
+	cache := newCaches()
+	tx, err := t.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, l := range leave {
+		if l.End.Before(l.Start) {
+			return fmt.Errorf("Leave %v of %v ends before it starts", l.SystemID, l.Email)
+		}
+		userid, err := t.emailToUser(tx, cache, l.System, l.Email)
+		if err != nil {
+			return err
+		}
+		var hours sql.NullFloat64
+		if l.Hours > 0 {
+			hours = sql.NullFloat64{Float64: l.Hours, Valid: true}
+		}
+		start, end := l.Start.Format("2006-01-02"), l.End.Format("2006-01-02")
+		resp, err := tx.Exec("UPDATE leave SET userid = $1, start_day = $2, end_day = $3, kind = $4, hours = $5 WHERE system = $6 AND systemid = $7",
+			userid, start, end, l.Kind, hours, l.System, l.SystemID)
+		if err != nil {
+			return err
+		}
+		if n, err := resp.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			_, err = tx.Exec("INSERT INTO leave (userid, system, systemid, start_day, end_day, kind, hours) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+				userid, l.System, l.SystemID, start, end, l.Kind, hours)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+const (
+	TimesheetOK    = "ok"
+	TimesheetGap   = "gap"   // Nothing logged on a day where time was expected
+	TimesheetUnder = "under" // Less than expected
+	TimesheetOver  = "over"  // More than expected
+	TimesheetOff   = "off"   // A working day, but a public holiday or a full day of leave
+)
+
+type TimesheetDay struct {
+	Day           time.Time
+	ExpectedHours float64
+	LoggedHours   float64
+	Holiday       string // Name of the public holiday
+	Leave         string // Kind of leave
+	Status        string
+}
+
+// The logged and expected hours of a single person, over a period
+type TimesheetSummary struct {
+	UserID        int64
+	Email         string
+	ExpectedHours float64
+	LoggedHours   float64
+	Gaps          int
+	Under         int
+	Over          int
+	Days          []TimesheetDay // Working days, and other days on which time was logged
+}
+
+// TimesheetQuery selects the people and period of a completeness report. For teams, a person's
+// days only count while they were a member of the team. The period is [Start, End), but never includes today.
+type TimesheetQuery struct {
+	UserIDs []int64
+	TeamIDs []int64
+	Start   time.Time
+	End     time.Time
+}
+
+// A day of leave
+type leaveDay struct {
+	kind  string
+	hours float64 // Zero for a full day
+}
+
+// Returns the hours that a person is expected to work on the day, given the name of its public holiday,
+// if any, and their leave, which is nil if they are not on leave
+func (c *TimesheetConfig) expectedHours(day time.Time, holiday string, leave *leaveDay) float64 {
+	if !c.isWorkDay(day.Weekday()) || holiday != "" {
+		return 0
+	}
+	expected := c.hoursPerDay()
+	if leave != nil {
+		if leave.hours == 0 || leave.hours >= expected {
+			return 0
+		}
+		expected -= leave.hours
+	}
+	return expected
+}
+
+// Returns the leave of the users within [start, end), keyed by dayKey
+func (t *TimeDB) leaveDays(userids []int64, start, end time.Time) (map[string]leaveDay, error) {
+	leave := map[string]leaveDay{}
+	clause, args := inClause("userid", userids, []interface{}{start, end})
+	rows, err := t.Conn.Query(`
+SELECT userid, start_day, end_day, COALESCE(kind, ''), COALESCE(hours, 0) FROM leave
+WHERE end_day >= $1 AND start_day < $2 AND `+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		userid := int64(0)
+		var from, to time.Time
+		l := leaveDay{}
+		if err := rows.Scan(&userid, &from, &to, &l.kind, &l.hours); err != nil {
+			return nil, err
+		}
+		for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+			leave[dayKey(userid, d)] = l
+		}
+	}
+	return leave, rows.Err()
+}
+
+func dayKey(userid int64, day time.Time) string {
+	return fmt.Sprintf("%v/%v", userid, day.Format("2006-01-02"))
+}
+
+// Returns the days on which each user is in scope of the query, keyed by dayKey
+func (t *TimeDB) timesheetScope(q *TimesheetQuery, days []time.Time) (map[int64]string, map[string]bool, error) {
+	emails := map[int64]string{}
+	active := map[string]bool{}
+	if len(q.UserIDs) != 0 {
+		clause, args := inClause("userid", q.UserIDs, nil)
+		rows, err := t.Conn.Query("SELECT userid, email FROM users WHERE "+clause, args...)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			userid := int64(0)
+			email := ""
+			if err := rows.Scan(&userid, &email); err != nil {
+				return nil, nil, err
+			}
+			emails[userid] = email
+			for _, day := range days {
+				active[dayKey(userid, day)] = true
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(q.TeamIDs) != 0 {
+		clause, args := inClause("m.teamid", q.TeamIDs, nil)
+		rows, err := t.Conn.Query("SELECT m.userid, u.email, m.effective_from, m.effective_to FROM team_members AS m INNER JOIN users AS u ON u.userid = m.userid WHERE "+clause, args...)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			m := TeamMember{}
+			if err := rows.Scan(&m.UserID, &m.Email, &m.EffectiveFrom, &m.EffectiveTo); err != nil {
+				return nil, nil, err
+			}
+			emails[m.UserID] = m.Email
+			for _, day := range days {
+				if m.ActiveAt(day) {
+					active[dayKey(m.UserID, day)] = true
+				}
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return emails, active, nil
+}
+
+// QueryTimesheets compares the hours that each person logged per day against the hours that they
+// were expected to log, taking weekends, public holidays and leave into account.
+// People are ordered by the number of gaps, most first.
+func (t *TimeDB) QueryTimesheets(q *TimesheetQuery) ([]TimesheetSummary, error) {
+	cfg := &t.Config.Timesheets
+	start := time.Date(q.Start.Year(), q.Start.Month(), q.Start.Day(), 0, 0, 0, 0, time.Local)
+	end := time.Date(q.End.Year(), q.End.Month(), q.End.Day(), 0, 0, 0, 0, time.Local)
+	now := time.Now()
+	if today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local); end.After(today) {
+		end = today
+	}
+	days := []time.Time{}
+	for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+		days = append(days, d)
+	}
+
+	emails, active, err := t.timesheetScope(q, days)
+	if err != nil || len(emails) == 0 {
+		return []TimesheetSummary{}, err
+	}
+	userids := []int64{}
+	for userid := range emails {
+		userids = append(userids, userid)
+	}
+
+	holidays, err := t.Holidays(start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	// Logged hours per user and day
+	logged := map[string]float64{}
+	clause, args := inClause("userid", userids, []interface{}{start, end})
+	rows, err := t.Conn.Query(`
+SELECT userid, start_time::DATE, sum(EXTRACT(EPOCH FROM end_time - start_time)) / 3600 FROM times
+WHERE start_time >= $1 AND start_time < $2 AND `+clause+`
+GROUP BY 1, 2`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		userid := int64(0)
+		day := time.Time{}
+		hours := 0.0
+		if err := rows.Scan(&userid, &day, &hours); err != nil {
+			return nil, err
+		}
+		logged[dayKey(userid, day)] = hours
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	leave, err := t.leaveDays(userids, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []TimesheetSummary{}
+	for _, userid := range userids {
+		s := TimesheetSummary{UserID: userid, Email: emails[userid], Days: []TimesheetDay{}}
+		for _, day := range days {
+			key := dayKey(userid, day)
+			if !active[key] {
+				continue
+			}
+			d := TimesheetDay{Day: day, LoggedHours: logged[key], Holiday: holidays[day.Format("2006-01-02")]}
+			workDay := cfg.isWorkDay(day.Weekday())
+			var dayLeave *leaveDay
+			if l, ok := leave[key]; ok {
+				dayLeave = &l
+				if workDay && d.Holiday == "" {
+					d.Leave = l.kind
+				}
+			}
+			d.ExpectedHours = cfg.expectedHours(day, d.Holiday, dayLeave)
+			if !workDay && d.LoggedHours == 0 {
+				continue
+			}
+			switch {
+			case d.ExpectedHours == 0 && d.LoggedHours == 0:
+				d.Status = TimesheetOff
+			case d.LoggedHours == 0:
+				d.Status = TimesheetGap
+				s.Gaps++
+			case d.LoggedHours < d.ExpectedHours-cfg.tolerance():
+				d.Status = TimesheetUnder
+				s.Under++
+			case d.LoggedHours > d.ExpectedHours+cfg.tolerance():
+				d.Status = TimesheetOver
+				s.Over++
+			default:
+				d.Status = TimesheetOK
+			}
+			s.ExpectedHours += d.ExpectedHours
+			s.LoggedHours += d.LoggedHours
+			s.Days = append(s.Days, d)
+		}
+		result = append(result, s)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Gaps != result[j].Gaps {
+			return result[i].Gaps > result[j].Gaps
+		}
+		return strings.ToLower(result[i].Email) < strings.ToLower(result[j].Email)
+	})
+	return result, nil
+}
+
+// NominalHours returns the hours that the members of the teams are expected to work on each day of [start, end),
+// which may be in the future, taking weekends, public holidays and leave into account. A person that is a member
+// of several of the teams counts once.
+func (t *TimeDB) NominalHours(teamids []int64, start, end time.Time) ([]float64, error) {
+	cfg := &t.Config.Timesheets
+	start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.Local)
+	end = time.Date(end.Year(), end.Month(), end.Day(), 0, 0, 0, 0, time.Local)
+	days := []time.Time{}
+	for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+		days = append(days, d)
+	}
+	hours := make([]float64, len(days))
+
+	emails, active, err := t.timesheetScope(&TimesheetQuery{TeamIDs: teamids}, days)
+	if err != nil || len(emails) == 0 {
+		return hours, err
+	}
+	userids := []int64{}
+	for userid := range emails {
+		userids = append(userids, userid)
+	}
+	holidays, err := t.Holidays(start, end)
+	if err != nil {
+		return nil, err
+	}
+	leave, err := t.leaveDays(userids, start, end)
+	if err != nil {
+		return nil, err
+	}
+	for i, day := range days {
+		for _, userid := range userids {
+			key := dayKey(userid, day)
+			if !active[key] {
+				continue
+			}
+			var dayLeave *leaveDay
+			if l, ok := leave[key]; ok {
+				dayLeave = &l
+			}
+			hours[i] += cfg.expectedHours(day, holidays[day.Format("2006-01-02")], dayLeave)
+		}
+	}
+	return hours, nil
+}
@@ -0,0 +1,244 @@
+package timedb
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type User struct {
+	UserID  int64
+	Email   string
+	Aliases []string
+	Seconds float64 // Total time logged
+}
+
+// A pair of users that are probably the same person
+type DuplicateUser struct {
+	A      User
+	B      User
+	Reason string
+}
+
+// Returns all users and their aliases, ordered by email
+func (t *TimeDB) Users() ([]User, error) {
+	rows, err := t.Conn.Query(`
+SELECT u.userid, u.email,
+	COALESCE((SELECT sum(EXTRACT(EPOCH FROM end_time - start_time)) FROM times WHERE times.userid = u.userid), 0),
+	COALESCE(a.email, '')
+FROM users AS u
+LEFT JOIN user_aliases AS a ON a.userid = u.userid
+ORDER BY lower(u.email), lower(a.email)`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := []User{}
+	for rows.Next() {
+		u := User{Aliases: []string{}}
+		alias := ""
+		if err := rows.Scan(&u.UserID, &u.Email, &u.Seconds, &alias); err != nil {
+			return nil, err
+		}
+		if len(users) == 0 || users[len(users)-1].UserID != u.UserID {
+			users = append(users, u)
+		}
+		if alias != "" {
+			last := &users[len(users)-1]
+			last.Aliases = append(last.Aliases, alias)
+		}
+	}
+	return users, rows.Err()
+}
+
+// Returns the userid of the user with the given email address, or alias. Returns 0 if there is no such user.
+func (t *TimeDB) UserIDFromEmail(email string) (int64, error) {
+	userid := int64(0)
+	err := t.Conn.QueryRow(`
+SELECT userid FROM users WHERE lower(email) = lower($1)
+UNION ALL
+SELECT userid FROM user_aliases WHERE lower(email) = lower($1)`, email).Scan(&userid)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return userid, err
+}
+
+// Normalize the local part of an email address, so that "ben.harper", "ben_harper" and "benharper" are equal
+func normalizeLocalPart(local string) string {
+	if plus := strings.IndexByte(local, '+'); plus != -1 {
+		local = local[:plus]
+	}
+	return strings.NewReplacer(".", "", "_", "", "-", "").Replace(local)
+}
+
+// Returns pairs of users whose email addresses suggest that they are the same person.
+// This is typically caused by a source system that uses a different domain, or a short name.
+func (t *TimeDB) LikelyDuplicateUsers() ([]DuplicateUser, error) {
+	users, err := t.Users()
+	if err != nil {
+		return nil, err
+	}
+	split := func(email string) (string, string) {
+		at := strings.LastIndexByte(email, '@')
+		if at == -1 {
+			return strings.ToLower(email), ""
+		}
+		return strings.ToLower(email[:at]), strings.ToLower(email[at+1:])
+	}
+	result := []DuplicateUser{}
+	for i := range users {
+		localA, domainA := split(users[i].Email)
+		for j := i + 1; j < len(users); j++ {
+			localB, domainB := split(users[j].Email)
+			reason := ""
+			switch {
+			case localA == localB:
+				reason = "Same name, different domain"
+			case normalizeLocalPart(localA) == normalizeLocalPart(localB):
+				reason = "Same name, different punctuation"
+			case domainA == domainB && (strings.HasPrefix(localB, localA+".") || strings.HasPrefix(localA, localB+".")):
+				reason = "Short name"
+			}
+			if reason != "" {
+				result = append(result, DuplicateUser{A: users[i], B: users[j], Reason: reason})
+			}
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].A.Seconds+result[i].B.Seconds > result[j].A.Seconds+result[j].B.Seconds
+	})
+	return result, nil
+}
+
+// Add an alias, so that time from the given email address is attributed to userid
+func (t *TimeDB) AddUserAlias(userid int64, email string) error {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return fmt.Errorf("Email may not be empty")
+	}
+	existing, err := t.UserIDFromEmail(email)
+	if err != nil {
+		return err
+	}
+	if existing != 0 {
+		return fmt.Errorf("%v already belongs to a user. Merge the users instead.", email)
+	}
+	_, err = t.Conn.Exec("INSERT INTO user_aliases (email, userid) VALUES ($1, $2)", email, userid)
+	return err
+}
+
+// Merge the user 'from' into the user 'into'. All time, tickets, commits and team memberships of 'from'
+// are moved over, and the email address of 'from' becomes an alias of 'into', so that future syncs
+// attribute its time to 'into'.
+func (t *TimeDB) MergeUsers(from, into int64) error {
+	if from == into {
+		return fmt.Errorf("Cannot merge a user into itself")
+	}
+	tx, err := t.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	fromEmail := ""
+	if err := tx.QueryRow("SELECT email FROM users WHERE userid = $1", from).Scan(&fromEmail); err != nil {
+		return fmt.Errorf("User %v: %v", from, err)
+	}
+	exists := false
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE userid = $1)", into).Scan(&exists); err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("User %v does not exist", into)
+	}
+
+	if err := mergeAnonymousTasks(tx, from, into); err != nil {
+		return err
+	}
+
+	for _, table := range []string{"times", "tickets", "commits", "team_members", "user_aliases", "leave", "rates", "job_roles"} {
+		if _, err := tx.Exec(fmt.Sprintf("UPDATE %v SET userid = $1 WHERE userid = $2", table), into, from); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("INSERT INTO user_aliases (email, userid) VALUES (lower($1), $2)", fromEmail, into); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM users WHERE userid = $1", from); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Anonymous task titles contain the userid (see generateAnonTaskName), so they must be renamed.
+// If 'into' already has an anonymous task with the same title, then the two tasks are merged.
+func mergeAnonymousTasks(tx *sql.Tx, from, into int64) error {
+	rows, err := tx.Query("SELECT ticketid, title FROM tickets WHERE system = $1 AND userid = $2", SystemTypeAnon, from)
+	if err != nil {
+		return err
+	}
+	type anonTask struct {
+		ticketid int64
+		title    string
+	}
+	tasks := []anonTask{}
+	for rows.Next() {
+		task := anonTask{}
+		if err := rows.Scan(&task.ticketid, &task.title); err != nil {
+			rows.Close()
+			return err
+		}
+		tasks = append(tasks, task)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	fromPrefix := generateAnonTaskName(from, "")
+	for _, task := range tasks {
+		newTitle := generateAnonTaskName(into, strings.TrimPrefix(task.title, fromPrefix))
+		existing := int64(0)
+		err := tx.QueryRow("SELECT ticketid FROM tickets WHERE title = $1", newTitle).Scan(&existing)
+		if err == sql.ErrNoRows {
+			if _, err := tx.Exec("UPDATE tickets SET title = $1 WHERE ticketid = $2", newTitle, task.ticketid); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		// TMetric systemids are derived from the ticketid and the day (see generateTimeSystemIDForDay).
+		// Where both users logged time against this task on the same day, add the time together,
+		// and rewrite the remaining systemids so that the next sync updates these rows.
+		sameDay := `a.ticketid = $1 AND b.ticketid = $2 AND a.system = $3 AND b.system = $3
+			AND substring(a.systemid from position(':' in a.systemid)) = substring(b.systemid from position(':' in b.systemid))`
+		if _, err := tx.Exec("UPDATE times AS a SET end_time = a.end_time + (b.end_time - b.start_time) FROM times AS b WHERE "+sameDay,
+			existing, task.ticketid, SystemTypeTMetric); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM times AS b USING times AS a WHERE "+sameDay, existing, task.ticketid, SystemTypeTMetric); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE times SET systemid = $1 || substring(systemid from position(':' in systemid)) WHERE ticketid = $2 AND system = $3",
+			fmt.Sprintf("%v", existing), task.ticketid, SystemTypeTMetric); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE times SET ticketid = $1 WHERE ticketid = $2", existing, task.ticketid); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE commit_tickets SET ticketid = $1 WHERE ticketid = $2 AND NOT EXISTS (SELECT 1 FROM commit_tickets AS c WHERE c.commitid = commit_tickets.commitid AND c.ticketid = $1)",
+			existing, task.ticketid); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM commit_tickets WHERE ticketid = $1", task.ticketid); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM tickets WHERE ticketid = $1", task.ticketid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
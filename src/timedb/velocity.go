@@ -0,0 +1,107 @@
+package timedb
+
+import (
+	"time"
+)
+
+// The resolved tickets of a team in a period, and the time that the team logged against them
+type VelocityPeriod struct {
+	Start          time.Time
+	Tickets        int     // Throughput: the number of tickets resolved
+	Points         int     // Velocity: the story points of the tickets resolved
+	Seconds        float64 // Time logged by the team against the resolved tickets and their sub-tasks, over their whole life
+	PointedSeconds float64 // Of Seconds, the time against tickets that have story points
+	HoursPerPoint  float64 // PointedSeconds, in hours, per point. 0 if no points were resolved.
+}
+
+type TeamVelocity struct {
+	TeamID  int64
+	Team    string
+	Periods []VelocityPeriod
+}
+
+// Joins the team memberships 'm' of the people who did the work 'w', at the time that they did it
+const workTeamJoin = `INNER JOIN team_members AS m ON m.userid = w.userid
+	AND (m.effective_from IS NULL OR m.effective_from <= w.start_time) AND (m.effective_to IS NULL OR w.start_time < m.effective_to)`
+
+// QueryVelocity returns the velocity, throughput and hours per point of the given teams, or of all teams
+// if teamids is nil, in consecutive periods of the given number of weeks, from start until end.
+// The last period is cut short by end. Every period is included, even if nothing was resolved in it.
+// A ticket belongs to every team whose members logged time against it, or its sub-tasks, while they were members.
+func (t *TimeDB) QueryVelocity(start, end time.Time, weeks int, teamids []int64) ([]TeamVelocity, error) {
+	length := time.Duration(weeks) * 7 * 24 * time.Hour
+	teams := newSelectQuery("teams").columns("teamid", "name").orderBy("name")
+	if teamids != nil {
+		teams.whereIn("teamid", teamids)
+	}
+	rows, err := t.Conn.Query(teams.sql(), teams.args()...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := []TeamVelocity{}
+	index := map[int64]int{}
+	for rows.Next() {
+		v := TeamVelocity{Periods: []VelocityPeriod{}}
+		if err := rows.Scan(&v.TeamID, &v.Team); err != nil {
+			return nil, err
+		}
+		for p := start; p.Before(end); p = p.Add(length) {
+			v.Periods = append(v.Periods, VelocityPeriod{Start: p})
+		}
+		index[v.TeamID] = len(result)
+		result = append(result, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return result, nil
+	}
+
+	// Sub-tasks and epics are not counted themselves, because their work and points are those of their stories
+	q := newSelectQuery("team_work AS tw")
+	startArg, subtaskArg := q.arg(start), q.arg(TicketTypeSubtask)
+	q.with("resolved", q.sub("tickets").
+		columns("ticketid", "ticket_key", "COALESCE(story_points, 0) AS points",
+			"floor(EXTRACT(EPOCH FROM resolve_time - "+startArg+"::TIMESTAMP) / "+q.arg(length.Seconds())+")::INTEGER AS period").
+		where("resolve_time >= "+startArg).where("resolve_time < "+q.arg(end)).
+		where("ticket_type NOT IN ("+subtaskArg+", "+q.arg(TicketTypeEpic)+")"))
+	q.with("work", q.sub("resolved AS r").
+		columns("r.ticketid", "t.userid", "t.start_time", secondsExpr+" AS seconds").
+		join("INNER JOIN tickets AS k ON k.ticketid = r.ticketid OR (k.system = "+q.arg(SystemTypeJira)+
+			" AND k.ticket_type = "+subtaskArg+" AND k.parent_key = r.ticket_key)").
+		join("INNER JOIN times AS t ON t.ticketid = k.ticketid"))
+	teamWork := q.sub("work AS w").columns("m.teamid", "w.ticketid", "sum(w.seconds) AS seconds").
+		join(workTeamJoin).groupBy("m.teamid", "w.ticketid")
+	if teamids != nil {
+		teamWork.whereIn("m.teamid", teamids)
+	}
+	q.with("team_work", teamWork)
+	q.columns("tw.teamid", "r.period", "count(*)", "sum(r.points)", "sum(tw.seconds)",
+		"COALESCE(sum(tw.seconds) FILTER (WHERE r.points > 0), 0)").
+		join("INNER JOIN resolved AS r ON r.ticketid = tw.ticketid").
+		groupBy("tw.teamid", "r.period")
+	rows, err = t.Conn.Query(q.sql(), q.args()...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		teamid, period := int64(0), 0
+		p := VelocityPeriod{}
+		if err := rows.Scan(&teamid, &period, &p.Tickets, &p.Points, &p.Seconds, &p.PointedSeconds); err != nil {
+			return nil, err
+		}
+		i, ok := index[teamid]
+		if !ok || period < 0 || period >= len(result[i].Periods) {
+			continue
+		}
+		p.Start = result[i].Periods[period].Start
+		if p.Points != 0 {
+			p.HoursPerPoint = p.PointedSeconds / 3600 / float64(p.Points)
+		}
+		result[i].Periods[period] = p
+	}
+	return result, rows.Err()
+}
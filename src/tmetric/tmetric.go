@@ -80,6 +80,10 @@ func (f *Fetcher) Name() string {
 	return "TMetric"
 }
 
+func (f *Fetcher) Scope() string {
+	return "account " + f.Config.AccountID
+}
+
 func (f *Fetcher) LoadConfig() error {
 	return f.Config.LoadFile("config/tmetric.json")
 }
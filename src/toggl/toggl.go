@@ -0,0 +1,210 @@
+package toggl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+	"timedb"
+)
+
+/*
+Toggl Track has a proper API, authenticated with a per-user API token (Profile settings > API Token).
+The token must belong to a workspace admin, otherwise the reports only include that user's own entries.
+
+Workspace users:
+
+GET https://api.track.toggl.com/api/v9/workspaces/{workspace_id}/users
+[{"id": 123, "email": "ben@imqs.co.za", "fullname": "Ben"}, ...]
+
+Detailed time entries (paged, the next page is given by the X-Next-Row-Number response header):
+
+POST https://api.track.toggl.com/reports/api/v3/workspace/{workspace_id}/search/time_entries
+{"start_date": "2016-12-05", "end_date": "2016-12-06", "page_size": 200, "first_row_number": 1}
+
+[{"user_id": 123, "username": "Ben", "description": "AlbServer must call CrudServer on the correct port",
+  "time_entries": [{"id": 456, "seconds": 12060, "start": "2016-12-05T08:00:00+02:00", "stop": "2016-12-05T11:21:00+02:00"}]}]
+*/
+
+const APIURL = "https://api.track.toggl.com"
+
+const APIDateFormat = "2006-01-02"
+
+const pageSize = 200
+
+type Config struct {
+	APIToken    string
+	WorkspaceID string
+}
+
+func (c *Config) LoadFile(filename string) error {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("Error loading config file %v: %v", filename, err)
+	}
+	if err := json.Unmarshal(bytes, c); err != nil {
+		return fmt.Errorf("Error decoding config file %v: %v", filename, err)
+	}
+	return nil
+}
+
+type Fetcher struct {
+	Config Config
+}
+
+func (f *Fetcher) Name() string {
+	return "Toggl"
+}
+
+func (f *Fetcher) Scope() string {
+	return "workspace " + f.Config.WorkspaceID
+}
+
+func (f *Fetcher) LoadConfig() error {
+	return f.Config.LoadFile("config/toggl.json")
+}
+
+type togglJsonUser struct {
+	Id       int64  `json:"id"`
+	Email    string `json:"email"`
+	FullName string `json:"fullname"`
+}
+
+type togglJsonTimeEntry struct {
+	Id      int64  `json:"id"`
+	Seconds int64  `json:"seconds"`
+	Start   string `json:"start"`
+	Stop    string `json:"stop"`
+}
+
+type togglJsonRow struct {
+	UserId      int64                `json:"user_id"`
+	Username    string               `json:"username"`
+	Description string               `json:"description"`
+	TimeEntries []togglJsonTimeEntry `json:"time_entries"`
+}
+
+type togglJsonSearch struct {
+	StartDate      string `json:"start_date"`
+	EndDate        string `json:"end_date"`
+	PageSize       int    `json:"page_size"`
+	FirstRowNumber int    `json:"first_row_number"`
+}
+
+func (f *Fetcher) Fetch(db *timedb.TimeDB, start, end time.Time) error {
+	userToEmail, err := f.fetchUsers()
+	if err != nil {
+		return err
+	}
+
+	row := 1
+	for row != 0 {
+		fmt.Printf("Fetching Toggl time entries from row %v\n", row)
+		raw, nextRow, err := f.fetchPage(start, end, row)
+		if err != nil {
+			return err
+		}
+		rows := []togglJsonRow{}
+		if err := json.Unmarshal(raw, &rows); err != nil {
+			return fmt.Errorf("Error decoding Toggl time entries: %v", err)
+		}
+
+		times := []timedb.TimeFormat2{}
+		for _, r := range rows {
+			email, ok := userToEmail[r.UserId]
+			if !ok {
+				return fmt.Errorf("Toggl user %v (%v) is not a member of workspace %v", r.UserId, r.Username, f.Config.WorkspaceID)
+			}
+			for _, e := range r.TimeEntries {
+				if e.Stop == "" || e.Seconds < 0 {
+					// This entry is still running
+					continue
+				}
+				tstart, err := time.Parse(time.RFC3339, e.Start)
+				if err != nil {
+					return fmt.Errorf("Invalid start time '%v' in Toggl time entry %v", e.Start, e.Id)
+				}
+				times = append(times, timedb.TimeFormat2{
+					System:    timedb.SystemTypeToggl,
+					SystemID:  strconv.FormatInt(e.Id, 10),
+					Email:     email,
+					TaskTitle: r.Description,
+					Start:     tstart,
+					End:       tstart.Add(time.Duration(e.Seconds) * time.Second),
+				})
+			}
+		}
+		if err := db.InsertTimes2(times); err != nil {
+			return err
+		}
+		row = nextRow
+	}
+	return nil
+}
+
+// Returns a map from Toggl user id to email address
+func (f *Fetcher) fetchUsers() (map[int64]string, error) {
+	raw, _, err := f.doRequest("GET", fmt.Sprintf("%v/api/v9/workspaces/%v/users", APIURL, f.Config.WorkspaceID), nil)
+	if err != nil {
+		return nil, err
+	}
+	users := []togglJsonUser{}
+	if err := json.Unmarshal(raw, &users); err != nil {
+		return nil, fmt.Errorf("Error decoding Toggl workspace users: %v", err)
+	}
+	userToEmail := map[int64]string{}
+	for _, u := range users {
+		userToEmail[u.Id] = u.Email
+	}
+	return userToEmail, nil
+}
+
+// Returns the raw page, and the row number of the next page (or zero, if this is the last page)
+func (f *Fetcher) fetchPage(start, end time.Time, firstRow int) ([]byte, int, error) {
+	search := togglJsonSearch{
+		StartDate:      start.Format(APIDateFormat),
+		EndDate:        end.Format(APIDateFormat),
+		PageSize:       pageSize,
+		FirstRowNumber: firstRow,
+	}
+	body, _ := json.Marshal(&search)
+	url := fmt.Sprintf("%v/reports/api/v3/workspace/%v/search/time_entries", APIURL, f.Config.WorkspaceID)
+	raw, header, err := f.doRequest("POST", url, body)
+	if err != nil {
+		return nil, 0, err
+	}
+	nextRow, _ := strconv.Atoi(header.Get("X-Next-Row-Number"))
+	return raw, nextRow, nil
+}
+
+func (f *Fetcher) FetchRaw(start, end time.Time) ([]byte, error) {
+	raw, _, err := f.fetchPage(start, end, 1)
+	return raw, err
+}
+
+func (f *Fetcher) doRequest(method, url string, body []byte) ([]byte, http.Header, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.SetBasicAuth(f.Config.APIToken, "api_token")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("HTTP Error: %v", resp.Status)
+	}
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error reading body: %v", err)
+	}
+	return raw, resp.Header, nil
+}
@@ -0,0 +1,372 @@
+
+// $http can't send a body, so we have our own little JSON request function
+function send_json(method, url, body, good) {
+	var req = new XMLHttpRequest();
+	req.onreadystatechange = function() {
+		if (req.readyState == 4) {
+			if (req.status == 200)
+				good(req);
+			else
+				alert(req.responseText);
+		}
+	};
+	req.open(method, url, true);
+	req.setRequestHeader("Content-Type", "application/json");
+	req.send(body === undefined ? null : JSON.stringify(body));
+}
+
+function escape_html(s) {
+	return String(s).replace(/&/g, "&amp;").replace(/</g, "&lt;").replace(/>/g, "&gt;").replace(/'/g, "&#39;");
+}
+
+function date_of(d) {
+	return d ? d.substr(0, 10) : "";
+}
+
+// Teams are also needed to choose the teams that an account leads
+var all_teams = [];
+
+function load_teams() {
+	send_json("GET", "/admin/teams", undefined, function(resp) {
+		all_teams = JSON.parse(resp.response);
+		show_teams(all_teams);
+		load_accounts();
+	});
+}
+
+function show_teams(teams) {
+	var html = "";
+	for (var i = 0; i < teams.length; i++) {
+		var t = teams[i];
+		html += "<h3>" + escape_html(t.Name) + " ";
+		html += "<button onclick='rename_team(" + t.TeamID + ")'>Rename</button> ";
+		html += "<button onclick='delete_team(" + t.TeamID + ")'>Delete</button></h3>";
+		html += "<table class='rollup'><tr><th>Email</th><th>From</th><th>To</th><th></th></tr>";
+		for (var j = 0; j < t.Members.length; j++) {
+			var m = t.Members[j];
+			html += "<tr><td>" + escape_html(m.Email) + "</td>";
+			html += "<td><input type='date' id='from_" + m.MemberID + "' value='" + date_of(m.EffectiveFrom) + "'></td>";
+			html += "<td><input type='date' id='to_" + m.MemberID + "' value='" + date_of(m.EffectiveTo) + "'></td>";
+			html += "<td><button onclick='update_member(" + m.MemberID + ")'>Save</button> ";
+			html += "<button onclick='remove_member(" + m.MemberID + ")'>Remove</button></td></tr>";
+		}
+		html += "<tr><td><input id='email_" + t.TeamID + "' placeholder='email'></td>";
+		html += "<td><input type='date' id='newfrom_" + t.TeamID + "'></td>";
+		html += "<td><input type='date' id='newto_" + t.TeamID + "'></td>";
+		html += "<td><button onclick='add_member(" + t.TeamID + ")'>Add</button></td></tr>";
+		html += "</table>";
+	}
+	$html($id('teams'), html);
+}
+
+function rename_team(teamid) {
+	var name = prompt("New name");
+	if (name)
+		send_json("PUT", "/admin/team?teamid=" + teamid, {Name: name}, load_teams);
+}
+
+function delete_team(teamid) {
+	if (confirm("Delete this team, and all of its memberships?"))
+		send_json("DELETE", "/admin/team?teamid=" + teamid, undefined, load_teams);
+}
+
+function add_member(teamid) {
+	var body = {
+		TeamID: teamid,
+		Email: $id('email_' + teamid).value,
+		EffectiveFrom: $id('newfrom_' + teamid).value,
+		EffectiveTo: $id('newto_' + teamid).value,
+	};
+	send_json("POST", "/admin/members", body, load_teams);
+}
+
+function update_member(memberid) {
+	var body = {
+		EffectiveFrom: $id('from_' + memberid).value,
+		EffectiveTo: $id('to_' + memberid).value,
+	};
+	send_json("PUT", "/admin/members?memberid=" + memberid, body, load_teams);
+}
+
+function remove_member(memberid) {
+	send_json("DELETE", "/admin/members?memberid=" + memberid, undefined, load_teams);
+}
+
+function load_accounts() {
+	send_json("GET", "/admin/accounts", undefined, function(resp) {
+		show_accounts(JSON.parse(resp.response));
+	});
+}
+
+function role_options(selected) {
+	// The server renders the list of roles into the new account form
+	var roles = $id('new_account_role').options;
+	var html = "";
+	for (var i = 0; i < roles.length; i++)
+		html += "<option" + (roles[i].value == selected ? " selected" : "") + ">" + escape_html(roles[i].value) + "</option>";
+	return html;
+}
+
+function show_accounts(accounts) {
+	var html = "<table class='rollup'><tr><th>Email</th><th>Role</th><th>Leads</th><th>Password</th><th></th></tr>";
+	for (var i = 0; i < accounts.length; i++) {
+		var a = accounts[i];
+		html += "<tr><td>" + escape_html(a.Email) + (a.UserID ? "" : " (no time recorded)") + "</td>";
+		html += "<td><select id='role_" + a.AccountID + "'>" + role_options(a.Role) + "</select></td><td>";
+		for (var j = 0; j < all_teams.length; j++) {
+			var t = all_teams[j];
+			var checked = a.LeadTeamIDs.indexOf(t.TeamID) != -1 ? " checked" : "";
+			html += "<label><input type='checkbox' class='lead_" + a.AccountID + "' value='" + t.TeamID + "'" + checked + ">" + escape_html(t.Name) + "</label> ";
+		}
+		html += "</td><td><input type='password' id='password_" + a.AccountID + "' placeholder='" + (a.HasPassword ? "unchanged" : "OIDC only") + "'></td>";
+		html += "<td><button onclick='update_account(" + a.AccountID + ")'>Save</button> ";
+		html += "<button onclick='delete_account(" + a.AccountID + ")'>Delete</button></td></tr>";
+	}
+	html += "</table>";
+	$html($id('accounts'), html);
+}
+
+function update_account(accountid) {
+	var lead = [];
+	var boxes = document.querySelectorAll(".lead_" + accountid);
+	for (var i = 0; i < boxes.length; i++) {
+		if (boxes[i].checked)
+			lead.push(parseInt(boxes[i].value));
+	}
+	var body = {
+		Role: $id('role_' + accountid).value,
+		Password: $id('password_' + accountid).value,
+		LeadTeamIDs: lead,
+	};
+	send_json("PUT", "/admin/account?accountid=" + accountid, body, load_accounts);
+}
+
+function delete_account(accountid) {
+	if (confirm("Delete this account?"))
+		send_json("DELETE", "/admin/account?accountid=" + accountid, undefined, load_accounts);
+}
+
+$id('new_account_button').onclick = function() {
+	var body = {
+		Email: $id('new_account_email').value,
+		Role: $id('new_account_role').value,
+		Password: $id('new_account_password').value,
+	};
+	send_json("POST", "/admin/accounts", body, function() {
+		$id('new_account_email').value = "";
+		$id('new_account_password').value = "";
+		load_accounts();
+	});
+};
+
+function load_duplicates() {
+	send_json("GET", "/admin/duplicates", undefined, function(resp) {
+		show_duplicates(JSON.parse(resp.response));
+	});
+}
+
+function user_label(u) {
+	return escape_html(u.Email) + " (" + (u.Seconds / 3600).toFixed(1) + " hours)";
+}
+
+function show_duplicates(pairs) {
+	if (pairs.length == 0) {
+		$html($id('duplicates'), "<p>No likely duplicates</p>");
+		return;
+	}
+	var html = "<table class='rollup'><tr><th>User</th><th>User</th><th>Reason</th><th></th></tr>";
+	for (var i = 0; i < pairs.length; i++) {
+		var p = pairs[i];
+		html += "<tr><td>" + user_label(p.A) + "</td><td>" + user_label(p.B) + "</td><td>" + escape_html(p.Reason) + "</td>";
+		html += "<td><button onclick='merge_users(" + p.A.UserID + "," + p.B.UserID + ")'>Merge into right</button> ";
+		html += "<button onclick='merge_users(" + p.B.UserID + "," + p.A.UserID + ")'>Merge into left</button></td></tr>";
+	}
+	html += "</table>";
+	$html($id('duplicates'), html);
+}
+
+function merge_users(from, into) {
+	if (confirm("Move all time to the other user, and delete this user?")) {
+		send_json("POST", "/admin/merge", {From: from, Into: into}, function() {
+			load_duplicates();
+			load_teams();
+		});
+	}
+}
+
+function load_rates() {
+	send_json("GET", "/admin/rates", undefined, function(resp) {
+		show_rates(JSON.parse(resp.response));
+	});
+}
+
+function show_rates(data) {
+	var currency = data.Currency ? " (" + escape_html(data.Currency) + ")" : "";
+	var html = "<table class='rollup'><tr><th>Person or job role</th><th>From</th><th>Hourly rate" + currency + "</th><th></th></tr>";
+	for (var i = 0; i < data.Rates.length; i++) {
+		var r = data.Rates[i];
+		html += "<tr><td>" + escape_html(r.UserID ? r.Email : "Job role: " + r.Role) + "</td><td>" + date_of(r.EffectiveFrom) + "</td>";
+		html += "<td>" + r.HourlyRate.toFixed(2) + "</td><td><button onclick='delete_rate(" + r.RateID + ")'>Delete</button></td></tr>";
+	}
+	html += "</table>";
+	$html($id('rates'), html);
+
+	html = "<table class='rollup'><tr><th>Email</th><th>Job role</th><th>From</th><th></th></tr>";
+	for (var i = 0; i < data.JobRoles.length; i++) {
+		var j = data.JobRoles[i];
+		html += "<tr><td>" + escape_html(j.Email) + "</td><td>" + escape_html(j.Role) + "</td><td>" + date_of(j.EffectiveFrom) + "</td>";
+		html += "<td><button onclick='delete_job_role(" + j.JobRoleID + ")'>Delete</button></td></tr>";
+	}
+	html += "</table>";
+	$html($id('job_roles'), html);
+}
+
+function delete_rate(rateid) {
+	if (confirm("Delete this rate?"))
+		send_json("DELETE", "/admin/rate?rateid=" + rateid, undefined, load_rates);
+}
+
+function delete_job_role(jobroleid) {
+	if (confirm("Delete this job role?"))
+		send_json("DELETE", "/admin/jobroles?jobroleid=" + jobroleid, undefined, load_rates);
+}
+
+// Returns the day before an exclusive end date, which is how people read the end of a period
+function last_day(d) {
+	if (!d)
+		return "";
+	var t = new Date(date_of(d) + "T00:00:00Z");
+	t.setUTCDate(t.getUTCDate() - 1);
+	return t.toISOString().substr(0, 10);
+}
+
+function load_billing() {
+	send_json("GET", "/admin/billing", undefined, function(resp) {
+		show_billing(JSON.parse(resp.response));
+	});
+}
+
+function show_billing(data) {
+	var html = "<table class='rollup'><tr><th>Client</th><th>Contract</th><th>Rate</th><th>From</th><th>To</th><th>Rounding</th><th>Scopes</th></tr>";
+	var options = "";
+	for (var i = 0; i < data.Contracts.length; i++) {
+		var c = data.Contracts[i];
+		var scopes = [];
+		for (var j = 0; j < c.Scopes.length; j++)
+			scopes.push(c.Scopes[j].Kind + ":" + c.Scopes[j].Value + (c.Scopes[j].Billable ? "" : " (non-billable)"));
+		var rounding = c.RoundMinutes ? c.RoundMode + " to " + c.RoundMinutes + " minutes per " + c.RoundPer : "none";
+		html += "<tr><td>" + escape_html(c.Client) + "</td><td>" + escape_html(c.Name) + "</td><td>" + c.HourlyRate.toFixed(2) + " " + escape_html(c.Currency) + "</td>";
+		html += "<td>" + date_of(c.Start) + "</td><td>" + last_day(c.End) + "</td><td>" + rounding + "</td><td>" + escape_html(scopes.join(", ")) + "</td></tr>";
+		options += "<option value='" + c.ContractID + "'>" + escape_html(c.Client + ": " + c.Name) + "</option>";
+	}
+	$html($id('contracts'), html + "</table>");
+	var selected = $id('statement_contract').value;
+	$html($id('statement_contract'), options);
+	if (selected)
+		$id('statement_contract').value = selected;
+
+	html = "<table class='rollup'><tr><th>Number</th><th>Client</th><th>Contract</th><th>Period</th><th>Hours</th><th>Amount</th><th>Issued</th><th></th></tr>";
+	for (var i = 0; i < data.Invoices.length; i++) {
+		var inv = data.Invoices[i];
+		html += "<tr><td>" + escape_html(inv.Number) + (inv.VoidedAt ? " (void)" : "") + "</td><td>" + escape_html(inv.Client) + "</td><td>" + escape_html(inv.Contract) + "</td>";
+		html += "<td>" + date_of(inv.PeriodStart) + " to " + last_day(inv.PeriodEnd) + "</td><td>" + inv.BillableHours.toFixed(2) + "</td>";
+		html += "<td>" + inv.Amount.toFixed(2) + " " + escape_html(inv.Currency) + "</td><td>" + date_of(inv.IssuedAt) + " " + escape_html(inv.IssuedBy) + "</td><td>";
+		html += "<a href='/admin/invoice?format=csv&invoiceid=" + inv.InvoiceID + "'>CSV</a> <a href='/admin/invoice?format=pdf&invoiceid=" + inv.InvoiceID + "'>PDF</a>";
+		if (!inv.VoidedAt)
+			html += " <button onclick='void_invoice(" + inv.InvoiceID + ")'>Void</button>";
+		html += "</td></tr>";
+	}
+	$html($id('invoices'), html + "</table>");
+}
+
+function statement_request() {
+	return {
+		ContractID: parseInt($id('statement_contract').value, 10),
+		From: $id('statement_from').value,
+		To: $id('statement_to').value,
+		Number: $id('invoice_number').value,
+	};
+}
+
+function statement_lines(lines, amounts) {
+	var html = "";
+	for (var i = 0; i < lines.length; i++) {
+		var l = lines[i];
+		html += "<tr><td>" + escape_html(l.TicketKey) + "</td><td>" + escape_html(l.Description) + "</td><td>" + l.RawHours.toFixed(2) + "</td><td>" + l.Hours.toFixed(2) + "</td>";
+		html += "<td>" + (amounts ? l.Amount.toFixed(2) : "") + "</td></tr>";
+	}
+	return html;
+}
+
+function show_statement() {
+	var req = statement_request();
+	var url = "/admin/statement?contractid=" + req.ContractID + "&from=" + req.From + "&to=" + req.To;
+	send_json("GET", url, undefined, function(resp) {
+		var s = JSON.parse(resp.response);
+		var html = "";
+		if (s.Invoice)
+			html += "<p>This period is locked by invoice " + escape_html(s.Invoice.Number) + ", of " + s.Invoice.BillableHours.toFixed(2) + " hours.</p>";
+		html += "<table class='rollup'><tr><th>Ticket</th><th>Description</th><th>Logged hours</th><th>Billed hours</th><th>Amount</th></tr>";
+		html += statement_lines(s.Lines, true);
+		html += "<tr><th></th><th>Billable</th><th></th><th>" + s.BillableHours.toFixed(2) + "</th><th>" + s.Amount.toFixed(2) + " " + escape_html(s.Contract.Currency) + "</th></tr>";
+		if (s.NonBillable.length != 0) {
+			html += statement_lines(s.NonBillable, false);
+			html += "<tr><th></th><th>Non-billable</th><th></th><th>" + s.NonBillableHours.toFixed(2) + "</th><th></th></tr>";
+		}
+		$html($id('statement'), html + "</table>");
+	});
+}
+
+function void_invoice(invoiceid) {
+	if (confirm("Void this invoice? Its period can then be invoiced again."))
+		send_json("DELETE", "/admin/invoice?invoiceid=" + invoiceid, undefined, load_billing);
+}
+
+// Rates and billing are only on the page for accounts that may see costs
+if ($id('rates')) {
+	$id('new_rate_button').onclick = function() {
+		var body = {
+			Email: $id('new_rate_email').value,
+			Role: $id('new_rate_role').value,
+			EffectiveFrom: $id('new_rate_from').value,
+			HourlyRate: parseFloat($id('new_rate_amount').value),
+		};
+		send_json("POST", "/admin/rates", body, function() {
+			$id('new_rate_amount').value = "";
+			load_rates();
+		});
+	};
+
+	$id('new_job_role_button').onclick = function() {
+		var body = {
+			Email: $id('new_job_role_email').value,
+			Role: $id('new_job_role_role').value,
+			EffectiveFrom: $id('new_job_role_from').value,
+		};
+		send_json("POST", "/admin/jobroles", body, function() {
+			$id('new_job_role_email').value = "";
+			load_rates();
+		});
+	};
+	load_rates();
+
+	$id('statement_button').onclick = show_statement;
+	$id('invoice_button').onclick = function() {
+		send_json("POST", "/admin/invoice", statement_request(), function() {
+			$id('invoice_number').value = "";
+			load_billing();
+			show_statement();
+		});
+	};
+	load_billing();
+}
+
+$id('new_team_button').onclick = function() {
+	send_json("POST", "/admin/teams", {Name: $id('new_team_name').value}, function() {
+		$id('new_team_name').value = "";
+		load_teams();
+	});
+};
+
+load_teams();
+load_duplicates();
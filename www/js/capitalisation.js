@@ -0,0 +1,153 @@
+
+// $http can't send a body, so we have our own little JSON request function
+function send_json(method, url, body, good) {
+	var req = new XMLHttpRequest();
+	req.onreadystatechange = function() {
+		if (req.readyState == 4) {
+			if (req.status == 200)
+				good(req);
+			else
+				alert(req.responseText);
+		}
+	};
+	req.open(method, url, true);
+	req.setRequestHeader("Content-Type", "application/json");
+	req.send(body === undefined ? null : JSON.stringify(body));
+}
+
+function escape_html(s) {
+	return String(s).replace(/&/g, "&amp;").replace(/</g, "&lt;").replace(/>/g, "&gt;").replace(/'/g, "&#39;");
+}
+
+function date_of(d) {
+	return d ? d.substr(0, 10) : "";
+}
+
+// Returns the day before an exclusive end date, which is how people read the end of a period
+function last_day(d) {
+	var t = new Date(date_of(d) + "T00:00:00Z");
+	t.setUTCDate(t.getUTCDate() - 1);
+	return t.toISOString().substr(0, 10);
+}
+
+function hours(seconds) {
+	return (seconds / 3600).toFixed(1);
+}
+
+function money(amount) {
+	return (amount || 0).toFixed(0).replace(/\B(?=(\d{3})+(?!\d))/g, " ");
+}
+
+function report_url() {
+	var url = "/capitalisation/report?from=" + $id('cap_from').value + "&to=" + $id('cap_to').value;
+	if ($id('cap_team').value)
+		url += "&teamid=" + $id('cap_team').value;
+	return url;
+}
+
+function report_rows(rows) {
+	var html = "";
+	var total = {CapExSeconds: 0, OpExSeconds: 0, CapExCost: 0, OpExCost: 0};
+	for (var i = 0; i < rows.length; i++) {
+		var r = rows[i];
+		var all = r.CapExSeconds + r.OpExSeconds;
+		html += "<tr><td>" + escape_html(r.Team || "(no team)") + "</td><td>" + escape_html(r.Project || "(none)") + "</td>";
+		html += "<td>" + hours(r.CapExSeconds) + "</td><td>" + hours(r.OpExSeconds) + "</td><td>" + (all ? (100 * r.CapExSeconds / all).toFixed(0) + "%" : "") + "</td>";
+		html += "<td>" + money(r.CapExCost) + "</td><td>" + money(r.OpExCost) + "</td></tr>";
+		for (var k in total)
+			total[k] += r[k] || 0;
+	}
+	var all = total.CapExSeconds + total.OpExSeconds;
+	html += "<tr><th>Total</th><th></th><th>" + hours(total.CapExSeconds) + "</th><th>" + hours(total.OpExSeconds) + "</th>";
+	html += "<th>" + (all ? (100 * total.CapExSeconds / all).toFixed(0) + "%" : "") + "</th><th>" + money(total.CapExCost) + "</th><th>" + money(total.OpExCost) + "</th></tr>";
+	return html;
+}
+
+function show_report() {
+	if (!$id('cap_from').value || !$id('cap_to').value)
+		return;
+	$id('cap_export').href = report_url() + "&format=csv";
+	send_json("GET", report_url(), undefined, function(resp) {
+		var data = JSON.parse(resp.response);
+		var currency = data.Currency ? " (" + escape_html(data.Currency) + ")" : "";
+		var header = "<tr><th>Team</th><th>Project</th><th>CapEx hours</th><th>OpEx hours</th><th>CapEx share</th><th>CapEx cost" + currency + "</th><th>OpEx cost" + currency + "</th></tr>";
+		var html = "";
+		if (data.SignOff) {
+			var s = data.SignOff;
+			html += "<p>Signed off by " + escape_html(s.SignedBy) + " on " + date_of(s.SignedAt) + (s.Note ? ": " + escape_html(s.Note) : "") + ". As signed off:</p>";
+			html += "<table class='rollup'>" + header + report_rows(s.Rows) + "</table><p>With the current rules and time:</p>";
+		}
+		$html($id('cap_signoff'), html);
+		$html($id('cap_report'), header + report_rows(data.Rows));
+		$id('cap_signoff_button').disabled = !!data.SignOff;
+	});
+}
+
+function load_rules() {
+	send_json("GET", "/capitalisation/rules", undefined, function(resp) {
+		var data = JSON.parse(resp.response);
+		var html = "<table class='rollup'><tr><th>Kind</th><th>Value</th><th>Class</th></tr>";
+		for (var i = 0; i < data.Rules.length; i++) {
+			var r = data.Rules[i];
+			html += "<tr><td>" + escape_html(r.Kind) + "</td><td>" + escape_html(r.Value) + "</td><td>" + escape_html(r.Class) + "</td></tr>";
+		}
+		$html($id('cap_rules'), html + "</table>");
+
+		html = "<table class='rollup'><tr><th>Period</th><th>Signed off by</th><th>On</th><th>Note</th></tr>";
+		for (var i = 0; i < data.SignOffs.length; i++) {
+			var s = data.SignOffs[i];
+			html += "<tr><td>" + date_of(s.PeriodStart) + " to " + last_day(s.PeriodEnd) + "</td><td>" + escape_html(s.SignedBy) + "</td>";
+			html += "<td>" + date_of(s.SignedAt) + "</td><td>" + escape_html(s.Note) + "</td></tr>";
+		}
+		$html($id('cap_signoffs'), html + "</table>");
+
+		html = "<table class='rollup'><tr><th>When</th><th>Who</th><th>Rule</th><th>From</th><th>To</th><th>Reason</th></tr>";
+		for (var i = 0; i < data.Changes.length; i++) {
+			var c = data.Changes[i];
+			html += "<tr><td>" + c.ChangedAt.substr(0, 16).replace("T", " ") + "</td><td>" + escape_html(c.ChangedBy) + "</td><td>" + escape_html(c.Kind + ":" + c.Value) + "</td>";
+			html += "<td>" + escape_html(c.OldClass || "(none)") + "</td><td>" + escape_html(c.NewClass || "(none)") + "</td><td>" + escape_html(c.Reason) + "</td></tr>";
+		}
+		$html($id('cap_changes'), html + "</table>");
+	});
+}
+
+$id('cap_button').onclick = show_report;
+$id('cap_team').onchange = show_report;
+
+$id('cap_signoff_button').onclick = function() {
+	if (!confirm("Sign off the capitalisation of " + $id('cap_from').value + " to " + $id('cap_to').value + "?"))
+		return;
+	var body = {From: $id('cap_from').value, To: $id('cap_to').value, Note: $id('cap_signoff_note').value};
+	send_json("POST", "/capitalisation/signoff", body, function() {
+		$id('cap_signoff_note').value = "";
+		show_report();
+		load_rules();
+	});
+};
+
+$id('cap_rule_button').onclick = function() {
+	var body = {
+		Kind: $id('cap_rule_kind').value,
+		Value: $id('cap_rule_value').value,
+		Class: $id('cap_rule_class').value,
+		Reason: $id('cap_rule_reason').value,
+	};
+	send_json("POST", "/capitalisation/rules", body, function() {
+		$id('cap_rule_value').value = "";
+		$id('cap_rule_reason').value = "";
+		load_rules();
+		show_report();
+	});
+};
+
+// Default to the previous calendar month, which is the usual period to sign off
+(function() {
+	var now = new Date();
+	var first = new Date(Date.UTC(now.getFullYear(), now.getMonth() - 1, 1));
+	var last = new Date(Date.UTC(now.getFullYear(), now.getMonth(), 0));
+	$id('cap_from').value = first.toISOString().substr(0, 10);
+	$id('cap_to').value = last.toISOString().substr(0, 10);
+})();
+
+show_report();
+load_rules();
@@ -1,6 +1,9 @@
 
 
-function show_bar_chart(data) {
+// The ticket type of each chart series
+var series_types = ["feat", "bug"];
+
+function show_bar_chart(data, months) {
 	var options = {
 	  width: 600,
 	  height: 300
@@ -11,10 +14,357 @@ function show_bar_chart(data) {
 	//	series: [[5, 2, 8, 3], [1, 3, 7, 2]]
 	//};
 
-	new Chartist.Bar('#monthly_chart', data, options);
+	var chart = new Chartist.Bar('#monthly_chart', data, options);
+	// Clicking a bar drills down into the tickets of that month and type
+	chart.on('draw', function(ctx) {
+		if (ctx.type == 'bar') {
+			ctx.element._node.style.cursor = "pointer";
+			ctx.element._node.onclick = function() {
+				show_drilldown(months[ctx.index], series_types[ctx.seriesIndex]);
+			};
+		}
+	});
+}
+
+// Returns the parameter that asks for costs, if the checkbox exists (ie the account may see costs), and is ticked
+function cost_param() {
+	var box = $id('show_cost');
+	return box && box.checked ? "&cost=1" : "";
+}
+
+function money(amount) {
+	return amount.toFixed(0).replace(/\B(?=(\d{3})+(?!\d))/g, " ");
+}
+
+// The tickets of the current drill-down, and how they are sorted
+var drilldown = {tickets: [], jira_url: "", cost: false, sort: "Seconds", descending: true};
+
+function show_drilldown(month, type) {
+	var good = function(resp) {
+		resp = JSON.parse(resp.response);
+		drilldown.tickets = resp.Tickets;
+		drilldown.jira_url = resp.JiraURL.replace(/\/$/, "");
+		drilldown.cost = cost_param() != "";
+		$html($id('drilldown_title'), escape_html(month.Month + " " + month.Year + ": " + (type == "bug" ? "bugs" : "features")));
+		$id('drilldown').style.display = "";
+		render_drilldown();
+	};
+	var url = "/drilldown?year=" + month.Year + "&month=" + month.MonthNumber + "&type=" + type;
+	if (current.userid)
+		url += "&userid=" + current.userid;
+	else
+		url += "&team=" + encodeURIComponent(current.team);
+	url += "&system=" + $id('select_system').value + cost_param();
+	$http({method: "GET", url: url, good: good});
+}
+
+function sort_drilldown(column) {
+	if (drilldown.sort == column) {
+		drilldown.descending = !drilldown.descending;
+	} else {
+		drilldown.sort = column;
+		drilldown.descending = column == "Seconds" || column == "StoryPoints" || column == "Cost";
+	}
+	render_drilldown();
+}
+
+function drilldown_matches(t, filter) {
+	if (filter == "")
+		return true;
+	var text = [t.Key, t.Title, t.Type];
+	for (var i = 0; i < t.People.length; i++)
+		text.push(t.People[i].Email);
+	return text.join(" ").toLowerCase().indexOf(filter) != -1;
+}
+
+function render_drilldown() {
+	var filter = $id('drilldown_filter').value.toLowerCase();
+	var tickets = drilldown.tickets.filter(function(t) { return drilldown_matches(t, filter); });
+	tickets.sort(function(a, b) {
+		var x = a[drilldown.sort], y = b[drilldown.sort];
+		var order = x < y ? -1 : (x > y ? 1 : 0);
+		return drilldown.descending ? -order : order;
+	});
+	var columns = [["Key", "Key"], ["Title", "Title"], ["Type", "Type"], ["StoryPoints", "Points"], ["Seconds", "Hours"]];
+	if (drilldown.cost)
+		columns.push(["Cost", "Cost"]);
+	var html = "<tr>";
+	for (var i = 0; i < columns.length; i++) {
+		var arrow = drilldown.sort == columns[i][0] ? (drilldown.descending ? " &#9660;" : " &#9650;") : "";
+		html += "<th><a href='#' onclick='sort_drilldown(\"" + columns[i][0] + "\"); return false;'>" + columns[i][1] + arrow + "</a></th>";
+	}
+	html += "<th>People</th></tr>";
+	for (var i = 0; i < tickets.length; i++) {
+		var t = tickets[i];
+		var key = escape_html(t.Key || "(none)");
+		if (t.Key && drilldown.jira_url)
+			key = "<a href='" + escape_html(drilldown.jira_url + "/browse/" + t.Key) + "' target='_blank'>" + key + "</a>";
+		var people = [];
+		for (var j = 0; j < t.People.length; j++)
+			people.push(escape_html(t.People[j].Email) + " " + (t.People[j].Seconds / 3600).toFixed(1));
+		html += "<tr><td>" + key + "</td><td><a href='#' onclick='show_ticket(" + t.TicketID + "); return false;'>" + escape_html(t.Title) + "</a></td>";
+		html += "<td>" + escape_html(t.Type) + "</td><td>" + t.StoryPoints + "</td><td>" + (t.Seconds / 3600).toFixed(1) + "</td>";
+		if (drilldown.cost)
+			html += "<td>" + money(t.Cost || 0) + "</td>";
+		html += "<td>" + people.join(", ") + "</td></tr>";
+	}
+	$html($id('drilldown_table'), html);
+}
+
+// The user or team that is currently being shown
+var current = {userid: undefined, team: undefined};
+
+function escape_html(s) {
+	return String(s).replace(/&/g, "&amp;").replace(/</g, "&lt;").replace(/>/g, "&gt;").replace(/'/g, "&#39;");
+}
+
+function show_rollup(userid, team) {
+	var good = function(resp) {
+		resp = JSON.parse(resp.response);
+		if (resp.Projects) {
+			var html = "<tr><th>Project</th><th>Hours</th>" + (resp.Cost ? "<th>Cost</th><th>Uncosted hours</th>" : "") + "</tr>";
+			for (var i = 0; i < resp.Projects.length; i++) {
+				var p = resp.Projects[i];
+				html += "<tr><td>" + escape_html(p.Project || "(none)") + "</td><td>" + (p.Seconds / 3600).toFixed(1) + "</td>";
+				if (resp.Cost)
+					html += "<td>" + money(p.Cost) + "</td><td>" + (p.UncostedSeconds / 3600).toFixed(1) + "</td>";
+				html += "</tr>";
+			}
+			$html($id('rollup_table'), html);
+			return;
+		}
+		var html = "<tr><th>Key</th><th>Title</th><th>Type</th><th>Points</th><th>Own hours</th><th>Child hours</th><th>Total hours</th>" + (resp.Cost ? "<th>Cost</th>" : "") + "</tr>";
+		for (var i = 0; i < resp.Tickets.length; i++) {
+			var t = resp.Tickets[i];
+			html += "<tr><td><a href='#' onclick='show_ticket(" + t.TicketID + "); return false;'>" + escape_html(t.Key || "(none)") + "</a></td><td>" + escape_html(t.Title) + "</td><td>" + escape_html(t.Type) + "</td>";
+			html += "<td>" + t.StoryPoints + "</td><td>" + (t.OwnSeconds / 3600).toFixed(1) + "</td>";
+			html += "<td>" + (t.ChildSeconds / 3600).toFixed(1) + "</td><td>" + ((t.OwnSeconds + t.ChildSeconds) / 3600).toFixed(1) + "</td>";
+			if (resp.Cost)
+				html += "<td>" + money((t.OwnCost || 0) + (t.ChildCost || 0)) + "</td>";
+			html += "</tr>";
+		}
+		$html($id('rollup_table'), html);
+	};
+	var url = "/rollup?level=" + $id('select_rollup').value;
+	if (userid)
+		url += "&userid=" + userid;
+	else
+		url += "&team=" + encodeURIComponent(team);
+	url += cost_param();
+	$http({method: "GET", url: url, good: good});
+}
+
+// Show hours per person, alongside the commits that mention the ticket
+function show_ticket(ticketid) {
+	var good = function(resp) {
+		resp = JSON.parse(resp.response);
+		var html = "<h3>" + escape_html(resp.Key + " " + resp.Title) + "</h3>";
+		html += "<table class='rollup'><tr><th>Person</th><th>Hours</th><th>Commits</th></tr>";
+		for (var i = 0; i < resp.Users.length; i++) {
+			var u = resp.Users[i];
+			html += "<tr><td>" + escape_html(u.Email) + "</td><td>" + (u.Seconds / 3600).toFixed(1) + "</td><td>" + u.Commits + "</td></tr>";
+		}
+		html += "</table>";
+		html += "<table class='rollup'><tr><th>Time</th><th>Person</th><th>Repo</th><th>Commit</th></tr>";
+		for (var i = 0; i < resp.Commits.length; i++) {
+			var c = resp.Commits[i];
+			html += "<tr><td>" + escape_html(c.Time.substr(0, 16).replace("T", " ")) + "</td><td>" + escape_html(c.Email) + "</td>";
+			html += "<td>" + escape_html(c.Repo) + "</td><td>" + escape_html(c.Hash.substr(0, 10) + " " + c.Summary) + "</td></tr>";
+		}
+		html += "</table>";
+		$html($id('ticket_activity'), html);
+	};
+	$http({method: "GET", url: "/ticket?ticketid=" + ticketid, good: good});
+}
+
+// The people of the current timesheet report
+var timesheets = [];
+
+function show_timesheets(userid, team) {
+	var good = function(resp) {
+		timesheets = JSON.parse(resp.response).People;
+		$id('timesheets').style.display = timesheets.length == 0 ? "none" : "";
+		var html = "<tr><th>Person</th><th>Expected hours</th><th>Logged hours</th><th>Gaps</th><th>Under</th><th>Over</th></tr>";
+		for (var i = 0; i < timesheets.length; i++) {
+			var p = timesheets[i];
+			html += "<tr><td><a href='#' onclick='show_timesheet_days(" + i + "); return false;'>" + escape_html(p.Email) + "</a></td>";
+			html += "<td>" + p.ExpectedHours.toFixed(1) + "</td><td>" + p.LoggedHours.toFixed(1) + "</td>";
+			html += "<td>" + p.Gaps + "</td><td>" + p.Under + "</td><td>" + p.Over + "</td></tr>";
+		}
+		$html($id('timesheets_table'), html);
+		$html($id('timesheet_days'), "");
+	};
+	var url = "/timesheets?";
+	if (userid)
+		url += "userid=" + userid;
+	else
+		url += "team=" + encodeURIComponent(team);
+	$http({method: "GET", url: url, good: good});
+}
+
+function show_timesheet_days(index) {
+	var p = timesheets[index];
+	var html = "<h4>" + escape_html(p.Email) + "</h4><table class='rollup'><tr><th>Day</th><th>Expected</th><th>Logged</th><th>Status</th><th></th></tr>";
+	for (var i = 0; i < p.Days.length; i++) {
+		var d = p.Days[i];
+		var note = [d.Holiday, d.Leave ? "leave: " + d.Leave : ""].filter(function(s) { return s != ""; }).join(", ");
+		html += "<tr class='timesheet-" + d.Status + "'><td>" + escape_html(d.Day.substr(0, 10)) + "</td><td>" + d.ExpectedHours.toFixed(1) + "</td>";
+		html += "<td>" + d.LoggedHours.toFixed(1) + "</td><td>" + escape_html(d.Status) + "</td><td>" + escape_html(note) + "</td></tr>";
+	}
+	html += "</table>";
+	$html($id('timesheet_days'), html);
+}
+
+// The colours of Chartist's first series, for the legend
+var series_colours = ["#d70206", "#f05b4f", "#f4c63d", "#d17905", "#453d3f", "#59922b", "#0544d3", "#6b0392"];
+
+// Velocity is a team metric, so it is only shown for a team
+function show_velocity(team) {
+	$id('velocity').style.display = team ? "" : "none";
+	if (!team)
+		return;
+	var good = function(resp) {
+		resp = JSON.parse(resp.response);
+		var metric = $id('select_velocity').value;
+		var data = {labels: [], series: []};
+		var html = "<table class='rollup'><tr><th>Team</th><th>Points</th><th>Tickets</th><th>Hours per point</th></tr>";
+		for (var i = 0; i < resp.Teams.length; i++) {
+			var t = resp.Teams[i];
+			var series = [];
+			var total = {Points: 0, Tickets: 0, PointedSeconds: 0};
+			for (var j = 0; j < t.Periods.length; j++) {
+				var p = t.Periods[j];
+				if (i == 0)
+					data.labels.push(p.Start.substr(5, 5));
+				// A period without points has no hours per point, rather than zero
+				series.push(metric == "HoursPerPoint" && p.Points == 0 ? null : p[metric]);
+				for (var k in total)
+					total[k] += p[k];
+			}
+			data.series.push(series);
+			var colour = series_colours[i % series_colours.length];
+			html += "<tr><td><span style='color: " + colour + "'>&#9632;</span> " + escape_html(t.Team) + "</td><td>" + total.Points + "</td><td>" + total.Tickets + "</td>";
+			html += "<td>" + (total.Points ? (total.PointedSeconds / 3600 / total.Points).toFixed(1) : "") + "</td></tr>";
+		}
+		new Chartist.Line('#velocity_chart', data, {width: 600, height: 300, low: 0});
+		$html($id('velocity_legend'), html + "</table>");
+	};
+	var url = "/velocity?team=" + encodeURIComponent(team) + "&weeks=" + $id('select_velocity_weeks').value;
+	$http({method: "GET", url: url, good: good});
+}
+
+// Cycle times are of the tickets that a team worked on, so they are only shown for a team
+function show_cycletime(team) {
+	$id('cycletime').style.display = team ? "" : "none";
+	if (!team)
+		return;
+	var good = function(resp) {
+		resp = JSON.parse(resp.response);
+		var metric = $id('select_cycletime').value;
+		var type = $id('select_cycletime_type').value;
+		var data = {labels: [], series: [[], [], []]};
+		var html = "<table class='rollup'><tr><th>Month</th><th>Tickets</th><th>Worked</th><th>50% (days)</th><th>85% (days)</th><th>95% (days)</th></tr>";
+		for (var i = 0; i < resp.Stats.length; i++) {
+			var s = resp.Stats[i];
+			if (s.TicketType != type)
+				continue;
+			var p = s[metric];
+			var days = [p.P50 / 86400, p.P85 / 86400, p.P95 / 86400];
+			data.labels.push(s.Period.substr(0, 7));
+			for (var j = 0; j < days.length; j++)
+				data.series[j].push(days[j]);
+			html += "<tr><td>" + s.Period.substr(0, 7) + "</td><td>" + s.Tickets + "</td><td>" + s.Worked + "</td>";
+			html += "<td>" + days[0].toFixed(1) + "</td><td>" + days[1].toFixed(1) + "</td><td>" + days[2].toFixed(1) + "</td></tr>";
+		}
+		new Chartist.Line('#cycletime_chart', data, {width: 600, height: 300, low: 0});
+		$html($id('cycletime_legend'), html + "</table>");
+	};
+	$http({method: "GET", url: "/cycletime?team=" + encodeURIComponent(team), good: good});
+}
+
+// Context switching is shown per team, with a series per team
+function show_focus(team) {
+	$id('focus').style.display = team ? "" : "none";
+	if (!team)
+		return;
+	var good = function(resp) {
+		resp = JSON.parse(resp.response);
+		var metric = $id('select_focus').value;
+		var scale = metric == "LongestBlockSeconds" ? 1 / 3600 : (metric == "InterruptShare" ? 100 : 1);
+		var weeks = [], teams = [], series = {};
+		for (var i = 0; i < resp.Weeks.length; i++) {
+			var w = resp.Weeks[i];
+			if (weeks.indexOf(w.Week) == -1)
+				weeks.push(w.Week);
+			if (!series[w.Team]) {
+				teams.push(w.Team);
+				series[w.Team] = {};
+			}
+			series[w.Team][w.Week] = w[metric] * scale;
+		}
+		weeks.sort();
+		var data = {labels: weeks.map(function(w) { return w.substr(5, 5); }), series: []};
+		var html = "";
+		for (var i = 0; i < teams.length; i++) {
+			data.series.push(weeks.map(function(w) { return series[teams[i]][w] === undefined ? null : series[teams[i]][w]; }));
+			html += "<span style='color: " + series_colours[i % series_colours.length] + "'>&#9632;</span> " + escape_html(teams[i]) + " ";
+		}
+		new Chartist.Line('#focus_chart', data, {width: 600, height: 300, low: 0});
+		$html($id('focus_legend'), html);
+	};
+	var url = "/focus?team=" + encodeURIComponent(team) + "&system=" + $id('select_system').value;
+	$http({method: "GET", url: url, good: good});
+}
+
+// The last 13 weeks of unplanned work, followed by its forecast, with the 80% band, and the capacity that it leaves
+function show_forecast(team) {
+	$id('forecast').style.display = team ? "" : "none";
+	if (!team)
+		return;
+	var good = function(resp) {
+		resp = JSON.parse(resp.response);
+		var history = resp.History.slice(-13);
+		var data = {labels: [], series: [[], [], [], [], []]};
+		for (var i = 0; i < history.length; i++) {
+			data.labels.push(history[i].Start.substr(5, 5));
+			data.series[0].push(history[i].Hours);
+			for (var j = 1; j < data.series.length; j++)
+				data.series[j].push(null);
+		}
+		for (var i = 0; i < resp.Weeks.length; i++) {
+			var w = resp.Weeks[i];
+			data.labels.push(w.Start.substr(5, 5));
+			data.series[0].push(null);
+			data.series[1].push(w.Unplanned);
+			data.series[2].push(w.Band80.Low);
+			data.series[3].push(w.Band80.High);
+			data.series[4].push(w.Available);
+		}
+		new Chartist.Line('#forecast_chart', data, {width: 800, height: 300, low: 0});
+		var names = ["Unplanned hours", "Forecast", "80% low", "80% high", "Available capacity"];
+		var html = "";
+		for (var i = 0; i < names.length; i++)
+			html += "<span style='color: " + series_colours[i] + "'>&#9632;</span> " + names[i] + " ";
+		var t = resp.Total;
+		html += "<p>Over the 13 weeks: capacity " + t.Capacity.toFixed(0) + " hours, of which unplanned work takes " + t.Unplanned.toFixed(0);
+		html += " (80%: " + t.Band80.Low.toFixed(0) + " to " + t.Band80.High.toFixed(0) + ", 95%: " + t.Band95.Low.toFixed(0) + " to " + t.Band95.High.toFixed(0) + ")";
+		html += ", leaving " + t.Available.toFixed(0) + " hours for planned work.</p>";
+		$html($id('forecast_summary'), html);
+	};
+	$http({method: "GET", url: "/forecast?team=" + encodeURIComponent(team), good: good});
 }
 
 function show_report(userid, team) {
+	current.userid = userid;
+	current.team = team;
+	show_rollup(userid, team);
+	show_timesheets(userid, team);
+	show_velocity(team);
+	show_cycletime(team);
+	show_focus(team);
+	show_forecast(team);
+	$id('drilldown').style.display = "none";
+
 	var good = function(resp) {
 		resp = JSON.parse(resp.response);
 		var data = {
@@ -23,19 +373,24 @@ function show_report(userid, team) {
 		}
 		for (var i = 0; i < resp.Months.length; i++) {
 			var m = resp.Months[i];
-			var totalDevTime = m.FeatureSeconds + m.BugSeconds;
-			var bugDevPercent = 100 * m.BugSeconds / totalDevTime;
+			// With costs, the chart is in currency rather than hours
+			var feature = resp.Cost ? m.FeatureCost : m.FeatureSeconds / 3600;
+			var bug = resp.Cost ? m.BugCost : m.BugSeconds / 3600;
+			var bugDevPercent = 100 * bug / (feature + bug);
 			data.labels.push(m.Month + " (" + bugDevPercent.toFixed(0) + "%)");
-			data.series[0].push(m.FeatureSeconds / 3600);
-			data.series[1].push(m.BugSeconds / 3600);
+			data.series[0].push(feature);
+			data.series[1].push(bug);
 		}
-		show_bar_chart(data);
+		show_bar_chart(data, resp.Months);
 	};
 	url = "";
 	if (userid)
 		url = "/monthly?userid=" + userid;
 	else
-		url = "/monthly?team=" + team;
+		url = "/monthly?team=" + encodeURIComponent(team);
+	url += "&system=" + $id('select_system').value;
+	$id('export_link').href = url.replace("/monthly?", "/export?format=xlsx&");
+	url += cost_param();
 	$http({method: "GET", url: url, good: good});
 }
 
@@ -47,4 +402,41 @@ $id('select_team').onchange = function(t) {
 	show_report(undefined, t.target.value);
 };
 
+$id('select_system').onchange = function(t) {
+	if (current.userid || current.team)
+		show_report(current.userid, current.team);
+};
+
+$id('select_rollup').onchange = function(t) {
+	if (current.userid || current.team)
+		show_rollup(current.userid, current.team);
+};
+
+$id('select_velocity').onchange = function() {
+	show_velocity(current.team);
+};
+
+$id('select_velocity_weeks').onchange = function() {
+	show_velocity(current.team);
+};
+
+$id('select_cycletime').onchange = function() {
+	show_cycletime(current.team);
+};
+
+$id('select_cycletime_type').onchange = function() {
+	show_cycletime(current.team);
+};
+
+$id('select_focus').onchange = function() {
+	show_focus(current.team);
+};
 
+$id('drilldown_filter').oninput = render_drilldown;
+
+if ($id('show_cost')) {
+	$id('show_cost').onchange = function() {
+		if (current.userid || current.team)
+			show_report(current.userid, current.team);
+	};
+}